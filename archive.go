@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+)
+
+const (
+	// defaultArchiveStorageClass 归档副本默认的存储类别, 毫秒级读取, 存储费用低于STANDARD_IA
+	defaultArchiveStorageClass = "GLACIER_IR"
+)
+
+// archiveOriginal 所有缩略图生成成功后归档原图, 复制到ArchivePrefix下并添加ArchiveTags
+// 原图保留在原位置, 删除原图会触发删除缩略图, 应该由生命周期规则按标签或者前缀处理
+func (s Imaging) archiveOriginal(ctx context.Context, original *Original) error {
+	if s.config.ArchivePrefix == "" && len(s.config.ArchiveTags) == 0 {
+		return nil
+	}
+
+	// 试运行不修改原图
+	if s.config.DryRun {
+		logger.InfoContext(ctx, "Dry run archive image", "archivePrefix", s.config.ArchivePrefix, "storageClass", s.config.ArchiveStorageClass, "tags", s.config.ArchiveTags)
+		return nil
+	}
+
+	if s.config.ArchivePrefix != "" {
+		if err := s.copyToArchive(ctx, original); err != nil {
+			logger.ErrorContext(ctx, "Copy image to archive failed", "error", err)
+			return err
+		}
+	}
+
+	if len(s.config.ArchiveTags) > 0 {
+		if err := s.tagArchived(ctx, original.Bucket, original.Key); err != nil {
+			logger.ErrorContext(ctx, "Put archive tags failed", "error", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyToArchive 将原图复制到同一bucket的ArchivePrefix下, 保留内容类型, 元数据和标签
+func (s Imaging) copyToArchive(ctx context.Context, original *Original) error {
+	key := s.config.ArchivePrefix + original.Key
+	err := s.copyObject(ctx, original.Bucket, original.Key, original.Version.ETag, original.Bucket, key, s.config.ArchiveStorageClass)
+	if err != nil {
+		return err
+	}
+
+	logger.InfoContext(ctx, "Archive image success", "archive", key, "storageClass", s.config.ArchiveStorageClass)
+	return nil
+}
+
+// copyObject 复制etag对应的对象, 支持服务端复制的存储直接复制
+// 其他存储读取后重新写入, 保留内容类型, 元数据和标签, 读取到的对象已经被覆盖时返回错误
+func (s Imaging) copyObject(ctx context.Context, bucket, key, etag, destinationBucket, destinationKey, storageClass string) error {
+	if copier, ok := s.store.(ObjectCopier); ok {
+		return s.retryStorage(ctx, "copy", false, func() error {
+			return copier.Copy(ctx, bucket, key, etag, destinationBucket, destinationKey, storageClass)
+		})
+	}
+
+	var object *Object
+	err := s.retryStorage(ctx, "get", false, func() error {
+		var err error
+		object, err = s.store.Get(ctx, bucket, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	if err = verifyETag(etag, object.ETag); err != nil {
+		return err
+	}
+
+	options := PutOptions{ContentType: object.ContentType, Metadata: object.Metadata, StorageClass: storageClass}
+	if reader, ok := s.store.(TagReader); ok {
+		if options.Tags, err = reader.Tags(ctx, bucket, key); err != nil {
+			return err
+		}
+	}
+
+	return s.store.Put(ctx, destinationBucket, destinationKey, object.Body, options)
+}
+
+// tagArchived 为原图添加ArchiveTags, 保留原有的标签, 不支持标签的存储忽略
+func (s Imaging) tagArchived(ctx context.Context, bucket, key string) error {
+	writer, ok := s.store.(TagWriter)
+	if !ok {
+		return nil
+	}
+
+	// 写入标签会替换所有标签
+	tags := make(map[string]string)
+	if reader, ok := s.store.(TagReader); ok {
+		sourceTags, err := reader.Tags(ctx, bucket, key)
+		if err != nil {
+			return err
+		}
+		for name, value := range sourceTags {
+			tags[name] = value
+		}
+	}
+
+	for name, value := range s.config.ArchiveTags {
+		tags[name] = value
+	}
+	if err := writer.PutTags(ctx, bucket, key, tags); err != nil {
+		return err
+	}
+
+	logger.InfoContext(ctx, "Tag archived image success", "tags", s.config.ArchiveTags)
+	return nil
+}
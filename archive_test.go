@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/nzai/resize/pkg/naming"
+)
+
+// copyCall 一次服务端复制的参数
+type copyCall struct {
+	bucket, key, etag                          string
+	destinationBucket, destinationKey, storage string
+}
+
+// copierStore 记录服务端复制的本地存储, 读取和写入都会失败
+type copierStore struct {
+	*LocalStore
+	copies []copyCall
+}
+
+// Get 服务端复制时不应该读取对象
+func (s *copierStore) Get(ctx context.Context, bucket, key string) (*Object, error) {
+	return nil, os.ErrPermission
+}
+
+// Copy 实现ObjectCopier
+func (s *copierStore) Copy(ctx context.Context, bucket, key, etag, destinationBucket, destinationKey, storageClass string) error {
+	s.copies = append(s.copies, copyCall{bucket, key, etag, destinationBucket, destinationKey, storageClass})
+	return nil
+}
+
+func TestArchiveUsesServerSideCopy(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "ArchivePrefix": "archive/"})
+	store := &copierStore{LocalStore: NewLocalStore()}
+	s.store = store
+
+	original := &Original{Bucket: "photos", Key: "a/b.jpg", Version: naming.Version{ETag: "abc"}}
+	if err := s.archiveOriginal(context.Background(), original); err != nil {
+		t.Fatalf("archive failed: %v", err)
+	}
+
+	expected := copyCall{"photos", "a/b.jpg", "abc", "photos", "archive/a/b.jpg", defaultArchiveStorageClass}
+	if len(store.copies) != 1 || store.copies[0] != expected {
+		t.Errorf("archive copied %+v, want %+v", store.copies, expected)
+	}
+}
+
+func TestQuarantineUsesServerSideCopy(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "QuarantineBucket": "quarantine"})
+	store := &copierStore{LocalStore: NewLocalStore()}
+	s.store = store
+	writeTestFile(t, bucket, "a.jpg", []byte("moderated"))
+
+	if err := s.quarantine(context.Background(), bucket, "a.jpg", "abc"); err != nil {
+		t.Fatalf("quarantine failed: %v", err)
+	}
+
+	expected := copyCall{bucket, "a.jpg", "abc", "quarantine", "a.jpg", ""}
+	if len(store.copies) != 1 || store.copies[0] != expected {
+		t.Errorf("quarantine copied %+v, want %+v", store.copies, expected)
+	}
+	if _, err := os.Stat(filepath.Join(bucket, "a.jpg")); !os.IsNotExist(err) {
+		t.Errorf("quarantined image was not deleted: %v", err)
+	}
+}
+
+func TestCopyObjectWithoutServerSideCopy(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100"})
+	writeTestFile(t, bucket, "a.jpg", []byte("original"))
+	info, err := s.store.Head(context.Background(), bucket, "a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.copyObject(context.Background(), bucket, "a.jpg", info.ETag, bucket, "archive/a.jpg", ""); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if content := readTestFile(t, bucket, "archive/a.jpg"); !bytes.Equal(content, []byte("original")) {
+		t.Errorf("copied content is %q", content)
+	}
+
+	// 原图已经被覆盖时不复制
+	if err = s.copyObject(context.Background(), bucket, "a.jpg", "stale", bucket, "archive/b.jpg", ""); err == nil {
+		t.Errorf("copy of an overwritten object returned no error")
+	}
+	if _, err = os.Stat(filepath.Join(bucket, "archive", "b.jpg")); !os.IsNotExist(err) {
+		t.Errorf("overwritten object was copied: %v", err)
+	}
+}
+
+func TestS3StoreCopy(t *testing.T) {
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		w.Write([]byte(`<CopyObjectResult><ETag>"abc"</ETag></CopyObjectResult>`))
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewS3Store(&Config{SSEAlgorithm: "aws:kms", KMSKeyID: "key"}, s3.New(sess))
+
+	if err = store.Copy(context.Background(), "photos", "a/猫 1.jpg", "abc", "photos", "archive/a.jpg", "GLACIER_IR"); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if request.Method != http.MethodPut || request.URL.Path != "/photos/archive/a.jpg" {
+		t.Errorf("copy requested %s %s", request.Method, request.URL.Path)
+	}
+
+	// 只复制事件对应的对象, 元数据和标签随对象复制
+	headers := map[string]string{
+		"X-Amz-Copy-Source":                           "photos/a/%E7%8C%AB%201.jpg",
+		"X-Amz-Copy-Source-If-Match":                  "abc",
+		"X-Amz-Metadata-Directive":                    s3.MetadataDirectiveCopy,
+		"X-Amz-Tagging-Directive":                     s3.TaggingDirectiveCopy,
+		"X-Amz-Storage-Class":                         "GLACIER_IR",
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key",
+	}
+	for name, value := range headers {
+		if actual := request.Header.Get(name); actual != value {
+			t.Errorf("header %s is %q, want %q", name, actual, value)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// azureAPIVersion Blob服务的API版本, 2019-12-12开始支持写入时设置标签
+	azureAPIVersion = "2020-04-08"
+	// azureMetadataPrefix 自定义元数据的请求头前缀
+	azureMetadataPrefix = "X-Ms-Meta-"
+)
+
+var (
+	// azureAccessTiers 支持的访问层, 其他存储类型不设置访问层
+	azureAccessTiers = map[string]string{
+		"hot":     "Hot",
+		"cool":    "Cool",
+		"cold":    "Cold",
+		"archive": "Archive",
+	}
+)
+
+// AzureStore 基于Azure Blob Storage REST API的对象存储, bucket对应container
+type AzureStore struct {
+	account  string
+	key      []byte
+	sasToken string
+	endpoint string
+	client   *http.Client
+}
+
+// NewAzureStore 新建Azure Blob存储, 使用共享密钥或SAS令牌访问
+func NewAzureStore(config *Config) (*AzureStore, error) {
+	store := &AzureStore{
+		account:  config.AzureAccountName,
+		sasToken: strings.TrimPrefix(config.AzureSASToken, "?"),
+		endpoint: strings.TrimSuffix(config.AzureEndpoint, "/"),
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+
+	if config.AzureAccountKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.AzureAccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("account key is invalid: %v", err)
+		}
+		store.key = key
+	}
+
+	// Azurite等模拟器使用http://127.0.0.1:10000/account形式的地址
+	if store.endpoint == "" {
+		store.endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", store.account)
+	}
+
+	return store, nil
+}
+
+// Get 读取对象
+func (s *AzureStore) Get(ctx context.Context, bucket, key string) (*Object, error) {
+	response, err := s.do(ctx, http.MethodGet, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{ObjectInfo: *azureObjectInfo(response), Body: response.Body}, nil
+}
+
+// Head 读取对象的元数据
+func (s *AzureStore) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	response, err := s.do(ctx, http.MethodHead, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	return azureObjectInfo(response), nil
+}
+
+// Put 写入块blob, 缩略图不大, 使用单次Put Blob
+func (s *AzureStore) Put(ctx context.Context, bucket, key string, body io.Reader, options PutOptions) error {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(content)
+	header := http.Header{}
+	header.Set("X-Ms-Blob-Type", "BlockBlob")
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	if options.ContentType != "" {
+		header.Set("X-Ms-Blob-Content-Type", options.ContentType)
+	}
+	if options.CacheControl != "" {
+		header.Set("X-Ms-Blob-Cache-Control", options.CacheControl)
+	}
+	if tier, found := azureAccessTiers[strings.ToLower(options.StorageClass)]; found {
+		header.Set("X-Ms-Access-Tier", tier)
+	}
+	// 元数据名称必须是合法的C#标识符, 不能包含-
+	for name, value := range options.Metadata {
+		header.Set(azureMetadataPrefix+strings.Replace(name, "-", "_", -1), value)
+	}
+	if len(options.Tags) > 0 {
+		tags := url.Values{}
+		for name, value := range options.Tags {
+			tags.Set(name, value)
+		}
+		header.Set("X-Ms-Tags", strings.Replace(tags.Encode(), "+", "%20", -1))
+	}
+
+	response, err := s.do(ctx, http.MethodPut, bucket, key, nil, header, content)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Delete 删除对象及其快照
+func (s *AzureStore) Delete(ctx context.Context, bucket, key string) error {
+	header := http.Header{}
+	header.Set("X-Ms-Delete-Snapshots", "include")
+
+	response, err := s.do(ctx, http.MethodDelete, bucket, key, nil, header, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Tags 读取blob索引标签
+func (s *AzureStore) Tags(ctx context.Context, bucket, key string) (map[string]string, error) {
+	response, err := s.do(ctx, http.MethodGet, bucket, key, url.Values{"comp": {"tags"}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		Tags []struct {
+			Key   string `xml:"Key"`
+			Value string `xml:"Value"`
+		} `xml:"TagSet>Tag"`
+	}
+	if err = xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(result.Tags))
+	for _, tag := range result.Tags {
+		tags[tag.Key] = tag.Value
+	}
+
+	return tags, nil
+}
+
+// do 发送请求, 失败的响应转换为StatusError
+func (s *AzureStore) do(ctx context.Context, method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	location, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	location.Path += "/" + bucket + "/" + key
+
+	// SAS令牌本身就是查询参数
+	rawQuery := query.Encode()
+	if s.key == nil && s.sasToken != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += s.sasToken
+	}
+	location.RawQuery = rawQuery
+
+	request, err := http.NewRequest(method, location.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	request.Header.Set("X-Ms-Version", azureAPIVersion)
+	request.ContentLength = int64(len(body))
+
+	if s.key != nil {
+		request.Header.Set("Authorization", "SharedKey "+s.account+":"+s.sign(request, query))
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, &StatusError{Service: "azure", StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	return response, nil
+}
+
+// sign 计算共享密钥签名
+func (s *AzureStore) sign(request *http.Request, query url.Values) string {
+	contentLength := ""
+	if request.ContentLength > 0 {
+		contentLength = fmt.Sprintf("%d", request.ContentLength)
+	}
+
+	// 规范化的x-ms-请求头, 按名称排序
+	var names []string
+	for name := range request.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(request.Header.Get(name)) + "\n")
+	}
+
+	// 规范化的资源, 查询参数按名称排序
+	canonicalResource := "/" + s.account + request.URL.EscapedPath()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		canonicalResource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		request.Method,
+		request.Header.Get("Content-Encoding"),
+		request.Header.Get("Content-Language"),
+		contentLength,
+		request.Header.Get("Content-MD5"),
+		request.Header.Get("Content-Type"),
+		"",
+		request.Header.Get("If-Modified-Since"),
+		request.Header.Get("If-Match"),
+		request.Header.Get("If-None-Match"),
+		request.Header.Get("If-Unmodified-Since"),
+		request.Header.Get("Range"),
+		canonicalHeaders.String() + canonicalResource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(stringToSign))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// azureObjectInfo 从响应头中读取元数据
+func azureObjectInfo(response *http.Response) *ObjectInfo {
+	info := &ObjectInfo{
+		ETag:        response.Header.Get("ETag"),
+		Size:        response.ContentLength,
+		ContentType: response.Header.Get("Content-Type"),
+		Metadata:    make(map[string]string),
+	}
+
+	// 分块上传的blob没有Content-MD5
+	if sum, err := base64.StdEncoding.DecodeString(response.Header.Get("Content-MD5")); err == nil && len(sum) == md5.Size {
+		info.MD5 = hex.EncodeToString(sum)
+	}
+
+	for name, values := range response.Header {
+		if strings.HasPrefix(name, azureMetadataPrefix) && len(values) > 0 {
+			name = strings.ToLower(strings.TrimPrefix(name, azureMetadataPrefix))
+			info.Metadata[strings.Replace(name, "_", "-", -1)] = values[0]
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// azureValidationEvent Event Grid订阅验证事件
+	azureValidationEvent = "Microsoft.EventGrid.SubscriptionValidationEvent"
+)
+
+// azureEventNames Event Grid事件类型对应的S3事件名
+var azureEventNames = map[string]string{
+	"Microsoft.Storage.BlobCreated": "ObjectCreated:Put",
+	"Microsoft.Storage.BlobDeleted": "ObjectRemoved:Delete",
+}
+
+// azureEvent Event Grid事件, 同时兼容Event Grid和CloudEvents两种架构
+type azureEvent struct {
+	EventType string `json:"eventType"`
+	Type      string `json:"type"`
+	Subject   string `json:"subject"`
+	Data      struct {
+		ETag           string `json:"eTag"`
+		ContentLength  int64  `json:"contentLength"`
+		URL            string `json:"url"`
+		ValidationCode string `json:"validationCode"`
+	} `json:"data"`
+}
+
+// AzureEvent 处理Event Grid推送的Blob事件, 支持直接的webhook和Azure Functions自定义处理程序
+func (s Imaging) AzureEvent(w http.ResponseWriter, r *http.Request) {
+	// CloudEvents架构的webhook验证
+	if r.Method == http.MethodOptions {
+		w.Header().Set("WebHook-Allowed-Origin", r.Header.Get("WebHook-Request-Origin"))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	azureEvents, invocation, err := parseAzureEvents(body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Parse azure event failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var s3Event events.S3Event
+	for _, event := range azureEvents {
+		// Event Grid webhook的订阅验证
+		if event.EventType == azureValidationEvent {
+			logger.InfoContext(r.Context(), "Validate event grid subscription")
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"validationResponse": event.Data.ValidationCode})
+			return
+		}
+
+		record, err := azureEventRecord(event)
+		if err != nil {
+			logger.WarnContext(r.Context(), "Ignore invalid azure event", "subject", event.Subject, "error", err)
+			continue
+		}
+		if record != nil {
+			s3Event.Records = append(s3Event.Records, *record)
+		}
+	}
+
+	// 返回错误时Event Grid会重新推送
+	if _, err = s.S3Event(r.Context(), s3Event); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 自定义处理程序需要返回调用结果
+	if invocation {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"Outputs": map[string]interface{}{}, "Logs": []string{}})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseAzureEvents 解析事件数组, 单个事件或者自定义处理程序的调用请求
+func parseAzureEvents(body []byte) ([]azureEvent, bool, error) {
+	body = []byte(strings.TrimSpace(string(body)))
+	if len(body) > 0 && body[0] == '[' {
+		var azureEvents []azureEvent
+		err := json.Unmarshal(body, &azureEvents)
+		return azureEvents, false, err
+	}
+
+	// 自定义处理程序的请求: {"Data": {"<binding>": event}, "Metadata": {...}}
+	var invocation struct {
+		Data map[string]json.RawMessage `json:"Data"`
+	}
+	if err := json.Unmarshal(body, &invocation); err == nil && invocation.Data != nil {
+		var azureEvents []azureEvent
+		for _, raw := range invocation.Data {
+			// 绑定数据可能是JSON字符串
+			var text string
+			if json.Unmarshal(raw, &text) == nil {
+				raw = json.RawMessage(text)
+			}
+
+			var event azureEvent
+			if err = json.Unmarshal(raw, &event); err != nil {
+				return nil, true, err
+			}
+			azureEvents = append(azureEvents, event)
+		}
+
+		return azureEvents, true, nil
+	}
+
+	var event azureEvent
+	err := json.Unmarshal(body, &event)
+	return []azureEvent{event}, false, err
+}
+
+// azureEventRecord 将Blob事件转换为S3事件记录, 不需要处理的事件返回nil
+func azureEventRecord(event azureEvent) (*events.S3EventRecord, error) {
+	eventType := event.EventType
+	if eventType == "" {
+		eventType = event.Type
+	}
+
+	eventName, found := azureEventNames[eventType]
+	if !found {
+		logger.Info("Ignore azure event", "eventType", eventType)
+		return nil, nil
+	}
+
+	// subject: /blobServices/default/containers/{container}/blobs/{blob}
+	parts := strings.SplitN(strings.TrimPrefix(event.Subject, "/blobServices/default/containers/"), "/blobs/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("subject %s is invalid", event.Subject)
+	}
+
+	record := &events.S3EventRecord{EventSource: "azure", EventName: eventName}
+	record.S3.Bucket.Name = parts[0]
+	// S3事件中的key经过URL编码, 保持一致
+	record.S3.Object.Key = url.QueryEscape(parts[1])
+	record.S3.Object.Size = event.Data.ContentLength
+	record.S3.Object.ETag = event.Data.ETag
+
+	return record, nil
+}
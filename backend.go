@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/nzai/resize/jpegscale"
+)
+
+const (
+	// BackendGo 使用Go解码并缩放
+	BackendGo = "go"
+	// BackendVips 使用libvips缩放, 需要使用-tags vips编译并安装libvips
+	BackendVips = "vips"
+)
+
+// vipsSupported 是否可以用vips生成该尺寸, 自定义的处理步骤, 水印, 锐化, 占位图, 补边, 旋转翻转, 自动色阶, 颜色效果, 4:4:4色度抽样和自定义焦点仍然使用Go实现
+func (s Imaging) vipsSupported(size Size) bool {
+	if s.config.Backend != BackendVips || !s.config.isDefaultPipeline() || s.watermark != nil || s.config.Sharpen.Amount > 0 {
+		return false
+	}
+	if size.Placeholder || size.Format != FormatJPEG || !size.Transform.IsZero() || size.Effect.Name != "" || size.Normalize {
+		return false
+	}
+	if size.Subsampling == jpegscale.Subsampling444 {
+		return false
+	}
+
+	switch size.Mode {
+	case ModeFill:
+		return size.Gravity.IsZero() || size.Gravity.Name == "center" || size.Gravity.IsSmart()
+	case ModeFit, ModeStretch:
+		return true
+	}
+
+	return false
+}
+
+// createThumbnailVips 用vips直接从原图内容生成缩略图
+func (s Imaging) createThumbnailVips(ctx context.Context, original *Original, size Size, result SizeResult, start time.Time) SizeResult {
+	// 避免放大原图
+	target := size
+	if size.upscaleFactor(original.Bounds) > 1 {
+		switch s.config.NoUpscale {
+		case "skip":
+			logger.InfoContext(ctx, "Skip thumbnail larger than original", "size", result.Size, "width", original.Bounds.X, "height", original.Bounds.Y)
+			result.finish(start, errSkipped)
+			return result
+		case "true":
+			target = size.limitTo(original.Bounds)
+		}
+	}
+
+	_, segment := beginSegment(ctx, "resize")
+	segment.annotate("size", result.Size)
+	content, width, height, err := vipsThumbnail(original.Source, target)
+	segment.end(err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Create thumbnail with vips failed", "size", result.Size, "error", err)
+		result.finish(start, err)
+		return result
+	}
+	result.Width, result.Height = width, height
+	result.ResizeMs = durationMs(start)
+	resized := time.Now()
+
+	uploadCtx, segment := beginSegment(ctx, "upload")
+	segment.annotate("size", result.Size)
+	err = s.putThumbnail(uploadCtx, original, s.withEXIF(original, content, size), size, &result)
+	segment.end(err)
+	result.finish(start, err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Save thumbnail failed", "size", result.Size, "thumbnail", result.Key, "error", err)
+		return result
+	}
+
+	logger.InfoContext(ctx, "Save thumbnail success", "size", result.Size, "thumbnail", result.Key, "durationMs", durationMs(resized))
+	return result
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// backfillChunkRows 每处理这么多行清单记录保存一次检查点
+	backfillChunkRows = 1000
+)
+
+// inventoryManifest S3 Inventory的manifest.json
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+// backfillCheckpoint 回填进度, 记录每个清单文件已经处理的行数, 重新运行时跳过
+type backfillCheckpoint struct {
+	Manifest string         `json:"manifest"`
+	Files    map[string]int `json:"files"`
+}
+
+// backfillStats 回填的统计
+type backfillStats struct {
+	Rows      int
+	Skipped   int
+	Processed int
+	Failed    int
+}
+
+// runBackfill 回填模式, 按S3 Inventory清单为尚未生成缩略图的历史原图生成缩略图
+// 配置与Lambda相同, 从环境变量和配置文件中读取
+func runBackfill(args []string) error {
+	flags := flag.NewFlagSet("resize backfill", flag.ContinueOnError)
+	manifest := flags.String("manifest", "", "S3 Inventory manifest, such as s3://inventory/photos/daily/2024-01-01T00-00Z/manifest.json")
+	concurrency := flags.Int("concurrency", runtime.NumCPU(), "number of images processed at the same time")
+	checkpoint := flags.String("checkpoint", "", "local file to save progress, an interrupted backfill resumes from it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *manifest == "" || *concurrency <= 0 {
+		flags.Usage()
+		return fmt.Errorf("invalid arguments")
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	imaging, err := newImaging(context.Background(), config)
+	if err != nil {
+		return err
+	}
+
+	// 中断时处理完当前的记录并保存检查点
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return imaging.backfill(ctx, *manifest, *concurrency, *checkpoint)
+}
+
+// backfill 读取清单中的所有文件, 处理缺少缩略图的原图
+func (s Imaging) backfill(ctx context.Context, location string, concurrency int, checkpointFile string) error {
+	bucket, key, ok := parseObjectLocation(location, "s3://")
+	if !ok {
+		return fmt.Errorf("manifest %s is invalid, use s3://bucket/key", location)
+	}
+
+	manifest, err := s.readInventoryManifest(ctx, bucket, key)
+	if err != nil {
+		return fmt.Errorf("read manifest %s failed due to %v", location, err)
+	}
+
+	// Parquet和ORC需要列式存储的解码库, 请在Inventory配置中选择CSV
+	if !strings.EqualFold(manifest.FileFormat, "CSV") {
+		return fmt.Errorf("inventory format %s is not supported, use CSV", manifest.FileFormat)
+	}
+
+	columns := inventoryColumns(manifest.FileSchema)
+	if _, found := columns["key"]; !found {
+		return fmt.Errorf("inventory schema %s has no Key field", manifest.FileSchema)
+	}
+
+	checkpoint, err := readBackfillCheckpoint(checkpointFile, location)
+	if err != nil {
+		return fmt.Errorf("read checkpoint %s failed due to %v", checkpointFile, err)
+	}
+
+	// 清单文件保存在destinationBucket中, 格式为arn:aws:s3:::bucket
+	inventoryBucket := manifest.DestinationBucket[strings.LastIndex(manifest.DestinationBucket, ":")+1:]
+
+	start := time.Now()
+	stats := new(backfillStats)
+	for _, file := range manifest.Files {
+		if ctx.Err() != nil {
+			break
+		}
+
+		fileCtx := withLogAttrs(ctx, "inventoryFile", file.Key)
+		err = s.backfillFile(fileCtx, inventoryBucket, file.Key, manifest.SourceBucket, columns, concurrency, checkpoint, checkpointFile, stats)
+		if err != nil {
+			logger.ErrorContext(fileCtx, "Backfill inventory file failed", "error", err)
+			return err
+		}
+	}
+
+	logger.InfoContext(ctx, "Backfill complete", "manifest", location, "rows", stats.Rows, "skipped", stats.Skipped, "processed", stats.Processed, "failed", stats.Failed, "interrupted", ctx.Err() != nil, "durationMs", durationMs(start))
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d of %d images failed", stats.Failed, stats.Processed)
+	}
+
+	return ctx.Err()
+}
+
+// readInventoryManifest 读取清单的manifest.json
+func (s Imaging) readInventoryManifest(ctx context.Context, bucket, key string) (*inventoryManifest, error) {
+	var object *Object
+	err := s.retryStorage(ctx, "get", false, func() error {
+		var err error
+		object, err = s.store.Get(ctx, bucket, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	manifest := new(inventoryManifest)
+	if err = json.NewDecoder(object.Body).Decode(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// backfillFile 分批读取一个gzip压缩的CSV清单文件, 每批处理完后保存检查点
+func (s Imaging) backfillFile(ctx context.Context, inventoryBucket, key, sourceBucket string, columns map[string]int, concurrency int, checkpoint *backfillCheckpoint, checkpointFile string, stats *backfillStats) error {
+	var object *Object
+	err := s.retryStorage(ctx, "get", false, func() error {
+		var err error
+		object, err = s.store.Get(ctx, inventoryBucket, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	gz, err := gzip.NewReader(object.Body)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	reader := csv.NewReader(gz)
+	reader.FieldsPerRecord = -1
+
+	completed := checkpoint.Files[key]
+	if completed > 0 {
+		logger.InfoContext(ctx, "Resume inventory file", "completedRows", completed)
+	}
+
+	var row int
+	for eof := false; !eof && ctx.Err() == nil; {
+		var records []events.S3EventRecord
+		for len(records) < backfillChunkRows {
+			fields, err := reader.Read()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			row++
+			if row <= completed {
+				continue
+			}
+
+			record, ok := inventoryRecord(fields, columns, sourceBucket)
+			if !ok {
+				stats.Rows++
+				stats.Skipped++
+				continue
+			}
+			records = append(records, record)
+		}
+		if row <= completed {
+			continue
+		}
+
+		// 中断时这一批可能没有处理完, 不保存检查点, 重新运行时再检查一次
+		s.backfillRecords(ctx, records, concurrency, stats)
+		if ctx.Err() != nil {
+			break
+		}
+
+		checkpoint.Files[key] = row
+		if err = checkpoint.save(checkpointFile); err != nil {
+			return err
+		}
+	}
+	logger.InfoContext(ctx, "Backfill inventory file", "rows", row)
+
+	return nil
+}
+
+// backfillRecords 并行检查和处理一批记录, 只处理缺少缩略图或者原图已更新的记录
+func (s Imaging) backfillRecords(ctx context.Context, records []events.S3EventRecord, concurrency int, stats *backfillStats) {
+	needed := make([]bool, len(records))
+	results := make([]RecordResult, len(records))
+
+	indexes := make(chan int)
+	wg := new(sync.WaitGroup)
+	wg.Add(concurrency)
+	for worker := 0; worker < concurrency; worker++ {
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if needed[index] = s.backfillNeeded(ctx, records[index]); needed[index] {
+					results[index] = s.processRecords(ctx, records[index:index+1])[0]
+				}
+			}
+		}()
+	}
+	for index := range records {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	var processed []RecordResult
+	for index, result := range results {
+		stats.Rows++
+		if !needed[index] {
+			stats.Skipped++
+			continue
+		}
+
+		stats.Processed++
+		if result.Err() != nil {
+			stats.Failed++
+		}
+		processed = append(processed, result)
+	}
+	if len(processed) > 0 {
+		s.logReport(ctx, processed)
+	}
+}
+
+// backfillNeeded 不读取原图, 判断是否有尚未生成或者不是由当前版本的原图生成的缩略图
+func (s Imaging) backfillNeeded(ctx context.Context, record events.S3EventRecord) bool {
+	bucket := record.S3.Bucket.Name
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil || strings.HasSuffix(key, "/") {
+		return false
+	}
+	s, _ = s.forObject(ctx, bucket, key)
+	if s.isThumbnailKey(bucket, key) || !s.config.KeyFilter.Match(key) || !s.isSupportedKey(key) {
+		return false
+	}
+
+	etag := strings.Trim(record.S3.Object.ETag, "\"")
+	for _, size := range s.config.sizesFor(key) {
+		thumbnailBucket, thumbnailKey := s.thumbnailLocation(bucket, key, recordVersion(record), size)
+		output, err := s.destination.Head(ctx, thumbnailBucket, thumbnailKey)
+		if err != nil || etag != "" && metadataValue(output.Metadata, "source-etag") != etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inventoryColumns 按fileSchema得到字段所在的列, 如"Bucket, Key, Size, LastModifiedDate, ETag", 字段名为小写
+func inventoryColumns(schema string) map[string]int {
+	columns := make(map[string]int)
+	for index, name := range strings.Split(schema, ",") {
+		columns[strings.ToLower(strings.TrimSpace(name))] = index
+	}
+
+	return columns
+}
+
+// inventoryRecord 清单中的一行对应的事件记录, 清单中的key与S3事件一样经过URL编码
+// 开启了版本控制时只处理最新版本, 忽略删除标记
+func inventoryRecord(fields []string, columns map[string]int, sourceBucket string) (events.S3EventRecord, bool) {
+	field := func(name string) string {
+		if index, found := columns[name]; found && index < len(fields) {
+			return fields[index]
+		}
+		return ""
+	}
+
+	record := events.S3EventRecord{EventSource: "aws:s3:inventory", EventName: "ObjectCreated:Put"}
+	if field("islatest") == "false" || field("isdeletemarker") == "true" || field("key") == "" {
+		return record, false
+	}
+
+	record.S3.Bucket.Name = field("bucket")
+	if record.S3.Bucket.Name == "" {
+		record.S3.Bucket.Name = sourceBucket
+	}
+	record.S3.Object.Key = field("key")
+	record.S3.Object.ETag = field("etag")
+	record.S3.Object.VersionID = field("versionid")
+	fmt.Sscan(field("size"), &record.S3.Object.Size)
+
+	return record, true
+}
+
+// readBackfillCheckpoint 读取检查点, 文件不存在或者属于其他清单时从头开始
+func readBackfillCheckpoint(file, manifest string) (*backfillCheckpoint, error) {
+	checkpoint := &backfillCheckpoint{Manifest: manifest, Files: make(map[string]int)}
+	if file == "" {
+		return checkpoint, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := new(backfillCheckpoint)
+	if err = json.Unmarshal(content, saved); err != nil {
+		return nil, err
+	}
+	if saved.Manifest != manifest {
+		logger.Warn("Ignore checkpoint of another manifest", "checkpoint", file, "manifest", saved.Manifest)
+		return checkpoint, nil
+	}
+	if saved.Files == nil {
+		saved.Files = make(map[string]int)
+	}
+
+	return saved, nil
+}
+
+// save 保存检查点, 先写入临时文件再重命名, 中断时不会留下不完整的文件
+func (c *backfillCheckpoint) save(file string) error {
+	if file == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	temp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err = ioutil.WriteFile(temp, content, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(temp, file)
+}
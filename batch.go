@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"image/jpeg"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// batchSucceeded 任务成功
+	batchSucceeded = "Succeeded"
+	// batchTemporaryFailure 任务失败, Batch Operations会重试
+	batchTemporaryFailure = "TemporaryFailure"
+	// batchPermanentFailure 任务失败, 不会重试
+	batchPermanentFailure = "PermanentFailure"
+)
+
+// BatchEvent S3 Batch Operations调用事件, 兼容1.0和2.0版本
+type BatchEvent struct {
+	InvocationSchemaVersion string `json:"invocationSchemaVersion"`
+	InvocationID            string `json:"invocationId"`
+	Job                     struct {
+		ID string `json:"id"`
+	} `json:"job"`
+	Tasks []BatchTask `json:"tasks"`
+}
+
+// BatchTask 批量任务
+type BatchTask struct {
+	TaskID      string `json:"taskId"`
+	S3Key       string `json:"s3Key"`
+	S3VersionID string `json:"s3VersionId"`
+	S3BucketArn string `json:"s3BucketArn"`
+	S3Bucket    string `json:"s3Bucket"`
+}
+
+// BatchResponse 批量任务的处理结果
+type BatchResponse struct {
+	InvocationSchemaVersion string        `json:"invocationSchemaVersion"`
+	TreatMissingKeysAs      string        `json:"treatMissingKeysAs"`
+	InvocationID            string        `json:"invocationId"`
+	Results                 []BatchResult `json:"results"`
+}
+
+// BatchResult 单个任务的处理结果
+type BatchResult struct {
+	TaskID       string `json:"taskId"`
+	ResultCode   string `json:"resultCode"`
+	ResultString string `json:"resultString"`
+}
+
+// BatchEvent 处理S3 Batch Operations的任务, 用于为已有的原图补充缩略图
+func (s Imaging) BatchEvent(ctx context.Context, event BatchEvent) BatchResponse {
+	records := make([]events.S3EventRecord, len(event.Tasks))
+	for index, task := range event.Tasks {
+		bucket := task.S3Bucket
+		if bucket == "" {
+			// arn:aws:s3:::bucket
+			bucket = task.S3BucketArn[strings.LastIndex(task.S3BucketArn, ":")+1:]
+		}
+
+		// 与S3通知一致, 任务中的key经过URL编码
+		records[index] = events.S3EventRecord{EventSource: "aws:s3:batch", EventName: "ObjectCreated:Batch"}
+		records[index].S3.Bucket.Name = bucket
+		records[index].S3.Object.Key = task.S3Key
+		records[index].S3.Object.VersionID = task.S3VersionID
+	}
+
+	// 结果的版本与调用事件一致
+	response := BatchResponse{
+		InvocationSchemaVersion: event.InvocationSchemaVersion,
+		TreatMissingKeysAs:      batchPermanentFailure,
+		InvocationID:            event.InvocationID,
+		Results:                 make([]BatchResult, len(event.Tasks)),
+	}
+
+	results := s.processRecords(ctx, records)
+	for index, recordResult := range results {
+		result := BatchResult{TaskID: event.Tasks[index].TaskID, ResultCode: batchSucceeded, ResultString: "ok"}
+		if err := recordResult.Err(); err != nil {
+			result.ResultCode, result.ResultString = batchResultCode(err), err.Error()
+		}
+		response.Results[index] = result
+	}
+
+	s.logReport(ctx, results)
+	logger.InfoContext(ctx, "Process batch tasks", "tasks", len(event.Tasks), "job", event.Job.ID)
+	return response
+}
+
+// batchResultCode 原图不存在, 过大或者无法解码时重试也不会成功
+func batchResultCode(err error) string {
+	if isNotFound(err) || isTooLarge(err) || isPermanentTimeout(err) || isCorrupt(err) {
+		return batchPermanentFailure
+	}
+
+	switch err.(type) {
+	case jpeg.FormatError, jpeg.UnsupportedError:
+		return batchPermanentFailure
+	}
+
+	return batchTemporaryFailure
+}
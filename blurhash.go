@@ -0,0 +1,127 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+const (
+	// blurHashCharacters BlurHash使用的base83字符表
+	blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	// blurHashSampleSize 计算BlurHash前将图像缩小到的最大边长
+	blurHashSampleSize = 32
+)
+
+// blurHash 计算图像的BlurHash, 参考https://github.com/woltapp/blurhash
+func blurHash(src image.Image, componentsX, componentsY int) string {
+	sample := pipeline.ToRGBA(resize.Thumbnail(blurHashSampleSize, blurHashSampleSize, src, resize.Bilinear))
+	width, height := sample.Bounds().Dx(), sample.Bounds().Dy()
+
+	// 先转换到线性空间
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := y*sample.Stride + x*4
+			linear[y*width+x] = [3]float64{
+				srgbToLinear(sample.Pix[offset+0]),
+				srgbToLinear(sample.Pix[offset+1]),
+				srgbToLinear(sample.Pix[offset+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	hash := new(strings.Builder)
+	encodeBase83(hash, (componentsX-1)+(componentsY-1)*9, 1)
+
+	// 交流分量的最大值
+	maximum := 1.0
+	if len(factors) > 1 {
+		var actual float64
+		for _, factor := range factors[1:] {
+			actual = math.Max(actual, math.Max(math.Abs(factor[0]), math.Max(math.Abs(factor[1]), math.Abs(factor[2]))))
+		}
+
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		encodeBase83(hash, quantised, 1)
+	} else {
+		encodeBase83(hash, 0, 1)
+	}
+
+	// 直流分量
+	dc := factors[0]
+	encodeBase83(hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	// 交流分量
+	for _, factor := range factors[1:] {
+		quantise := func(value float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximum, 0.5)*9+9.5))))
+		}
+		encodeBase83(hash, quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2)
+	}
+
+	return hash.String()
+}
+
+// encodeBase83 以base83编码value, 固定length位
+func encodeBase83(builder *strings.Builder, value, length int) {
+	for index := 1; index <= length; index++ {
+		digit := (value / int(math.Pow(83, float64(length-index)))) % 83
+		builder.WriteByte(blurHashCharacters[digit])
+	}
+}
+
+// srgbToLinear sRGB转换到线性空间
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB 线性空间转换到sRGB
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow 保留符号的幂运算
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer 超过该大小的缓冲区不放回池中, 避免偶尔的大图长期占用内存
+const maxPooledBuffer = 32 << 20
+
+// bufferPool 复用编码和下载使用的缓冲区, 同一次调用的多条记录和热启动的多次调用之间共享
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer 从池中取出清空的缓冲区
+func getBuffer() *bytes.Buffer {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+
+	return buffer
+}
+
+// putBuffer 用完后放回池中, 之后不能再使用buffer及其内容
+func putBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBuffer {
+		return
+	}
+
+	bufferPool.Put(buffer)
+}
+
+// pooledReader 读取池中缓冲区的内容, 关闭时归还缓冲区
+type pooledReader struct {
+	*bytes.Reader
+	buffer *bytes.Buffer
+	once   sync.Once
+}
+
+// newPooledReader 新建读取content的pooledReader, content是buffer中的内容
+func newPooledReader(buffer *bytes.Buffer, content []byte) *pooledReader {
+	return &pooledReader{Reader: bytes.NewReader(content), buffer: buffer}
+}
+
+// Close 实现io.Closer, 多次关闭只归还一次
+func (r *pooledReader) Close() error {
+	r.once.Do(func() { putBuffer(r.buffer) })
+	return nil
+}
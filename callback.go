@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// callbackTimeout 单次回调的超时时间
+	callbackTimeout = 10 * time.Second
+	// callbackBackoff 首次重试的等待时间, 之后每次翻倍
+	callbackBackoff = 500 * time.Millisecond
+)
+
+// callbackPayload 回调的请求体
+type callbackPayload struct {
+	completionMessage
+	Event  string `json:"event"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// callback 处理完成或失败后回调配置的地址, 忽略和全部跳过的记录以及试运行时不回调
+// 请求头X-Resize-Signature是用CallbackSecret对"时间戳.请求体"计算的HMAC-SHA256
+func (s Imaging) callback(ctx context.Context, result *RecordResult) {
+	if s.config.CallbackURL == "" || s.config.DryRun || result.Status == StatusIgnored || result.Status == StatusSkipped {
+		return
+	}
+
+	body, err := json.Marshal(callbackPayload{
+		completionMessage: s.completion(ctx, result),
+		Event:             result.Event,
+		Status:            result.Status,
+		Error:             result.Error,
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Marshal callback failed", "error", err)
+		return
+	}
+
+	backoff := callbackBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.postCallback(ctx, body)
+		if err == nil {
+			logger.InfoContext(ctx, "Callback success", "url", s.config.CallbackURL)
+			return
+		}
+
+		if !retry || attempt >= s.config.CallbackRetry {
+			logger.ErrorContext(ctx, "Callback failed", "url", s.config.CallbackURL, "error", err)
+			return
+		}
+
+		logger.WarnContext(ctx, "Retry callback", "url", s.config.CallbackURL, "backoffMs", int64(backoff/time.Millisecond), "error", err)
+		select {
+		case <-ctx.Done():
+			logger.ErrorContext(ctx, "Callback canceled", "url", s.config.CallbackURL, "error", ctx.Err())
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// postCallback 发送一次回调, 返回失败时是否需要重试
+func (s Imaging) postCallback(ctx context.Context, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, s.config.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Resize-Timestamp", timestamp)
+	if s.config.CallbackSecret != "" {
+		request.Header.Set("X-Resize-Signature", "sha256="+callbackSignature(s.config.CallbackSecret, timestamp, body))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	// 只重试限流和服务端错误
+	err = &StatusError{Service: "callback", StatusCode: response.StatusCode, Message: response.Status}
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500, err
+}
+
+// callbackSignature 计算回调的签名
+func callbackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
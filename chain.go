@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+// errSharedRender 共用缩放结果的尺寸中, 负责缩放的尺寸panic时其他尺寸返回的错误
+var errSharedRender = errors.New("shared render failed")
+
+// chainSources 尺寸从大到小排列, 每个尺寸从上一级的中间图像生成, 避免每个尺寸都缩放整张原图
+// 中间图像保留完整画面, 是该尺寸需要的2倍大小, 返回每个尺寸生成缩略图使用的图像
+func (s Imaging) chainSources(ctx context.Context, original *Original, sizes []Size) []image.Image {
+	start := time.Now()
+	src := original.Image
+	bounds := src.Bounds().Size()
+
+	order := make([]int, len(sizes))
+	for index := range order {
+		order[index] = index
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sizes[order[i]].coverScale(bounds) > sizes[order[j]].coverScale(bounds)
+	})
+
+	sources := make([]image.Image, len(sizes))
+	current, currentScale := src, 1.0
+	intermediates := 0
+	for _, index := range order {
+		// 至少能再缩小一半时才生成新的中间图像
+		scale := sizes[index].coverScale(bounds) * 2
+		if scale > 0 && scale <= currentScale/2 {
+			width := int(math.Ceil(float64(bounds.X) * scale))
+			height := int(math.Ceil(float64(bounds.Y) * scale))
+			current = resize.Resize(uint(width), uint(height), current, s.config.Filter)
+			currentScale = scale
+			intermediates++
+		}
+		sources[index] = current
+	}
+	logger.DebugContext(ctx, "Chain resize", "sizes", len(sizes), "intermediates", intermediates, "durationMs", durationMs(start))
+
+	return sources
+}
+
+// sharedRender 只有名称, 输出格式和编码选项不同的尺寸共用一次缩放, 如同一尺寸同时输出jpeg和webp
+type sharedRender struct {
+	once  sync.Once
+	image image.Image
+	err   error
+}
+
+// render 第一个开始的尺寸执行do, 其他尺寸等待并使用同一个图像, 编码时不会修改图像
+// r为nil时直接执行do
+func (r *sharedRender) render(do func() (image.Image, error)) (image.Image, error) {
+	if r == nil {
+		return do()
+	}
+
+	r.once.Do(func() {
+		// do中panic时once仍然算作完成, 其他尺寸不能把nil当作跳过
+		r.err = errSharedRender
+		r.image, r.err = do()
+	})
+
+	return r.image, r.err
+}
+
+// renderKey 影响缩放结果的尺寸选项和缩放的来源
+type renderKey struct {
+	point       image.Point
+	mode        string
+	gravity     pipeline.Gravity
+	background  color.Color
+	placeholder bool
+	transform   pipeline.Transform
+	effect      pipeline.Effect
+	normalize   bool
+	source      image.Image
+}
+
+// sharedRenders 按缩放结果分组, 返回每个尺寸共用的缩放, 只有一个尺寸的组为nil
+func sharedRenders(sizes []Size, sources []image.Image) []*sharedRender {
+	groups := make(map[renderKey][]int)
+	for index, size := range sizes {
+		key := renderKey{
+			point:       size.Point,
+			mode:        size.Mode,
+			gravity:     size.Gravity,
+			background:  size.Background,
+			placeholder: size.Placeholder,
+			transform:   size.Transform,
+			effect:      size.Effect,
+			normalize:   size.Normalize,
+			source:      sources[index],
+		}
+		groups[key] = append(groups[key], index)
+	}
+
+	shared := make([]*sharedRender, len(sizes))
+	for _, indexes := range groups {
+		if len(indexes) < 2 {
+			continue
+		}
+
+		render := new(sharedRender)
+		for _, index := range indexes {
+			shared[index] = render
+		}
+	}
+
+	return shared
+}
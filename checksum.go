@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// checksumReader 读取时计算md5和长度
+type checksumReader struct {
+	reader io.Reader
+	md5    hash.Hash
+	length int64
+}
+
+// newChecksumReader 新建checksumReader
+func newChecksumReader(reader io.Reader) *checksumReader {
+	return &checksumReader{reader: reader, md5: md5.New()}
+}
+
+// Read 实现io.Reader
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.md5.Write(p[:n])
+	r.length += int64(n)
+
+	return n, err
+}
+
+// verify 读完剩余内容后校验长度和md5, 分段上传和KMS加密的对象ETag不是md5, 只校验长度
+func (r *checksumReader) verify(etag string, contentLength int64) error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+
+	if contentLength >= 0 && r.length != contentLength {
+		return fmt.Errorf("object is truncated: read %d bytes, expected %d bytes", r.length, contentLength)
+	}
+
+	etag = strings.Trim(etag, "\"")
+	if !isMD5ETag(etag) {
+		return nil
+	}
+
+	if actual := hex.EncodeToString(r.md5.Sum(nil)); actual != etag {
+		return fmt.Errorf("object md5 %s does not match etag %s", actual, etag)
+	}
+
+	return nil
+}
+
+// isMD5ETag ETag是否是对象内容的md5
+func isMD5ETag(etag string) bool {
+	if len(etag) != md5.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
+
+// verifyETag 校验读取到的对象与事件中的对象是否一致
+func verifyETag(eventETag, objectETag string) error {
+	eventETag, objectETag = strings.Trim(eventETag, "\""), strings.Trim(objectETag, "\"")
+	if eventETag == "" || objectETag == "" || eventETag == objectETag {
+		return nil
+	}
+
+	return fmt.Errorf("object etag %s does not match event etag %s", objectETag, eventETag)
+}
+
+// verifySize 检查读取到的对象与事件中的大小一致, 任意一方未知时不检查
+func verifySize(eventSize, objectSize int64) error {
+	if eventSize <= 0 || objectSize <= 0 || eventSize == objectSize {
+		return nil
+	}
+
+	return fmt.Errorf("object size %d does not match event size %d", objectSize, eventSize)
+}
+
+// withChecksumSHA256 为单次上传的PutObject请求附加x-amz-checksum-sha256, 分段上传的每个分段由SDK计算Content-MD5
+func withChecksumSHA256(r *request.Request) {
+	r.Handlers.Build.PushBack(func(r *request.Request) {
+		if r.Error != nil || r.Operation.Name != "PutObject" || !aws.IsReaderSeekable(r.Body) {
+			return
+		}
+
+		start, err := r.Body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return
+		}
+
+		hash := sha256.New()
+		if _, err = io.Copy(hash, r.Body); err != nil {
+			r.Error = err
+			return
+		}
+
+		if _, err = r.Body.Seek(start, io.SeekStart); err != nil {
+			r.Error = err
+			return
+		}
+
+		r.HTTPRequest.Header.Set("x-amz-checksum-sha256", base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// runCLI 命令行模式, 遍历本地目录生成缩略图, 不依赖AWS
+// 其他配置仍然从环境变量中读取
+func runCLI(args []string) error {
+	flags := flag.NewFlagSet("resize", flag.ContinueOnError)
+	in := flags.String("in", "", "directory of original images")
+	out := flags.String("out", "", "directory to save thumbnails, defaults to the input directory")
+	sizes := flags.String("sizes", os.Getenv("Sizes"), "thumbnail sizes, such as 200x200,800x800:fill")
+	configFile := flags.String("config", os.Getenv("ConfigFile"), "JSON or YAML config file, environment variables override its values")
+	concurrency := flags.Int("concurrency", runtime.NumCPU(), "number of images processed at the same time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" || *concurrency <= 0 {
+		flags.Usage()
+		return fmt.Errorf("invalid arguments")
+	}
+	if *out == "" {
+		*out = *in
+	}
+
+	input, err := filepath.Abs(*in)
+	if err != nil {
+		return err
+	}
+	output, err := filepath.Abs(*out)
+	if err != nil {
+		return err
+	}
+
+	// 命令行参数覆盖环境变量
+	os.Setenv("Storage", StorageLocal)
+	os.Setenv("Sizes", *sizes)
+	os.Setenv("ConfigFile", *configFile)
+	if output != input {
+		os.Setenv("DestinationBucket", output)
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	imaging := NewImaging(config, NewLocalStore())
+	if err = imaging.loadWatermark(context.Background()); err != nil {
+		return fmt.Errorf("load watermark %s failed due to %v", config.Watermark, err)
+	}
+
+	start := time.Now()
+	var count int
+	var failed error
+	var batch []events.S3EventRecord
+	err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// 输出目录在输入目录中时不处理已生成的缩略图
+		if info.IsDir() {
+			if path == output && output != input {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		key, err := filepath.Rel(input, path)
+		if err != nil {
+			return err
+		}
+
+		// 与S3事件一致, key经过URL编码
+		record := events.S3EventRecord{EventSource: "local", EventName: "ObjectCreated:Put"}
+		record.S3.Bucket.Name = input
+		record.S3.Object.Key = url.QueryEscape(filepath.ToSlash(key))
+		record.S3.Object.Size = info.Size()
+
+		batch = append(batch, record)
+		count++
+		if len(batch) >= *concurrency {
+			if _, err := imaging.S3Event(context.Background(), events.S3Event{Records: batch}); err != nil {
+				failed = err
+			}
+			batch = nil
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		if _, err := imaging.S3Event(context.Background(), events.S3Event{Records: batch}); err != nil {
+			failed = err
+		}
+	}
+	logger.Info("Process files", "files", count, "directory", input, "durationMs", durationMs(start))
+
+	return failed
+}
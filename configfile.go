@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	// fileConfig 配置文件中的配置, 名称与环境变量相同
+	fileConfig map[string]string
+	// configScope 读取单个bucket的配置时为bucket名称
+	configScope string
+)
+
+// configValue 读取配置, bucket.Name形式的单个bucket的配置优先, 然后是环境变量, 最后是配置文件中的值
+func configValue(name string) string {
+	if configScope != "" {
+		if value := fileConfig[configScope+"."+name]; value != "" {
+			return value
+		}
+	}
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fileConfig[name]
+}
+
+// parseList 解析逗号分隔的列表
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// configBuckets 配置中有单独配置的bucket, bucket名称可能包含点, 以最后一个点分隔配置名
+func configBuckets() []string {
+	var buckets []string
+	found := make(map[string]bool)
+	for name := range fileConfig {
+		index := strings.LastIndex(name, ".")
+		if index <= 0 || found[name[:index]] || strings.HasPrefix(name, tenantScopePrefix) {
+			continue
+		}
+		found[name[:index]] = true
+		buckets = append(buckets, name[:index])
+	}
+	sort.Strings(buckets)
+
+	return buckets
+}
+
+// loadConfigFile 读取部署包中或者S3上(s3://bucket/key)的JSON或YAML配置文件
+func loadConfigFile(location string) (map[string]string, error) {
+	content, err := readConfigFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(path.Ext(location)) {
+	case ".json":
+		return parseJSONConfig(content)
+	case ".yaml", ".yml":
+		return parseYAMLConfig(content)
+	default:
+		return nil, fmt.Errorf("config file %s must be .json, .yaml or .yml", location)
+	}
+}
+
+// readConfigFile 读取配置文件的内容
+func readConfigFile(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return ioutil.ReadFile(location)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("config file %s is invalid", location)
+	}
+
+	sess, err := configSession()
+	if err != nil {
+		return nil, err
+	}
+
+	s3Config := aws.NewConfig().WithS3ForcePathStyle(os.Getenv("S3ForcePathStyle") == "true")
+	if endpoint := os.Getenv("S3Endpoint"); endpoint != "" {
+		s3Config = s3Config.WithEndpoint(endpoint)
+	}
+
+	output, err := s3.New(sess, s3Config).GetObject(&s3.GetObjectInput{Bucket: aws.String(parts[0]), Key: aws.String(parts[1])})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	return ioutil.ReadAll(output.Body)
+}
+
+// configSession 读取配置前还没有创建客户端, 使用环境变量中的区域和凭证
+func configSession() (*session.Session, error) {
+	region := os.Getenv("Region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	awsConfig := aws.NewConfig().WithRegion(region)
+	if accessKeyID, secretAccessKey := os.Getenv("AccessKeyID"), os.Getenv("SecretAccessKey"); accessKeyID != "" && secretAccessKey != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""))
+	}
+
+	return session.NewSession(awsConfig)
+}
+
+// parseJSONConfig 解析JSON配置, 数组以逗号连接, 对象转换为name=value的列表
+func parseJSONConfig(content []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+	// Buckets中按bucket名称配置, 展开为bucket.Name形式
+	if buckets, ok := raw["Buckets"].(map[string]interface{}); ok {
+		delete(raw, "Buckets")
+		for bucket, settings := range buckets {
+			settings, ok := settings.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("config Buckets.%s must be an object", bucket)
+			}
+			for name, value := range settings {
+				text, err := configText(value)
+				if err != nil {
+					return nil, fmt.Errorf("config Buckets.%s.%s is invalid: %v", bucket, name, err)
+				}
+				values[bucket+"."+name] = text
+			}
+		}
+	}
+
+	for name, value := range raw {
+		text, err := configText(value)
+		if err != nil {
+			return nil, fmt.Errorf("config %s is invalid: %v", name, err)
+		}
+		values[name] = text
+	}
+
+	return values, nil
+}
+
+// configText 将配置文件中的值转换为环境变量的写法
+func configText(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case json.Number:
+		return value.String(), nil
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			text, err := configText(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		items := make([]string, 0, len(value))
+		for _, name := range names {
+			text, err := configText(value[name])
+			if err != nil {
+				return "", err
+			}
+			items = append(items, name+"="+text)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// parseYAMLConfig 解析YAML配置, 只支持一层的映射, 值可以是标量, 列表或者一层的映射
+// Buckets中按bucket名称配置, 与JSON一样展开为bucket.Name形式, 更深的缩进返回错误
+//
+//	Sizes:
+//	  - thumb=150x150
+//	  - card=400x300:fill
+//	Quality: 85
+//	ThumbnailTags:
+//	  team: web
+//	photos.Sizes: [400x400, 1200x1200]
+//	Buckets:
+//	  avatars:
+//	    Sizes: [64x64:fill]
+//	    ThumbnailTags:
+//	      team: profile
+func parseYAMLConfig(content []byte) (map[string]string, error) {
+	var lines []yamlLine
+	for index, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{number: index + 1, indent: len(line) - len(strings.TrimLeft(line, " \t")), text: trimmed})
+	}
+
+	values := make(map[string]string)
+	if len(lines) > 0 && lines[0].indent > 0 {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[0].number)
+	}
+	if err := parseYAMLMapping(lines, "", true, values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// yamlLine 去掉注释后的非空行
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// parseYAMLMapping 解析同一缩进的name: value, 配置名加上prefix, 只有最外层的映射可以包含Buckets
+func parseYAMLMapping(lines []yamlLine, prefix string, topLevel bool, values map[string]string) error {
+	for index := 0; index < len(lines); {
+		line := lines[index]
+		if line.indent != lines[0].indent {
+			return fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+
+		// 缩进更深的后续行是这个配置的值
+		end := index + 1
+		for end < len(lines) && lines[end].indent > line.indent {
+			end++
+		}
+		children := lines[index+1 : end]
+		index = end
+
+		name, value, ok := splitYAMLPair(line.text)
+		if !ok {
+			return fmt.Errorf("line %d: %s is invalid", line.number, line.text)
+		}
+		if value != "" && len(children) > 0 {
+			return fmt.Errorf("line %d: unexpected indentation", children[0].number)
+		}
+
+		switch {
+		case topLevel && name == "Buckets" && len(children) > 0:
+			if err := parseYAMLBuckets(children, values); err != nil {
+				return err
+			}
+		case len(children) > 0:
+			text, err := parseYAMLBlock(children)
+			if err != nil {
+				return err
+			}
+			values[prefix+name] = text
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			var list []string
+			for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ",") {
+				if item = yamlScalar(strings.TrimSpace(item)); item != "" {
+					list = append(list, item)
+				}
+			}
+			values[prefix+name] = strings.Join(list, ",")
+		default:
+			values[prefix+name] = value
+		}
+	}
+
+	return nil
+}
+
+// parseYAMLBuckets 解析Buckets中每个bucket的映射
+func parseYAMLBuckets(lines []yamlLine, values map[string]string) error {
+	for index := 0; index < len(lines); {
+		line := lines[index]
+		if line.indent != lines[0].indent {
+			return fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+
+		end := index + 1
+		for end < len(lines) && lines[end].indent > line.indent {
+			end++
+		}
+		settings := lines[index+1 : end]
+		index = end
+
+		bucket, value, ok := splitYAMLPair(line.text)
+		if !ok {
+			return fmt.Errorf("line %d: %s is invalid", line.number, line.text)
+		}
+		if value != "" {
+			return fmt.Errorf("line %d: Buckets.%s must be a mapping", line.number, bucket)
+		}
+		if err := parseYAMLMapping(settings, bucket+".", false, values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseYAMLBlock 解析缩进的列表或者映射, 列表项在前, 映射转换为name=value, 不支持更深的缩进
+func parseYAMLBlock(lines []yamlLine) (string, error) {
+	var items []string
+	var pairs []string
+	for _, line := range lines {
+		if line.indent != lines[0].indent {
+			return "", fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+
+		if strings.HasPrefix(line.text, "- ") || line.text == "-" {
+			items = append(items, yamlScalar(strings.TrimSpace(strings.TrimPrefix(line.text, "-"))))
+			continue
+		}
+		name, value, ok := splitYAMLPair(line.text)
+		if !ok {
+			return "", fmt.Errorf("line %d: %s is invalid", line.number, line.text)
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+
+	return strings.Join(append(items, pairs...), ","), nil
+}
+
+// splitYAMLPair 拆分name: value
+func splitYAMLPair(line string) (string, string, bool) {
+	index := strings.Index(line, ":")
+	if index <= 0 {
+		return "", "", false
+	}
+
+	name := yamlScalar(strings.TrimSpace(line[:index]))
+	value := strings.TrimSpace(line[index+1:])
+	if strings.HasPrefix(value, "[") {
+		return name, value, true
+	}
+
+	return name, yamlScalar(value), true
+}
+
+// yamlScalar 去掉标量两端的引号
+func yamlScalar(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
+
+// stripYAMLComment 去掉引号外以#开始的注释
+func stripYAMLComment(line string) string {
+	var quote byte
+	for index := 0; index < len(line); index++ {
+		switch c := line[index]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (index == 0 || line[index-1] == ' ' || line[index-1] == '\t'):
+			return line[:index]
+		}
+	}
+
+	return line
+}
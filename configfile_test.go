@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAMLConfig(t *testing.T) {
+	content := `---
+# 全局配置
+Sizes:
+  - thumb=150x150
+  - "card=400x300:fill"
+Quality: 85 # 注释
+Watermark: 'logo #1.png'
+ThumbnailTags:
+  team: web
+  env: prod
+photos.Sizes: [400x400, 1200x1200]
+Empty:
+Buckets:
+  avatars:
+    Sizes: [64x64:fill]
+    ThumbnailTags:
+      team: profile
+    Quality: 70
+  media.example.com:
+    Sizes:
+      - 800x600
+`
+	values, err := parseYAMLConfig([]byte(content))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"Sizes":                   "thumb=150x150,card=400x300:fill",
+		"Quality":                 "85",
+		"Watermark":               "logo #1.png",
+		"ThumbnailTags":           "team=web,env=prod",
+		"photos.Sizes":            "400x400,1200x1200",
+		"Empty":                   "",
+		"avatars.Sizes":           "64x64:fill",
+		"avatars.ThumbnailTags":   "team=profile",
+		"avatars.Quality":         "70",
+		"media.example.com.Sizes": "800x600",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("parsed %v, want %v", values, expected)
+	}
+}
+
+func TestParseYAMLBucketsMatchesJSON(t *testing.T) {
+	yaml := `Sizes: [100x100]
+Buckets:
+  photos:
+    Sizes: [400x400, 1200x1200]
+    Quality: 90
+    ThumbnailTags:
+      team: web
+`
+	json := `{
+  "Sizes": ["100x100"],
+  "Buckets": {
+    "photos": {
+      "Sizes": ["400x400", "1200x1200"],
+      "Quality": 90,
+      "ThumbnailTags": {"team": "web"}
+    }
+  }
+}`
+
+	yamlValues, err := parseYAMLConfig([]byte(yaml))
+	if err != nil {
+		t.Fatalf("parse yaml failed: %v", err)
+	}
+	jsonValues, err := parseJSONConfig([]byte(json))
+	if err != nil {
+		t.Fatalf("parse json failed: %v", err)
+	}
+	if !reflect.DeepEqual(yamlValues, jsonValues) {
+		t.Errorf("yaml parsed %v, json parsed %v", yamlValues, jsonValues)
+	}
+
+	saved := fileConfig
+	defer func() { fileConfig = saved }()
+	fileConfig = yamlValues
+	if buckets := configBuckets(); !reflect.DeepEqual(buckets, []string{"photos"}) {
+		t.Errorf("configured buckets are %v, want [photos]", buckets)
+	}
+}
+
+func TestParseYAMLConfigErrors(t *testing.T) {
+	cases := []struct {
+		name, content, message string
+	}{
+		{"indented first line", "  Sizes: 100x100\n", "line 1: unexpected indentation"},
+		{"indented after scalar", "Quality: 85\n  team: web\n", "line 2: unexpected indentation"},
+		{"nested mapping", "ThumbnailTags:\n  team:\n    name: web\n", "line 3: unexpected indentation"},
+		{"uneven block", "Sizes:\n    - 100x100\n  - 200x200\n", "line 3: unexpected indentation"},
+		{"bucket scalar", "Buckets:\n  photos: 100x100\n", "line 2: Buckets.photos must be a mapping"},
+		{"nested bucket setting", "Buckets:\n  photos:\n    ThumbnailTags:\n      team:\n        name: web\n", "line 5: unexpected indentation"},
+		{"uneven bucket", "Buckets:\n    photos:\n      Quality: 90\n  avatars:\n", "line 4: unexpected indentation"},
+		{"missing colon", "Sizes\n", "line 1: Sizes is invalid"},
+		{"invalid block line", "ThumbnailTags:\n  team\n", "line 2: team is invalid"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseYAMLConfig([]byte(c.content))
+			if err == nil || !strings.Contains(err.Error(), c.message) {
+				t.Errorf("parse returned %v, want %s", err, c.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/nzai/resize/jpegscale"
+)
+
+const (
+	// errorCodeCorrupt 原图为空或者不完整, 报告中的code, 可以按日志告警
+	errorCodeCorrupt = "corrupt"
+)
+
+// CorruptImageError 原图为空或者内容不完整, 重试也不会成功
+type CorruptImageError struct {
+	Key    string
+	Reason string
+}
+
+// Error 实现error
+func (e *CorruptImageError) Error() string {
+	return fmt.Sprintf("corrupt image: %s %s", e.Key, e.Reason)
+}
+
+// isCorrupt 是否是原图损坏的错误
+func isCorrupt(err error) bool {
+	_, ok := err.(*CorruptImageError)
+	return ok
+}
+
+// errorCode 报告中错误的分类, 未分类的错误为空
+func errorCode(err error) string {
+	if isCorrupt(err) {
+		return errorCodeCorrupt
+	}
+
+	return ""
+}
+
+// truncatedErrors 内容提前结束时解码返回的错误, 解码器把熵编码数据中的EOF转换为short Huffman data
+var truncatedErrors = []error{
+	io.EOF,
+	io.ErrUnexpectedEOF,
+	jpeg.FormatError("short Huffman data"),
+	jpegscale.FormatError("short Huffman data"),
+}
+
+// truncatedError 解码时遇到意外的结尾, 而对象已经完整下载时, 原图本身不完整
+// 下载中断导致的错误仍然返回原来的错误, 可以重试
+func truncatedError(key string, body *checksumReader, object *Object, err error) error {
+	truncated := false
+	for _, truncatedErr := range truncatedErrors {
+		if err == truncatedErr {
+			truncated = true
+		}
+	}
+	if !truncated {
+		return err
+	}
+
+	if _, readErr := io.Copy(ioutil.Discard, body); readErr != nil {
+		return err
+	}
+	if object.Size >= 0 && body.length != object.Size {
+		return err
+	}
+
+	return &CorruptImageError{Key: key, Reason: fmt.Sprintf("is truncated at %d bytes", body.length)}
+}
+
+// markCorrupt 在原图上添加CorruptTags, 可以按标签查找和清理损坏的原图, 不支持标签的存储忽略
+func (s Imaging) markCorrupt(ctx context.Context, record events.S3EventRecord, err error) {
+	logger.WarnContext(ctx, "Corrupt image", "code", errorCodeCorrupt, "error", err)
+	if len(s.config.CorruptTags) == 0 {
+		return
+	}
+
+	if s.config.DryRun {
+		logger.InfoContext(ctx, "Dry run tag corrupt image", "tags", s.config.CorruptTags)
+		return
+	}
+
+	writer, ok := s.store.(TagWriter)
+	if !ok {
+		return
+	}
+
+	// 写入标签会替换所有标签
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	tags := make(map[string]string)
+	if reader, ok := s.store.(TagReader); ok {
+		sourceTags, err := reader.Tags(ctx, bucket, key)
+		if err != nil {
+			logger.WarnContext(ctx, "Read tags failed", "error", err)
+			return
+		}
+		for name, value := range sourceTags {
+			tags[name] = value
+		}
+	}
+	for name, value := range s.config.CorruptTags {
+		tags[name] = value
+	}
+
+	if err := writer.PutTags(ctx, bucket, key, tags); err != nil {
+		logger.WarnContext(ctx, "Tag corrupt image failed", "error", err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Tag corrupt image success", "tags", s.config.CorruptTags)
+}
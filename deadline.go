@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// defaultDeadlineMargin 调用超时前预留的时间, 用于上传已经开始的缩略图和输出结果
+const defaultDeadlineMargin = 2 * time.Second
+
+// deadlineNear 调用剩余的时间是否已经不足DeadlineMargin, 没有超时时间时总是返回false
+func (s Imaging) deadlineNear(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok || s.config.DeadlineMargin <= 0 {
+		return 0, false
+	}
+
+	remaining := time.Until(deadline)
+	return remaining, remaining < s.config.DeadlineMargin
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+// dedupEntry 去重索引中的一项, 记录第一次处理该内容的原图和生成的缩略图
+type dedupEntry struct {
+	Bucket     string                    `json:"bucket"`
+	Key        string                    `json:"key"`
+	Thumbnails map[string]dedupThumbnail `json:"thumbnails"`
+}
+
+// dedupThumbnail 已生成的缩略图, Spec为生成时的完整尺寸参数和影响内容的配置, 参数改变后不再复制
+type dedupThumbnail struct {
+	Spec   string `json:"spec"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// hashingBody 读取时计算哈希的对象内容
+type hashingBody struct {
+	io.Reader
+	io.Closer
+}
+
+// dedupLocation 内容哈希对应的索引保存的bucket和key, 与缩略图保存在同一个bucket
+func (s Imaging) dedupLocation(bucket, hash string) (string, string) {
+	return s.destinationBucket(bucket), s.config.DedupPrefix + hash + ".json"
+}
+
+// dedupRender 尺寸之外影响缩略图内容的配置, 租户和bucket的配置不同时不会复制彼此的缩略图
+type dedupRender struct {
+	Filter             resize.InterpolationFunction
+	Watermark          string
+	WatermarkPosition  string
+	WatermarkOpacity   float64
+	WatermarkMargin    int
+	Sharpen            pipeline.Sharpen
+	Pipeline           []string
+	PreserveExif       bool
+	StripSensitiveExif bool
+	Backend            string
+	OptimizeJPEG       bool
+	JPEGOptimizer      string
+}
+
+// dedupSpec 影响缩略图内容的全部尺寸参数和配置的摘要
+func (s Imaging) dedupSpec(size Size) string {
+	render := dedupRender{
+		Filter:             s.config.Filter,
+		Watermark:          s.config.Watermark,
+		WatermarkPosition:  s.config.WatermarkPosition,
+		WatermarkOpacity:   s.config.WatermarkOpacity,
+		WatermarkMargin:    s.config.WatermarkMargin,
+		Sharpen:            s.config.Sharpen,
+		Pipeline:           s.config.Pipeline,
+		PreserveExif:       s.config.PreserveExif,
+		StripSensitiveExif: s.config.StripSensitiveExif,
+		Backend:            s.config.Backend,
+		OptimizeJPEG:       s.config.OptimizeJPEG,
+		JPEGOptimizer:      s.config.JPEGOptimizer,
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v %#v", size, render)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// readDedupEntry 读取相同内容的原图的索引, 没有或者读取失败时返回nil, 按正常流程生成
+func (s Imaging) readDedupEntry(ctx context.Context, original *Original) *dedupEntry {
+	if s.config.DedupPrefix == "" || original.ContentHash == "" {
+		return nil
+	}
+
+	bucket, key := s.dedupLocation(original.Bucket, original.ContentHash)
+	object, err := s.destination.Get(ctx, bucket, key)
+	if err != nil {
+		if !isNotFound(err) {
+			logger.WarnContext(ctx, "Read dedup index failed", "dedupIndex", key, "error", err)
+		}
+		return nil
+	}
+	defer object.Body.Close()
+
+	entry := new(dedupEntry)
+	if err = json.NewDecoder(object.Body).Decode(entry); err != nil {
+		logger.WarnContext(ctx, "Decode dedup index failed", "dedupIndex", key, "error", err)
+		return nil
+	}
+	if entry.Thumbnails == nil {
+		entry.Thumbnails = make(map[string]dedupThumbnail)
+	}
+
+	return entry
+}
+
+// copyDuplicates 复制相同内容的原图已经生成的缩略图, 返回仍然需要生成的尺寸
+// 缩略图按当前原图的元数据和标签重新写入, 复制失败的尺寸照常生成
+func (s Imaging) copyDuplicates(ctx context.Context, original *Original, entry *dedupEntry, sizes []Size, result *RecordResult) []Size {
+	if entry == nil {
+		return sizes
+	}
+
+	var remaining []Size
+	for _, size := range sizes {
+		thumbnail, found := entry.Thumbnails[sizeName(size)]
+		if !found || thumbnail.Spec != s.dedupSpec(size) {
+			remaining = append(remaining, size)
+			continue
+		}
+
+		start := time.Now()
+		bucket, key := s.thumbnailLocation(original.Bucket, original.Key, original.Version, size)
+		sizeResult := SizeResult{Size: sizeName(size), Bucket: bucket, Key: key}
+		err := s.copyThumbnail(ctx, original, thumbnail, size, &sizeResult)
+		if err != nil {
+			logger.WarnContext(ctx, "Copy duplicate thumbnail failed", "size", sizeName(size), "thumbnail", thumbnail.Key, "error", err)
+			remaining = append(remaining, size)
+			continue
+		}
+
+		logger.InfoContext(ctx, "Copy duplicate thumbnail success", "size", sizeName(size), "thumbnail", key, "duplicateOf", entry.Key)
+		sizeResult.finish(start, nil)
+		result.Sizes = append(result.Sizes, sizeResult)
+	}
+
+	return remaining
+}
+
+// copyThumbnail 读取已有的缩略图并写入当前原图的缩略图位置
+func (s Imaging) copyThumbnail(ctx context.Context, original *Original, thumbnail dedupThumbnail, size Size, result *SizeResult) error {
+	var object *Object
+	err := s.retryStorage(ctx, "get", false, func() error {
+		var err error
+		object, err = s.destination.Get(ctx, thumbnail.Bucket, thumbnail.Key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	content, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return err
+	}
+
+	// 同一个原图重复上传时缩略图已经在原位置
+	if thumbnail.Bucket == result.Bucket && thumbnail.Key == result.Key {
+		result.Bytes = int64(len(content))
+		return nil
+	}
+
+	return s.putThumbnail(ctx, original, content, size, result)
+}
+
+// writeDedupEntry 所有尺寸成功后记录内容哈希对应的缩略图, 已有的索引不覆盖, 保留第一次生成的缩略图
+func (s Imaging) writeDedupEntry(ctx context.Context, original *Original, entry *dedupEntry, sizes []Size, result *RecordResult) error {
+	if s.config.DedupPrefix == "" || original.ContentHash == "" || s.config.DryRun {
+		return nil
+	}
+
+	if entry == nil {
+		entry = &dedupEntry{Bucket: original.Bucket, Key: original.Key, Thumbnails: make(map[string]dedupThumbnail)}
+	}
+
+	// 只补充索引中没有或者参数已经改变的尺寸
+	var changed bool
+	for _, size := range sizes {
+		name := sizeName(size)
+		if thumbnail, found := entry.Thumbnails[name]; found && thumbnail.Spec == s.dedupSpec(size) {
+			continue
+		}
+
+		for _, sizeResult := range result.Sizes {
+			if sizeResult.Size == name && sizeResult.Status == StatusSucceeded {
+				entry.Thumbnails[name] = dedupThumbnail{Spec: s.dedupSpec(size), Bucket: sizeResult.Bucket, Key: sizeResult.Key}
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	bucket, key := s.dedupLocation(original.Bucket, original.ContentHash)
+	options := PutOptions{ContentType: "application/json", Metadata: map[string]string{"kind": "dedup-index"}}
+	err = s.retryStorage(ctx, "put", false, func() error {
+		return s.destination.Put(ctx, bucket, key, bytes.NewReader(content), options)
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Put dedup index failed", "dedupIndex", key, "error", err)
+		return err
+	}
+
+	logger.DebugContext(ctx, "Put dedup index success", "dedupIndex", key, "hash", original.ContentHash)
+	return nil
+}
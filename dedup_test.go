@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+func TestDedupSpecIncludesRenderConfig(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "50x50"})
+	size := s.config.Sizes[0]
+	spec := s.dedupSpec(size)
+
+	changes := map[string]func(config *Config){
+		"watermark":     func(config *Config) { config.Watermark = "s3://assets/logo.png" },
+		"opacity":       func(config *Config) { config.WatermarkOpacity = 0.3 },
+		"sharpen":       func(config *Config) { config.Sharpen = pipeline.Sharpen{Amount: 1, Radius: 1} },
+		"pipeline":      func(config *Config) { config.Pipeline = []string{"resize", "watermark"} },
+		"preserve exif": func(config *Config) { config.PreserveExif = true },
+	}
+	for name, change := range changes {
+		config := *s.config
+		change(&config)
+		changed := Imaging{config: &config}
+		if changed.dedupSpec(size) == spec {
+			t.Errorf("spec does not change with %s", name)
+		}
+	}
+
+	same := Imaging{config: s.config}
+	if same.dedupSpec(size) != spec {
+		t.Errorf("spec changes without config changes")
+	}
+}
+
+func TestDedupRegeneratesAfterRenderChange(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "50x50", "DedupPrefix": ".dedup/"})
+	original := testJPEG(t, 120, 90)
+	process := func(s *Imaging, key string) []byte {
+		writeTestFile(t, bucket, key+".jpg", original)
+		if result := s.processRecord(context.Background(), createdRecord(t, s, bucket, key+".jpg")); result.Status != StatusSucceeded {
+			t.Fatalf("%s status is %s: %s", key, result.Status, result.Error)
+		}
+		return readTestFile(t, bucket, key+"_50x50.jpg")
+	}
+
+	// 标记第一次生成的缩略图, 复制的缩略图带有标记
+	marked := append(process(s, "a"), "marked"...)
+	writeTestFile(t, bucket, "a_50x50.jpg", marked)
+	if copied := process(s, "b"); !bytes.Equal(copied, marked) {
+		t.Errorf("duplicate was not copied with the same config")
+	}
+
+	sharpened := newTestImaging(t, map[string]string{"Sizes": "50x50", "DedupPrefix": ".dedup/", "SharpenAmount": "1"})
+	if regenerated := process(sharpened, "c"); bytes.Equal(regenerated, marked) {
+		t.Errorf("duplicate was copied after Sharpen changed")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// DerivativeInventoryMetadata 原地复制原图, 在用户元数据中记录缩略图, 一次HeadObject即可得知
+	DerivativeInventoryMetadata = "metadata"
+	// DerivativeInventoryTags 在原图的标签中记录缩略图, 不产生新的对象版本, 标签值最多256个字符
+	DerivativeInventoryTags = "tags"
+
+	// derivativeKeysLimit 元数据中缩略图key列表的最大长度, S3的用户元数据总共不能超过2KB
+	derivativeKeysLimit = 1536
+	// derivativeTagLimit S3标签值的最大长度
+	derivativeTagLimit = 256
+)
+
+// tagValuePattern S3标签值允许的字符
+var tagValuePattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// derivativeKeys 已经生成或者已经存在的缩略图key
+func derivativeKeys(result *RecordResult) []string {
+	var keys []string
+	for _, sizeResult := range result.Sizes {
+		if sizeResult.Status == StatusSucceeded || sizeResult.Status == StatusSkipped {
+			keys = append(keys, sizeResult.Key)
+		}
+	}
+
+	return keys
+}
+
+// recordDerivatives 所有缩略图都已生成后在原图上记录缩略图和thumbnails=complete标记
+func (s Imaging) recordDerivatives(ctx context.Context, original *Original, result *RecordResult) error {
+	if s.config.DerivativeInventory == "" {
+		return nil
+	}
+
+	keys := derivativeKeys(result)
+	if s.config.DryRun {
+		logger.InfoContext(ctx, "Dry run record derivatives", "mode", s.config.DerivativeInventory, "thumbnails", keys)
+		return nil
+	}
+
+	var err error
+	switch s.config.DerivativeInventory {
+	case DerivativeInventoryMetadata:
+		err = s.writeDerivativeMetadata(ctx, original, keys)
+	case DerivativeInventoryTags:
+		err = s.writeDerivativeTags(ctx, original, keys)
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Record derivatives failed", "mode", s.config.DerivativeInventory, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeDerivativeMetadata 原地复制原图, 保留原有的元数据并添加缩略图列表, key按S3事件的方式URL编码后以逗号分隔
+// 复制会触发ObjectCreated:Copy事件, thumbnails-of与原图key一致时忽略该事件
+func (s Imaging) writeDerivativeMetadata(ctx context.Context, original *Original, keys []string) error {
+	writer, ok := s.store.(MetadataWriter)
+	if !ok {
+		logger.DebugContext(ctx, "Skip derivative metadata, storage does not support replacing metadata")
+		return nil
+	}
+
+	metadata := make(map[string]string, len(original.Metadata)+4)
+	for name, value := range original.Metadata {
+		metadata[strings.ToLower(name)] = value
+	}
+	metadata["thumbnails"] = "complete"
+	metadata["thumbnails-of"] = url.QueryEscape(original.Key)
+	metadata["thumbnail-count"] = strconv.Itoa(len(keys))
+
+	escaped := make([]string, len(keys))
+	for index, key := range keys {
+		escaped[index] = url.QueryEscape(key)
+	}
+	if list := strings.Join(escaped, ","); len(list) <= derivativeKeysLimit {
+		metadata["thumbnail-keys"] = list
+	} else {
+		logger.WarnContext(ctx, "Omit derivative keys exceeding metadata limit", "bytes", len(list), "limit", derivativeKeysLimit)
+		delete(metadata, "thumbnail-keys")
+	}
+
+	etag := "\"" + original.Version.ETag + "\""
+	err := s.retryStorage(ctx, "copy", false, func() error {
+		return writer.ReplaceMetadata(ctx, original.Bucket, original.Key, etag, metadata)
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.InfoContext(ctx, "Record derivatives in metadata success", "thumbnails", len(keys))
+	return nil
+}
+
+// writeDerivativeTags 在原图的标签中添加缩略图列表, key以空格分隔, 超过长度或者包含标签不允许的字符时只记录数量
+func (s Imaging) writeDerivativeTags(ctx context.Context, original *Original, keys []string) error {
+	writer, ok := s.store.(TagWriter)
+	if !ok {
+		logger.DebugContext(ctx, "Skip derivative tags, storage does not support tags")
+		return nil
+	}
+
+	// 写入标签会替换所有标签
+	tags := make(map[string]string)
+	if reader, ok := s.store.(TagReader); ok {
+		var sourceTags map[string]string
+		err := s.retryStorage(ctx, "get", false, func() error {
+			var err error
+			sourceTags, err = reader.Tags(ctx, original.Bucket, original.Key)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for name, value := range sourceTags {
+			tags[name] = value
+		}
+	}
+
+	tags["thumbnails"] = "complete"
+	tags["thumbnail-count"] = strconv.Itoa(len(keys))
+	delete(tags, "thumbnail-keys")
+	if list := strings.Join(keys, " "); len(list) <= derivativeTagLimit && tagValuePattern.MatchString(list) {
+		tags["thumbnail-keys"] = list
+	} else {
+		logger.WarnContext(ctx, "Omit derivative keys not fit for tag", "bytes", len(list), "limit", derivativeTagLimit)
+	}
+
+	err := s.retryStorage(ctx, "put", false, func() error {
+		return writer.PutTags(ctx, original.Bucket, original.Key, tags)
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.InfoContext(ctx, "Record derivatives in tags success", "thumbnails", len(keys))
+	return nil
+}
+
+// derivativeMetadataCopy 是否是记录缩略图的原地复制触发的事件, 复制到其他key的原图仍然需要处理
+func (s Imaging) derivativeMetadataCopy(ctx context.Context, record events.S3EventRecord) (bool, error) {
+	if s.config.DerivativeInventory != DerivativeInventoryMetadata || record.EventName != eventNameCopy {
+		return false, nil
+	}
+
+	var info *ObjectInfo
+	err := s.retryStorage(ctx, "head", false, func() error {
+		var err error
+		info, err = s.store.Head(ctx, record.S3.Bucket.Name, record.S3.Object.Key)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return metadataValue(info.Metadata, "thumbnails") == "complete" && metadataValue(info.Metadata, "thumbnails-of") == url.QueryEscape(record.S3.Object.Key), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// isDerived 是否是其他程序写入的衍生文件, 先按key的后缀判断, 再读取标签
+// 已删除的对象和不保存标签的本地存储只按后缀判断, 元数据在读取原图之后由isDerivedOriginal判断
+func (s Imaging) isDerived(ctx context.Context, record events.S3EventRecord) (bool, error) {
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	if s.isDerivedKey(key) {
+		return true, nil
+	}
+	if len(s.config.DerivedTags) == 0 {
+		return false, nil
+	}
+	if strings.HasPrefix(record.EventName, "ObjectRemoved:") || s.config.Storage == StorageLocal {
+		return false, nil
+	}
+
+	reader, ok := s.store.(TagReader)
+	if !ok {
+		return false, nil
+	}
+
+	var tags map[string]string
+	err := s.retryStorage(ctx, "tags", true, func() error {
+		var err error
+		tags, err = reader.Tags(ctx, bucket, key)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return hasAnyName(tags, s.config.DerivedTags), nil
+}
+
+// isDerivedOriginal 读取的原图是否有DerivedMetadata中的元数据, 使用读取原图时获取的元数据, 不再单独Head
+func (s Imaging) isDerivedOriginal(original *Original) bool {
+	return hasAnyName(original.Metadata, s.config.DerivedMetadata)
+}
+
+// isDerivedKey 按DerivedSuffixes判断是否是衍生文件, 后缀与去掉扩展名的key或者完整的key比较, 忽略大小写
+func (s Imaging) isDerivedKey(key string) bool {
+	key = strings.ToLower(key)
+	name := strings.TrimSuffix(key, path.Ext(key))
+	for _, suffix := range s.config.DerivedSuffixes {
+		suffix = strings.ToLower(suffix)
+		if strings.HasSuffix(name, suffix) || strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasAnyName 元数据或者标签中是否有其中任意一个名称, 名称忽略大小写, 值为空时也算作有
+func hasAnyName(values map[string]string, names []string) bool {
+	for name := range values {
+		for _, marker := range names {
+			if strings.EqualFold(name, marker) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// derivedStore 按key返回元数据并记录Head次数的本地存储
+type derivedStore struct {
+	*LocalStore
+	metadata map[string]map[string]string
+	mutex    sync.Mutex
+	heads    int
+}
+
+// Get 读取文件, 附加key对应的元数据
+func (s *derivedStore) Get(ctx context.Context, bucket, key string) (*Object, error) {
+	object, err := s.LocalStore.Get(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if metadata, found := s.metadata[key]; found {
+		object.Metadata = metadata
+	}
+
+	return object, nil
+}
+
+// Head 读取文件信息, 记录调用次数
+func (s *derivedStore) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	s.mutex.Lock()
+	s.heads++
+	s.mutex.Unlock()
+
+	return s.LocalStore.Head(ctx, bucket, key)
+}
+
+func TestIgnoreDerivedAssets(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{
+		"Sizes":           "50x50",
+		"DerivedSuffixes": "_preview",
+		"DerivedMetadata": "generated-by",
+	})
+	store := &derivedStore{LocalStore: NewLocalStore(), metadata: map[string]map[string]string{
+		"marked.jpg": {"Generated-By": ""},
+		"plain.jpg":  {"owner": "alice"},
+	}}
+	s.store = store
+
+	cases := []struct {
+		key    string
+		status string
+	}{
+		{"a_preview.jpg", StatusIgnored},
+		{"marked.jpg", StatusIgnored},
+		{"plain.jpg", StatusSucceeded},
+	}
+	for _, c := range cases {
+		writeTestFile(t, bucket, c.key, testJPEG(t, 120, 90))
+		result := s.processRecord(context.Background(), createdRecord(t, s, bucket, c.key))
+		if result.Status != c.status {
+			t.Errorf("%s status is %s, want %s: %s", c.key, result.Status, c.status, result.Error)
+		}
+		if c.status == StatusIgnored && len(result.Sizes) != 0 {
+			t.Errorf("%s generated sizes %+v", c.key, result.Sizes)
+		}
+	}
+}
+
+func TestDerivedMetadataWithoutHead(t *testing.T) {
+	bucket := t.TempDir()
+	writeTestFile(t, bucket, "plain.jpg", testJPEG(t, 120, 90))
+
+	// 按S3存储判断, 本地存储时不会读取元数据和标签
+	heads := func(derivedMetadata []string) int {
+		s := newTestImaging(t, map[string]string{"Sizes": "50x50"})
+		s.config.Storage = StorageS3
+		s.config.DerivedMetadata = derivedMetadata
+		store := &derivedStore{LocalStore: NewLocalStore()}
+		s.store = store
+
+		result := s.processRecord(context.Background(), createdRecord(t, s, bucket, "plain.jpg"))
+		if result.Status != StatusSucceeded {
+			t.Fatalf("status is %s: %s", result.Status, result.Error)
+		}
+
+		return store.heads
+	}
+
+	// 元数据使用读取原图时获取的对象信息, 不再单独Head
+	if without, with := heads(nil), heads([]string{"generated-by"}); with != without {
+		t.Errorf("DerivedMetadata made %d head calls, %d without it", with, without)
+	}
+}
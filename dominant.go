@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/nfnt/resize"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+const (
+	// dominantSampleSize 计算主色调前将图像缩小到的最大边长
+	dominantSampleSize = 64
+)
+
+// dominantColor 计算图像的主色调, 以#rrggbb格式返回
+func dominantColor(src image.Image) string {
+	sample := pipeline.ToRGBA(resize.Thumbnail(dominantSampleSize, dominantSampleSize, src, resize.Bilinear))
+
+	// 每个通道量化为16级后统计出现最多的颜色, 再取该颜色区间内像素的平均值
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+
+	var best *bucket
+	for offset := 0; offset+3 < len(sample.Pix); offset += 4 {
+		// 忽略透明像素
+		if sample.Pix[offset+3] < 0x80 {
+			continue
+		}
+
+		r, g, b := int(sample.Pix[offset+0]), int(sample.Pix[offset+1]), int(sample.Pix[offset+2])
+		index := (r>>4)<<8 | (g>>4)<<4 | b>>4
+
+		current, found := buckets[index]
+		if !found {
+			current = new(bucket)
+			buckets[index] = current
+		}
+
+		current.count++
+		current.r += r
+		current.g += g
+		current.b += b
+
+		if best == nil || current.count > best.count {
+			best = current
+		}
+	}
+
+	if best == nil {
+		return "#000000"
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
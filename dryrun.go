@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// dryRunStore 试运行时写入缩略图使用的存储, 读取照常进行, 写入和删除只输出日志
+type dryRunStore struct {
+	ObjectStore
+}
+
+// newDestinationStore 写入缩略图使用的存储, 开启DryRun时不会真正写入
+func newDestinationStore(config *Config, store ObjectStore) ObjectStore {
+	if config.DryRun {
+		return dryRunStore{ObjectStore: store}
+	}
+
+	return store
+}
+
+// Put 读取内容并输出将要写入的对象
+func (s dryRunStore) Put(ctx context.Context, bucket, key string, body io.Reader, options PutOptions) error {
+	size, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return err
+	}
+
+	logger.InfoContext(ctx, "Dry run put",
+		"thumbnailBucket", bucket,
+		"thumbnail", key,
+		"bytes", size,
+		"contentType", options.ContentType,
+		"cacheControl", options.CacheControl,
+		"storageClass", options.StorageClass,
+		"metadata", options.Metadata,
+		"tags", options.Tags,
+	)
+
+	return nil
+}
+
+// Delete 输出将要删除的对象
+func (s dryRunStore) Delete(ctx context.Context, bucket, key string) error {
+	logger.InfoContext(ctx, "Dry run delete", "thumbnailBucket", bucket, "thumbnail", key)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nzai/resize/pkg/naming"
+)
+
+const (
+	// maxEdgeResponseSize origin-response生成的响应体最大1MB
+	maxEdgeResponseSize = 1 << 20
+)
+
+// CloudFrontEvent Lambda@Edge事件
+type CloudFrontEvent struct {
+	Records []struct {
+		CF CloudFrontRecord `json:"cf"`
+	} `json:"Records"`
+}
+
+// CloudFrontRecord Lambda@Edge事件记录
+type CloudFrontRecord struct {
+	Config struct {
+		DistributionDomainName string `json:"distributionDomainName"`
+		EventType              string `json:"eventType"`
+	} `json:"config"`
+	Request struct {
+		URI         string `json:"uri"`
+		Querystring string `json:"querystring"`
+		Origin      struct {
+			S3 struct {
+				DomainName string `json:"domainName"`
+			} `json:"s3"`
+		} `json:"origin"`
+	} `json:"request"`
+	Response CloudFrontResponse `json:"response"`
+}
+
+// CloudFrontResponse 返回给CloudFront的响应
+type CloudFrontResponse struct {
+	Status            string                        `json:"status"`
+	StatusDescription string                        `json:"statusDescription"`
+	Headers           map[string][]CloudFrontHeader `json:"headers"`
+	Body              string                        `json:"body,omitempty"`
+	BodyEncoding      string                        `json:"bodyEncoding,omitempty"`
+}
+
+// CloudFrontHeader 响应头
+type CloudFrontHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// CloudFrontEvent 处理origin-response事件, 缩略图不存在时生成并保存, 之后的请求直接从S3返回
+func (s Imaging) CloudFrontEvent(ctx context.Context, event CloudFrontEvent) (CloudFrontResponse, error) {
+	if len(event.Records) == 0 {
+		return CloudFrontResponse{}, fmt.Errorf("cloudfront event has no records")
+	}
+
+	record := event.Records[0].CF
+	response := record.Response
+
+	// S3在没有ListBucket权限时对不存在的对象返回403
+	if record.Config.EventType != "origin-response" || (response.Status != "403" && response.Status != "404") {
+		return response, nil
+	}
+
+	thumbnailKey, err := url.PathUnescape(strings.TrimPrefix(record.Request.URI, "/"))
+	if err != nil {
+		return response, nil
+	}
+
+	// 缩略图需要保存到CloudFront的源bucket, 原图默认也在这个bucket中
+	sourceBucket := s.config.SourceBucket
+	if sourceBucket == "" {
+		sourceBucket = originBucket(record.Request.Origin.S3.DomainName)
+	}
+	if sourceBucket == "" {
+		logger.WarnContext(ctx, "Unknown origin", "origin", record.Request.Origin.S3.DomainName)
+		return response, nil
+	}
+
+	key, size, found := s.originalOf(ctx, sourceBucket, thumbnailKey)
+	if !found {
+		logger.InfoContext(ctx, "Ignore missing object", "thumbnail", thumbnailKey)
+		return response, nil
+	}
+
+	logger.InfoContext(ctx, "Create missing thumbnail", "thumbnail", thumbnailKey, "key", key)
+	content, err := s.resizeOnDemand(ctx, sourceBucket, key, size, true)
+	if err != nil {
+		logger.ErrorContext(ctx, "Resize on demand failed", "key", key, "size", sizeName(size), "error", err)
+		return response, nil
+	}
+
+	headers := map[string][]CloudFrontHeader{
+		"content-type": {{Key: "Content-Type", Value: formats[size.Format].ContentType}},
+	}
+	if s.config.CacheControl != "" {
+		headers["cache-control"] = []CloudFrontHeader{{Key: "Cache-Control", Value: s.config.CacheControl}}
+	}
+
+	// 响应体超过限制时重定向到同一地址, 缩略图已经保存, 再次请求时由S3返回
+	if base64.StdEncoding.EncodedLen(len(content)) > maxEdgeResponseSize {
+		location := record.Request.URI
+		if record.Request.Querystring != "" {
+			location += "?" + record.Request.Querystring
+		}
+
+		return CloudFrontResponse{
+			Status:            "302",
+			StatusDescription: "Found",
+			Headers: map[string][]CloudFrontHeader{
+				"location":      {{Key: "Location", Value: location}},
+				"cache-control": {{Key: "Cache-Control", Value: "no-cache"}},
+			},
+		}, nil
+	}
+
+	return CloudFrontResponse{
+		Status:            "200",
+		StatusDescription: "OK",
+		Headers:           headers,
+		Body:              base64.StdEncoding.EncodeToString(content),
+		BodyEncoding:      "base64",
+	}, nil
+}
+
+// originalOf 根据缩略图的key查找原图和尺寸, 只支持默认的命名规则和配置的尺寸
+func (s Imaging) originalOf(ctx context.Context, bucket, thumbnailKey string) (string, Size, bool) {
+	if s.config.KeyTemplate != "" || !strings.HasPrefix(thumbnailKey, s.config.DestinationPrefix) {
+		return "", Size{}, false
+	}
+	name := strings.TrimPrefix(thumbnailKey, s.config.DestinationPrefix)
+
+	sizes := append(s.config.allSizes(), s.config.OnDemandSizes...)
+	for _, size := range sizes {
+		size = s.config.sizeDefaults(size)
+
+		index := strings.LastIndex(name, "_"+sizeName(size))
+		if index <= 0 {
+			continue
+		}
+
+		// 原图一般是小写扩展名
+		for _, ext := range []string{".jpg", ".JPG", ".Jpg"} {
+			key := name[:index] + ext
+			if s.thumbnailKey(key, naming.Version{}, size) != name || !s.config.KeyFilter.Match(key) {
+				continue
+			}
+
+			if _, err := s.store.Head(ctx, bucket, key); err == nil {
+				return key, size, true
+			}
+		}
+	}
+
+	return "", Size{}, false
+}
+
+// originBucket 从S3源的域名中读取bucket, 如bucket.s3.amazonaws.com或bucket.s3.us-west-2.amazonaws.com
+func originBucket(domainName string) string {
+	index := strings.Index(domainName, ".s3.")
+	if index <= 0 {
+		index = strings.Index(domainName, ".s3-")
+	}
+	if index <= 0 {
+		return ""
+	}
+
+	return domainName[:index]
+}
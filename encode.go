@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nzai/resize/jpegscale"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+const (
+	// FormatJPEG jpeg格式
+	FormatJPEG = pipeline.FormatJPEG
+	// FormatPNG png格式
+	FormatPNG = pipeline.FormatPNG
+	// FormatWebP 无损的webp格式, 原图是动图时生成动画
+	FormatWebP = pipeline.FormatWebP
+)
+
+// Format 缩略图的输出格式
+type Format struct {
+	Name        string
+	Extension   string
+	ContentType string
+}
+
+var (
+	// formats 支持的输出格式
+	formats = map[string]Format{
+		FormatJPEG: {Name: FormatJPEG, Extension: ".jpg", ContentType: "image/jpeg"},
+		FormatPNG:  {Name: FormatPNG, Extension: ".png", ContentType: "image/png"},
+		FormatWebP: {Name: FormatWebP, Extension: ".webp", ContentType: "image/webp"},
+	}
+)
+
+// parseFormat 解析输出格式, jpg是jpeg的别名
+func parseFormat(value string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(value))
+	if name == "jpg" {
+		name = FormatJPEG
+	}
+
+	if _, found := formats[name]; !found {
+		return "", fmt.Errorf("format %s is not supported", value)
+	}
+
+	return name, nil
+}
+
+// formatExtension 缩略图的扩展名, 与原图格式相同时保留原图的扩展名
+func formatExtension(key, format string) string {
+	ext := path.Ext(key)
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		if format == FormatJPEG {
+			return ext
+		}
+	case ".png":
+		if format == FormatPNG {
+			return ext
+		}
+	}
+
+	return formats[format].Extension
+}
+
+// encodeImage 按尺寸配置的格式编码图像
+func encodeImage(writer io.Writer, img image.Image, size Size) error {
+	return pipeline.Encode(writer, img, pipeline.EncodeOptions{
+		Format:      size.Format,
+		Quality:     size.Quality,
+		Subsampling: size.Subsampling,
+		Background:  size.Background,
+		Colors:      size.Colors,
+		Compression: size.Compression,
+	})
+}
+
+// pngCompressions png的压缩级别
+var pngCompressions = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// parseColors 解析png调色板的颜色数量, 2到256
+func parseColors(value string) (int, error) {
+	colors, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || colors < 2 || colors > 256 {
+		return 0, fmt.Errorf("colors %s is invalid", value)
+	}
+
+	return colors, nil
+}
+
+// parseCompression 解析png的压缩级别, default, none, speed或best
+func parseCompression(value string) (png.CompressionLevel, error) {
+	level, found := pngCompressions[strings.ToLower(strings.TrimSpace(value))]
+	if !found {
+		return png.DefaultCompression, fmt.Errorf("compression %s is invalid", value)
+	}
+
+	return level, nil
+}
+
+// parseSubsampling 解析jpeg的色度抽样, 支持420和444, 也可以写作4:2:0和4:4:4
+func parseSubsampling(value string) (jpegscale.Subsampling, error) {
+	switch strings.ReplaceAll(strings.TrimSpace(value), ":", "") {
+	case "420":
+		return jpegscale.Subsampling420, nil
+	case "444":
+		return jpegscale.Subsampling444, nil
+	default:
+		return 0, fmt.Errorf("subsampling %s is not supported", value)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// eventNameCopy 通过CopyObject创建的对象, 包括原地复制修改元数据或者存储类型
+	eventNameCopy = "ObjectCreated:Copy"
+	// eventNameCompleteMultipartUpload 分段上传完成, 事件中的大小为合并后的大小
+	eventNameCompleteMultipartUpload = "ObjectCreated:CompleteMultipartUpload"
+)
+
+// defaultEventTypes 默认处理的事件类型, 与S3通知配置一样可以使用*匹配一类事件
+var defaultEventTypes = []string{"ObjectCreated:*", "ObjectRemoved:*"}
+
+// parseEventTypes 解析处理的事件类型, 如ObjectCreated:Put,ObjectCreated:CompleteMultipartUpload,ObjectRemoved:*
+func parseEventTypes(value string) ([]string, error) {
+	types := parseList(value)
+	if len(types) == 0 {
+		return defaultEventTypes, nil
+	}
+
+	for _, eventType := range types {
+		index := strings.Index(eventType, ":")
+		if index <= 0 || index == len(eventType)-1 || strings.Contains(eventType[:index], "*") {
+			return nil, fmt.Errorf("event type %s is invalid, use such as ObjectCreated:Put or ObjectCreated:*", eventType)
+		}
+	}
+
+	return types, nil
+}
+
+// notificationSources 存储服务发送的事件通知的来源, 其他来源的记录是明确要求处理的, 不按事件类型过滤
+var notificationSources = map[string]bool{
+	"aws:s3":               true,
+	eventSourceEventBridge: true,
+	"gcs":                  true,
+	"azure":                true,
+}
+
+// matchEventType 事件名是否属于配置的事件类型
+func matchEventType(types []string, eventName string) bool {
+	for _, eventType := range types {
+		if strings.HasSuffix(eventType, ":*") && strings.HasPrefix(eventName, strings.TrimSuffix(eventType, "*")) {
+			return true
+		}
+		if eventType == eventName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventSizeReliable 事件中的大小是否是对象的实际大小, 其他来源的记录没有大小时为0
+func eventSizeReliable(record events.S3EventRecord) bool {
+	return record.EventSource == "aws:s3" || record.EventSource == eventSourceEventBridge
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	exifTagJPEGInterchangeFormat       = 0x0201
+	exifTagJPEGInterchangeFormatLength = 0x0202
+	exifTagMakerNote                   = 0x927c
+	exifTagCameraOwnerName             = 0xa430
+	exifTagBodySerialNumber            = 0xa431
+	exifTagLensSerialNumber            = 0xa435
+	exifTagCameraSerialNumber          = 0xc62f
+
+	// maxEXIFSegment APP1段最多能保存的EXIF长度, 段长度字段为2字节且包含自身和Exif标识
+	maxEXIFSegment = 0xffff - 2 - 6
+)
+
+// exifTypeWidths TIFF各数据类型每个值的字节数
+var exifTypeWidths = map[uint16]uint64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// exifSensitiveTags 可以识别相机和拍摄者的标签, 厂商注释中通常也包含机身序列号
+var exifSensitiveTags = map[uint16]bool{
+	exifTagMakerNote:          true,
+	exifTagCameraOwnerName:    true,
+	exifTagBodySerialNumber:   true,
+	exifTagLensSerialNumber:   true,
+	exifTagCameraSerialNumber: true,
+}
+
+// exifSegment jpeg图像头中TIFF格式的EXIF内容, 没有EXIF时返回nil
+func exifSegment(header []byte) []byte {
+	var content []byte
+	jpegSegments(header, func(marker byte, segment []byte) bool {
+		// 图像数据之前的段才是元数据
+		if jpegFrameMarker(marker) {
+			return false
+		}
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			content = segment[6:]
+			return false
+		}
+		return true
+	})
+
+	return content
+}
+
+// sanitizeEXIF 复制EXIF并删除其中的缩略图, stripSensitive为true时还删除GPS位置和序列号等标签
+// 删除的标签的值会被清零, 不会残留在缩略图中, 无法解析时返回nil, 不保留EXIF
+func sanitizeEXIF(content []byte, stripSensitive bool) []byte {
+	if len(content) < 8 || len(content) > maxEXIFSegment {
+		return nil
+	}
+
+	var order binary.ByteOrder
+	switch string(content[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	content = append([]byte(nil), content...)
+	ifd0 := order.Uint32(content[4:8])
+	entries, next, ok := readIFD(content, order, ifd0)
+	if !ok {
+		return nil
+	}
+
+	// 原图的缩略图是未裁剪的完整画面, 与缩略图的内容不一致
+	if next != 0 {
+		if thumbnail, _, ok := readIFD(content, order, next); ok {
+			offset, length := thumbnail[exifTagJPEGInterchangeFormat], thumbnail[exifTagJPEGInterchangeFormatLength]
+			if len(offset) == 1 && len(length) == 1 && uint64(offset[0])+uint64(length[0]) <= uint64(len(content)) {
+				zeroBytes(content[offset[0] : offset[0]+length[0]])
+			}
+		}
+		if !removeIFDEntries(content, order, next, func(uint16) bool { return true }) {
+			return nil
+		}
+		order.PutUint32(content[ifd0+2+uint32(order.Uint16(content[ifd0:]))*12:], 0)
+	}
+
+	if !stripSensitive {
+		return content
+	}
+
+	if gps := entries[exifTagGPSIFD]; len(gps) == 1 && gps[0] != 0 {
+		if !removeIFDEntries(content, order, gps[0], func(uint16) bool { return true }) {
+			return nil
+		}
+	}
+	if pointer := entries[exifTagExifIFD]; len(pointer) == 1 {
+		if !removeIFDEntries(content, order, pointer[0], func(tag uint16) bool { return exifSensitiveTags[tag] }) {
+			return nil
+		}
+	}
+	if !removeIFDEntries(content, order, ifd0, func(tag uint16) bool { return tag == exifTagGPSIFD || exifSensitiveTags[tag] }) {
+		return nil
+	}
+
+	return content
+}
+
+// removeIFDEntries 删除IFD中满足条件的条目并清零条目的值, 其余条目前移, 下一个IFD的位置随之前移
+func removeIFDEntries(content []byte, order binary.ByteOrder, offset uint32, remove func(tag uint16) bool) bool {
+	if uint64(offset)+2 > uint64(len(content)) {
+		return false
+	}
+	count := uint64(order.Uint16(content[offset:]))
+	start := uint64(offset) + 2
+	if start+count*12+4 > uint64(len(content)) {
+		return false
+	}
+
+	kept := uint64(0)
+	for index := uint64(0); index < count; index++ {
+		entry := content[start+index*12 : start+index*12+12]
+		tag, kind, number := order.Uint16(entry), order.Uint16(entry[2:]), uint64(order.Uint32(entry[4:]))
+		if !remove(tag) {
+			copy(content[start+kept*12:], entry)
+			kept++
+			continue
+		}
+
+		// 不超过4字节的值直接保存在条目中, 否则条目中是值的位置
+		if width, found := exifTypeWidths[kind]; found && number*width > 4 {
+			valueOffset := uint64(order.Uint32(entry[8:]))
+			if valueOffset+number*width <= uint64(len(content)) {
+				zeroBytes(content[valueOffset : valueOffset+number*width])
+			}
+		}
+	}
+
+	next := order.Uint32(content[start+count*12:])
+	zeroBytes(content[start+kept*12 : start+count*12+4])
+	order.PutUint16(content[offset:], uint16(kept))
+	order.PutUint32(content[start+kept*12:], next)
+
+	return true
+}
+
+// zeroBytes 清零
+func zeroBytes(data []byte) {
+	for index := range data {
+		data[index] = 0
+	}
+}
+
+// insertEXIF 在编码后的jpeg的SOI之后插入EXIF段
+func insertEXIF(content, exif []byte) []byte {
+	if len(exif) == 0 || len(content) < 2 || content[0] != 0xff || content[1] != 0xd8 {
+		return content
+	}
+
+	result := make([]byte, 0, len(content)+len(exif)+10)
+	result = append(result, 0xff, 0xd8, 0xff, 0xe1)
+	result = append(result, byte((len(exif)+8)>>8), byte(len(exif)+8))
+	result = append(result, "Exif\x00\x00"...)
+	result = append(result, exif...)
+
+	return append(result, content[2:]...)
+}
+
+// withEXIF 配置了PreserveExif时为jpeg缩略图写入原图的EXIF, 其他格式不写入
+func (s Imaging) withEXIF(original *Original, content []byte, size Size) []byte {
+	if !s.config.PreserveExif || size.Format != FormatJPEG || original.exifData == nil {
+		return content
+	}
+
+	return insertEXIF(content, original.exifData)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+// detectFaces 使用Rekognition检测人脸, 返回包含所有人脸区域中心的焦点
+func (s Imaging) detectFaces(ctx context.Context, bucket, key string) (pipeline.Gravity, error) {
+	start := time.Now()
+	output, err := s.rekognition.DetectFacesWithContext(ctx, &rekognition.DetectFacesInput{
+		Image: &rekognition.Image{
+			S3Object: &rekognition.S3Object{
+				Bucket: aws.String(bucket),
+				Name:   aws.String(key),
+			},
+		},
+	})
+	if err != nil {
+		return pipeline.Gravity{}, err
+	}
+
+	// 计算所有人脸的外接矩形
+	left, top, right, bottom := math.MaxFloat64, math.MaxFloat64, 0.0, 0.0
+	for _, face := range output.FaceDetails {
+		box := face.BoundingBox
+		if box == nil {
+			continue
+		}
+
+		left = math.Min(left, aws.Float64Value(box.Left))
+		top = math.Min(top, aws.Float64Value(box.Top))
+		right = math.Max(right, aws.Float64Value(box.Left)+aws.Float64Value(box.Width))
+		bottom = math.Max(bottom, aws.Float64Value(box.Top)+aws.Float64Value(box.Height))
+	}
+	logger.DebugContext(ctx, "Detect faces", "faces", len(output.FaceDetails), "durationMs", durationMs(start))
+
+	if right <= left || bottom <= top {
+		return pipeline.Gravity{}, nil
+	}
+
+	return pipeline.Gravity{
+		Name: "face",
+		X:    clampFloat((left+right)/2, 0, 1),
+		Y:    clampFloat((top+bottom)/2, 0, 1),
+	}, nil
+}
+
+// needFaces 是否有尺寸需要检测人脸
+func needFaces(sizes []Size) bool {
+	for _, size := range sizes {
+		if size.Mode == ModeFill && size.Gravity.IsFace() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clampFloat 将value限制在min与max之间
+func clampFloat(value, min, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// gcsDefaultEndpoint GCS的XML API地址
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	// gcsTokenURL 元数据服务器提供的服务账号令牌
+	gcsTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// gcsMetadataPrefix 自定义元数据的请求头前缀
+	gcsMetadataPrefix = "X-Goog-Meta-"
+)
+
+// GCSStore 基于Google Cloud Storage XML API的对象存储
+type GCSStore struct {
+	endpoint string
+	client   *http.Client
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewGCSStore 新建GCS存储, 未配置访问令牌时从元数据服务器获取服务账号的令牌
+func NewGCSStore(config *Config) *GCSStore {
+	store := &GCSStore{
+		endpoint: strings.TrimSuffix(config.GCSEndpoint, "/"),
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		token:    config.GCSAccessToken,
+	}
+	if store.endpoint == "" {
+		store.endpoint = gcsDefaultEndpoint
+	}
+	if store.token != "" {
+		// 静态令牌不会过期
+		store.expires = time.Now().AddDate(100, 0, 0)
+	}
+
+	return store
+}
+
+// Get 读取对象
+func (s *GCSStore) Get(ctx context.Context, bucket, key string) (*Object, error) {
+	response, err := s.do(ctx, http.MethodGet, bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{ObjectInfo: *gcsObjectInfo(response), Body: response.Body}, nil
+}
+
+// Head 读取对象的元数据
+func (s *GCSStore) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	response, err := s.do(ctx, http.MethodHead, bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	return gcsObjectInfo(response), nil
+}
+
+// Put 写入对象, GCS没有对象标签, 标签会被忽略
+func (s *GCSStore) Put(ctx context.Context, bucket, key string, body io.Reader, options PutOptions) error {
+	// 缩略图不大, 读入内存后可以计算md5并在失败时重试
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(content)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	if options.ContentType != "" {
+		header.Set("Content-Type", options.ContentType)
+	}
+	if options.CacheControl != "" {
+		header.Set("Cache-Control", options.CacheControl)
+	}
+	if !options.Expires.IsZero() {
+		header.Set("Expires", options.Expires.UTC().Format(http.TimeFormat))
+	}
+	if options.StorageClass != "" {
+		header.Set("X-Goog-Storage-Class", options.StorageClass)
+	}
+	for name, value := range options.Metadata {
+		header.Set(gcsMetadataPrefix+name, value)
+	}
+
+	response, err := s.do(ctx, http.MethodPut, bucket, key, header, content)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Delete 删除对象
+func (s *GCSStore) Delete(ctx context.Context, bucket, key string) error {
+	response, err := s.do(ctx, http.MethodDelete, bucket, key, nil, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// do 发送请求, 失败的响应转换为StatusError
+func (s *GCSStore) do(ctx context.Context, method, bucket, key string, header http.Header, body []byte) (*http.Response, error) {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	location := s.endpoint + (&url.URL{Path: "/" + bucket + "/" + key}).EscapedPath()
+	request, err := http.NewRequest(method, location, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.ContentLength = int64(len(body))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, &StatusError{Service: "gcs", StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	return response, nil
+}
+
+// accessToken 读取访问令牌, 过期前一分钟刷新
+func (s *GCSStore) accessToken(ctx context.Context) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, gcsTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Metadata-Flavor", "Google")
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("read access token from metadata server failed with status %d", response.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	s.token = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return s.token, nil
+}
+
+// gcsObjectInfo 从响应头中读取元数据
+func gcsObjectInfo(response *http.Response) *ObjectInfo {
+	info := &ObjectInfo{
+		ETag:        response.Header.Get("ETag"),
+		Size:        response.ContentLength,
+		ContentType: response.Header.Get("Content-Type"),
+		Metadata:    make(map[string]string),
+	}
+
+	// 压缩传输时Content-Length是压缩后的长度, 使用原始长度
+	if length, err := strconv.ParseInt(response.Header.Get("X-Goog-Stored-Content-Length"), 10, 64); err == nil {
+		info.Size = length
+	}
+
+	// x-goog-hash: crc32c=...,md5=..., 组合对象没有md5
+	for _, values := range response.Header["X-Goog-Hash"] {
+		for _, value := range strings.Split(values, ",") {
+			value = strings.TrimSpace(value)
+			if !strings.HasPrefix(value, "md5=") {
+				continue
+			}
+
+			if sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "md5=")); err == nil {
+				info.MD5 = hex.EncodeToString(sum)
+			}
+		}
+	}
+
+	for name, values := range response.Header {
+		if strings.HasPrefix(name, gcsMetadataPrefix) && len(values) > 0 {
+			info.Metadata[strings.ToLower(strings.TrimPrefix(name, gcsMetadataPrefix))] = values[0]
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// gcsEventNames GCS事件类型对应的S3事件名, 包括CloudEvents(Eventarc)和Pub/Sub通知两种写法
+var gcsEventNames = map[string]string{
+	"google.cloud.storage.object.v1.finalized": "ObjectCreated:Put",
+	"google.cloud.storage.object.v1.deleted":   "ObjectRemoved:Delete",
+	"OBJECT_FINALIZE":                          "ObjectCreated:Put",
+	"OBJECT_DELETE":                            "ObjectRemoved:Delete",
+}
+
+// gcsObject GCS通知中的对象资源
+type gcsObject struct {
+	Bucket  string `json:"bucket"`
+	Name    string `json:"name"`
+	Size    string `json:"size"`
+	MD5Hash string `json:"md5Hash"`
+}
+
+// gcsPushMessage Pub/Sub推送的消息
+type gcsPushMessage struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       string            `json:"data"`
+	} `json:"message"`
+}
+
+// gcsCloudEvent 结构化模式的CloudEvent
+type gcsCloudEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// GCSEvent 处理Eventarc, Cloud Functions或Pub/Sub推送的GCS事件
+func (s Imaging) GCSEvent(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	record, err := parseGCSEvent(r.Header, body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Parse gcs event failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 不关心的事件直接确认, 避免重复推送
+	if record == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// 返回错误时Pub/Sub和Eventarc会重新推送
+	if _, err = s.S3Event(r.Context(), events.S3Event{Records: []events.S3EventRecord{*record}}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseGCSEvent 将GCS事件转换为S3事件记录, 不需要处理的事件返回nil
+func parseGCSEvent(header http.Header, body []byte) (*events.S3EventRecord, error) {
+	var eventType string
+	var object gcsObject
+
+	switch {
+	case header.Get("Ce-Type") != "":
+		// 二进制模式的CloudEvent, 事件类型在请求头中, 请求体是对象资源
+		eventType = header.Get("Ce-Type")
+		if err := json.Unmarshal(body, &object); err != nil {
+			return nil, err
+		}
+
+	case strings.HasPrefix(header.Get("Content-Type"), "application/cloudevents+json"):
+		var event gcsCloudEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, err
+		}
+		eventType = event.Type
+		if err := json.Unmarshal(event.Data, &object); err != nil {
+			return nil, err
+		}
+
+	default:
+		var push gcsPushMessage
+		if err := json.Unmarshal(body, &push); err != nil {
+			return nil, err
+		}
+
+		if push.Message.Attributes != nil {
+			// Pub/Sub通知, 对象资源经过base64编码
+			eventType = push.Message.Attributes["eventType"]
+			data, err := base64.StdEncoding.DecodeString(push.Message.Data)
+			if err != nil {
+				return nil, err
+			}
+			if err = json.Unmarshal(data, &object); err != nil {
+				return nil, err
+			}
+			if object.Bucket == "" {
+				object.Bucket = push.Message.Attributes["bucketId"]
+			}
+			if object.Name == "" {
+				object.Name = push.Message.Attributes["objectId"]
+			}
+		} else {
+			// 自定义的触发器直接推送对象资源, 视为新建对象
+			eventType = "OBJECT_FINALIZE"
+			if err := json.Unmarshal(body, &object); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	eventName, found := gcsEventNames[eventType]
+	if !found {
+		logger.Info("Ignore gcs event", "eventType", eventType)
+		return nil, nil
+	}
+
+	if object.Bucket == "" || object.Name == "" {
+		return nil, fmt.Errorf("gcs event %s has no bucket or object name", eventType)
+	}
+
+	record := &events.S3EventRecord{EventSource: "gcs", EventName: eventName}
+	record.S3.Bucket.Name = object.Bucket
+	// S3事件中的key经过URL编码, 保持一致
+	record.S3.Object.Key = url.QueryEscape(object.Name)
+	record.S3.Object.Size, _ = strconv.ParseInt(object.Size, 10, 64)
+
+	// 非组合对象的XML API ETag是十六进制的md5
+	if sum, err := base64.StdEncoding.DecodeString(object.MD5Hash); err == nil && len(sum) > 0 {
+		record.S3.Object.ETag = hex.EncodeToString(sum)
+	}
+
+	return record, nil
+}
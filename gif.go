@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/gif"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+// isGIF 是否是gif图片
+func isGIF(key string) bool {
+	return strings.ToLower(filepath.Ext(key)) == ".gif"
+}
+
+// decodeGIF 解码gif图片, 第一帧作为原图
+// 有webp尺寸并且是动图时合成所有帧, 用于生成动画webp
+func (s Imaging) decodeGIF(bucket, key string, object *Object, sizes []Size) (*Original, error) {
+	start := time.Now()
+
+	// 读取图像头, 已读取的内容在解码时重新使用
+	body := newChecksumReader(object.Body)
+	header := getBuffer()
+	defer putBuffer(header)
+	imageConfig, err := gif.DecodeConfig(io.TeeReader(body, header))
+	if err != nil {
+		logger.Error("Decode image config failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	if err = s.checkPixels(key, imageConfig.Width, imageConfig.Height); err != nil {
+		logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	animation, err := gif.DecodeAll(io.MultiReader(header, body))
+	if err != nil {
+		logger.Error("Decode image failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 只有需要时才保留所有帧, 以免占用过多内存
+	frames := pipeline.ComposeGIF(animation, len(animation.Image) > 1 && hasFormat(sizes, FormatWebP))
+	logger.Debug("Decode image", "bucket", bucket, "key", key, "frames", len(animation.Image), "durationMs", durationMs(start))
+
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Image, original.Bounds, original.Scale = frames[0].Image, image.Pt(imageConfig.Width, imageConfig.Height), 1
+	if len(frames) > 1 {
+		original.frames, original.loopCount = frames, pipeline.GIFLoopCount(animation.LoopCount)
+	}
+
+	return original, nil
+}
+
+// hasFormat 是否有尺寸使用该输出格式
+func hasFormat(sizes []Size, format string) bool {
+	for _, size := range sizes {
+		if size.Format == format && !size.Placeholder {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createAnimatedThumbnail 为每一帧生成缩略图并保存为动画webp
+// 智能裁剪对每一帧的结果不同, 动画中改为居中裁剪, 避免画面抖动
+func (s Imaging) createAnimatedThumbnail(ctx context.Context, original *Original, size Size, result SizeResult, start time.Time) SizeResult {
+	if size.Gravity.IsSmart() {
+		size.Gravity = pipeline.GravityCenter
+	}
+
+	_, segment := beginSegment(ctx, "resize")
+	segment.annotate("size", result.Size)
+	frames := make([]pipeline.Frame, len(original.frames))
+	for index, frame := range original.frames {
+		thumbnail := s.renderThumbnail(original, frame.Image, size)
+		if thumbnail == nil {
+			segment.end(nil)
+			result.finish(start, errSkipped)
+			return result
+		}
+		frames[index] = pipeline.Frame{Image: thumbnail, Duration: frame.Duration}
+	}
+	segment.end(nil)
+	result.Width, result.Height = frames[0].Image.Bounds().Dx(), frames[0].Image.Bounds().Dy()
+	resized := time.Now()
+	result.ResizeMs = durationMs(start)
+
+	uploadCtx, segment := beginSegment(ctx, "upload")
+	segment.annotate("size", result.Size)
+	err := s.saveAnimatedThumbnail(uploadCtx, original, frames, size, &result)
+	segment.end(err)
+	result.finish(start, err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Save thumbnail failed", "size", result.Size, "thumbnail", result.Key, "error", err)
+		return result
+	}
+
+	logger.InfoContext(ctx, "Save thumbnail success", "size", result.Size, "thumbnail", result.Key, "frames", len(frames), "durationMs", durationMs(resized))
+	return result
+}
+
+// saveAnimatedThumbnail 编码并保存动画webp缩略图
+func (s Imaging) saveAnimatedThumbnail(ctx context.Context, original *Original, frames []pipeline.Frame, size Size, result *SizeResult) error {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+
+	_, segment := beginSegment(ctx, "encode")
+	err := pipeline.EncodeAnimatedWebP(buffer, frames, original.loopCount)
+	segment.end(err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Encode thumbnail failed", "format", size.Format, "frames", len(frames), "error", err)
+		return err
+	}
+
+	return s.putThumbnail(ctx, original, buffer.Bytes(), size, result)
+}
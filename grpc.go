@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// grpcServicePath gRPC服务的路径前缀, 与proto/resize.proto中的服务名一致
+	grpcServicePath = "/resize.v1.Resizer/"
+	// grpcMaxMessageSize 未配置MaxObjectSize时请求消息的最大字节数
+	grpcMaxMessageSize = 64 << 20
+	// grpcDefaultName Resize请求中没有文件名时按jpeg处理
+	grpcDefaultName = "image.jpg"
+	// statusMissing 缩略图尚未生成
+	statusMissing = "missing"
+
+	grpcCodeOK                = 0
+	grpcCodeCanceled          = 1
+	grpcCodeInvalidArgument   = 3
+	grpcCodeDeadlineExceeded  = 4
+	grpcCodeNotFound          = 5
+	grpcCodePermissionDenied  = 7
+	grpcCodeResourceExhausted = 8
+	grpcCodeUnimplemented     = 12
+	grpcCodeInternal          = 13
+
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+// grpcError 带gRPC状态码的错误
+type grpcError struct {
+	code    int
+	message string
+}
+
+// Error 实现error
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// newGRPCError 新建gRPC错误
+func newGRPCError(code int, format string, args ...interface{}) error {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// grpcResizeRequest Resize的请求
+type grpcResizeRequest struct {
+	Image []byte
+	Name  string
+	Size  string
+}
+
+// grpcObjectRequest ResizeFromS3和GetVariants的请求
+type grpcObjectRequest struct {
+	Bucket string
+	Key    string
+}
+
+// grpcResizeResponse Resize的响应
+type grpcResizeResponse struct {
+	Image       []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// grpcVariant 缩略图
+type grpcVariant struct {
+	Size   string
+	Bucket string
+	Key    string
+	Width  int
+	Height int
+	Bytes  int64
+	Status string
+	Error  string
+}
+
+// GRPC 处理gRPC调用, 只支持一元调用和未压缩的消息, 不依赖gRPC库
+// 服务模式开启了h2c, gRPC客户端可以直接以明文HTTP/2连接
+func (s Imaging) GRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "grpc request is required", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, grpcServicePath)
+	ctx := withLogAttrs(r.Context(), "method", method)
+
+	var response []byte
+	request, err := s.readGRPCMessage(r.Body)
+	if err == nil {
+		response, err = s.callGRPC(ctx, method, request)
+	}
+
+	// 状态码在trailer中返回, 需要在写入响应前声明
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if err == nil {
+		prefix := make([]byte, 5)
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(response)))
+		w.Write(prefix)
+		w.Write(response)
+	}
+
+	code, message := grpcCodeOK, ""
+	if err != nil {
+		code, message = grpcCodeInternal, err.Error()
+		var statusErr *grpcError
+		if errors.As(err, &statusErr) {
+			code = statusErr.code
+		}
+		logger.WarnContext(ctx, "Call grpc method failed", "code", code, "error", err)
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(message))
+	}
+}
+
+// readGRPCMessage 读取带长度前缀的请求消息
+func (s Imaging) readGRPCMessage(body io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(body, prefix); err != nil {
+		return nil, newGRPCError(grpcCodeInvalidArgument, "read message failed: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, newGRPCError(grpcCodeUnimplemented, "compressed message is not supported")
+	}
+
+	maxSize := int64(grpcMaxMessageSize)
+	if s.config.MaxObjectSize > 0 {
+		// 消息中除了原图还有文件名和尺寸
+		maxSize = s.config.MaxObjectSize + 4096
+	}
+	length := int64(binary.BigEndian.Uint32(prefix[1:]))
+	if length > maxSize {
+		return nil, newGRPCError(grpcCodeResourceExhausted, "message is %d bytes, limit is %d bytes", length, maxSize)
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, newGRPCError(grpcCodeInvalidArgument, "read message failed: %v", err)
+	}
+
+	return message, nil
+}
+
+// callGRPC 按方法名调用, 返回编码后的响应消息
+func (s Imaging) callGRPC(ctx context.Context, method string, request []byte) ([]byte, error) {
+	switch method {
+	case "Resize":
+		var message grpcResizeRequest
+		if err := message.unmarshal(request); err != nil {
+			return nil, err
+		}
+		response, err := s.grpcResize(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return response.marshal(), nil
+	case "ResizeFromS3", "GetVariants":
+		var message grpcObjectRequest
+		if err := message.unmarshal(request); err != nil {
+			return nil, err
+		}
+		if message.Bucket == "" {
+			message.Bucket = s.config.SourceBucket
+		}
+		if message.Bucket == "" || message.Key == "" {
+			return nil, newGRPCError(grpcCodeInvalidArgument, "bucket and key are required")
+		}
+		if !validObjectKey(message.Key) {
+			return nil, newGRPCError(grpcCodeInvalidArgument, "key %s is invalid", message.Key)
+		}
+		// 与服务模式的HTTP接口一样只能读写SourceBucket或者有单独配置的bucket
+		if !s.bucketAllowed(message.Bucket) {
+			return nil, newGRPCError(grpcCodePermissionDenied, "bucket %s is not allowed", message.Bucket)
+		}
+
+		var variants []grpcVariant
+		var err error
+		if method == "ResizeFromS3" {
+			variants, err = s.grpcResizeFromS3(ctx, message)
+		} else {
+			variants, err = s.grpcVariants(ctx, message)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return marshalVariants(variants), nil
+	}
+
+	return nil, newGRPCError(grpcCodeUnimplemented, "method %s is not implemented", method)
+}
+
+// grpcResize 为请求中的原图生成一个尺寸的缩略图, 不保存
+func (s Imaging) grpcResize(ctx context.Context, request grpcResizeRequest) (*grpcResizeResponse, error) {
+	name := request.Name
+	if name == "" {
+		name = grpcDefaultName
+	}
+	if len(request.Image) == 0 || request.Size == "" {
+		return nil, newGRPCError(grpcCodeInvalidArgument, "image and size are required")
+	}
+	if !s.isSupportedKey(name) {
+		return nil, newGRPCError(grpcCodeInvalidArgument, "format of %s is not supported", name)
+	}
+
+	size, err := parseSize(request.Size)
+	if err != nil {
+		return nil, newGRPCError(grpcCodeInvalidArgument, "%v", err)
+	}
+	if size.X > s.config.MaxDimension || size.Y > s.config.MaxDimension {
+		return nil, newGRPCError(grpcCodeInvalidArgument, "size %s is larger than %d", request.Size, s.config.MaxDimension)
+	}
+	// 与按需缩放一样只能请求OnDemandSizes中的尺寸
+	size, err = s.onDemandSize(size)
+	if err != nil {
+		return nil, newGRPCError(grpcCodeInvalidArgument, "%v", err)
+	}
+
+	if err = s.checkObjectSize(name, int64(len(request.Image))); err != nil {
+		return nil, newGRPCError(grpcCodeResourceExhausted, "%v", err)
+	}
+
+	// 与事件处理共用同时处理的原图数量限制, 等待时请求结束则不再处理
+	if s.imageSlots != nil {
+		select {
+		case s.imageSlots <- struct{}{}:
+			defer func() { <-s.imageSlots }()
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, newGRPCError(grpcCodeDeadlineExceeded, "wait for image slot: %v", ctx.Err())
+			}
+			return nil, newGRPCError(grpcCodeCanceled, "wait for image slot: %v", ctx.Err())
+		}
+	}
+
+	// 原图不在存储中, bucket为空, prepareSizes不会按bucket和key识别人脸
+	object := &Object{ObjectInfo: ObjectInfo{Size: int64(len(request.Image))}, Body: ioutil.NopCloser(bytes.NewReader(request.Image))}
+	original, err := s.decodeOriginal("", name, object, []Size{size})
+	if err == nil {
+		err = original.decode()
+	}
+	if err != nil {
+		if isTooLarge(err) {
+			return nil, newGRPCError(grpcCodeResourceExhausted, "%v", err)
+		}
+		return nil, newGRPCError(grpcCodeInvalidArgument, "decode image failed: %v", err)
+	}
+
+	size = s.prepareSizes(ctx, original, []Size{size})[0]
+	thumbnail := s.renderThumbnail(original, original.Image, size)
+	if thumbnail == nil {
+		// 不放大时直接返回原尺寸
+		size = size.limitTo(original.Bounds)
+		thumbnail = s.renderThumbnail(original, original.Image, size)
+	}
+
+	// 响应在返回后才编码, 不能使用缓冲池
+	buffer := new(bytes.Buffer)
+	if err = encodeImage(buffer, thumbnail, size); err != nil {
+		return nil, err
+	}
+
+	logger.InfoContext(ctx, "Resize image success", "size", sizeName(size), "bytes", buffer.Len())
+	return &grpcResizeResponse{
+		Image:       s.optimizeThumbnail(ctx, buffer.Bytes(), size),
+		ContentType: formats[size.Format].ContentType,
+		Width:       thumbnail.Bounds().Dx(),
+		Height:      thumbnail.Bounds().Dy(),
+	}, nil
+}
+
+// grpcResizeFromS3 与收到ObjectCreated事件相同, 生成并保存所有配置的尺寸
+func (s Imaging) grpcResizeFromS3(ctx context.Context, request grpcObjectRequest) ([]grpcVariant, error) {
+	results := s.processRecords(ctx, []events.S3EventRecord{serveEventRecord(request.Bucket, request.Key, 0)})
+	s.logReport(ctx, results)
+
+	result := results[0]
+	if err := result.Err(); err != nil && len(result.Sizes) == 0 {
+		switch {
+		case isNotFound(err):
+			return nil, newGRPCError(grpcCodeNotFound, "key %s is not found", request.Key)
+		case isTooLarge(err):
+			return nil, newGRPCError(grpcCodeResourceExhausted, "%v", err)
+		}
+		return nil, err
+	}
+
+	variants := make([]grpcVariant, 0, len(result.Sizes))
+	for _, size := range result.Sizes {
+		variants = append(variants, grpcVariant{
+			Size:   size.Size,
+			Bucket: size.Bucket,
+			Key:    size.Key,
+			Width:  size.Width,
+			Height: size.Height,
+			Bytes:  size.Bytes,
+			Status: size.Status,
+			Error:  size.Error,
+		})
+	}
+
+	return variants, nil
+}
+
+// grpcVariants 查询原图按配置的尺寸已经生成的缩略图, 不存在的尺寸状态为missing
+func (s Imaging) grpcVariants(ctx context.Context, request grpcObjectRequest) ([]grpcVariant, error) {
+	s, _ = s.forObject(ctx, request.Bucket, request.Key)
+
+	version, err := s.sourceVersion(ctx, request.Bucket, request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var variants []grpcVariant
+	for _, size := range s.config.sizesFor(request.Key) {
+		bucket, key := s.thumbnailLocation(request.Bucket, request.Key, version, size)
+		variant := grpcVariant{Size: sizeName(size), Bucket: bucket, Key: key, Status: StatusSucceeded}
+
+		info, err := s.destination.Head(ctx, bucket, key)
+		switch {
+		case err == nil:
+			variant.Bytes = info.Size
+		case isNotFound(err):
+			variant.Status = statusMissing
+		default:
+			variant.Status, variant.Error = StatusFailed, err.Error()
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants, nil
+}
+
+// grpcEscape 按gRPC的规定对错误信息进行百分号编码
+func grpcEscape(message string) string {
+	var builder strings.Builder
+	for index := 0; index < len(message); index++ {
+		if c := message[index]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		} else {
+			builder.WriteByte(c)
+		}
+	}
+
+	return builder.String()
+}
+
+// unmarshal 解码Resize的请求
+func (m *grpcResizeRequest) unmarshal(data []byte) error {
+	return readProto(data, func(number int, value uint64, content []byte) {
+		switch number {
+		case 1:
+			m.Image = content
+		case 2:
+			m.Name = string(content)
+		case 3:
+			m.Size = string(content)
+		}
+	})
+}
+
+// unmarshal 解码ResizeFromS3和GetVariants的请求
+func (m *grpcObjectRequest) unmarshal(data []byte) error {
+	return readProto(data, func(number int, value uint64, content []byte) {
+		switch number {
+		case 1:
+			m.Bucket = string(content)
+		case 2:
+			m.Key = string(content)
+		}
+	})
+}
+
+// marshal 编码Resize的响应
+func (m *grpcResizeResponse) marshal() []byte {
+	var writer protoWriter
+	writer.bytes(1, m.Image)
+	writer.bytes(2, []byte(m.ContentType))
+	writer.varint(3, uint64(m.Width))
+	writer.varint(4, uint64(m.Height))
+
+	return writer.buffer
+}
+
+// marshal 编码缩略图
+func (m grpcVariant) marshal() []byte {
+	var writer protoWriter
+	writer.bytes(1, []byte(m.Size))
+	writer.bytes(2, []byte(m.Bucket))
+	writer.bytes(3, []byte(m.Key))
+	writer.varint(4, uint64(m.Width))
+	writer.varint(5, uint64(m.Height))
+	writer.varint(6, uint64(m.Bytes))
+	writer.bytes(7, []byte(m.Status))
+	writer.bytes(8, []byte(m.Error))
+
+	return writer.buffer
+}
+
+// marshalVariants 编码VariantsResponse
+func marshalVariants(variants []grpcVariant) []byte {
+	var writer protoWriter
+	for _, variant := range variants {
+		writer.message(1, variant.marshal())
+	}
+
+	return writer.buffer
+}
+
+// protoWriter protobuf消息的编码, proto3中的默认值不写入
+type protoWriter struct {
+	buffer []byte
+}
+
+// varint 写入整数字段
+func (w *protoWriter) varint(number int, value uint64) {
+	if value == 0 {
+		return
+	}
+	w.buffer = binary.AppendUvarint(w.buffer, uint64(number)<<3|protoWireVarint)
+	w.buffer = binary.AppendUvarint(w.buffer, value)
+}
+
+// bytes 写入字符串或字节字段
+func (w *protoWriter) bytes(number int, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	w.message(number, value)
+}
+
+// message 写入嵌套消息, 重复字段中的空消息也需要写入
+func (w *protoWriter) message(number int, value []byte) {
+	w.buffer = binary.AppendUvarint(w.buffer, uint64(number)<<3|protoWireBytes)
+	w.buffer = binary.AppendUvarint(w.buffer, uint64(len(value)))
+	w.buffer = append(w.buffer, value...)
+}
+
+// readProto 遍历protobuf消息的字段, 整数字段通过value返回, 长度分隔的字段通过content返回
+func readProto(data []byte, field func(number int, value uint64, content []byte)) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return newGRPCError(grpcCodeInvalidArgument, "invalid message")
+		}
+		data = data[n:]
+
+		number, wireType := int(tag>>3), int(tag&7)
+		switch wireType {
+		case protoWireVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return newGRPCError(grpcCodeInvalidArgument, "invalid message")
+			}
+			data = data[n:]
+			field(number, value, nil)
+		case protoWireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return newGRPCError(grpcCodeInvalidArgument, "invalid message")
+			}
+			field(number, 0, data[n:n+int(length)])
+			data = data[n+int(length):]
+		case protoWireFixed64:
+			if len(data) < 8 {
+				return newGRPCError(grpcCodeInvalidArgument, "invalid message")
+			}
+			data = data[8:]
+		case protoWireFixed32:
+			if len(data) < 4 {
+				return newGRPCError(grpcCodeInvalidArgument, "invalid message")
+			}
+			data = data[4:]
+		default:
+			return newGRPCError(grpcCodeInvalidArgument, "wire type %d is not supported", wireType)
+		}
+	}
+
+	return nil
+}
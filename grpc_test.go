@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// grpcRequest 带长度前缀的请求
+func grpcRequest(ctx context.Context, method string, message []byte) *http.Request {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	request := httptest.NewRequest(http.MethodPost, grpcServicePath+method, bytes.NewReader(append(prefix, message...)))
+	request.Header.Set("Content-Type", "application/grpc")
+
+	return request.WithContext(ctx)
+}
+
+// callTestGRPC 调用gRPC方法, 返回trailer中的状态码, 错误信息和响应消息
+func callTestGRPC(t *testing.T, s *Imaging, request *http.Request) (int, string, []byte) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	s.GRPC(recorder, request)
+
+	response := recorder.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("http status is %d", response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/grpc" {
+		t.Errorf("content type is %s", contentType)
+	}
+	code, err := strconv.Atoi(response.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("grpc status trailer %q is invalid", response.Trailer.Get("Grpc-Status"))
+	}
+
+	body := recorder.Body.Bytes()
+	if len(body) == 0 {
+		return code, response.Trailer.Get("Grpc-Message"), nil
+	}
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		t.Fatalf("response message prefix is invalid: % x", body[:5])
+	}
+
+	return code, response.Trailer.Get("Grpc-Message"), body[5:]
+}
+
+// unmarshalTestVariants 解码VariantsResponse
+func unmarshalTestVariants(t *testing.T, data []byte) []grpcVariant {
+	t.Helper()
+	var variants []grpcVariant
+	err := readProto(data, func(number int, value uint64, content []byte) {
+		if number != 1 {
+			return
+		}
+		var variant grpcVariant
+		readProto(content, func(number int, value uint64, content []byte) {
+			switch number {
+			case 1:
+				variant.Size = string(content)
+			case 2:
+				variant.Bucket = string(content)
+			case 3:
+				variant.Key = string(content)
+			case 4:
+				variant.Width = int(value)
+			case 5:
+				variant.Height = int(value)
+			case 6:
+				variant.Bytes = int64(value)
+			case 7:
+				variant.Status = string(content)
+			case 8:
+				variant.Error = string(content)
+			}
+		})
+		variants = append(variants, variant)
+	})
+	if err != nil {
+		t.Fatalf("decode variants failed: %v", err)
+	}
+
+	return variants
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	var writer protoWriter
+	writer.bytes(1, []byte{0xff, 0x00, 0xd8})
+	writer.bytes(2, []byte("照片.png"))
+	writer.bytes(3, []byte("200x200:fill"))
+	// 未知字段被跳过
+	writer.varint(9, 300)
+	writer.buffer = append(writer.buffer, 10<<3|protoWireFixed32, 1, 2, 3, 4)
+	writer.buffer = append(writer.buffer, 11<<3|protoWireFixed64, 1, 2, 3, 4, 5, 6, 7, 8)
+
+	var request grpcResizeRequest
+	if err := request.unmarshal(writer.buffer); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if !bytes.Equal(request.Image, []byte{0xff, 0x00, 0xd8}) || request.Name != "照片.png" || request.Size != "200x200:fill" {
+		t.Errorf("unmarshaled %+v", request)
+	}
+
+	variants := []grpcVariant{
+		{Size: "100x100", Bucket: "photos", Key: "a_100x100.jpg", Width: 100, Height: 75, Bytes: 1 << 33, Status: StatusSucceeded},
+		// 全部为默认值的消息也需要写入
+		{},
+		{Size: "200x200", Status: StatusFailed, Error: "put failed"},
+	}
+	decoded := unmarshalTestVariants(t, marshalVariants(variants))
+	if len(decoded) != len(variants) {
+		t.Fatalf("decoded %d variants, want %d", len(decoded), len(variants))
+	}
+	for index := range variants {
+		if decoded[index] != variants[index] {
+			t.Errorf("variant %d decoded as %+v, want %+v", index, decoded[index], variants[index])
+		}
+	}
+
+	response := grpcResizeResponse{Image: []byte("image"), ContentType: "image/webp", Width: 640, Height: 0}
+	var width, height uint64
+	var contentType string
+	readProto(response.marshal(), func(number int, value uint64, content []byte) {
+		switch number {
+		case 2:
+			contentType = string(content)
+		case 3:
+			width = value
+		case 4:
+			height = value
+		}
+	})
+	if contentType != "image/webp" || width != 640 || height != 0 {
+		t.Errorf("response decoded as %s %dx%d", contentType, width, height)
+	}
+}
+
+func TestReadProtoInvalid(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated tag":     {0x80},
+		"truncated varint":  {1 << 3, 0x80},
+		"truncated bytes":   {1<<3 | protoWireBytes, 5, 'a'},
+		"truncated fixed32": {1<<3 | protoWireFixed32, 1, 2},
+		"truncated fixed64": {1<<3 | protoWireFixed64, 1, 2, 3},
+		"group":             {1<<3 | 3},
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := readProto(data, func(int, uint64, []byte) {})
+			var statusErr *grpcError
+			if !errors.As(err, &statusErr) || statusErr.code != grpcCodeInvalidArgument {
+				t.Errorf("read returned %v, want invalid argument", err)
+			}
+		})
+	}
+}
+
+func TestGRPCResize(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "MaxObjectSize": "1MB"})
+
+	var writer protoWriter
+	writer.bytes(1, testJPEG(t, 400, 300))
+	writer.bytes(3, []byte("80x80:fill"))
+	code, message, response := callTestGRPC(t, s, grpcRequest(context.Background(), "Resize", writer.buffer))
+	if code != grpcCodeOK {
+		t.Fatalf("grpc status is %d: %s", code, message)
+	}
+
+	var thumbnail []byte
+	var width, height uint64
+	readProto(response, func(number int, value uint64, content []byte) {
+		switch number {
+		case 1:
+			thumbnail = content
+		case 3:
+			width = value
+		case 4:
+			height = value
+		}
+	})
+	config, _, err := image.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		t.Fatalf("decode thumbnail failed: %v", err)
+	}
+	if width != 80 || height != 80 || config.Width != 80 || config.Height != 80 {
+		t.Errorf("thumbnail is %dx%d, response is %dx%d", config.Width, config.Height, width, height)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "MaxObjectSize": "1KB"})
+
+	resize := func(size string) []byte {
+		var writer protoWriter
+		writer.bytes(1, []byte("not an image"))
+		writer.bytes(3, []byte(size))
+		return writer.buffer
+	}
+
+	// 压缩标志为1
+	frame := append([]byte{1, 0, 0, 0, 0}, resize("100x100")...)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(frame)-5))
+	compressed := httptest.NewRequest(http.MethodPost, grpcServicePath+"Resize", bytes.NewReader(frame))
+	compressed.Header.Set("Content-Type", "application/grpc")
+
+	cases := []struct {
+		name    string
+		request *http.Request
+		code    int
+		message string
+	}{
+		{"unknown method", grpcRequest(context.Background(), "Crop", nil), grpcCodeUnimplemented, "method Crop is not implemented"},
+		{"compressed", compressed, grpcCodeUnimplemented, "compressed message is not supported"},
+		{"too large", grpcRequest(context.Background(), "Resize", make([]byte, 8192)), grpcCodeResourceExhausted, "message is 8192 bytes, limit is 5120 bytes"},
+		{"missing size", grpcRequest(context.Background(), "Resize", resize("")), grpcCodeInvalidArgument, "image and size are required"},
+		{"invalid image", grpcRequest(context.Background(), "Resize", resize("100x100")), grpcCodeInvalidArgument, "decode image failed: "},
+		{"missing key", grpcRequest(context.Background(), "GetVariants", nil), grpcCodeInvalidArgument, "bucket and key are required"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			code, message, response := callTestGRPC(t, s, c.request)
+			if code != c.code {
+				t.Errorf("grpc status is %d, want %d", code, c.code)
+			}
+			if !strings.HasPrefix(message, c.message) {
+				t.Errorf("grpc message is %q, want %q", message, c.message)
+			}
+			if response != nil {
+				t.Errorf("failed call returned a %d bytes message", len(response))
+			}
+		})
+	}
+
+	if escaped := grpcEscape("100% 失败\n"); escaped != "100%25 %E5%A4%B1%E8%B4%A5%0A" {
+		t.Errorf("escaped message is %s", escaped)
+	}
+	unsupported := httptest.NewRecorder()
+	s.GRPC(unsupported, httptest.NewRequest(http.MethodPost, grpcServicePath+"Resize", nil))
+	if unsupported.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("request without grpc content type returned %d", unsupported.Code)
+	}
+}
+
+func TestGRPCResizeWaitsForImageSlot(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "MaxConcurrentImages": "1"})
+
+	// 事件处理占用了唯一的处理槽
+	s.imageSlots <- struct{}{}
+	var writer protoWriter
+	writer.bytes(1, testJPEG(t, 40, 30))
+	writer.bytes(3, []byte("20x20"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	code, message, _ := callTestGRPC(t, s, grpcRequest(ctx, "Resize", writer.buffer))
+	if code != grpcCodeDeadlineExceeded {
+		t.Errorf("grpc status is %d: %s, want %d", code, message, grpcCodeDeadlineExceeded)
+	}
+
+	// 处理槽释放后可以处理
+	<-s.imageSlots
+	code, message, _ = callTestGRPC(t, s, grpcRequest(context.Background(), "Resize", writer.buffer))
+	if code != grpcCodeOK {
+		t.Errorf("grpc status is %d: %s", code, message)
+	}
+	if len(s.imageSlots) != 0 {
+		t.Errorf("resize did not release the image slot")
+	}
+}
+
+func TestGRPCResizeFromS3AndVariants(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100,50x50:fill", "SourceBucket": bucket})
+	writeTestFile(t, bucket, "猫 1.jpg", testJPEG(t, 400, 300))
+
+	var writer protoWriter
+	writer.bytes(2, []byte("猫 1.jpg"))
+
+	// 查询前还没有生成
+	code, message, response := callTestGRPC(t, s, grpcRequest(context.Background(), "GetVariants", writer.buffer))
+	if code != grpcCodeOK {
+		t.Fatalf("grpc status is %d: %s", code, message)
+	}
+	for _, variant := range unmarshalTestVariants(t, response) {
+		if variant.Status != statusMissing {
+			t.Errorf("variant %s status is %s before resize", variant.Size, variant.Status)
+		}
+	}
+
+	code, message, response = callTestGRPC(t, s, grpcRequest(context.Background(), "ResizeFromS3", writer.buffer))
+	if code != grpcCodeOK {
+		t.Fatalf("grpc status is %d: %s", code, message)
+	}
+	created := unmarshalTestVariants(t, response)
+	if len(created) != 2 {
+		t.Fatalf("created %d variants, want 2", len(created))
+	}
+	for _, variant := range created {
+		if variant.Status != StatusSucceeded || variant.Bucket != bucket || variant.Bytes <= 0 {
+			t.Errorf("variant %+v is not created", variant)
+		}
+		readTestFile(t, bucket, variant.Key)
+	}
+
+	code, message, response = callTestGRPC(t, s, grpcRequest(context.Background(), "GetVariants", writer.buffer))
+	if code != grpcCodeOK {
+		t.Fatalf("grpc status is %d: %s", code, message)
+	}
+	for index, variant := range unmarshalTestVariants(t, response) {
+		if variant.Status != StatusSucceeded || variant.Key != created[index].Key || variant.Bytes != created[index].Bytes {
+			t.Errorf("variant %+v does not match created %+v", variant, created[index])
+		}
+	}
+
+	var missing protoWriter
+	missing.bytes(2, []byte("missing.jpg"))
+	if code, _, _ = callTestGRPC(t, s, grpcRequest(context.Background(), "ResizeFromS3", missing.buffer)); code != grpcCodeNotFound {
+		t.Errorf("grpc status for missing key is %d, want %d", code, grpcCodeNotFound)
+	}
+}
+
+func TestGRPCRestrictions(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "SourceBucket": bucket, "OnDemandSizes": "80x80:fill"})
+	writeTestFile(t, bucket, "a.jpg", testJPEG(t, 400, 300))
+
+	resize := func(size string) []byte {
+		var writer protoWriter
+		writer.bytes(1, testJPEG(t, 400, 300))
+		writer.bytes(3, []byte(size))
+		return writer.buffer
+	}
+	object := func(bucket, key string) []byte {
+		var writer protoWriter
+		writer.bytes(1, []byte(bucket))
+		writer.bytes(2, []byte(key))
+		return writer.buffer
+	}
+
+	cases := []struct {
+		name, method string
+		request      []byte
+		code         int
+	}{
+		{"allowed size", "Resize", resize("80x80:fill"), grpcCodeOK},
+		{"disallowed size", "Resize", resize("60x60:fill"), grpcCodeInvalidArgument},
+		{"source bucket", "GetVariants", object("", "a.jpg"), grpcCodeOK},
+		{"other bucket", "ResizeFromS3", object(t.TempDir(), "a.jpg"), grpcCodePermissionDenied},
+		{"other bucket variants", "GetVariants", object(t.TempDir(), "a.jpg"), grpcCodePermissionDenied},
+		{"parent key", "ResizeFromS3", object("", "../a.jpg"), grpcCodeInvalidArgument},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if code, message, _ := callTestGRPC(t, s, grpcRequest(context.Background(), c.method, c.request)); code != c.code {
+				t.Errorf("grpc status is %d: %s, want %d", code, message, c.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// eventSourceSQS SQS消息的事件来源
+	eventSourceSQS = "aws:sqs"
+	// eventSourceSNS SNS通知的事件来源
+	eventSourceSNS = "aws:sns"
+	// eventSourceEventBridge S3发送到EventBridge的事件来源
+	eventSourceEventBridge = "aws.s3"
+	// eventSourceKinesis Kinesis数据流的事件来源
+	eventSourceKinesis = "aws:kinesis"
+	// eventSourceFirehose Firehose数据转换的记录, 事件中没有来源字段, 只用于报告
+	eventSourceFirehose = "aws:firehose"
+
+	// errorCodeUnparsed 无法解析的通知, 报告中的code, 可以按日志告警
+	errorCodeUnparsed = "unparsed"
+)
+
+// eventBridgeEventNames EventBridge事件类型对应的S3事件名
+var eventBridgeEventNames = map[string]string{
+	"Object Created": "ObjectCreated:Put",
+	"Object Deleted": "ObjectRemoved:Delete",
+}
+
+// eventBridgeReasons Object Created事件的reason对应的S3事件名, 区分上传, 复制和分段上传
+var eventBridgeReasons = map[string]string{
+	"PutObject":               "ObjectCreated:Put",
+	"POST Object":             "ObjectCreated:Post",
+	"CopyObject":              eventNameCopy,
+	"CompleteMultipartUpload": eventNameCompleteMultipartUpload,
+}
+
+// lambdaEvent 用于识别Lambda调用的事件格式, SNS事件的字段名首字母大写
+type lambdaEvent struct {
+	Records []struct {
+		EventSource    string          `json:"eventSource"`
+		EventSourceSNS string          `json:"EventSource"`
+		CF             json.RawMessage `json:"cf"`
+	} `json:"Records"`
+	Source           string          `json:"source"`
+	DetailType       string          `json:"detail-type"`
+	Warmup           bool            `json:"warmup"`
+	Command          string          `json:"command"`
+	HTTPMethod       string          `json:"httpMethod"`
+	GetObjectContext json.RawMessage `json:"getObjectContext"`
+	InvocationID     string          `json:"invocationId"`
+	DeliveryStream   string          `json:"deliveryStreamArn"`
+	SourceKey        string          `json:"sourceKey"`
+	RequestContext   struct {
+		HTTP struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// Handle 处理Lambda调用, 根据事件格式分发到对应的处理方法
+func (s Imaging) Handle(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var event lambdaEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("unknown event: %v", err)
+	}
+
+	if len(event.Records) > 0 && event.Records[0].EventSource == eventSourceSQS {
+		var sqsEvent SQSEvent
+		if err := json.Unmarshal(payload, &sqsEvent); err != nil {
+			return nil, err
+		}
+
+		return s.SQSEvent(ctx, sqsEvent), nil
+	}
+
+	if len(event.Records) > 0 && event.Records[0].EventSource == eventSourceKinesis {
+		var kinesisEvent events.KinesisEvent
+		if err := json.Unmarshal(payload, &kinesisEvent); err != nil {
+			return nil, err
+		}
+
+		return s.KinesisEvent(ctx, kinesisEvent), nil
+	}
+
+	// Firehose的数据转换, 与Batch Operations一样带有invocationId
+	if event.DeliveryStream != "" {
+		var firehoseEvent events.KinesisFirehoseEvent
+		if err := json.Unmarshal(payload, &firehoseEvent); err != nil {
+			return nil, err
+		}
+
+		return s.FirehoseEvent(ctx, firehoseEvent), nil
+	}
+
+	// Lambda@Edge的事件记录中只有cf
+	if len(event.Records) > 0 && len(event.Records[0].CF) > 0 {
+		var cloudFrontEvent CloudFrontEvent
+		if err := json.Unmarshal(payload, &cloudFrontEvent); err != nil {
+			return nil, err
+		}
+
+		return s.CloudFrontEvent(ctx, cloudFrontEvent)
+	}
+
+	if len(event.Records) > 0 && event.Records[0].EventSourceSNS == eventSourceSNS {
+		var snsEvent events.SNSEvent
+		if err := json.Unmarshal(payload, &snsEvent); err != nil {
+			return nil, err
+		}
+		return s.SNSEvent(ctx, snsEvent)
+	}
+
+	// Batch Operations的任务
+	if event.InvocationID != "" {
+		var batchEvent BatchEvent
+		if err := json.Unmarshal(payload, &batchEvent); err != nil {
+			return nil, err
+		}
+
+		return s.BatchEvent(ctx, batchEvent), nil
+	}
+
+	// Object Lambda访问点的GET请求
+	if len(event.GetObjectContext) > 0 {
+		var objectLambdaEvent ObjectLambdaEvent
+		if err := json.Unmarshal(payload, &objectLambdaEvent); err != nil {
+			return nil, err
+		}
+
+		return s.ObjectLambdaEvent(ctx, objectLambdaEvent)
+	}
+
+	// API Gateway或Function URL的按需缩放请求
+	if event.HTTPMethod != "" || event.RequestContext.HTTP.Method != "" {
+		var request httpRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, err
+		}
+
+		return s.HTTPEvent(ctx, request), nil
+	}
+
+	// 手动调用{"command": "version"}返回版本和功能, EventBridge事件中的version字段是事件格式的版本, 不能复用
+	if event.Command == "version" {
+		return buildInfo(), nil
+	}
+
+	// 定时规则或者手动调用{"warmup": true}触发自检
+	if event.Warmup || event.Source == eventSourceScheduled && event.DetailType == eventDetailScheduled {
+		return s.WarmupEvent(ctx)
+	}
+
+	if event.Source == eventSourceEventBridge {
+		var cloudWatchEvent events.CloudWatchEvent
+		if err := json.Unmarshal(payload, &cloudWatchEvent); err != nil {
+			return nil, err
+		}
+		return s.EventBridgeEvent(ctx, cloudWatchEvent)
+	}
+
+	// Step Functions的任务
+	if event.SourceKey != "" {
+		var input StepFunctionsInput
+		if err := json.Unmarshal(payload, &input); err != nil {
+			return nil, err
+		}
+		return s.StepFunctionsEvent(ctx, input)
+	}
+
+	var s3Event events.S3Event
+	if err := json.Unmarshal(payload, &s3Event); err != nil {
+		return nil, err
+	}
+	return s.S3Event(ctx, s3Event)
+}
+
+// SNSEvent 处理S3通知到SNS后再触发的事件
+func (s Imaging) SNSEvent(ctx context.Context, snsEvent events.SNSEvent) (Report, error) {
+	var records []events.S3EventRecord
+	var unparsed []RecordResult
+	for _, record := range snsEvent.Records {
+		s3Event, err := parseS3Notification(record.SNS.Message)
+		if err != nil {
+			logger.ErrorContext(ctx, "Parse notification failed", "messageId", record.SNS.MessageID, "error", err)
+			unparsed = append(unparsed, unparsedResult(eventSourceSNS, record.SNS.MessageID, err))
+			continue
+		}
+
+		records = append(records, s3Event.Records...)
+	}
+
+	// 无法解析的通知重试也不会成功, 计入报告以便按ErrorMode返回错误和告警
+	return s.report(ctx, append(s.processRecords(ctx, records), unparsed...))
+}
+
+// unparsedResult 无法解析的通知对应的失败结果, id是消息或者记录的标识
+func unparsedResult(source, id string, err error) RecordResult {
+	result := RecordResult{Event: source}
+	result.finish(time.Now(), fmt.Errorf("parse notification %s failed: %v", id, err))
+	result.Code = errorCodeUnparsed
+
+	return result
+}
+
+// snsNotification SNS投递到SQS或HTTP的消息信封
+type snsNotification struct {
+	Type      string `json:"Type"`
+	MessageID string `json:"MessageId"`
+	Message   string `json:"Message"`
+}
+
+// parseS3Notification 解析S3通知, 支持经过SNS转发并包含信封的消息
+func parseS3Notification(body string) (events.S3Event, error) {
+	var notification snsNotification
+	if err := json.Unmarshal([]byte(body), &notification); err == nil && notification.Type == "Notification" {
+		body = notification.Message
+	}
+
+	var s3Event events.S3Event
+	err := json.Unmarshal([]byte(body), &s3Event)
+	return s3Event, err
+}
+
+// eventBridgeDetail EventBridge中S3事件的详情
+type eventBridgeDetail struct {
+	Reason string `json:"reason"`
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key       string `json:"key"`
+		Size      int64  `json:"size"`
+		ETag      string `json:"etag"`
+		VersionID string `json:"version-id"`
+		Sequencer string `json:"sequencer"`
+	} `json:"object"`
+}
+
+// EventBridgeEvent 处理EventBridge规则转发的Object Created和Object Deleted事件
+func (s Imaging) EventBridgeEvent(ctx context.Context, event events.CloudWatchEvent) (Report, error) {
+	eventName, found := eventBridgeEventNames[event.DetailType]
+	if !found {
+		logger.InfoContext(ctx, "Ignore event", "detailType", event.DetailType)
+		return newReport(nil), nil
+	}
+
+	var detail eventBridgeDetail
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		logger.ErrorContext(ctx, "Parse event failed", "eventId", event.ID, "error", err)
+		return newReport(nil), nil
+	}
+
+	if name, found := eventBridgeReasons[detail.Reason]; found && event.DetailType == "Object Created" {
+		eventName = name
+	}
+
+	// 与S3通知一致, 事件中的key经过URL编码
+	record := events.S3EventRecord{
+		EventSource: event.Source,
+		AWSRegion:   event.Region,
+		EventTime:   event.Time,
+		EventName:   eventName,
+	}
+	record.S3.Bucket.Name = detail.Bucket.Name
+	record.S3.Object.Key = detail.Object.Key
+	record.S3.Object.Size = detail.Object.Size
+	record.S3.Object.ETag = detail.Object.ETag
+	record.S3.Object.VersionID = detail.Object.VersionID
+	record.S3.Object.Sequencer = detail.Object.Sequencer
+
+	return s.report(ctx, s.processRecords(ctx, []events.S3EventRecord{record}))
+}
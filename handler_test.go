@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandleS3Event(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{
+		"Sizes":     "100x100,40x40:fill",
+		"ErrorMode": ErrorModeAny,
+	})
+
+	writeTestFile(t, bucket, "photos/my cat.jpg", testJPEG(t, 400, 300))
+	writeTestFile(t, bucket, "notes.txt", []byte("notes"))
+	writeTestFile(t, bucket, "photos/gone.jpg", testJPEG(t, 40, 30))
+	records := []events.S3EventRecord{
+		createdRecord(t, s, bucket, "photos/my cat.jpg"),
+		createdRecord(t, s, bucket, "notes.txt"),
+		createdRecord(t, s, bucket, "photos/gone.jpg"),
+	}
+	// 事件到达前原图已经被删除
+	if err := os.Remove(filepath.Join(bucket, "photos", "gone.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(events.S3Event{Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := s.Handle(context.Background(), payload)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 records failed") {
+		t.Errorf("handle returned error %v, want 1 of 3 records failed", err)
+	}
+
+	report, ok := response.(Report)
+	if !ok {
+		t.Fatalf("handle returned %T, want Report", response)
+	}
+	if report.Succeeded != 1 || report.Ignored != 1 || report.Failed != 1 {
+		t.Errorf("report is %d succeeded, %d ignored, %d failed", report.Succeeded, report.Ignored, report.Failed)
+	}
+
+	created := report.Records[0]
+	if created.Key != "photos/my cat.jpg" || created.Status != StatusSucceeded || len(created.Sizes) != 2 {
+		t.Fatalf("record %+v is not created", created)
+	}
+	for _, size := range created.Sizes {
+		if size.Status != StatusSucceeded {
+			t.Errorf("size %s status is %s", size.Size, size.Status)
+		}
+		readTestFile(t, bucket, size.Key)
+	}
+	if report.Records[1].Status != StatusIgnored {
+		t.Errorf("unsupported file status is %s, want %s", report.Records[1].Status, StatusIgnored)
+	}
+	if report.Records[2].Status != StatusFailed {
+		t.Errorf("removed original status is %s, want %s", report.Records[2].Status, StatusFailed)
+	}
+
+	// 缩略图的上传事件不会再次生成缩略图
+	thumbnailRecord := createdRecord(t, s, bucket, created.Sizes[0].Key)
+	payload, _ = json.Marshal(events.S3Event{Records: []events.S3EventRecord{thumbnailRecord}})
+	response, err = s.Handle(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("handle thumbnail event failed: %v", err)
+	}
+	if report := response.(Report); report.Ignored != 1 {
+		t.Errorf("thumbnail event report is %+v, want ignored", report)
+	}
+}
+
+func TestErrorModeDefault(t *testing.T) {
+	failed := []RecordResult{{Status: StatusSucceeded}, {Status: StatusFailed, err: errors.New("get object failed")}}
+
+	t.Run("default", func(t *testing.T) {
+		s := newTestImaging(t, map[string]string{"Sizes": "100x100"})
+		if s.config.ErrorMode != ErrorModeAny {
+			t.Errorf("error mode is %s, want %s", s.config.ErrorMode, ErrorModeAny)
+		}
+		if err := s.recordsError(failed); err == nil {
+			t.Errorf("failed records returned no error by default")
+		}
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		s := newTestImaging(t, map[string]string{"Sizes": "100x100", "ErrorMode": ErrorModeIgnore})
+		if err := s.recordsError(failed); err != nil {
+			t.Errorf("failed records returned %v with ignore", err)
+		}
+	})
+}
+
+func TestProcessRecordDecodesKeyOnce(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{
+		"Sizes":       "100x100",
+		"PrefixSizes": "相册 2024/=60x60",
+	})
+
+	// 租户只覆盖缩略图的前缀, 选择租户时使用解码后的key
+	tenant := *s.config
+	tenant.TenantPrefixes = []string{"客户/acme+co/"}
+	tenant.DestinationPrefix = "acme/"
+	s.config.Tenants = map[string]*Config{"acme": &tenant}
+
+	cases := []struct {
+		name, encoded, key, prefix string
+		width                      int
+	}{
+		{"space", "my+photo.jpg", "my photo.jpg", "", 100},
+		{"plus", "a%2Bb.jpg", "a+b.jpg", "", 100},
+		{"percent", "100%25.jpg", "100%.jpg", "", 100},
+		{"cjk", url.QueryEscape("照片/猫.jpg"), "照片/猫.jpg", "", 100},
+		{"emoji", url.QueryEscape("😀 smile.jpg"), "😀 smile.jpg", "", 100},
+		{"prefix sizes", "%E7%9B%B8%E5%86%8C+2024%2F%E7%8C%AB.jpg", "相册 2024/猫.jpg", "", 60},
+		{"tenant", url.QueryEscape("客户/acme+co/猫.jpg"), "客户/acme+co/猫.jpg", "acme/", 100},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			writeTestFile(t, bucket, c.key, testJPEG(t, 400, 300))
+			record := createdRecord(t, s, bucket, c.key)
+			if record.S3.Object.Key != c.encoded {
+				t.Fatalf("encoded key is %s, want %s", record.S3.Object.Key, c.encoded)
+			}
+
+			result := s.processRecord(context.Background(), record)
+			if err := result.Err(); err != nil {
+				t.Fatalf("process failed: %v", err)
+			}
+			if result.Key != c.key {
+				t.Errorf("result key is %s, want %s", result.Key, c.key)
+			}
+			if len(result.Sizes) != 1 {
+				t.Fatalf("created %d sizes, want 1", len(result.Sizes))
+			}
+
+			size := result.Sizes[0]
+			if !strings.HasPrefix(size.Key, c.prefix) || c.prefix == "" && strings.HasPrefix(size.Key, tenant.DestinationPrefix) {
+				t.Errorf("thumbnail %s does not use prefix %q", size.Key, c.prefix)
+			}
+			if !strings.Contains(size.Key, strings.TrimSuffix(c.key[strings.LastIndex(c.key, "/")+1:], ".jpg")) {
+				t.Errorf("thumbnail %s is not named after %s", size.Key, c.key)
+			}
+
+			thumbnail, _, err := image.DecodeConfig(bytes.NewReader(readTestFile(t, bucket, size.Key)))
+			if err != nil {
+				t.Fatalf("decode thumbnail failed: %v", err)
+			}
+			if width := thumbnail.Width; width != c.width {
+				t.Errorf("thumbnail width is %d, want %d", width, c.width)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// newTestImaging 按环境变量读取配置, 使用本地存储新建图片处理, 配置文件中的配置不生效
+func newTestImaging(t *testing.T, env map[string]string) *Imaging {
+	t.Helper()
+	t.Setenv("Storage", StorageLocal)
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	saved := fileConfig
+	fileConfig = nil
+	t.Cleanup(func() { fileConfig = saved })
+
+	config, err := readConfig()
+	if err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+
+	return NewImaging(config, NewLocalStore())
+}
+
+// testImage 渐变的测试图像
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+
+	return img
+}
+
+// testJPEG 编码测试图像
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	buffer := new(bytes.Buffer)
+	if err := jpeg.Encode(buffer, testImage(width, height), nil); err != nil {
+		t.Fatalf("encode jpeg failed: %v", err)
+	}
+
+	return buffer.Bytes()
+}
+
+// writeTestFile 在bucket目录中写入文件
+func writeTestFile(t *testing.T, bucket, key string, content []byte) {
+	t.Helper()
+	path := filepath.Join(bucket, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile 读取bucket目录中的文件
+func readTestFile(t *testing.T, bucket, key string) []byte {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(bucket, filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatalf("read %s failed: %v", key, err)
+	}
+
+	return content
+}
+
+// createdRecord 本地文件的上传事件, 与S3通知一样key经过URL编码, 记录文件当前的ETag和大小
+func createdRecord(t *testing.T, s *Imaging, bucket, key string) events.S3EventRecord {
+	t.Helper()
+	record := events.S3EventRecord{EventSource: "aws:s3", EventName: "ObjectCreated:Put"}
+	record.S3.Bucket.Name = bucket
+	record.S3.Object.Key = url.QueryEscape(key)
+
+	info, err := s.store.Head(context.Background(), bucket, key)
+	if err != nil {
+		t.Fatalf("head %s failed: %v", key, err)
+	}
+	record.S3.Object.ETag, record.S3.Object.Size = info.ETag, info.Size
+
+	return record
+}
@@ -0,0 +1,69 @@
+package jpegscale
+
+import (
+	"math"
+)
+
+// scaledCos4 holds the basis functions C(u) * cos((2x+1)uπ/8) of a 4-point
+// inverse DCT as Q12 fixed point numbers, indexed by [x*4+u].
+var scaledCos4 = func() (table [16]int32) {
+	for x := 0; x < 4; x++ {
+		for u := 0; u < 4; u++ {
+			c := 1.0
+			if u == 0 {
+				c = math.Sqrt2 / 2
+			}
+			table[x*4+u] = int32(math.Round(4096 * c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/8)))
+		}
+	}
+	return table
+}()
+
+// scaledIDCT computes an n×n block of pixels from the lowest n×n frequencies
+// of the dequantized coefficients in b, which approximates an 8×8 inverse DCT
+// followed by an 8/n box downsample. The coefficients keep the normalization
+// of the full 8-point transform, so each output is
+// 1/4 ΣΣ C(u)C(v) F(v,u) cos((2x+1)uπ/2n) cos((2y+1)vπ/2n).
+//
+// The results are written to the top left n×n entries of b, at the same
+// level as the outputs of idct.
+func scaledIDCT(b *block, n int) {
+	switch n {
+	case 1:
+		// Only the DC coefficient contributes, and it is 8 times the mean.
+		b[0] = (b[0] + 4) >> 3
+	case 2:
+		// Every 2-point basis function is ±1/√2, so each output is a signed
+		// sum of the four coefficients divided by 8.
+		f00, f01, f10, f11 := b[0], b[1], b[8], b[9]
+		b[0] = (f00 + f01 + f10 + f11 + 4) >> 3
+		b[1] = (f00 - f01 + f10 - f11 + 4) >> 3
+		b[8] = (f00 + f01 - f10 - f11 + 4) >> 3
+		b[9] = (f00 - f01 - f10 + f11 + 4) >> 3
+	case 4:
+		scaledIDCT4(b)
+	}
+}
+
+// scaledIDCT4 is scaledIDCT for n == 4.
+func scaledIDCT4(b *block) {
+	table := &scaledCos4
+
+	// Rows first: tmp[v*4+x] is the 1D inverse transform of row v, in Q12.
+	var tmp [16]int32
+	for v := 0; v < 4; v++ {
+		f0, f1, f2, f3 := b[v*8], b[v*8+1], b[v*8+2], b[v*8+3]
+		for x := 0; x < 4; x++ {
+			tmp[v*4+x] = table[x*4]*f0 + table[x*4+1]*f1 + table[x*4+2]*f2 + table[x*4+3]*f3
+		}
+	}
+
+	// Then columns, in Q24, and divide by 4 with rounding.
+	for y := 0; y < 4; y++ {
+		t0, t1, t2, t3 := int64(table[y*4]), int64(table[y*4+1]), int64(table[y*4+2]), int64(table[y*4+3])
+		for x := 0; x < 4; x++ {
+			sum := t0*int64(tmp[x]) + t1*int64(tmp[4+x]) + t2*int64(tmp[8+x]) + t3*int64(tmp[12+x])
+			b[y*8+x] = int32((sum + 1<<25) >> 26)
+		}
+	}
+}
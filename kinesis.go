@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// KinesisEvent 处理S3通知经过Kinesis数据流投递的记录, 返回值与SQS的批量处理结果格式相同, 事件源映射需要开启ReportBatchItemFailures
+// Lambda从返回的最小序列号开始重新投递, 所以只返回第一条失败的记录, 之后的记录不再处理
+// 按KinesisBatchSize分批依次处理, 剩余时间不足时返回下一批的第一条记录, 已经处理的记录不会重新投递
+func (s Imaging) KinesisEvent(ctx context.Context, kinesisEvent events.KinesisEvent) SQSBatchResponse {
+	var records []events.S3EventRecord
+	var sequenceNumbers []string
+	var unparsed []RecordResult
+	response := SQSBatchResponse{BatchItemFailures: []SQSBatchItemFailure{}}
+
+	for _, record := range kinesisEvent.Records {
+		// 无法解析的记录重试也不会成功, 跳过以免阻塞整个分片, 在报告中记为失败
+		s3Event, err := parseS3Notification(string(record.Kinesis.Data))
+		if err != nil {
+			logger.ErrorContext(ctx, "Parse record failed", "sequenceNumber", record.Kinesis.SequenceNumber, "error", err)
+			unparsed = append(unparsed, unparsedResult(eventSourceKinesis, record.Kinesis.SequenceNumber, err))
+			continue
+		}
+
+		if len(s3Event.Records) == 0 {
+			logger.InfoContext(ctx, "Ignore record without records", "sequenceNumber", record.Kinesis.SequenceNumber)
+			continue
+		}
+
+		for _, s3Record := range s3Event.Records {
+			records = append(records, s3Record)
+			sequenceNumbers = append(sequenceNumbers, record.Kinesis.SequenceNumber)
+		}
+	}
+
+	batchSize := s.config.KinesisBatchSize
+	if batchSize <= 0 {
+		batchSize = len(records)
+	}
+
+	var results []RecordResult
+	var batchDuration time.Duration
+	for start := 0; start < len(records); start += batchSize {
+		// 按上一批的耗时估计下一批, 剩余时间不足时让Lambda从这里继续
+		if s.batchTimeShort(ctx, batchDuration) {
+			logger.WarnContext(ctx, "Checkpoint records near deadline", "sequenceNumber", sequenceNumbers[start], "remaining", len(records)-start)
+			response.BatchItemFailures = append(response.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: sequenceNumbers[start]})
+			break
+		}
+
+		end := start + batchSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		batchStart := time.Now()
+		batchResults := s.processRecords(ctx, records[start:end])
+		batchDuration = time.Since(batchStart)
+		results = append(results, batchResults...)
+
+		if failed := firstFailure(batchResults); failed >= 0 {
+			response.BatchItemFailures = append(response.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: sequenceNumbers[start+failed]})
+			break
+		}
+	}
+
+	s.logReport(ctx, append(results, unparsed...))
+	logger.InfoContext(ctx, "Process stream records", "records", len(kinesisEvent.Records), "processed", len(results), "unparsed", len(unparsed), "failures", len(response.BatchItemFailures))
+	return response
+}
+
+// firstFailure 第一条处理失败的记录, 全部成功时返回-1
+func firstFailure(results []RecordResult) int {
+	for index, result := range results {
+		if result.Err() != nil {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// FirehoseEvent 处理Firehose数据转换中的S3通知, 原样返回记录内容, 处理失败的记录标记为ProcessingFailed
+// Firehose不会重试转换失败的记录, 这些记录写入目标的错误前缀, 需要从那里重新投递
+func (s Imaging) FirehoseEvent(ctx context.Context, firehoseEvent events.KinesisFirehoseEvent) events.KinesisFirehoseResponse {
+	var records []events.S3EventRecord
+	var recordIndexes []int
+	var unparsed []RecordResult
+	response := events.KinesisFirehoseResponse{Records: make([]events.KinesisFirehoseResponseRecord, len(firehoseEvent.Records))}
+
+	for index, record := range firehoseEvent.Records {
+		response.Records[index] = events.KinesisFirehoseResponseRecord{
+			RecordID: record.RecordID,
+			Result:   events.KinesisFirehoseTransformedStateOk,
+			Data:     record.Data,
+		}
+
+		s3Event, err := parseS3Notification(string(record.Data))
+		if err != nil {
+			logger.ErrorContext(ctx, "Parse record failed", "recordId", record.RecordID, "error", err)
+			response.Records[index].Result = events.KinesisFirehoseTransformedStateProcessingFailed
+			unparsed = append(unparsed, unparsedResult(eventSourceFirehose, record.RecordID, err))
+			continue
+		}
+
+		for _, s3Record := range s3Event.Records {
+			records = append(records, s3Record)
+			recordIndexes = append(recordIndexes, index)
+		}
+	}
+
+	// 一条记录可能包含多条S3记录, 任意一条失败都标记整条记录
+	results := s.processRecords(ctx, records)
+	for index, result := range results {
+		if result.Err() != nil {
+			response.Records[recordIndexes[index]].Result = events.KinesisFirehoseTransformedStateProcessingFailed
+		}
+	}
+
+	var failures int
+	for _, record := range response.Records {
+		if record.Result == events.KinesisFirehoseTransformedStateProcessingFailed {
+			failures++
+		}
+	}
+
+	s.logReport(ctx, append(results, unparsed...))
+	logger.InfoContext(ctx, "Process delivery stream records", "records", len(firehoseEvent.Records), "failures", failures)
+	return response
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// notificationTestRecords 本地原图的上传通知和一条无法解析的通知
+func notificationTestRecords(t *testing.T) (*Imaging, []byte) {
+	t.Helper()
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "50x50", "ErrorMode": ErrorModeAny})
+	s.prometheus = newPromMetrics()
+
+	writeTestFile(t, bucket, "a.jpg", testJPEG(t, 120, 90))
+	notification, err := json.Marshal(events.S3Event{Records: []events.S3EventRecord{createdRecord(t, s, bucket, "a.jpg")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, notification
+}
+
+// reportedRecords 报告中各状态的记录数
+func reportedRecords(s *Imaging) map[string]float64 {
+	s.prometheus.mutex.Lock()
+	defer s.prometheus.mutex.Unlock()
+
+	records := make(map[string]float64)
+	for status, count := range s.prometheus.records {
+		records[status] = count
+	}
+
+	return records
+}
+
+func TestKinesisEventReportsUnparsedRecords(t *testing.T) {
+	s, notification := notificationTestRecords(t)
+
+	var event events.KinesisEvent
+	for index, data := range [][]byte{[]byte("not json"), notification} {
+		var record events.KinesisEventRecord
+		record.EventSource = eventSourceKinesis
+		record.Kinesis.SequenceNumber = strings.Repeat("1", index+1)
+		record.Kinesis.Data = data
+		event.Records = append(event.Records, record)
+	}
+
+	// 无法解析的记录不阻塞分片, 但是计入报告
+	response := s.KinesisEvent(context.Background(), event)
+	if len(response.BatchItemFailures) != 0 {
+		t.Errorf("batch item failures are %v, want none", response.BatchItemFailures)
+	}
+	if records := reportedRecords(s); records[StatusFailed] != 1 || records[StatusSucceeded] != 1 {
+		t.Errorf("reported records are %v, want 1 failed and 1 succeeded", records)
+	}
+}
+
+func TestFirehoseEventReportsUnparsedRecords(t *testing.T) {
+	s, notification := notificationTestRecords(t)
+
+	event := events.KinesisFirehoseEvent{Records: []events.KinesisFirehoseEventRecord{
+		{RecordID: "bad", Data: []byte("not json")},
+		{RecordID: "good", Data: notification},
+	}}
+	response := s.FirehoseEvent(context.Background(), event)
+	if response.Records[0].Result != events.KinesisFirehoseTransformedStateProcessingFailed || response.Records[1].Result != events.KinesisFirehoseTransformedStateOk {
+		t.Errorf("firehose results are %s and %s", response.Records[0].Result, response.Records[1].Result)
+	}
+	if records := reportedRecords(s); records[StatusFailed] != 1 || records[StatusSucceeded] != 1 {
+		t.Errorf("reported records are %v, want 1 failed and 1 succeeded", records)
+	}
+}
+
+func TestSNSEventReportsUnparsedNotifications(t *testing.T) {
+	s, notification := notificationTestRecords(t)
+
+	event := events.SNSEvent{Records: []events.SNSEventRecord{
+		{EventSource: eventSourceSNS, SNS: events.SNSEntity{MessageID: "bad", Message: "not json"}},
+		{EventSource: eventSourceSNS, SNS: events.SNSEntity{MessageID: "good", Message: string(notification)}},
+	}}
+	report, err := s.SNSEvent(context.Background(), event)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 records failed") {
+		t.Errorf("sns event returned error %v, want 1 of 2 records failed", err)
+	}
+	if report.Failed != 1 || report.Succeeded != 1 {
+		t.Fatalf("report is %d failed and %d succeeded", report.Failed, report.Succeeded)
+	}
+
+	unparsed := report.Records[1]
+	if unparsed.Code != errorCodeUnparsed || unparsed.Event != eventSourceSNS || !strings.Contains(unparsed.Error, "parse notification bad failed") {
+		t.Errorf("unparsed record is %+v", unparsed)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// ledgerProcessing 正在处理
+	ledgerProcessing = "processing"
+	// ledgerLease 超过该时间仍在处理的记录视为调用已中断, 可以重新处理
+	ledgerLease = 15 * time.Minute
+)
+
+// ledgerID 台账中原图的id
+func ledgerID(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// claimLedger 在台账中登记开始处理, 同一ETag的原图已经成功处理或者正在处理时返回false
+// 没有ETag的事件和删除事件无法判断是否重复, 总是处理
+func (s Imaging) claimLedger(ctx context.Context, result *RecordResult) (bool, error) {
+	if s.dynamodb == nil {
+		return true, nil
+	}
+
+	now := time.Now()
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.config.LedgerTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(ledgerID(result.Bucket, result.Key))},
+		},
+		UpdateExpression: aws.String("SET #bucket = :bucket, #key = :key, #etag = :etag, #event = :event, #status = :processing, " +
+			"startedAt = :now, createdAt = if_not_exists(createdAt, :now) ADD attempts :one REMOVE #error"),
+		ExpressionAttributeNames: map[string]*string{
+			"#bucket": aws.String("bucket"),
+			"#key":    aws.String("key"),
+			"#etag":   aws.String("etag"),
+			"#event":  aws.String("event"),
+			"#status": aws.String("status"),
+			"#error":  aws.String("error"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":bucket":     {S: aws.String(result.Bucket)},
+			":key":        {S: aws.String(result.Key)},
+			":etag":       {S: aws.String(result.etag)},
+			":event":      {S: aws.String(result.Event)},
+			":processing": {S: aws.String(ledgerProcessing)},
+			":now":        {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			":one":        {N: aws.String("1")},
+		},
+	}
+
+	if result.etag != "" && !strings.HasPrefix(result.Event, "ObjectRemoved:") {
+		// 新的原图, 其他版本的原图, 上次失败, 或者上次处理已超时
+		input.ConditionExpression = aws.String("attribute_not_exists(id) OR #etag <> :etag OR #status = :failed OR " +
+			"(#status = :processing AND startedAt < :expired)")
+		input.ExpressionAttributeValues[":failed"] = &dynamodb.AttributeValue{S: aws.String(StatusFailed)}
+		input.ExpressionAttributeValues[":expired"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(-ledgerLease).Unix(), 10))}
+	}
+
+	_, err := s.dynamodb.UpdateItemWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	result.claimed = true
+	return true, nil
+}
+
+// completeLedger 在台账中记录处理结果, 原图已被新版本覆盖时不更新
+func (s Imaging) completeLedger(ctx context.Context, result *RecordResult) {
+	if s.dynamodb == nil || !result.claimed {
+		return
+	}
+
+	var sizes []*dynamodb.AttributeValue
+	for _, size := range result.Sizes {
+		sizes = append(sizes, &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+			"size":   {S: aws.String(size.Size)},
+			"key":    {S: aws.String(size.Key)},
+			"status": {S: aws.String(size.Status)},
+		}})
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":etag":       {S: aws.String(result.etag)},
+		":status":     {S: aws.String(result.Status)},
+		":sizes":      {L: sizes},
+		":now":        {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		":durationMs": {N: aws.String(strconv.FormatInt(result.DurationMs, 10))},
+	}
+	expression := "SET #status = :status, sizes = :sizes, finishedAt = :now, durationMs = :durationMs"
+	if result.Error != "" {
+		values[":error"] = &dynamodb.AttributeValue{S: aws.String(result.Error)}
+		expression += ", #error = :error"
+	} else {
+		expression += " REMOVE #error"
+	}
+
+	_, err := s.dynamodb.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.config.LedgerTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(ledgerID(result.Bucket, result.Key))},
+		},
+		UpdateExpression:    aws.String(expression),
+		ConditionExpression: aws.String("#etag = :etag"),
+		ExpressionAttributeNames: map[string]*string{
+			"#etag":   aws.String("etag"),
+			"#status": aws.String("status"),
+			"#error":  aws.String("error"),
+		},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Update ledger failed", "error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ImageTooLargeError 原图超过了配置的大小限制, 重试也不会成功
+type ImageTooLargeError struct {
+	Key    string
+	Reason string
+}
+
+// Error 实现error
+func (e *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image too large: %s %s", e.Key, e.Reason)
+}
+
+// isTooLarge 是否是原图过大的错误
+func isTooLarge(err error) bool {
+	_, ok := err.(*ImageTooLargeError)
+	return ok
+}
+
+// checkObjectSize 在下载前按事件或者对象的字节数检查原图, 未知大小时不检查
+func (s Imaging) checkObjectSize(key string, size int64) error {
+	if s.config.MaxObjectSize > 0 && size > s.config.MaxObjectSize {
+		return &ImageTooLargeError{Key: key, Reason: fmt.Sprintf("is %d bytes, limit is %d bytes", size, s.config.MaxObjectSize)}
+	}
+
+	return nil
+}
+
+// checkPixels 在完整解码前按图像头中的尺寸检查原图
+func (s Imaging) checkPixels(key string, width, height int) error {
+	if s.config.MaxPixels > 0 && int64(width)*int64(height) > s.config.MaxPixels {
+		return &ImageTooLargeError{Key: key, Reason: fmt.Sprintf("is %dx%d pixels, limit is %d pixels", width, height, s.config.MaxPixels)}
+	}
+
+	return nil
+}
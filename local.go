@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStore 基于本地文件系统的对象存储, bucket对应目录, key对应相对路径
+// 文件系统不保存元数据和标签, 写入时会被忽略
+type LocalStore struct{}
+
+// NewLocalStore 新建本地存储
+func NewLocalStore() *LocalStore {
+	return &LocalStore{}
+}
+
+// Get 读取文件
+func (s *LocalStore) Get(ctx context.Context, bucket, key string) (*Object, error) {
+	info, err := s.Head(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(s.path(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{ObjectInfo: *info, Body: file}, nil
+}
+
+// Head 读取文件信息
+func (s *LocalStore) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	stat, err := os.Stat(s.path(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+
+	// 本地文件没有ETag, 按修改时间和大小生成, 文件改变时随之改变
+	etag := fnv.New64a()
+	fmt.Fprintf(etag, "%d-%d", stat.ModTime().UnixNano(), stat.Size())
+
+	return &ObjectInfo{
+		ETag:        fmt.Sprintf("%016x", etag.Sum64()),
+		Size:        stat.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		Metadata:    map[string]string{},
+	}, nil
+}
+
+// Put 写入文件, 先写临时文件再重命名, 避免留下不完整的缩略图
+func (s *LocalStore) Put(ctx context.Context, bucket, key string, body io.Reader, options PutOptions) error {
+	path := s.path(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, body); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return os.Rename(temp, path)
+}
+
+// Delete 删除文件
+func (s *LocalStore) Delete(ctx context.Context, bucket, key string) error {
+	err := os.Remove(s.path(bucket, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// List 遍历bucket目录, 按key的顺序列出前缀下的文件, 忽略写入中的临时文件
+func (s *LocalStore) List(ctx context.Context, bucket, prefix, startAfter string, limit int) ([]string, bool, error) {
+	var keys []string
+	err := filepath.Walk(bucket, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+
+		relative, err := filepath.Rel(bucket, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(relative); strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Strings(keys)
+
+	if len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+
+	return keys, false, nil
+}
+
+// path 文件路径
+func (s *LocalStore) path(bucket, key string) string {
+	return filepath.Join(bucket, filepath.FromSlash(key))
+}
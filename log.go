@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+var (
+	// logLevel 日志级别, 读取配置时设置
+	logLevel = new(slog.LevelVar)
+	// logger 输出到标准输出的JSON日志
+	logger = slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})})
+)
+
+// logAttrsKey context中日志字段的key
+type logAttrsKey struct{}
+
+// withLogAttrs 返回携带日志字段的context, 之后使用该context输出的日志都包含这些字段
+func withLogAttrs(ctx context.Context, args ...interface{}) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]interface{})
+	merged := make([]interface{}, 0, len(attrs)+len(args))
+
+	return context.WithValue(ctx, logAttrsKey{}, append(append(merged, attrs...), args...))
+}
+
+// resetLogAttrs 返回只携带args日志字段的context, 处理一条记录时处理其他记录, 不携带当前记录的字段
+func resetLogAttrs(ctx context.Context, args ...interface{}) context.Context {
+	return context.WithValue(ctx, logAttrsKey{}, args)
+}
+
+// contextHandler 为日志补充Lambda请求ID和context中的字段
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle 实现slog.Handler
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		record.AddAttrs(slog.String("requestId", lc.AwsRequestID))
+	}
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]interface{}); ok {
+		record.Add(attrs...)
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs 实现slog.Handler
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup 实现slog.Handler
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// parseLogLevel 解析日志级别, 支持debug, info, warn和error
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(value))); err != nil {
+		return level, fmt.Errorf("log level %s is invalid", value)
+	}
+
+	return level, nil
+}
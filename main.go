@@ -3,9 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -14,249 +26,2837 @@ import (
 	"time"
 
 	"image/jpeg"
+	"image/png"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/rekognition"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sns"
 
 	"github.com/nfnt/resize"
+	"github.com/nzai/resize/pkg/naming"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+const (
+	// envFile 随部署包发布的配置文件
+	envFile = "resize.env"
+
+	// ErrorModeIgnore 忽略处理失败的记录
+	ErrorModeIgnore = "ignore"
+	// ErrorModeAny 任意记录失败时返回错误
+	ErrorModeAny = "any"
+	// ErrorModeAll 全部记录失败时返回错误
+	ErrorModeAll = "all"
 )
 
 var (
 	sizePattern = regexp.MustCompile("(\\d+)x(\\d+)")
+
+	// filters 支持的插值算法
+	filters = map[string]resize.InterpolationFunction{
+		"nearestneighbor": resize.NearestNeighbor,
+		"bilinear":        resize.Bilinear,
+		"bicubic":         resize.Bicubic,
+		"lanczos2":        resize.Lanczos2,
+		"lanczos3":        resize.Lanczos3,
+	}
 )
 
-func main() {
+func main() {
+
+	info := buildInfo()
+	logger.Info("Start", "version", info.Version, "commit", info.Commit, "backends", strings.Join(info.Backends, ","), "decoders", strings.Join(info.Decoders, ","), "encoders", strings.Join(info.Encoders, ","))
+	// 带参数运行时处理本地目录, serve参数启动HTTP服务, backfill参数按S3 Inventory清单回填, version参数输出版本
+	if len(os.Args) > 1 {
+		run, args := runCLI, os.Args[1:]
+		switch args[0] {
+		case "serve":
+			run, args = runServe, args[1:]
+		case "backfill":
+			run, args = runBackfill, args[1:]
+		case "version":
+			run, args = runVersion, args[1:]
+		}
+		if err := run(args); err != nil {
+			logger.Error("Run failed", "error", err)
+			os.Exit(1)
+		}
+
+		logger.Info("End")
+		return
+	}
+
+	// Lambda@Edge不支持环境变量, 配置随部署包一起发布
+	if err := loadEnvFile(envFile); err != nil {
+		logger.Error("Load env file failed", "file", envFile, "error", err)
+		return
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		logger.Error("Read config failed", "error", err)
+		return
+	}
+
+	if config.Storage == StorageLocal {
+		logger.Error("Storage is only supported in command line mode", "storage", config.Storage)
+		return
+	}
+
+	imaging, err := newImaging(context.Background(), config)
+	if err != nil {
+		logger.Error("Create imaging failed", "error", err)
+		return
+	}
+
+	// 处理事件
+	switch config.Storage {
+	case StorageGCS:
+		// Cloud Run和Cloud Functions通过HTTP推送事件
+		imaging.prometheus = newPromMetrics()
+		logger.Info("Listen", "port", config.Port)
+		if err = http.ListenAndServe(":"+config.Port, serveMux(imaging.prometheus, imaging.GCSEvent)); err != nil {
+			logger.Error("Serve failed", "error", err)
+		}
+	case StorageAzure:
+		// Event Grid webhook或者Azure Functions自定义处理程序
+		imaging.prometheus = newPromMetrics()
+		logger.Info("Listen", "port", config.Port)
+		if err = http.ListenAndServe(":"+config.Port, serveMux(imaging.prometheus, imaging.AzureEvent)); err != nil {
+			logger.Error("Serve failed", "error", err)
+		}
+	default:
+		if config.ConfigRefreshInterval > 0 {
+			handler := &refreshingHandler{imaging: imaging, expires: time.Now().Add(config.ConfigRefreshInterval)}
+			lambda.Start(handler.Handle)
+			break
+		}
+		lambda.Start(imaging.Handle)
+	}
+
+	logger.Info("End")
+}
+
+// newImaging 按配置的存储服务新建图片处理并加载水印
+func newImaging(ctx context.Context, config *Config) (*Imaging, error) {
+	var imaging *Imaging
+	switch config.Storage {
+	case StorageGCS:
+		imaging = NewImaging(config, NewGCSStore(config))
+	case StorageLocal:
+		imaging = NewImaging(config, NewLocalStore())
+	case StorageAzure:
+		store, err := NewAzureStore(config)
+		if err != nil {
+			return nil, fmt.Errorf("create azure store failed due to %v", err)
+		}
+		imaging = NewImaging(config, store)
+	default:
+		var err error
+		imaging, err = newS3Imaging(config)
+		if err != nil {
+			return nil, fmt.Errorf("create aws session failed due to %v", err)
+		}
+	}
+
+	// 加载水印
+	if err := imaging.loadWatermark(ctx); err != nil {
+		return nil, fmt.Errorf("load watermark %s failed due to %v", config.Watermark, err)
+	}
+	if err := imaging.loadTenantWatermarks(ctx); err != nil {
+		return nil, fmt.Errorf("load tenant watermark failed due to %v", err)
+	}
+
+	return imaging, nil
+}
+
+// newS3Imaging 新建使用S3存储的图片处理
+func newS3Imaging(config *Config) (*Imaging, error) {
+	// 初始化s3 client, 未配置访问密钥时使用默认的凭证链(Lambda执行角色)
+	awsConfig := aws.NewConfig().WithRegion(config.Region).WithMaxRetries(config.MaxRetry)
+	if config.AccessKeyID != "" && config.SecretAccessKey != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentialsFromCreds(credentials.Value{AccessKeyID: config.AccessKeyID, SecretAccessKey: config.SecretAccessKey}))
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if config.Tracing {
+		instrumentHandlers(&sess.Handlers)
+	}
+	// S3兼容存储(MinIO, Ceph RGW, LocalStack)需要自定义endpoint和路径风格
+	s3Config := aws.NewConfig().WithS3ForcePathStyle(config.S3ForcePathStyle)
+	if config.S3Endpoint != "" {
+		s3Config = s3Config.WithEndpoint(config.S3Endpoint)
+	}
+
+	// 源和目标bucket的请求共用同一个限速
+	limitS3Requests(&sess.Handlers, config)
+
+	imaging := NewImaging(config, NewS3Store(config, s3.New(sess, s3Config)))
+	if config.anyBucket(func(c *Config) bool { return c.FaceDetection || c.Moderation }) {
+		imaging.rekognition = rekognition.New(sess)
+	}
+	// 试运行不发送通知, 也不记录处理结果, 以免影响正式的处理
+	if !config.DryRun && config.anyBucket(func(c *Config) bool { return c.NotificationTopicArn != "" }) {
+		imaging.sns = sns.New(sess)
+	}
+	if !config.DryRun && (config.SavingsTable != "" || config.anyBucket(func(c *Config) bool { return c.LedgerTable != "" })) {
+		imaging.dynamodb = dynamodb.New(sess)
+	}
+
+	// 缩略图保存到其他账号的bucket时, 扮演该账号的角色写入
+	if config.DestinationRoleArn != "" {
+		imaging.destination = newDestinationStore(config, NewS3Store(config, s3.New(sess, s3Config.Copy().WithCredentials(stscreds.NewCredentials(sess, config.DestinationRoleArn)))))
+	}
+
+	// 每个副本区域单独的客户端, 与缩略图使用相同的凭证
+	for _, region := range replicaRegions(config) {
+		if imaging.replicas == nil {
+			imaging.replicas = make(map[string]ObjectStore)
+		}
+		replicaConfig := s3Config.Copy().WithRegion(region)
+		if config.DestinationRoleArn != "" {
+			replicaConfig = replicaConfig.WithCredentials(stscreds.NewCredentials(sess, config.DestinationRoleArn))
+		}
+		imaging.replicas[region] = newDestinationStore(config, NewS3Store(config, s3.New(sess, replicaConfig)))
+	}
+
+	return imaging, nil
+}
+
+// Config 配置
+type Config struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+	MaxRetry        int
+	Sizes           []Size
+	// PrefixSizes 指定前缀下的原图使用的尺寸
+	PrefixSizes   []PrefixSizes
+	Filter        resize.InterpolationFunction
+	Gravity       pipeline.Gravity
+	Transform     pipeline.Transform
+	FaceDetection bool
+	Background    color.Color
+	NoUpscale     string
+
+	Watermark         string
+	WatermarkPosition string
+	WatermarkOpacity  float64
+	WatermarkMargin   int
+
+	Sharpen pipeline.Sharpen
+	// Pipeline 解码之后和编码之前依次执行的步骤, 默认orient,crop,resize,normalize,sharpen,effect,watermark
+	Pipeline []string
+
+	BlurHash           bool
+	BlurHashComponents image.Point
+	DominantColor      bool
+
+	DestinationBucket string
+	DestinationPrefix string
+	// DestinationRoleArn 写入缩略图时扮演的角色, 用于跨账号写入
+	DestinationRoleArn string
+	KeyTemplate        string
+	SkipExisting       bool
+	// Manifest 在缩略图旁边写入列出所有尺寸的清单文件, 如photo.jpg.manifest.json
+	Manifest bool
+	// Sidecar 在缩略图旁边写入原图的尺寸, 格式, 大小和EXIF信息, 如photo.jpg.metadata.json
+	Sidecar bool
+	// DerivativeInventory 所有缩略图生成后在原图的元数据(metadata)或者标签(tags)中记录缩略图key和thumbnails=complete
+	DerivativeInventory string
+	// Replicas 同时写入缩略图副本的其他区域的bucket, 如eu-west-1:photos-eu, 副本的key与缩略图相同
+	Replicas []replicaBucket
+
+	KeyFilter naming.KeyFilter
+	// EventTypes 处理的事件类型, 默认为ObjectCreated:*和ObjectRemoved:*
+	EventTypes []string
+	// DerivedSuffixes 其他程序写入同一bucket的衍生文件的key后缀, 与去掉扩展名的key或者完整的key比较, 如_preview
+	DerivedSuffixes []string
+	// DerivedMetadata 衍生文件的元数据名称, 有任意一项时不当作原图处理
+	DerivedMetadata []string
+	// DerivedTags 衍生文件的标签名称, 有任意一项时不当作原图处理
+	DerivedTags []string
+
+	SSEAlgorithm string
+	KMSKeyID     string
+	// SSECustomerKey 读取原图和写入缩略图使用的SSE-C密钥, 解码后的32字节, 不能与SSEAlgorithm同时使用
+	SSECustomerKey string
+	StorageClass   string
+	Format         string
+	CacheControl   string
+	Expires        time.Duration
+	// PresignExpires 在通知, 回调和清单中附带缩略图的预签名地址, 为有效期, 最长7天
+	PresignExpires time.Duration
+
+	CopyTags      bool
+	ThumbnailTags map[string]string
+	// OptOut 原图的元数据或者标签中包含其中任意一项时不生成缩略图, 如no-thumbnail=true
+	OptOut    map[string]string
+	ObjectACL string
+	PartSize  int64
+	// CorruptTags 空的和不完整的原图添加的标签, 如thumbnail-status=corrupt
+	CorruptTags map[string]string
+	// PreserveExif 在jpeg缩略图中保留原图的EXIF, 不包括原图中的缩略图
+	PreserveExif bool
+	// StripSensitiveExif 保留EXIF时删除GPS位置, 机身和镜头序列号, 所有者和厂商注释
+	StripSensitiveExif bool
+	// RegenerateMarker 重新生成的控制对象名称, 如.regenerate, 上传photos/album1/.regenerate时重新处理photos/album1/下的所有原图
+	RegenerateMarker string
+	// MetadataOverrides 原图元数据中的resize-sizes, resize-mode, resize-format和resize-quality覆盖配置的尺寸
+	MetadataOverrides bool
+
+	// Backend 缩放的实现, go或vips
+	Backend string
+	// DecodeScaling 缩略图远小于原图时按1/2, 1/4或1/8解码jpeg
+	DecodeScaling bool
+	// ChainResize 按尺寸从大到小逐级缩小, 每个尺寸从更大的中间图像生成
+	ChainResize bool
+
+	// SourceCacheSize 热启动时缓存解码后原图的最大字节数, 0表示不缓存
+	SourceCacheSize int64
+
+	// MaxObjectSize 原图的最大字节数, 0表示不限制
+	MaxObjectSize int64
+	// MaxPixels 原图的最大像素数, 0表示不限制
+	MaxPixels int64
+
+	DownloadThreshold   int64
+	DownloadPartSize    int64
+	DownloadConcurrency int
+
+	// MaxConcurrentImages 同时处理的原图数量, 0表示不限制
+	MaxConcurrentImages int
+	// MaxConcurrentSizes 每张原图同时生成的缩略图数量, 0表示不限制
+	MaxConcurrentSizes int
+	// KinesisBatchSize 依次处理Kinesis批次中的记录, 每次并行处理的记录数量, 出现失败后不再处理之后的记录, 0表示全部并行
+	KinesisBatchSize int
+	// MemorySize 可用内存, 单位MB, 默认为Lambda函数的内存, 用于计算未配置的MaxConcurrentImages和MaxPixels
+	MemorySize int64
+	// DownloadTimeout 下载原图的超时, 包括解码时读取剩余的内容, 0表示不限制
+	DownloadTimeout time.Duration
+	// DecodeTimeout 解码原图的超时, 超时后解码在后台继续运行直到结束
+	DecodeTimeout time.Duration
+	// ResizeTimeout 生成每个尺寸的超时, 只限制Go后端的缩小, 超时后缩小在后台继续运行直到结束
+	ResizeTimeout time.Duration
+	// UploadTimeout 写入每个尺寸的超时, 包括重试和副本
+	UploadTimeout time.Duration
+	// S3GetRate 每秒最多发出的S3读取请求(GetObject, HeadObject), 0表示不限制
+	S3GetRate float64
+	// S3PutRate 每秒最多发出的S3写入请求(PutObject, 分段上传, DeleteObject), 0表示不限制
+	S3PutRate float64
+
+	S3Endpoint       string
+	S3ForcePathStyle bool
+
+	// Storage 存储服务, s3, gcs, azure或local
+	Storage        string
+	Port           string
+	GCSEndpoint    string
+	GCSAccessToken string
+
+	AzureAccountName string
+	AzureAccountKey  string
+	AzureSASToken    string
+	AzureEndpoint    string
+
+	// SourceBucket 按需缩放读取原图的bucket, 为空时不支持按需缩放
+	SourceBucket  string
+	OnDemandSizes []Size
+	CacheResized  bool
+	MaxDimension  int
+
+	// ErrorMode 记录处理失败时是否返回错误, 默认any, ignore时失败的记录不会重试
+	ErrorMode string
+	// NotificationTopicArn 缩略图全部生成后发送通知的SNS主题
+	NotificationTopicArn string
+	// CallbackURL 处理完成或失败后回调的地址
+	CallbackURL    string
+	CallbackSecret string
+	CallbackRetry  int
+	// LedgerTable 记录处理结果的DynamoDB表, 分区键为字符串类型的id
+	LedgerTable string
+	// SavingsTable 按月和bucket累计原图和缩略图字节数的DynamoDB表, 分区键为字符串类型的id
+	SavingsTable string
+	// SavingsInterval 热启动时输出节省字节数汇总并写入SavingsTable的间隔, 0表示不汇总, 配置了SavingsTable时默认5m
+	// 汇总在间隔之后的下一次调用中进行, 没有调用时不会输出
+	SavingsInterval time.Duration
+
+	// Metrics 输出CloudWatch嵌入式指标
+	Metrics          bool
+	MetricsNamespace string
+	// Tracing 发送X-Ray跟踪, 需要函数开启主动跟踪
+	Tracing bool
+
+	// StorageRetry 读写对象遇到限流, 服务端错误或者刚写入的对象还读不到时的重试次数, 与SDK的MaxRetries分开
+	StorageRetry int
+	// PDF 为PDF文档的第一页生成缩略图, 需要安装poppler的pdftoppm
+	PDF         bool
+	PDFRenderer string
+	// SVG 为SVG矢量图生成缩略图, 需要安装librsvg的rsvg-convert
+	SVG         bool
+	SVGRenderer string
+	// Video 为mp4和mov视频截取一帧生成缩略图, 需要安装ffmpeg
+	Video         bool
+	VideoRenderer string
+	// PosterTime 截取的视频帧的时间点
+	PosterTime time.Duration
+	// RAW 为CR2, NEF, ARW和DNG文件使用内嵌的jpeg预览生成缩略图
+	RAW bool
+	// GIF 为gif图片生成缩略图, 动图的webp尺寸生成动画
+	GIF bool
+	// PNG 为png图片生成缩略图, 输出jpeg时透明部分合成到尺寸的背景色上
+	PNG bool
+	// PNGColors png缩略图调色板的颜色数量, 0表示保留全部颜色
+	PNGColors      int
+	PNGCompression png.CompressionLevel
+	// TIFF 为未压缩的8位和16位tiff图片生成缩略图, 16位图像按16位缩放, 编码时抖动为8位
+	TIFF bool
+	// OptimizeJPEG 上传前用jpegtran无损优化jpeg缩略图, 体积通常减小5%到15%
+	OptimizeJPEG  bool
+	JPEGOptimizer string
+	// StreamUpload 编码的同时上传缩略图, 不在内存中保留完整的编码结果, 需要优化, 写入EXIF或复制到副本的尺寸仍然先编码
+	StreamUpload bool
+
+	// Moderation 生成缩略图前用Rekognition审核原图, 未通过时只标记或隔离原图
+	Moderation           bool
+	ModerationConfidence float64
+	// QuarantineBucket 未通过审核的原图移动到的bucket, 为空时只添加标签
+	QuarantineBucket string
+
+	// DedupPrefix 去重索引的前缀, 按原图内容的哈希复制已经生成的缩略图, 为空时不去重
+	DedupPrefix string
+
+	// ArchivePrefix 所有缩略图生成成功后把原图复制到该前缀下, 为空时不复制
+	ArchivePrefix       string
+	ArchiveStorageClass string
+	// ArchiveTags 所有缩略图生成成功后为原图添加的标签, 供生命周期规则转换存储类别
+	ArchiveTags map[string]string
+
+	// DeadlineMargin 调用剩余时间不足时不再开始新的记录和尺寸, 0表示不检查
+	DeadlineMargin time.Duration
+
+	// DryRun 试运行, 照常读取和生成缩略图, 但只输出将要写入的对象
+	DryRun bool
+
+	// Buckets 单个bucket的配置, 未配置的bucket使用当前配置
+	Buckets map[string]*Config
+	// Tenants 租户的配置, 按TenantPrefixes或者bucket的TenantTag标签选择, 优先于bucket的配置
+	Tenants map[string]*Config
+	// TenantPrefixes 租户的原图所在的前缀, 只能在租户的配置中设置, 如Tenant.acme.TenantPrefixes=customers/acme/
+	TenantPrefixes []string
+	// TenantTag bucket标签的名称, 标签的值为bucket所属的租户, 没有匹配的前缀时使用
+	TenantTag string
+
+	// ConfigRefreshInterval 重新读取配置文件, Parameter Store和Secrets Manager的间隔, 0表示不刷新
+	ConfigRefreshInterval time.Duration
+}
+
+// readConfig 从环境变量中读取配置
+func readConfig() (*Config, error) {
+	// 结构化的配置文件, 环境变量覆盖其中的配置
+	fileConfig = nil
+	if location := os.Getenv("ConfigFile"); location != "" {
+		values, err := loadConfigFile(location)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables ConfigFile %s is invalid: %v", location, err)
+		}
+		fileConfig = values
+	}
+	values, err := loadRemoteConfig(fileConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables ConfigParameter or ConfigSecret is invalid: %v", err)
+	}
+	fileConfig = values
+
+	config, err := parseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// 订阅多个bucket时, 配置中bucket.Name形式的值只用于该bucket
+	for _, bucket := range configBuckets() {
+		configScope = bucket
+		bucketConfig, err := parseConfig()
+		configScope = ""
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %v", bucket, err)
+		}
+
+		if config.Buckets == nil {
+			config.Buckets = make(map[string]*Config)
+		}
+		config.Buckets[bucket] = bucketConfig
+	}
+
+	// 一个部署服务多个租户, 配置中Tenant.租户.Name形式的值只用于该租户
+	if err = readTenantConfigs(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// parseConfig 解析当前范围的配置
+func parseConfig() (*Config, error) {
+	accessKeyID := configValue("AccessKeyID")
+	secretAccessKey := configValue("SecretAccessKey")
+	region := configValue("Region")
+	if region == "" {
+		// Lambda运行环境会设置AWS_REGION
+		region = os.Getenv("AWS_REGION")
+	}
+
+	// 默认使用S3, 只有S3需要region
+	storage := strings.ToLower(configValue("Storage"))
+	if storage == "" {
+		storage = StorageS3
+	}
+	if storage != StorageS3 && storage != StorageGCS && storage != StorageAzure && storage != StorageLocal {
+		return nil, fmt.Errorf("Environment viriables Storage %s is invalid", storage)
+	}
+
+	// 各区域的CDN读取本区域的副本, 不需要对整个bucket开启跨区域复制
+	replicas, err := parseReplicas(configValue("Replicas"))
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables Replicas %s is invalid: %v", configValue("Replicas"), err)
+	}
+	if len(replicas) > 0 && storage != StorageS3 {
+		return nil, fmt.Errorf("Environment viriables Replicas requires Storage %s", StorageS3)
+	}
+
+	// Azure Blob使用共享密钥或者SAS令牌访问
+	azureAccountName := configValue("AzureAccountName")
+	if storage == StorageAzure && (azureAccountName == "" || (configValue("AzureAccountKey") == "" && configValue("AzureSASToken") == "")) {
+		return nil, fmt.Errorf("Environment viriables AzureAccountName and AzureAccountKey or AzureSASToken are required")
+	}
+
+	// Cloud Run通过PORT指定监听端口, Azure Functions自定义处理程序通过FUNCTIONS_CUSTOMHANDLER_PORT指定
+	port := os.Getenv("PORT")
+	if customHandlerPort := os.Getenv("FUNCTIONS_CUSTOMHANDLER_PORT"); customHandlerPort != "" {
+		port = customHandlerPort
+	}
+	if port == "" {
+		port = "8080"
+	}
+
+	sizeString := configValue("Sizes")
+	if (storage == StorageS3 && region == "") || sizeString == "" {
+		return nil, fmt.Errorf("Environment viriables is invalid")
+	}
+
+	// 访问密钥只用于本地测试, 需要同时配置
+	if (accessKeyID == "") != (secretAccessKey == "") {
+		return nil, fmt.Errorf("Environment viriables AccessKeyID and SecretAccessKey must be set together")
+	}
+
+	sizes, err := parseSizes(sizeString)
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables Sizes %s is invalid: %v", sizeString, err)
+	}
+
+	// 为每个尺寸生成@2x, @3x等高分辨率屏幕使用的版本
+	var ratios []int
+	if ratioString := configValue("PixelRatios"); ratioString != "" {
+		ratios, err = parsePixelRatios(ratioString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables PixelRatios %s is invalid", ratioString)
+		}
+		sizes = withPixelRatios(sizes, ratios)
+	}
+
+	// 指定前缀下的原图使用单独的尺寸, 没有匹配的前缀时使用Sizes
+	var prefixSizes []PrefixSizes
+	if prefixString := configValue("PrefixSizes"); prefixString != "" {
+		prefixSizes, err = parsePrefixSizes(prefixString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables PrefixSizes %s is invalid: %v", prefixString, err)
+		}
+		if ratios != nil {
+			for index := range prefixSizes {
+				prefixSizes[index].Sizes = withPixelRatios(prefixSizes[index].Sizes, ratios)
+			}
+		}
+	}
+
+	maxRetry, err := strconv.Atoi(configValue("MaxRetries"))
+	if err != nil {
+		maxRetry = 3
+	}
+
+	// 默认使用双线性插值
+	filter := resize.Bilinear
+	if filterString := configValue("Filter"); filterString != "" {
+		var found bool
+		filter, found = filters[strings.ToLower(filterString)]
+		if !found {
+			return nil, fmt.Errorf("Environment viriables Filter %s is invalid", filterString)
+		}
+	}
+
+	// 默认居中裁剪
+	gravity := pipeline.GravityCenter
+	if gravityString := configValue("Gravity"); gravityString != "" {
+		gravity, err = pipeline.ParseGravity(gravityString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables Gravity %s is invalid: %v", gravityString, err)
+		}
+	}
+
+	// 默认白色背景
+	var background color.Color = color.White
+	if backgroundString := configValue("Background"); backgroundString != "" {
+		background, err = parseColor(backgroundString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables Background %s is invalid: %v", backgroundString, err)
+		}
+	}
+
+	// 所有原图都需要旋转或翻转时统一配置, 如扫描件
+	var transform pipeline.Transform
+	if rotateString := configValue("Rotate"); rotateString != "" {
+		transform.Rotate, err = parseRotate(rotateString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables Rotate %s is invalid: %v", rotateString, err)
+		}
+	}
+	if flipString := configValue("Flip"); flipString != "" {
+		transform.FlipH, transform.FlipV, err = parseFlip(flipString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables Flip %s is invalid: %v", flipString, err)
+		}
+	}
+
+	// png缩略图默认不减少颜色, 使用默认的压缩级别
+	var pngColors int
+	if colorsString := configValue("PNGColors"); colorsString != "" {
+		pngColors, err = parseColors(colorsString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables PNGColors %s is invalid: %v", colorsString, err)
+		}
+	}
+	pngCompression := png.DefaultCompression
+	if compressionString := configValue("PNGCompression"); compressionString != "" {
+		pngCompression, err = parseCompression(compressionString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables PNGCompression %s is invalid: %v", compressionString, err)
+		}
+	}
+
+	for index := range sizes {
+		if sizes[index].Gravity.IsZero() {
+			sizes[index].Gravity = gravity
+		}
+		if sizes[index].Colors == 0 {
+			sizes[index].Colors = pngColors
+		}
+		if sizes[index].Compression == png.DefaultCompression {
+			sizes[index].Compression = pngCompression
+		}
+		if sizes[index].Background == nil {
+			sizes[index].Background = background
+		}
+		if sizes[index].Transform.IsZero() {
+			sizes[index].Transform = transform
+		}
+	}
+
+	// 人脸检测会增加延迟和费用, 需要显式开启
+	faceDetection := configValue("FaceDetection") == "true"
+
+	// 内容审核同样需要显式开启, 默认拒绝置信度不低于80%的审核标签
+	moderation := configValue("Moderation") == "true"
+	moderationConfidence := float64(defaultModerationConfidence)
+	if confidenceString := configValue("ModerationConfidence"); confidenceString != "" {
+		moderationConfidence, err = strconv.ParseFloat(confidenceString, 64)
+		if err != nil || moderationConfidence <= 0 || moderationConfidence > 100 {
+			return nil, fmt.Errorf("Environment viriables ModerationConfidence %s is invalid", confidenceString)
+		}
+	}
+
+	// 原图小于缩略图尺寸时, true表示限制为原图尺寸, skip表示跳过该尺寸
+	noUpscale := strings.ToLower(configValue("NoUpscale"))
+	if noUpscale != "" && noUpscale != "true" && noUpscale != "false" && noUpscale != "skip" {
+		return nil, fmt.Errorf("Environment viriables NoUpscale %s is invalid", noUpscale)
+	}
+
+	// 水印位置默认右下角, 不透明, 边距10像素
+	watermarkPosition := strings.ToLower(configValue("WatermarkPosition"))
+	if watermarkPosition == "" {
+		watermarkPosition = "bottom-right"
+	}
+	if !watermarkPositions[watermarkPosition] {
+		return nil, fmt.Errorf("Environment viriables WatermarkPosition %s is invalid", watermarkPosition)
+	}
+
+	watermarkOpacity := 1.0
+	if opacityString := configValue("WatermarkOpacity"); opacityString != "" {
+		watermarkOpacity, err = strconv.ParseFloat(opacityString, 64)
+		if err != nil || watermarkOpacity < 0 || watermarkOpacity > 1 {
+			return nil, fmt.Errorf("Environment viriables WatermarkOpacity %s is invalid", opacityString)
+		}
+	}
+
+	watermarkMargin := 10
+	if marginString := configValue("WatermarkMargin"); marginString != "" {
+		watermarkMargin, err = strconv.Atoi(marginString)
+		if err != nil || watermarkMargin < 0 {
+			return nil, fmt.Errorf("Environment viriables WatermarkMargin %s is invalid", marginString)
+		}
+	}
+
+	// 缩放后的锐化, 默认不锐化
+	var sharpen pipeline.Sharpen
+	if amountString := configValue("SharpenAmount"); amountString != "" {
+		sharpen.Amount, err = strconv.ParseFloat(amountString, 64)
+		if err != nil || sharpen.Amount < 0 {
+			return nil, fmt.Errorf("Environment viriables SharpenAmount %s is invalid", amountString)
+		}
+
+		sharpen.Radius = 1
+		if radiusString := configValue("SharpenRadius"); radiusString != "" {
+			sharpen.Radius, err = strconv.ParseFloat(radiusString, 64)
+			if err != nil || sharpen.Radius <= 0 {
+				return nil, fmt.Errorf("Environment viriables SharpenRadius %s is invalid", radiusString)
+			}
+		}
+	}
+
+	// 缩放前后的处理步骤, 默认与之前的处理顺序相同
+	pipelineString := configValue("Pipeline")
+	pipelineSteps, err := parsePipeline(pipelineString)
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables Pipeline %s is invalid: %v", pipelineString, err)
+	}
+
+	// BlurHash默认使用4x3个分量
+	blurHash := configValue("BlurHash") == "true"
+	blurHashComponents := image.Pt(4, 3)
+	if componentsString := configValue("BlurHashComponents"); componentsString != "" {
+		group := sizePattern.FindStringSubmatch(componentsString)
+		if len(group) != 3 || group[0] != componentsString {
+			return nil, fmt.Errorf("Environment viriables BlurHashComponents %s is invalid", componentsString)
+		}
+
+		blurHashComponents.X, _ = strconv.Atoi(group[1])
+		blurHashComponents.Y, _ = strconv.Atoi(group[2])
+		if blurHashComponents.X < 1 || blurHashComponents.X > 9 || blurHashComponents.Y < 1 || blurHashComponents.Y > 9 {
+			return nil, fmt.Errorf("Environment viriables BlurHashComponents %s is invalid", componentsString)
+		}
+	}
+
+	dominant := configValue("DominantColor") == "true"
+
+	// 缩略图key模板, 默认在原图文件名后追加_WxH
+	keyTemplate := configValue("KeyTemplate")
+	if err = naming.ValidateTemplate(keyTemplate); err != nil {
+		return nil, fmt.Errorf("Environment viriables KeyTemplate %s is invalid: %v", keyTemplate, err)
+	}
+
+	// 在原图上记录缩略图, 原地复制会产生新的版本, 不能用于按版本命名的缩略图
+	derivativeInventory := strings.ToLower(configValue("DerivativeInventory"))
+	if derivativeInventory != "" && derivativeInventory != DerivativeInventoryMetadata && derivativeInventory != DerivativeInventoryTags {
+		return nil, fmt.Errorf("Environment viriables DerivativeInventory %s is invalid", derivativeInventory)
+	}
+	if derivativeInventory == DerivativeInventoryMetadata && naming.Versioned(keyTemplate) {
+		return nil, fmt.Errorf("Environment viriables DerivativeInventory %s cannot be used with versioned KeyTemplate %s, use %s", derivativeInventory, keyTemplate, DerivativeInventoryTags)
+	}
+
+	keyFilter := naming.KeyFilter{
+		IncludePrefixes: parseList(configValue("IncludePrefixes")),
+		ExcludePrefixes: parseList(configValue("ExcludePrefixes")),
+		IncludeSuffixes: parseList(configValue("IncludeSuffixes")),
+		ExcludeSuffixes: parseList(configValue("ExcludeSuffixes")),
+	}
+
+	// 处理的事件类型, 如只处理ObjectCreated:Put和ObjectCreated:CompleteMultipartUpload
+	eventTypes, err := parseEventTypes(configValue("EventTypes"))
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables EventTypes %s is invalid: %v", configValue("EventTypes"), err)
+	}
+
+	// 缩略图的服务端加密, 支持AES256和aws:kms
+	sseAlgorithm, kmsKeyID := configValue("SSEAlgorithm"), configValue("KMSKeyID")
+	if sseAlgorithm != "" && sseAlgorithm != s3.ServerSideEncryptionAes256 && sseAlgorithm != s3.ServerSideEncryptionAwsKms {
+		return nil, fmt.Errorf("Environment viriables SSEAlgorithm %s is invalid", sseAlgorithm)
+	}
+	if kmsKeyID != "" && sseAlgorithm != s3.ServerSideEncryptionAwsKms {
+		return nil, fmt.Errorf("Environment viriables KMSKeyID requires SSEAlgorithm %s", s3.ServerSideEncryptionAwsKms)
+	}
+
+	// SSE-C的密钥为base64编码的256位密钥, 应该保存在ConfigSecret中而不是环境变量
+	var sseCustomerKey string
+	if keyString := configValue("SSECustomerKey"); keyString != "" {
+		key, err := base64.StdEncoding.DecodeString(keyString)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Environment viriables SSECustomerKey must be a base64 encoded 256-bit key")
+		}
+		if sseAlgorithm != "" {
+			return nil, fmt.Errorf("Environment viriables SSECustomerKey can not be used with SSEAlgorithm %s", sseAlgorithm)
+		}
+		// Rekognition直接读取S3中的原图, 无法读取SSE-C加密的对象
+		if faceDetection || moderation {
+			return nil, fmt.Errorf("Environment viriables SSECustomerKey can not be used with FaceDetection or Moderation")
+		}
+		sseCustomerKey = string(key)
+	}
+
+	// 默认使用标准存储
+	storageClass := s3.StorageClassStandard
+	if classString := configValue("StorageClass"); classString != "" {
+		storageClass, err = parseStorageClass(classString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables StorageClass %s is invalid: %v", classString, err)
+		}
+	}
+
+	// 默认输出jpeg
+	format := FormatJPEG
+	if formatString := configValue("Format"); formatString != "" {
+		format, err = parseFormat(formatString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables Format %s is invalid: %v", formatString, err)
+		}
+	}
+
+	for index := range sizes {
+		if sizes[index].StorageClass == "" {
+			sizes[index].StorageClass = storageClass
+		}
+		if sizes[index].Format == "" {
+			sizes[index].Format = format
+		}
+	}
+
+	// 缩略图预签名地址的有效期, SSE-C加密的缩略图读取时需要提供密钥, 无法使用预签名地址
+	var presignExpires time.Duration
+	if presignString := configValue("PresignExpires"); presignString != "" {
+		presignExpires, err = time.ParseDuration(presignString)
+		if err != nil || presignExpires <= 0 || presignExpires > maxPresignExpires {
+			return nil, fmt.Errorf("Environment viriables PresignExpires %s is invalid", presignString)
+		}
+		if sseCustomerKey != "" {
+			return nil, fmt.Errorf("Environment viriables PresignExpires cannot be used with SSECustomerKey")
+		}
+	}
+
+	// 缩略图的过期时间, 如720h
+	var expires time.Duration
+	if expiresString := configValue("Expires"); expiresString != "" {
+		expires, err = time.ParseDuration(expiresString)
+		if err != nil || expires <= 0 {
+			return nil, fmt.Errorf("Environment viriables Expires %s is invalid", expiresString)
+		}
+	}
+
+	// 渲染PDF需要pdftoppm, 可以配置为绝对路径
+	pdf := configValue("PDF") == "true"
+	pdfRenderer := configValue("PDFRenderer")
+	if pdfRenderer == "" {
+		pdfRenderer = defaultPDFRenderer
+	}
+	if pdf {
+		if _, err = exec.LookPath(pdfRenderer); err != nil {
+			return nil, fmt.Errorf("Environment viriables PDFRenderer %s is invalid: %v", pdfRenderer, err)
+		}
+	}
+
+	// 栅格化SVG需要rsvg-convert, 可以配置为绝对路径
+	svg := configValue("SVG") == "true"
+	svgRenderer := configValue("SVGRenderer")
+	if svgRenderer == "" {
+		svgRenderer = defaultSVGRenderer
+	}
+	if svg {
+		if _, err = exec.LookPath(svgRenderer); err != nil {
+			return nil, fmt.Errorf("Environment viriables SVGRenderer %s is invalid: %v", svgRenderer, err)
+		}
+	}
+
+	// 截取视频帧需要ffmpeg, 可以配置为绝对路径
+	video := configValue("Video") == "true"
+	videoRenderer := configValue("VideoRenderer")
+	if videoRenderer == "" {
+		videoRenderer = defaultVideoRenderer
+	}
+	if video {
+		if _, err = exec.LookPath(videoRenderer); err != nil {
+			return nil, fmt.Errorf("Environment viriables VideoRenderer %s is invalid: %v", videoRenderer, err)
+		}
+	}
+
+	// 无损优化jpeg缩略图需要jpegtran, 可以配置为绝对路径
+	optimizeJPEG := configValue("OptimizeJPEG") == "true"
+	jpegOptimizer := configValue("JPEGOptimizer")
+	if jpegOptimizer == "" {
+		jpegOptimizer = defaultJPEGOptimizer
+	}
+	if optimizeJPEG {
+		if _, err = exec.LookPath(jpegOptimizer); err != nil {
+			return nil, fmt.Errorf("Environment viriables JPEGOptimizer %s is invalid: %v", jpegOptimizer, err)
+		}
+	}
+
+	// 截取视频帧的时间点, 如1.5s
+	posterTime := defaultPosterTime
+	if timeString := configValue("PosterTime"); timeString != "" {
+		posterTime, err = time.ParseDuration(timeString)
+		if err != nil || posterTime < 0 {
+			return nil, fmt.Errorf("Environment viriables PosterTime %s is invalid", timeString)
+		}
+	}
+
+	storageRetry := 3
+	if retryString := configValue("StorageRetry"); retryString != "" {
+		storageRetry, err = strconv.Atoi(retryString)
+		if err != nil || storageRetry < 0 {
+			return nil, fmt.Errorf("Environment viriables StorageRetry %s is invalid", retryString)
+		}
+	}
+
+	// 调用超时前预留的时间, 如2s
+	deadlineMargin := defaultDeadlineMargin
+	if marginString := configValue("DeadlineMargin"); marginString != "" {
+		deadlineMargin, err = time.ParseDuration(marginString)
+		if err != nil || deadlineMargin < 0 {
+			return nil, fmt.Errorf("Environment viriables DeadlineMargin %s is invalid", marginString)
+		}
+	}
+
+	// 热启动时重新读取配置的间隔, 如5m
+	var configRefreshInterval time.Duration
+	if intervalString := os.Getenv("ConfigRefreshInterval"); intervalString != "" {
+		configRefreshInterval, err = time.ParseDuration(intervalString)
+		if err != nil || configRefreshInterval <= 0 {
+			return nil, fmt.Errorf("Environment viriables ConfigRefreshInterval %s is invalid", intervalString)
+		}
+	}
+
+	// 节省字节数汇总的间隔, 如1h, 按月汇总的表也按这个间隔批量写入
+	var savingsInterval time.Duration
+	if intervalString := configValue("SavingsInterval"); intervalString != "" {
+		savingsInterval, err = time.ParseDuration(intervalString)
+		if err != nil || savingsInterval <= 0 {
+			return nil, fmt.Errorf("Environment viriables SavingsInterval %s is invalid", intervalString)
+		}
+	} else if configValue("SavingsTable") != "" {
+		savingsInterval = defaultSavingsInterval
+	}
+
+	thumbnailTags, err := parseTags(configValue("ThumbnailTags"))
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables ThumbnailTags is invalid: %v", err)
+	}
+
+	// 归档副本默认使用低频访问的即时检索存储
+	archiveStorageClass := defaultArchiveStorageClass
+	if classString := configValue("ArchiveStorageClass"); classString != "" {
+		archiveStorageClass, err = parseStorageClass(classString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables ArchiveStorageClass %s is invalid: %v", classString, err)
+		}
+	}
+
+	archiveTags, err := parseTags(configValue("ArchiveTags"))
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables ArchiveTags is invalid: %v", err)
+	}
+
+	// 空的和不完整的原图添加的标签, 默认为thumbnail-status=corrupt, 为none时不添加
+	corruptTags := map[string]string{"thumbnail-status": "corrupt"}
+	if corruptString := configValue("CorruptTags"); corruptString == "none" {
+		corruptTags = nil
+	} else if corruptString != "" {
+		corruptTags, err = parseTags(corruptString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables CorruptTags is invalid: %v", err)
+		}
+	}
+
+	// 上传时可以通过元数据或者标签跳过生成缩略图
+	optOut, err := parseTags(configValue("OptOut"))
+	if err != nil {
+		return nil, fmt.Errorf("Environment viriables OptOut is invalid: %v", err)
+	}
+
+	// 缩略图的访问权限, 默认使用bucket的设置
+	objectACL := configValue("ObjectACL")
+	switch objectACL {
+	case "", s3.ObjectCannedACLPrivate, s3.ObjectCannedACLPublicRead, s3.ObjectCannedACLPublicReadWrite,
+		s3.ObjectCannedACLAuthenticatedRead, s3.ObjectCannedACLAwsExecRead,
+		s3.ObjectCannedACLBucketOwnerRead, s3.ObjectCannedACLBucketOwnerFullControl:
+	default:
+		return nil, fmt.Errorf("Environment viriables ObjectACL %s is invalid", objectACL)
+	}
+
+	// 分段上传的分段大小, 最小5MB
+	partSize := s3manager.DefaultUploadPartSize
+	if partSizeString := configValue("PartSize"); partSizeString != "" {
+		partSize, err = parseBytes(partSizeString)
+		if err != nil || partSize < s3manager.MinUploadPartSize {
+			return nil, fmt.Errorf("Environment viriables PartSize %s is invalid", partSizeString)
+		}
+	}
+
+	// 超过阈值的原图使用分段并行下载, 默认关闭
+	var downloadThreshold int64
+	if thresholdString := configValue("DownloadThreshold"); thresholdString != "" {
+		downloadThreshold, err = parseBytes(thresholdString)
+		if err != nil || downloadThreshold < 0 {
+			return nil, fmt.Errorf("Environment viriables DownloadThreshold %s is invalid", thresholdString)
+		}
+	}
+
+	downloadPartSize := int64(s3manager.DefaultDownloadPartSize)
+	if partSizeString := configValue("DownloadPartSize"); partSizeString != "" {
+		downloadPartSize, err = parseBytes(partSizeString)
+		if err != nil || downloadPartSize <= 0 {
+			return nil, fmt.Errorf("Environment viriables DownloadPartSize %s is invalid", partSizeString)
+		}
+	}
+
+	downloadConcurrency := s3manager.DefaultDownloadConcurrency
+	if concurrencyString := configValue("DownloadConcurrency"); concurrencyString != "" {
+		downloadConcurrency, err = strconv.Atoi(concurrencyString)
+		if err != nil || downloadConcurrency <= 0 {
+			return nil, fmt.Errorf("Environment viriables DownloadConcurrency %s is invalid", concurrencyString)
+		}
+	}
+
+	// vips后端需要使用-tags vips编译
+	backend := strings.ToLower(configValue("Backend"))
+	if backend == "" {
+		backend = BackendGo
+	}
+	if (backend != BackendGo && backend != BackendVips) || (backend == BackendVips && !vipsAvailable) {
+		return nil, fmt.Errorf("Environment viriables Backend %s is invalid", backend)
+	}
+
+	// 缓存最近解码的原图, 默认不缓存
+	var sourceCacheSize int64
+	if sizeString := configValue("SourceCacheSize"); sizeString != "" {
+		sourceCacheSize, err = parseBytes(sizeString)
+		if err != nil || sourceCacheSize < 0 {
+			return nil, fmt.Errorf("Environment viriables SourceCacheSize %s is invalid", sizeString)
+		}
+	}
+
+	// 拒绝过大的原图, 避免耗尽内存, 默认不限制
+	var maxObjectSize int64
+	if sizeString := configValue("MaxObjectSize"); sizeString != "" {
+		maxObjectSize, err = parseBytes(sizeString)
+		if err != nil || maxObjectSize < 0 {
+			return nil, fmt.Errorf("Environment viriables MaxObjectSize %s is invalid", sizeString)
+		}
+	}
+
+	var maxPixels int64
+	if pixelsString := configValue("MaxPixels"); pixelsString != "" {
+		maxPixels, err = strconv.ParseInt(pixelsString, 10, 64)
+		if err != nil || maxPixels < 0 {
+			return nil, fmt.Errorf("Environment viriables MaxPixels %s is invalid", pixelsString)
+		}
+	}
+
+	// 限制并发以控制内存峰值和请求速率, 默认不限制
+	var maxConcurrentImages int
+	if concurrencyString := configValue("MaxConcurrentImages"); concurrencyString != "" {
+		maxConcurrentImages, err = strconv.Atoi(concurrencyString)
+		if err != nil || maxConcurrentImages < 0 {
+			return nil, fmt.Errorf("Environment viriables MaxConcurrentImages %s is invalid", concurrencyString)
+		}
+	}
+
+	var maxConcurrentSizes int
+	if concurrencyString := configValue("MaxConcurrentSizes"); concurrencyString != "" {
+		maxConcurrentSizes, err = strconv.Atoi(concurrencyString)
+		if err != nil || maxConcurrentSizes < 0 {
+			return nil, fmt.Errorf("Environment viriables MaxConcurrentSizes %s is invalid", concurrencyString)
+		}
+	}
+
+	var kinesisBatchSize int
+	if batchString := configValue("KinesisBatchSize"); batchString != "" {
+		kinesisBatchSize, err = strconv.Atoi(batchString)
+		if err != nil || kinesisBatchSize < 0 {
+			return nil, fmt.Errorf("Environment viriables KinesisBatchSize %s is invalid", batchString)
+		}
+	}
+
+	// 未配置并发和像素限制时按内存大小计算, 同一份代码在256MB和10GB的函数中都可以安全运行
+	memorySize := lambdaMemoryMB()
+	if memoryString := configValue("MemorySize"); memoryString != "" {
+		memorySize, err = strconv.ParseInt(memoryString, 10, 64)
+		if err != nil || memorySize < 0 {
+			return nil, fmt.Errorf("Environment viriables MemorySize %s is invalid", memoryString)
+		}
+	}
+	if budget := newMemoryBudget(memorySize); budget != nil {
+		if configValue("MaxConcurrentImages") == "" {
+			maxConcurrentImages = budget.MaxConcurrentImages
+		}
+		if configValue("MaxPixels") == "" {
+			maxPixels = budget.MaxPixels
+		}
+	}
+
+	// 各阶段的超时, 一张异常的原图不会耗尽整个调用的时间, 默认不限制
+	stageTimeouts := make(map[string]time.Duration)
+	for _, name := range []string{"DownloadTimeout", "DecodeTimeout", "ResizeTimeout", "UploadTimeout"} {
+		if timeoutString := configValue(name); timeoutString != "" {
+			timeout, err := time.ParseDuration(timeoutString)
+			if err != nil || timeout < 0 {
+				return nil, fmt.Errorf("Environment viriables %s %s is invalid", name, timeoutString)
+			}
+			stageTimeouts[name] = timeout
+		}
+	}
+
+	// 突发的大量事件同时读写S3时会被按前缀限流, 限制请求速率以免限流后的重试越来越多
+	var s3GetRate float64
+	if rateString := configValue("S3GetRate"); rateString != "" {
+		s3GetRate, err = strconv.ParseFloat(rateString, 64)
+		if err != nil || s3GetRate < 0 {
+			return nil, fmt.Errorf("Environment viriables S3GetRate %s is invalid", rateString)
+		}
+	}
+
+	var s3PutRate float64
+	if rateString := configValue("S3PutRate"); rateString != "" {
+		s3PutRate, err = strconv.ParseFloat(rateString, 64)
+		if err != nil || s3PutRate < 0 {
+			return nil, fmt.Errorf("Environment viriables S3PutRate %s is invalid", rateString)
+		}
+	}
+
+	// 按需缩放允许的尺寸, 为空时允许不超过MaxDimension的任意尺寸
+	var onDemandSizes []Size
+	if sizesString := configValue("OnDemandSizes"); sizesString != "" {
+		onDemandSizes, err = parseSizes(sizesString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables OnDemandSizes %s is invalid: %v", sizesString, err)
+		}
+	}
+
+	maxDimension := 4096
+	if dimensionString := configValue("MaxDimension"); dimensionString != "" {
+		maxDimension, err = strconv.Atoi(dimensionString)
+		if err != nil || maxDimension <= 0 {
+			return nil, fmt.Errorf("Environment viriables MaxDimension %s is invalid", dimensionString)
+		}
+	}
+
+	// 默认任意记录失败时返回错误, 由Lambda重试或者送入死信队列
+	errorMode := strings.ToLower(configValue("ErrorMode"))
+	if errorMode == "" {
+		errorMode = ErrorModeAny
+	}
+	if errorMode != ErrorModeIgnore && errorMode != ErrorModeAny && errorMode != ErrorModeAll {
+		return nil, fmt.Errorf("Environment viriables ErrorMode %s is invalid", errorMode)
+	}
+
+	// 回调地址必须是http或https
+	callbackURL := configValue("CallbackURL")
+	if callbackURL != "" {
+		parsed, err := url.Parse(callbackURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("Environment viriables CallbackURL %s is invalid", callbackURL)
+		}
+	}
+
+	callbackRetry := 3
+	if retryString := configValue("CallbackRetry"); retryString != "" {
+		callbackRetry, err = strconv.Atoi(retryString)
+		if err != nil || callbackRetry < 0 {
+			return nil, fmt.Errorf("Environment viriables CallbackRetry %s is invalid", retryString)
+		}
+	}
+
+	// 控制对象名称不能包含路径
+	regenerateMarker := configValue("RegenerateMarker")
+	if strings.Contains(regenerateMarker, "/") || regenerateMarker == "." || regenerateMarker == ".." {
+		return nil, fmt.Errorf("Environment viriables RegenerateMarker %s is invalid", regenerateMarker)
+	}
+
+	metricsNamespace := configValue("MetricsNamespace")
+	if metricsNamespace == "" {
+		metricsNamespace = "Resize"
+	}
+
+	// 默认输出info及以上的日志, debug=true等同于LogLevel=debug
+	level := slog.LevelInfo
+	if levelString := configValue("LogLevel"); levelString != "" {
+		level, err = parseLogLevel(levelString)
+		if err != nil {
+			return nil, fmt.Errorf("Environment viriables LogLevel %s is invalid", levelString)
+		}
+	}
+	if configValue("debug") == "true" {
+		level = slog.LevelDebug
+	}
+	logLevel.Set(level)
+	tracingEnabled = configValue("Tracing") == "true"
+
+	// 不输出SecretAccessKey等密钥
+	logger.Debug("Read config",
+		"Bucket", configScope,
+		"DryRun", configValue("DryRun"),
+		"ConfigFile", os.Getenv("ConfigFile"),
+		"ConfigParameter", os.Getenv("ConfigParameter"),
+		"ConfigSecret", os.Getenv("ConfigSecret"),
+		"ConfigRefreshInterval", configRefreshInterval,
+		"TenantTag", configValue("TenantTag"),
+		"DeadlineMargin", deadlineMargin,
+		"StorageRetry", storageRetry,
+		"PDF", pdf,
+		"PDFRenderer", pdfRenderer,
+		"SVG", svg,
+		"SVGRenderer", svgRenderer,
+		"Video", video,
+		"VideoRenderer", videoRenderer,
+		"PosterTime", posterTime,
+		"RAW", configValue("RAW"),
+		"GIF", configValue("GIF"),
+		"PNG", configValue("PNG"),
+		"PNGColors", pngColors,
+		"PNGCompression", configValue("PNGCompression"),
+		"TIFF", configValue("TIFF"),
+		"OptimizeJPEG", optimizeJPEG,
+		"JPEGOptimizer", jpegOptimizer,
+		"StreamUpload", configValue("StreamUpload"),
+		"AccessKeyID", accessKeyID,
+		"Storage", storage,
+		"Sizes", fmt.Sprint(sizes),
+		"PrefixSizes", fmt.Sprint(prefixSizes),
+		"PixelRatios", configValue("PixelRatios"),
+		"MaxRetries", maxRetry,
+		"S3Endpoint", configValue("S3Endpoint"),
+		"S3ForcePathStyle", configValue("S3ForcePathStyle"),
+		"GCSEndpoint", configValue("GCSEndpoint"),
+		"Port", port,
+		"AzureAccountName", azureAccountName,
+		"AzureEndpoint", configValue("AzureEndpoint"),
+		"ErrorMode", errorMode,
+		"NotificationTopicArn", configValue("NotificationTopicArn"),
+		"CallbackURL", callbackURL,
+		"CallbackRetry", callbackRetry,
+		"LedgerTable", configValue("LedgerTable"),
+		"SavingsTable", configValue("SavingsTable"),
+		"SavingsInterval", savingsInterval,
+		"Metrics", configValue("Metrics"),
+		"MetricsNamespace", metricsNamespace,
+		"Tracing", tracingEnabled,
+		"SourceBucket", configValue("SourceBucket"),
+		"OnDemandSizes", fmt.Sprint(onDemandSizes),
+		"CacheResized", configValue("CacheResized"),
+		"MaxDimension", maxDimension,
+		"LogLevel", level.String(),
+		"Filter", configValue("Filter"),
+		"Gravity", fmt.Sprint(gravity),
+		"Transform", transform.String(),
+		"FaceDetection", faceDetection,
+		"Moderation", moderation,
+		"ModerationConfidence", moderationConfidence,
+		"QuarantineBucket", configValue("QuarantineBucket"),
+		"DedupPrefix", configValue("DedupPrefix"),
+		"ArchivePrefix", configValue("ArchivePrefix"),
+		"ArchiveStorageClass", archiveStorageClass,
+		"ArchiveTags", fmt.Sprint(archiveTags),
+		"Background", fmt.Sprint(background),
+		"NoUpscale", noUpscale,
+		"Watermark", configValue("Watermark"),
+		"WatermarkPosition", watermarkPosition,
+		"WatermarkOpacity", watermarkOpacity,
+		"WatermarkMargin", watermarkMargin,
+		"SharpenAmount", sharpen.Amount,
+		"SharpenRadius", sharpen.Radius,
+		"Pipeline", strings.Join(pipelineSteps, ","),
+		"BlurHash", blurHash,
+		"BlurHashComponents", fmt.Sprintf("%dx%d", blurHashComponents.X, blurHashComponents.Y),
+		"DominantColor", dominant,
+		"DestinationBucket", configValue("DestinationBucket"),
+		"DestinationPrefix", configValue("DestinationPrefix"),
+		"DestinationRoleArn", configValue("DestinationRoleArn"),
+		"Replicas", fmt.Sprint(replicas),
+		"KeyTemplate", keyTemplate,
+		"SkipExisting", configValue("SkipExisting"),
+		"Manifest", configValue("Manifest"),
+		"Sidecar", configValue("Sidecar"),
+		"DerivativeInventory", derivativeInventory,
+		"KeyFilter", fmt.Sprintf("%+v", keyFilter),
+		"EventTypes", strings.Join(eventTypes, ","),
+		"DerivedSuffixes", configValue("DerivedSuffixes"),
+		"DerivedMetadata", configValue("DerivedMetadata"),
+		"DerivedTags", configValue("DerivedTags"),
+		"SSEAlgorithm", sseAlgorithm,
+		"KMSKeyID", kmsKeyID,
+		"SSECustomerKey", sseCustomerKey != "",
+		"StorageClass", storageClass,
+		"Format", format,
+		"CacheControl", configValue("CacheControl"),
+		"Expires", expires.String(),
+		"PresignExpires", presignExpires.String(),
+		"CopyTags", configValue("CopyTags"),
+		"ThumbnailTags", fmt.Sprint(thumbnailTags),
+		"OptOut", fmt.Sprint(optOut),
+		"CorruptTags", fmt.Sprint(corruptTags),
+		"PreserveExif", configValue("PreserveExif"),
+		"StripSensitiveExif", configValue("StripSensitiveExif"),
+		"RegenerateMarker", regenerateMarker,
+		"MetadataOverrides", configValue("MetadataOverrides"),
+		"ObjectACL", objectACL,
+		"PartSize", partSize,
+		"Backend", backend,
+		"DecodeScaling", configValue("DecodeScaling"),
+		"ChainResize", configValue("ChainResize"),
+		"SourceCacheSize", sourceCacheSize,
+		"MaxObjectSize", maxObjectSize,
+		"MaxPixels", maxPixels,
+		"DownloadThreshold", downloadThreshold,
+		"DownloadPartSize", downloadPartSize,
+		"DownloadConcurrency", downloadConcurrency,
+		"MaxConcurrentImages", maxConcurrentImages,
+		"MaxConcurrentSizes", maxConcurrentSizes,
+		"KinesisBatchSize", kinesisBatchSize,
+		"MemorySize", memorySize,
+		"DownloadTimeout", stageTimeouts["DownloadTimeout"].String(),
+		"DecodeTimeout", stageTimeouts["DecodeTimeout"].String(),
+		"ResizeTimeout", stageTimeouts["ResizeTimeout"].String(),
+		"UploadTimeout", stageTimeouts["UploadTimeout"].String(),
+		"S3GetRate", s3GetRate,
+		"S3PutRate", s3PutRate,
+	)
+
+	config := &Config{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		Region:          region,
+		Sizes:           sizes,
+		PrefixSizes:     prefixSizes,
+		MaxRetry:        maxRetry,
+		Filter:          filter,
+		Gravity:         gravity,
+		Transform:       transform,
+		FaceDetection:   faceDetection,
+		Background:      background,
+		NoUpscale:       noUpscale,
+
+		Watermark:         configValue("Watermark"),
+		WatermarkPosition: watermarkPosition,
+		WatermarkOpacity:  watermarkOpacity,
+		WatermarkMargin:   watermarkMargin,
+
+		Sharpen:  sharpen,
+		Pipeline: pipelineSteps,
+
+		BlurHash:           blurHash,
+		BlurHashComponents: blurHashComponents,
+		DominantColor:      dominant,
+
+		DestinationBucket:  configValue("DestinationBucket"),
+		DestinationPrefix:  configValue("DestinationPrefix"),
+		DestinationRoleArn: configValue("DestinationRoleArn"),
+		Replicas:           replicas,
+		KeyTemplate:        keyTemplate,
+		SkipExisting:       configValue("SkipExisting") == "true",
+		Manifest:           configValue("Manifest") == "true",
+		Sidecar:            configValue("Sidecar") == "true",
+
+		DerivativeInventory: derivativeInventory,
+
+		KeyFilter:  keyFilter,
+		EventTypes: eventTypes,
+
+		DerivedSuffixes: parseList(configValue("DerivedSuffixes")),
+		DerivedMetadata: parseList(configValue("DerivedMetadata")),
+		DerivedTags:     parseList(configValue("DerivedTags")),
+
+		SSEAlgorithm:   sseAlgorithm,
+		KMSKeyID:       kmsKeyID,
+		SSECustomerKey: sseCustomerKey,
+		StorageClass:   storageClass,
+		Format:         format,
+		CacheControl:   configValue("CacheControl"),
+		Expires:        expires,
+		PresignExpires: presignExpires,
+
+		CopyTags:      configValue("CopyTags") == "true",
+		ThumbnailTags: thumbnailTags,
+		OptOut:        optOut,
+		CorruptTags:   corruptTags,
+		ObjectACL:     objectACL,
+		PartSize:      partSize,
+
+		PreserveExif:       configValue("PreserveExif") == "true",
+		StripSensitiveExif: configValue("StripSensitiveExif") == "true",
+		RegenerateMarker:   regenerateMarker,
+		MetadataOverrides:  configValue("MetadataOverrides") == "true",
+
+		Backend:         backend,
+		DecodeScaling:   configValue("DecodeScaling") == "true",
+		ChainResize:     configValue("ChainResize") == "true",
+		SourceCacheSize: sourceCacheSize,
+		MaxObjectSize:   maxObjectSize,
+		MaxPixels:       maxPixels,
+
+		DownloadThreshold:   downloadThreshold,
+		DownloadPartSize:    downloadPartSize,
+		DownloadConcurrency: downloadConcurrency,
+
+		MaxConcurrentImages: maxConcurrentImages,
+		MaxConcurrentSizes:  maxConcurrentSizes,
+		KinesisBatchSize:    kinesisBatchSize,
+		MemorySize:          memorySize,
+		DownloadTimeout:     stageTimeouts["DownloadTimeout"],
+		DecodeTimeout:       stageTimeouts["DecodeTimeout"],
+		ResizeTimeout:       stageTimeouts["ResizeTimeout"],
+		UploadTimeout:       stageTimeouts["UploadTimeout"],
+		S3GetRate:           s3GetRate,
+		S3PutRate:           s3PutRate,
+
+		S3Endpoint:       configValue("S3Endpoint"),
+		S3ForcePathStyle: configValue("S3ForcePathStyle") == "true",
+
+		Storage:        storage,
+		Port:           port,
+		GCSEndpoint:    configValue("GCSEndpoint"),
+		GCSAccessToken: configValue("GCSAccessToken"),
+
+		AzureAccountName: azureAccountName,
+		AzureAccountKey:  configValue("AzureAccountKey"),
+		AzureSASToken:    configValue("AzureSASToken"),
+		AzureEndpoint:    configValue("AzureEndpoint"),
+
+		SourceBucket:  configValue("SourceBucket"),
+		OnDemandSizes: onDemandSizes,
+		CacheResized:  configValue("CacheResized") == "true",
+		MaxDimension:  maxDimension,
+
+		ErrorMode:             errorMode,
+		NotificationTopicArn:  configValue("NotificationTopicArn"),
+		CallbackURL:           callbackURL,
+		CallbackSecret:        configValue("CallbackSecret"),
+		CallbackRetry:         callbackRetry,
+		LedgerTable:           configValue("LedgerTable"),
+		SavingsTable:          configValue("SavingsTable"),
+		SavingsInterval:       savingsInterval,
+		Metrics:               configValue("Metrics") == "true",
+		MetricsNamespace:      metricsNamespace,
+		Tracing:               tracingEnabled,
+		ConfigRefreshInterval: configRefreshInterval,
+		TenantTag:             configValue("TenantTag"),
+		DryRun:                configValue("DryRun") == "true",
+		DeadlineMargin:        deadlineMargin,
+		StorageRetry:          storageRetry,
+		PDF:                   pdf,
+		PDFRenderer:           pdfRenderer,
+		SVG:                   svg,
+		SVGRenderer:           svgRenderer,
+		Video:                 video,
+		VideoRenderer:         videoRenderer,
+		PosterTime:            posterTime,
+		RAW:                   configValue("RAW") == "true",
+		GIF:                   configValue("GIF") == "true",
+		PNG:                   configValue("PNG") == "true",
+		PNGColors:             pngColors,
+		PNGCompression:        pngCompression,
+		TIFF:                  configValue("TIFF") == "true",
+		OptimizeJPEG:          optimizeJPEG,
+		JPEGOptimizer:         jpegOptimizer,
+		StreamUpload:          configValue("StreamUpload") == "true",
+		Moderation:            moderation,
+		ModerationConfidence:  moderationConfidence,
+		QuarantineBucket:      configValue("QuarantineBucket"),
+		DedupPrefix:           configValue("DedupPrefix"),
+		ArchivePrefix:         configValue("ArchivePrefix"),
+		ArchiveStorageClass:   archiveStorageClass,
+		ArchiveTags:           archiveTags,
+	}
+
+	// 前缀的尺寸使用与Sizes相同的默认值
+	for _, prefix := range config.PrefixSizes {
+		for index := range prefix.Sizes {
+			prefix.Sizes[index] = config.sizeDefaults(prefix.Sizes[index])
+		}
+	}
+
+	return config, nil
+}
+
+// forBucket bucket使用的配置
+func (c *Config) forBucket(bucket string) *Config {
+	if config, found := c.Buckets[bucket]; found {
+		return config
+	}
+
+	return c
+}
+
+// anyBucket 当前配置或者任意bucket和租户的配置满足条件
+func (c *Config) anyBucket(match func(*Config) bool) bool {
+	if match(c) {
+		return true
+	}
+	for _, config := range c.Buckets {
+		if match(config) {
+			return true
+		}
+	}
+	for _, config := range c.Tenants {
+		if match(config) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sizesFor 原图使用的尺寸, 匹配最长的前缀, 没有匹配的前缀时使用Sizes
+func (c *Config) sizesFor(key string) []Size {
+	for _, prefix := range c.PrefixSizes {
+		if strings.HasPrefix(key, prefix.Prefix) {
+			return prefix.Sizes
+		}
+	}
+
+	return c.Sizes
+}
+
+// allSizes Sizes和所有前缀的尺寸
+func (c *Config) allSizes() []Size {
+	sizes := append([]Size{}, c.Sizes...)
+	for _, prefix := range c.PrefixSizes {
+		sizes = append(sizes, prefix.Sizes...)
+	}
+
+	return sizes
+}
+
+// sizeDefaults 为尺寸补充全局配置的焦点, 背景色, 存储类型, 格式, 旋转翻转和png选项
+func (c *Config) sizeDefaults(size Size) Size {
+	if size.Gravity.IsZero() {
+		size.Gravity = c.Gravity
+	}
+	if size.Background == nil {
+		size.Background = c.Background
+	}
+	if size.StorageClass == "" {
+		size.StorageClass = c.StorageClass
+	}
+	if size.Format == "" {
+		size.Format = c.Format
+	}
+	if size.Transform.IsZero() {
+		size.Transform = c.Transform
+	}
+	if size.Colors == 0 {
+		size.Colors = c.PNGColors
+	}
+	if size.Compression == png.DefaultCompression {
+		size.Compression = c.PNGCompression
+	}
+
+	return size
+}
+
+// loadEnvFile 从KEY=VALUE格式的文件中读取环境变量, 已经设置的环境变量优先, 文件不存在时忽略
+func loadEnvFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("line %s is invalid", line)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		if _, found := os.LookupEnv(name); !found {
+			os.Setenv(name, strings.Trim(strings.TrimSpace(parts[1]), "\""))
+		}
+	}
+
+	return nil
+}
+
+// parseBytes 解析字节数, 支持KB, MB, GB后缀
+func parseBytes(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	unit := int64(1)
+	for suffix, multiple := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, suffix)), multiple
+			break
+		}
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return number * unit, nil
+}
+
+// Imaging 图片处理
+type Imaging struct {
+	config *Config
+	store  ObjectStore
+	// destination 写入缩略图使用的存储, 默认与原图相同
+	destination ObjectStore
+	// replicas 各区域写入缩略图副本使用的存储
+	replicas    map[string]ObjectStore
+	rekognition *rekognition.Rekognition
+	sns         *sns.SNS
+	dynamodb    *dynamodb.DynamoDB
+	// prometheus 服务模式下的指标
+	prometheus *promMetrics
+	// imageSlots 限制同时处理的原图数量, 服务模式下在请求之间共享
+	imageSlots chan struct{}
+	// sourceCache 热启动时缓存的原图
+	sourceCache *sourceCache
+	watermark   *Watermark
+	// tenantWatermarks 各租户配置的水印
+	tenantWatermarks map[string]*Watermark
+	// bucketTenants 按bucket标签选择的租户
+	bucketTenants *bucketTenants
+	// savings 热启动的调用之间累计的节省字节数
+	savings *savingsReporter
+}
+
+// NewImaging 新建图片处理
+func NewImaging(config *Config, store ObjectStore) *Imaging {
+	imaging := &Imaging{config: config, store: store, destination: newDestinationStore(config, store)}
+	if config.MaxConcurrentImages > 0 {
+		imaging.imageSlots = make(chan struct{}, config.MaxConcurrentImages)
+	}
+	if config.SourceCacheSize > 0 {
+		imaging.sourceCache = newSourceCache(config.SourceCacheSize)
+	}
+	if config.TenantTag != "" {
+		imaging.bucketTenants = newBucketTenants()
+	}
+	if config.SavingsInterval > 0 {
+		imaging.savings = newSavingsReporter()
+	}
+
+	return imaging
+}
+
+// loadWatermark 加载配置的水印
+func (s *Imaging) loadWatermark(ctx context.Context) error {
+	if s.config.Watermark == "" {
+		return nil
+	}
+
+	img, err := loadImage(ctx, s.store, s.config.Watermark)
+	if err != nil {
+		return err
+	}
+
+	s.watermark = &Watermark{
+		Image:    img,
+		Position: s.config.WatermarkPosition,
+		Opacity:  s.config.WatermarkOpacity,
+		Margin:   s.config.WatermarkMargin,
+	}
+
+	return nil
+}
+
+// S3Event S3事件
+// 返回每条记录的处理结果, 并按ErrorMode返回错误, 以便平台重试或者投递到死信队列
+func (s Imaging) S3Event(ctx context.Context, s3Event events.S3Event) (Report, error) {
+	return s.report(ctx, s.processRecords(ctx, s3Event.Records))
+}
+
+// report 汇总并输出处理结果, 按ErrorMode返回错误
+func (s Imaging) report(ctx context.Context, results []RecordResult) (Report, error) {
+	return s.logReport(ctx, results), s.recordsError(results)
+}
+
+// logReport 汇总处理结果, 输出日志和指标
+func (s Imaging) logReport(ctx context.Context, results []RecordResult) Report {
+	report := newReport(results)
+	report.log(ctx)
+	if s.config.Metrics {
+		emitMetrics(s.config.MetricsNamespace, results)
+	}
+	if s.prometheus != nil {
+		s.prometheus.observe(results)
+	}
+	s.recordSavings(ctx, results)
+
+	return report
+}
+
+// recordsError 按ErrorMode汇总记录的处理结果, ignore不返回错误, any任意记录失败时返回错误, all全部记录失败时返回错误
+func (s Imaging) recordsError(results []RecordResult) error {
+	var failed int
+	var firstErr error
+	for _, result := range results {
+		if err := result.Err(); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if failed == 0 {
+		return nil
+	}
+
+	switch s.config.ErrorMode {
+	case ErrorModeAny:
+	case ErrorModeAll:
+		if failed < len(results) {
+			return nil
+		}
+	default:
+		// 失败的记录不会重试, 也不会送入死信队列
+		logger.Warn("Ignore failed records", "failed", failed, "records", len(results), "error", firstErr)
+		return nil
+	}
+
+	return fmt.Errorf("%d of %d records failed, first error: %v", failed, len(results), firstErr)
+}
+
+// processRecords 并行处理事件记录, 返回每条记录的处理结果
+func (s Imaging) processRecords(ctx context.Context, records []events.S3EventRecord) []RecordResult {
+	results := make([]RecordResult, len(records))
+
+	wg := new(sync.WaitGroup)
+	wg.Add(len(records))
+	for index, record := range records {
+		go func(index int, record events.S3EventRecord) {
+			defer wg.Done()
+			if s.imageSlots != nil {
+				s.imageSlots <- struct{}{}
+				defer func() { <-s.imageSlots }()
+			}
+			results[index] = s.processRecord(ctx, record)
+		}(index, record)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// processRecord 处理单条事件记录并记录结果和耗时
+func (s Imaging) processRecord(ctx context.Context, record events.S3EventRecord) RecordResult {
+	// 事件中的key经过了URL编码, 空格会编码为+, 选择配置之前解码一次, 之后都使用解码后的key
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		logger.WarnContext(ctx, "Decode key failed", "key", record.S3.Object.Key, "error", err)
+	} else {
+		record.S3.Object.Key = key
+	}
+
+	// 存储和凭证在所有bucket和租户之间共享, 其他配置可以按租户或者bucket覆盖, 水印只能按租户覆盖
+	s, tenant := s.forObject(ctx, record.S3.Bucket.Name, record.S3.Object.Key)
+	if tenant != "" {
+		ctx = withLogAttrs(ctx, "tenant", tenant)
+	}
+	start := time.Now()
+	result := RecordResult{
+		Bucket: record.S3.Bucket.Name,
+		Key:    record.S3.Object.Key,
+		Event:  record.EventName,
+		etag:   strings.Trim(record.S3.Object.ETag, "\""),
+	}
+
+	ctx, segment := beginSegment(ctx, "record")
+	if remaining, near := s.deadlineNear(ctx); near {
+		logger.WarnContext(ctx, "Skip record near deadline", "bucket", result.Bucket, "key", result.Key, "remainingMs", remaining.Milliseconds())
+		err = errDeadline
+	} else {
+		err = s.safeHandleRecord(ctx, record, &result)
+	}
+	result.finish(start, err)
+	segment.annotate("bucket", result.Bucket)
+	segment.annotate("key", result.Key)
+	segment.annotate("status", result.Status)
+	segment.end(err)
+	s.completeLedger(ctx, &result)
+	s.callback(ctx, &result)
+
+	return result
+}
+
+// handleRecord 处理单条事件记录, 忽略的记录不返回错误
+func (s Imaging) handleRecord(ctx context.Context, record events.S3EventRecord, result *RecordResult) error {
+	// processRecord已经解码了key
+	ctx = withLogAttrs(ctx, "bucket", record.S3.Bucket.Name, "key", record.S3.Object.Key)
+
+	// 按配置的事件类型过滤, 如ObjectRestore和ObjectTagging等事件不应该当作上传处理
+	if notificationSources[record.EventSource] && !matchEventType(s.config.EventTypes, record.EventName) {
+		logger.InfoContext(ctx, "Ignore event type", "event", record.EventName)
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 创建了目录
+	if strings.HasSuffix(record.S3.Object.Key, "/") {
+		logger.InfoContext(ctx, "Ignore create dir")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 上传控制对象时重新生成同一前缀下的所有原图
+	if s.isRegenerateMarker(record.S3.Object.Key) {
+		return s.onRegenerate(ctx, record, result)
+	}
+
+	// 按配置的前缀和后缀过滤
+	if !s.config.KeyFilter.Match(record.S3.Object.Key) {
+		logger.InfoContext(ctx, "Ignore filtered key")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 归档的原图副本
+	if s.config.ArchivePrefix != "" && strings.HasPrefix(record.S3.Object.Key, s.config.ArchivePrefix) {
+		logger.InfoContext(ctx, "Ignore archived image")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 只支持jpg, 按配置支持PDF, SVG, 视频, RAW, gif和png
+	if !s.isSupportedKey(record.S3.Object.Key) {
+		logger.InfoContext(ctx, "Ignore unknown file type")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 忽略resize上传的缩略图, 可能需要读取对象的元数据, 放在其他过滤条件之后
+	thumbnail, err := s.isThumbnail(ctx, record)
+	if err != nil {
+		logger.ErrorContext(ctx, "Head object failed", "error", err)
+		return err
+	}
+	if thumbnail {
+		logger.InfoContext(ctx, "Ignore thumbnail")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 其他程序写入的衍生文件, 避免为它们递归生成缩略图
+	derived, err := s.isDerived(ctx, record)
+	if err != nil {
+		logger.ErrorContext(ctx, "Read derived marker failed", "error", err)
+		return err
+	}
+	if derived {
+		logger.InfoContext(ctx, "Ignore derived asset")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 在处理台账中登记, 同一版本的原图已经处理或者正在处理时跳过
+	claimed, err := s.claimLedger(ctx, result)
+	if err != nil {
+		logger.ErrorContext(ctx, "Claim ledger failed", "error", err)
+		return err
+	}
+	if !claimed {
+		logger.InfoContext(ctx, "Skip already processed image")
+		result.Status = StatusSkipped
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(record.EventName, "ObjectRemoved:"):
+		// 原图被删除时删除缩略图
+		logger.InfoContext(ctx, "Image removed")
+		return s.onImageRemoved(ctx, record, result)
+	case !strings.HasPrefix(record.EventName, "ObjectCreated:"):
+		logger.InfoContext(ctx, "Ignore event type", "event", record.EventName)
+		result.Status = StatusIgnored
+		return nil
+	case record.EventName == eventNameCompleteMultipartUpload:
+		logger.InfoContext(ctx, "Image created by multipart upload", "size", record.S3.Object.Size)
+	case record.EventName == eventNameCopy:
+		logger.InfoContext(ctx, "Image created by copy", "size", record.S3.Object.Size)
+	default:
+		logger.InfoContext(ctx, "Image created")
+	}
+
+	return s.onImageCreated(ctx, record, result)
+}
+
+// onImageCreated 有图片更新时创建缩略图
+func (s Imaging) onImageCreated(ctx context.Context, record events.S3EventRecord, result *RecordResult) error {
+
+	// 记录缩略图时原地复制原图触发的事件
+	selfCopy, err := s.derivativeMetadataCopy(ctx, record)
+	if err != nil {
+		logger.ErrorContext(ctx, "Head object failed", "error", err)
+		return err
+	}
+	if selfCopy {
+		logger.InfoContext(ctx, "Ignore derivative metadata update")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 上传时标记了不需要缩略图
+	optedOut, err := s.optedOut(ctx, record.S3.Bucket.Name, record.S3.Object.Key)
+	if err != nil {
+		logger.ErrorContext(ctx, "Read opt-out marker failed", "error", err)
+		return err
+	}
+	if optedOut {
+		logger.InfoContext(ctx, "Ignore opted out image")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 未通过内容审核的原图不生成缩略图
+	if s.rekognition != nil && s.config.Moderation {
+		labels, err := s.detectModeration(ctx, record.S3.Bucket.Name, record.S3.Object.Key)
+		if err != nil {
+			logger.ErrorContext(ctx, "Detect moderation labels failed", "error", err)
+			return err
+		}
+
+		if len(labels) > 0 {
+			logger.WarnContext(ctx, "Reject moderated image", "labels", labels)
+			result.Status = StatusSkipped
+			return s.rejectModerated(ctx, record, labels)
+		}
+	}
+
+	// S3事件至少送达一次, 跳过已经按同一版本原图生成过的缩略图
+	// 复制事件通常是原地修改元数据或者存储类型, 内容没有改变, 总是先检查已有的缩略图
+	configSizes, err := s.objectSizes(ctx, record)
+	if err != nil {
+		logger.ErrorContext(ctx, "Head object failed", "error", err)
+		return err
+	}
+	if s.config.SkipExisting || record.EventName == eventNameCopy {
+		configSizes = s.missingSizes(ctx, record, configSizes, result)
+		if len(configSizes) == 0 {
+			logger.InfoContext(ctx, "All thumbnails already exist")
+			result.Status = StatusSkipped
+			return nil
+		}
+	}
+
+	// 尝试从S3读取图像
+	original, err := s.readImage(ctx, record, configSizes, true)
+	if small, ok := err.(*SmallImageError); ok {
+		s.skipSmallImage(ctx, record, configSizes, small, result)
+		return nil
+	}
+	if isCorrupt(err) {
+		s.markCorrupt(ctx, record, err)
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Read image failed", "error", err)
+		return err
+	}
+
+	// 按原图的元数据标记的衍生文件
+	if s.isDerivedOriginal(original) {
+		logger.InfoContext(ctx, "Ignore derived asset")
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	result.BytesIn, result.DecodeMs = original.Bytes, original.DecodeMs
+	sizes := s.prepareSizes(ctx, original, configSizes)
+
+	// 缩略图沿用原图的标签, 以便生命周期和成本分摊规则生效
+	original.ThumbnailTags, err = s.thumbnailTags(ctx, original)
+	if err != nil {
+		logger.WarnContext(ctx, "Read tags failed", "error", err)
+	}
+
+	// 计算占位信息需要解码后的图像
+	if s.config.BlurHash || s.config.DominantColor {
+		if err = original.decode(); err != nil {
+			logger.ErrorContext(ctx, "Decode image failed", "error", err)
+			return err
+		}
+	}
+
+	// 计算BlurHash供前端渲染占位图
+	if s.config.BlurHash {
+		start := time.Now()
+		hash := blurHash(original.Image, s.config.BlurHashComponents.X, s.config.BlurHashComponents.Y)
+		original.ThumbnailMetadata["blurhash"] = hash
+		logger.DebugContext(ctx, "Compute blurhash", "blurhash", hash, "durationMs", durationMs(start))
+	}
+
+	// 计算主色调供前端绘制纯色占位
+	if s.config.DominantColor {
+		dominant := dominantColor(original.Image)
+		original.ThumbnailMetadata["dominant-color"] = dominant
+		logger.DebugContext(ctx, "Compute dominant color", "color", dominant)
+	}
+
+	// 相同内容的原图已经处理过时复制已有的缩略图, 只生成其余的尺寸
+	dedup := s.readDedupEntry(ctx, original)
+	allSizes := sizes
+	sizes = s.copyDuplicates(ctx, original, dedup, sizes, result)
+
+	// 逐级缩小需要先生成所有中间图像, vips后端直接从原图内容生成, SVG每个尺寸单独栅格化, 动图每一帧单独缩小
+	sources := make([]image.Image, len(sizes))
+	if s.config.ChainResize && s.config.Backend != BackendVips && original.svgRenderer == "" && original.frames == nil {
+		if err = original.decode(); err != nil {
+			logger.ErrorContext(ctx, "Decode image failed", "error", err)
+			return err
+		}
+		sources = s.chainSources(ctx, original, sizes)
+	}
+
+	var sizeSlots chan struct{}
+	if s.config.MaxConcurrentSizes > 0 {
+		sizeSlots = make(chan struct{}, s.config.MaxConcurrentSizes)
+	}
+
+	// 只有输出格式和编码选项不同的尺寸共用一次缩放
+	shared := sharedRenders(sizes, sources)
+
+	sizeResults := make([]SizeResult, len(sizes))
+	thumbnailWaitGroup := new(sync.WaitGroup)
+	thumbnailWaitGroup.Add(len(sizes))
+	for index, size := range sizes {
+		// 并行创建缩略图
+		go func(index int, size Size) {
+			defer thumbnailWaitGroup.Done()
+			if sizeSlots != nil {
+				sizeSlots <- struct{}{}
+				defer func() { <-sizeSlots }()
+			}
+			sizeResults[index] = s.safeCreateThumbnail(ctx, original, sources[index], shared[index], size)
+		}(index, size)
+	}
+	thumbnailWaitGroup.Wait()
+	result.Sizes = append(result.Sizes, sizeResults...)
+
+	for _, sizeResult := range sizeResults {
+		if sizeResult.err != nil {
+			return sizeResult.err
+		}
+	}
 
-	fmt.Printf("[Start]\n")
-	config, err := readConfig()
-	if err != nil {
-		fmt.Printf("Read config failed due to %v\n", err)
-		return
+	if err = s.writeDedupEntry(ctx, original, dedup, allSizes, result); err != nil {
+		return err
 	}
 
-	// 初始化s3 client
-	creds := credentials.NewStaticCredentialsFromCreds(credentials.Value{AccessKeyID: config.AccessKeyID, SecretAccessKey: config.SecretAccessKey})
-	awsConfig := aws.NewConfig().WithCredentials(creds).WithRegion(config.Region).WithMaxRetries(config.MaxRetry)
-	client := s3.New(session.New(awsConfig))
+	// 写入所有缩略图的清单, 供前端生成srcset
+	if s.config.Manifest {
+		if err = s.writeManifest(ctx, original, result); err != nil {
+			return err
+		}
+	}
 
-	// 处理事件
-	imaging := NewImaging(config, client)
-	lambda.Start(imaging.S3Event)
+	// 写入原图信息, 下游不需要重新下载原图建立索引
+	if s.config.Sidecar {
+		if err = s.writeSidecar(ctx, original, result); err != nil {
+			return err
+		}
+	}
+
+	// 在原图上记录缩略图, 一次HeadObject即可得知有哪些尺寸
+	if err = s.recordDerivatives(ctx, original, result); err != nil {
+		return err
+	}
+
+	// 所有缩略图都已生成, 归档原图
+	if err = s.archiveOriginal(ctx, original); err != nil {
+		return err
+	}
 
-	fmt.Printf("[End]\n")
+	// 通知下游缩略图已经就绪
+	s.notify(ctx, result)
+
+	return nil
 }
 
-// Config 配置
-type Config struct {
-	AccessKeyID     string
-	SecretAccessKey string
-	Region          string
-	MaxRetry        int
-	Sizes           []image.Point
+// Original 原图
+type Original struct {
+	Bucket string
+	Key    string
+	// Image 解码后的图像, vips后端在需要时才通过decode解码
+	Image image.Image
+	// Bounds 原图的尺寸
+	Bounds image.Point
+	// Scale 解码时缩小的倍数, Image的尺寸是Bounds的1/Scale
+	Scale int
+	// Source 原图内容, 只有vips后端保留
+	Source []byte
+	// Metadata 原图的元数据
+	Metadata map[string]string
+	// ThumbnailMetadata 需要写入每个缩略图的元数据
+	ThumbnailMetadata map[string]string
+	// ThumbnailTags 需要写入每个缩略图的标签
+	ThumbnailTags map[string]string
+	// Bytes 读取的原图字节数
+	Bytes int64
+	// DecodeMs 读取并解码原图的毫秒数
+	DecodeMs int64
+	// ContentHash 原图内容的sha256, 只有开启去重时计算
+	ContentHash string
+	// Version 原图的版本, 用于生成带版本的缩略图key
+	Version naming.Version
+
+	// svgRenderer SVG原图的栅格化命令, 每个尺寸从Source单独栅格化
+	svgRenderer string
+	// frames 动图合成后的所有帧, 只有需要生成动画时保留
+	frames []pipeline.Frame
+	// loopCount 动画的播放次数, 0表示无限循环
+	loopCount int
+	// exif 从EXIF读取的拍摄信息, 写入原图信息文件
+	exif exifInfo
+	// exifData 写入jpeg缩略图的EXIF, 只有开启PreserveExif时保留
+	exifData []byte
+
+	decodeOnce sync.Once
+	decodeErr  error
 }
 
-// readConfig 从环境变量中读取配置
-func readConfig() (*Config, error) {
-	accessKeyID := os.Getenv("AccessKeyID")
-	secretAccessKey := os.Getenv("SecretAccessKey")
-	region := os.Getenv("Region")
-	sizeString := os.Getenv("Sizes")
-	if accessKeyID == "" || secretAccessKey == "" || region == "" || sizeString == "" {
-		return nil, fmt.Errorf("Environment viriables is invalid")
+// decode 解码原图内容, 已经解码时直接返回
+func (o *Original) decode() error {
+	o.decodeOnce.Do(func() {
+		switch {
+		case o.Image != nil:
+		case o.svgRenderer != "":
+			// 需要完整图像时按固有尺寸栅格化
+			o.Image, o.decodeErr = rasterizeSVG(o.svgRenderer, o.Source, o.Bounds.X, o.Bounds.Y, "white")
+		default:
+			o.Image, o.decodeErr = pipeline.DecodeJPEG(bytes.NewReader(o.Source), o.Scale)
+		}
+	})
+
+	return o.decodeErr
+}
+
+// prepareSizes 按原图的元数据和人脸位置调整尺寸的裁剪焦点和旋转翻转
+func (s Imaging) prepareSizes(ctx context.Context, original *Original, configSizes []Size) []Size {
+	// 对象元数据中可以指定裁剪焦点
+	var gravity pipeline.Gravity
+	if gravityString := metadataValue(original.Metadata, "gravity"); gravityString != "" {
+		var err error
+		gravity, err = pipeline.ParseGravity(gravityString)
+		if err != nil {
+			logger.WarnContext(ctx, "Ignore invalid gravity metadata", "error", err)
+		}
 	}
 
-	var sizes []image.Point
-	for _, group := range sizePattern.FindAllStringSubmatch(sizeString, -1) {
-		if len(group) != 3 {
-			return nil, fmt.Errorf("Environment viriables Sizes %v is invalid", group)
+	// 对象元数据中也可以指定旋转和翻转, 覆盖配置的变换
+	transform, hasTransform := metadataTransform(ctx, original.Metadata)
+
+	sizes := make([]Size, len(configSizes))
+	for index, size := range configSizes {
+		if !gravity.IsZero() {
+			size.Gravity = gravity
+		}
+		if hasTransform {
+			size.Transform = transform
 		}
+		sizes[index] = size
+	}
 
-		width, err := strconv.Atoi(group[1])
+	// 按人脸位置裁剪, 识别时按bucket和key读取原图, 不在存储中的原图按配置的焦点裁剪
+	if s.rekognition != nil && original.Bucket != "" && needFaces(sizes) {
+		face, err := s.detectFaces(ctx, original.Bucket, original.Key)
 		if err != nil {
-			return nil, fmt.Errorf("Environment viriables Sizes %v is invalid: %v", group, err)
+			logger.WarnContext(ctx, "Detect faces failed", "error", err)
+		}
+
+		if !face.IsZero() {
+			for index := range sizes {
+				if sizes[index].Gravity.IsFace() {
+					sizes[index].Gravity = face
+				}
+			}
 		}
+	}
+
+	return sizes
+}
+
+// onImageRemoved 原图删除时删除所有尺寸的缩略图
+func (s Imaging) onImageRemoved(ctx context.Context, record events.S3EventRecord, result *RecordResult) error {
+	var lastErr error
+
+	for _, sizeResult := range s.removedThumbnails(ctx, record) {
+		start := time.Now()
+		err := s.destination.Delete(ctx, sizeResult.Bucket, sizeResult.Key)
+		sizeResult.finish(start, err)
+		result.Sizes = append(result.Sizes, sizeResult)
 
-		height, err := strconv.Atoi(group[2])
 		if err != nil {
-			return nil, fmt.Errorf("Environment viriables Sizes %v is invalid: %v", group, err)
+			logger.ErrorContext(ctx, "Delete thumbnail failed", "thumbnailBucket", sizeResult.Bucket, "thumbnail", sizeResult.Key, "error", err)
+			lastErr = err
+			continue
 		}
 
-		sizes = append(sizes, image.Pt(width, height))
-	}
+		logger.InfoContext(ctx, "Delete thumbnail success", "thumbnail", sizeResult.Key)
 
-	var err error
-	maxRetry, err := strconv.Atoi(os.Getenv("MaxRetries"))
-	if err != nil {
-		maxRetry = 3
+		if err = s.removeReplicas(ctx, sizeResult.Key); err != nil {
+			lastErr = err
+		}
 	}
 
-	if os.Getenv("debug") == "true" {
-		fmt.Printf("AccessKeyID: %s\n", accessKeyID)
-		fmt.Printf("SecretAccessKey: %s\n", secretAccessKey)
-		fmt.Printf("Sizes: %v\n", sizes)
-		fmt.Printf("MaxRetries: %d\n", maxRetry)
+	// 清单和原图信息文件不是jpg, 删除时不会触发处理
+	if s.config.Manifest {
+		if err := s.removeManifest(ctx, result); err != nil {
+			lastErr = err
+		}
+	}
+	if s.config.Sidecar {
+		if err := s.removeSidecar(ctx, result); err != nil {
+			lastErr = err
+		}
 	}
 
-	return &Config{
-		AccessKeyID:     accessKeyID,
-		SecretAccessKey: secretAccessKey,
-		Region:          region,
-		Sizes:           sizes,
-		MaxRetry:        maxRetry,
-	}, nil
+	return lastErr
 }
 
-// Imaging 图片处理
-type Imaging struct {
-	config *Config
-	client *s3.S3
-}
+// removedThumbnails 原图删除时需要删除的缩略图
+// 带版本的key需要原图的ETag, 删除事件中没有ETag, 只能按清单中记录的缩略图删除
+// 元数据可以覆盖尺寸时, 已删除的原图没有元数据, 有清单时同样按清单删除
+func (s Imaging) removedThumbnails(ctx context.Context, record events.S3EventRecord) []SizeResult {
+	var thumbnails []SizeResult
+	if !naming.Versioned(s.config.KeyTemplate) && !(s.config.MetadataOverrides && s.config.Manifest) {
+		for _, size := range s.config.sizesFor(record.S3.Object.Key) {
+			bucket, key := s.thumbnailLocation(record.S3.Bucket.Name, record.S3.Object.Key, naming.Version{}, size)
+			thumbnails = append(thumbnails, SizeResult{Size: sizeName(size), Bucket: bucket, Key: key})
+		}
+		return thumbnails
+	}
 
-// NewImaging 新建图片处理
-func NewImaging(config *Config, client *s3.S3) *Imaging {
-	return &Imaging{config: config, client: client}
+	if !s.config.Manifest {
+		logger.WarnContext(ctx, "Skip deleting versioned thumbnails without manifest")
+		return nil
+	}
+
+	bucket, key := s.manifestLocation(record.S3.Bucket.Name, record.S3.Object.Key)
+	manifest, err := s.readManifest(ctx, bucket, key)
+	if err != nil {
+		logger.WarnContext(ctx, "Read manifest failed", "manifest", key, "error", err)
+		return nil
+	}
+	for _, variant := range manifest.Variants {
+		thumbnails = append(thumbnails, SizeResult{Size: variant.Size, Bucket: bucket, Key: variant.Key})
+	}
+
+	return thumbnails
 }
 
-// S3Event S3事件
-func (s Imaging) S3Event(ctx context.Context, s3Event events.S3Event) {
+// readImage 从key中读取图像及其元数据, 按需要生成的尺寸决定解码的大小
+// skipSmall为true并且不放大原图时, 原图小于所有尺寸则只读取图像头, 返回SmallImageError
+func (s Imaging) readImage(ctx context.Context, record events.S3EventRecord, sizes []Size, skipSmall bool) (*Original, error) {
 
-	wg := new(sync.WaitGroup)
-	wg.Add(len(s3Event.Records))
+	// S3事件中的大小为0时是空对象, 不需要下载
+	if eventSizeReliable(record) && record.S3.Object.Size == 0 {
+		return nil, &CorruptImageError{Key: record.S3.Object.Key, Reason: "is zero bytes"}
+	}
 
-	for _, record := range s3Event.Records {
+	// 事件中有对象大小时, 过大的原图不下载
+	if err := s.checkObjectSize(record.S3.Object.Key, record.S3.Object.Size); err != nil {
+		logger.ErrorContext(ctx, "Reject image", "error", err)
+		return nil, err
+	}
 
-		// 创建了目录
-		if strings.HasSuffix(record.S3.Object.Key, "/") {
-			fmt.Printf("Ignore create dir %s\n", record.S3.Object.Key)
-			wg.Done()
-			continue
-		}
+	// 同一版本的原图已经按足够的大小解码过时直接使用
+	if original, found := s.cachedOriginal(record, sizes); found {
+		logger.InfoContext(ctx, "Use cached image", "etag", record.S3.Object.ETag)
+		return original, nil
+	}
 
-		// 忽略resize上传的缩略图
-		if sizePattern.Match([]byte(record.S3.Object.Key)) {
-			fmt.Printf("Ignore thumbnail %s\n", record.S3.Object.Key)
-			wg.Done()
-			continue
-		}
+	start := time.Now()
+	// 获取文件, 下载超时包括解码时读取剩余的内容
+	stageCtx, cancel := stageContext(ctx, s.config.DownloadTimeout)
+	defer cancel()
+	downloadCtx, segment := beginSegment(stageCtx, "download")
+	var output *Object
+	err := s.retryStorage(downloadCtx, "get", true, func() error {
+		var err error
+		output, err = s.getSource(downloadCtx, record)
+		return err
+	})
+	err = stageError(ctx, stageCtx, stageDownload, s.config.DownloadTimeout, err)
+	segment.end(err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Get object failed", "error", err)
+		return nil, err
+	}
+	defer output.Body.Close()
+	logger.DebugContext(ctx, "Read image", "durationMs", durationMs(start))
 
-		// 只支持jpg
-		if !strings.HasSuffix(strings.ToLower(record.S3.Object.Key), ".jpg") {
-			fmt.Printf("Ignore unknown file type %s\n", record.S3.Object.Key)
-			wg.Done()
-			continue
+	// 读取到的对象必须是触发事件的对象
+	if err = verifyETag(record.S3.Object.ETag, output.ETag); err != nil {
+		logger.ErrorContext(ctx, "Verify object failed", "error", err)
+		return nil, err
+	}
+
+	if output.Size == 0 {
+		return nil, &CorruptImageError{Key: record.S3.Object.Key, Reason: "is zero bytes"}
+	}
+
+	// 分段上传和复制的对象也必须与事件中的大小一致
+	if err = verifySize(record.S3.Object.Size, output.Size); err != nil {
+		logger.ErrorContext(ctx, "Verify object failed", "error", err)
+		return nil, err
+	}
+
+	if err = s.checkObjectSize(record.S3.Object.Key, output.Size); err != nil {
+		logger.ErrorContext(ctx, "Reject image", "error", err)
+		return nil, err
+	}
+
+	// 去重需要原图内容的哈希, 边读取边计算
+	var hasher hash.Hash
+	if s.config.DedupPrefix != "" {
+		hasher = sha256.New()
+		output.Body = hashingBody{Reader: io.TeeReader(output.Body, hasher), Closer: output.Body}
+	}
+
+	// 不放大原图时先读取图像头, 原图小于所有尺寸时不再下载剩余的内容
+	if skipSmall && s.config.NoUpscale == "skip" {
+		if err = s.probeImage(ctx, record.S3.Object.Key, output, sizes); err != nil {
+			return nil, err
 		}
+	}
 
-		fmt.Printf("Image created: %s\n", record.S3.Object.Key)
-		// 并行创建缩略图
-		go s.onImageCreated(ctx, record, wg)
+	// 边下载边解码, 解码的耗时包含读取剩余内容
+	// 解码超时后不再读取解码的结果, 关闭原图内容使仍在读取的解码尽快结束
+	_, segment = beginSegment(ctx, "decode")
+	var original *Original
+	err = runStage(ctx, stageDecode, s.config.DecodeTimeout, func() error {
+		var err error
+		original, err = s.decodeOriginal(record.S3.Bucket.Name, record.S3.Object.Key, output, sizes)
+		return err
+	})
+	err = stageError(ctx, stageCtx, stageDownload, s.config.DownloadTimeout, err)
+	segment.end(err)
+	if _, timeout := err.(*StageTimeoutError); timeout {
+		logger.ErrorContext(ctx, "Decode image failed", "error", err)
+		return nil, err
 	}
-	wg.Wait()
+	if err == nil && hasher != nil {
+		// 解码不一定读完全部内容
+		if _, err = io.Copy(ioutil.Discard, output.Body); err != nil {
+			logger.ErrorContext(ctx, "Read image failed", "error", err)
+			return nil, err
+		}
+		original.ContentHash = hex.EncodeToString(hasher.Sum(nil))
+	}
+	if err == nil {
+		original.Version = naming.Version{ETag: strings.Trim(output.ETag, "\""), ID: output.VersionID}
+	}
+	if err == nil && s.sourceCache != nil && output.ETag != "" {
+		s.sourceCache.add(output.ETag, original)
+	}
+
+	return original, err
 }
 
-// onImageCreated 有图片更新时创建缩略图
-func (s Imaging) onImageCreated(ctx context.Context, record events.S3EventRecord, wg *sync.WaitGroup) {
-	defer wg.Done()
+// getSource 读取触发事件的原图版本, 事件中没有版本ID或者存储不支持版本时读取最新版本
+func (s Imaging) getSource(ctx context.Context, record events.S3EventRecord) (*Object, error) {
+	bucket, key, versionID := record.S3.Bucket.Name, record.S3.Object.Key, record.S3.Object.VersionID
+	if reader, ok := s.store.(VersionReader); ok && versionID != "" {
+		return reader.GetVersion(ctx, bucket, key, versionID)
+	}
 
-	// 尝试从S3读取图像
-	src, err := s.readImage(ctx, record)
-	if err != nil {
-		fmt.Printf("Read image from bucket %s object %s failed due to %v\n", record.S3.Bucket.Name, record.S3.Object.Key, err)
-		return
+	return s.store.Get(ctx, bucket, key)
+}
+
+// cachedOriginal 读取缓存的原图, 事件中没有ETag或者缓存的原图解码得太小时不使用缓存
+func (s Imaging) cachedOriginal(record events.S3EventRecord, sizes []Size) (*Original, bool) {
+	if s.sourceCache == nil || record.S3.Object.ETag == "" {
+		return nil, false
 	}
 
-	thumbnailWaitGroup := new(sync.WaitGroup)
-	thumbnailWaitGroup.Add(len(s.config.Sizes))
-	for _, size := range s.config.Sizes {
-		// 并行创建缩略图
-		go s.createThumbnail(ctx, record.S3.Bucket.Name, record.S3.Object.Key, src, size, thumbnailWaitGroup)
+	original, found := s.sourceCache.get(record.S3.Bucket.Name, record.S3.Object.Key, record.S3.Object.ETag)
+	if !found || original.Scale > s.decodeScale(original.Bounds, sizes) {
+		return nil, false
 	}
 
-	thumbnailWaitGroup.Wait()
+	// 没有读取和解码原图
+	original.Bytes, original.DecodeMs = 0, 0
+	return original, true
 }
 
-// readImage 从key中读取图像
-func (s Imaging) readImage(ctx context.Context, record events.S3EventRecord) (image.Image, error) {
+// decodeOriginal 解码读取到的原图, 先读取图像头检查尺寸, 避免解码过大的图像耗尽内存
+// 原图远大于所有尺寸时按比例缩小解码
+func (s Imaging) decodeOriginal(bucket, key string, object *Object, sizes []Size) (*Original, error) {
+	if s.config.PDF && isPDF(key) {
+		return s.decodePDF(bucket, key, object, sizes)
+	}
+	if s.config.SVG && isSVG(key) {
+		return s.decodeSVG(bucket, key, object)
+	}
+	if s.config.Video && isVideo(key) {
+		return s.decodeVideo(bucket, key, object)
+	}
+	if s.config.RAW && isRAW(key) {
+		return s.decodeRAW(bucket, key, object, sizes)
+	}
+	if s.config.GIF && isGIF(key) {
+		return s.decodeGIF(bucket, key, object, sizes)
+	}
+	if s.config.PNG && isPNG(key) {
+		return s.decodePNG(bucket, key, object)
+	}
+	if s.config.TIFF && isTIFF(key) {
+		return s.decodeTIFF(bucket, key, object)
+	}
 
 	start := time.Now()
-	// 获取文件
-	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(record.S3.Bucket.Name),
-		Key:    aws.String(record.S3.Object.Key),
-	})
+
+	// 读取图像头, 已读取的内容在解码时重新使用
+	body := newChecksumReader(object.Body)
+	header := getBuffer()
+	defer putBuffer(header)
+	imageConfig, err := jpeg.DecodeConfig(io.TeeReader(body, header))
 	if err != nil {
-		fmt.Printf("Get object %s failed due to %v\n", record.S3.Object.Key, err)
+		err = truncatedError(key, body, object, err)
+		logger.Error("Decode image config failed", "bucket", bucket, "key", key, "error", err)
 		return nil, err
 	}
-	defer output.Body.Close()
-	read := time.Now()
-	fmt.Printf("Read image %s in %s\n", record.S3.Object.Key, read.Sub(start).String())
 
-	// 读取图像
-	img, err := jpeg.Decode(output.Body)
+	if err = s.checkPixels(key, imageConfig.Width, imageConfig.Height); err != nil {
+		logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+	progressive := jpegProgressive(header.Bytes())
+	if progressive {
+		if err = s.checkProgressive(key, imageConfig.Width, imageConfig.Height); err != nil {
+			logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+			return nil, err
+		}
+	}
+
+	// 图像头中已经包含EXIF, 解码时会读取header中的内容, 需要先解析
+	exif := jpegEXIF(header.Bytes(), imageConfig.ColorModel)
+	var exifData []byte
+	if s.config.PreserveExif {
+		exifData = sanitizeEXIF(exifSegment(header.Bytes()), s.config.StripSensitiveExif)
+	}
+
+	// vips后端直接处理原图内容, 其他情况下读取并解码图像
+	bounds := image.Pt(imageConfig.Width, imageConfig.Height)
+	scale := s.decodeScale(bounds, sizes)
+	var img image.Image
+	var source []byte
+	if s.config.Backend == BackendVips {
+		source, err = ioutil.ReadAll(io.MultiReader(header, body))
+	} else {
+		img, err = pipeline.DecodeJPEG(io.MultiReader(header, body), scale)
+	}
 	if err != nil {
-		fmt.Printf("Decode image from %s failed due to %v\n", record.S3.Object.Key, err)
+		err = truncatedError(key, body, object, err)
+		logger.Error("Decode image failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+	logger.Debug("Decode image", "bucket", bucket, "key", key, "scale", scale, "progressive", progressive, "durationMs", durationMs(start))
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
 		return nil, err
 	}
-	fmt.Printf("Decode image %s in %s\n", record.S3.Object.Key, time.Now().Sub(read).String())
 
-	return img, nil
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Image, original.Bounds, original.Scale, original.Source = img, bounds, scale, source
+	original.exif, original.exifData = exif, exifData
+
+	return original, nil
+}
+
+// newOriginal 按读取的对象新建原图, 由调用方设置解码后的图像
+func newOriginal(bucket, key string, object *Object, length int64, start time.Time) *Original {
+	original := &Original{
+		Bucket:            bucket,
+		Key:               key,
+		Metadata:          object.Metadata,
+		ThumbnailMetadata: map[string]string{"kind": "thumbnail"},
+		Bytes:             length,
+		DecodeMs:          durationMs(start),
+	}
+
+	// 记录原图的ETag, 用于判断缩略图是否需要重新生成
+	if etag := strings.Trim(object.ETag, "\""); etag != "" {
+		original.ThumbnailMetadata["source-etag"] = etag
+	}
+	// 开启了版本控制时记录生成缩略图的原图版本
+	if object.VersionID != "" {
+		original.ThumbnailMetadata["source-version-id"] = object.VersionID
+	}
+
+	return original
+}
+
+// metadataValue 读取对象元数据, 忽略大小写
+func metadataValue(metadata map[string]string, name string) string {
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// decodeScale 解码jpeg时可以缩小的倍数, 缩小后的图像仍然足够生成所有尺寸而不需要放大
+func (s Imaging) decodeScale(bounds image.Point, sizes []Size) int {
+	if !s.config.DecodeScaling || len(sizes) == 0 {
+		return 1
+	}
+
+	for _, scale := range []int{8, 4, 2} {
+		fits := true
+		for _, size := range sizes {
+			if size.coverScale(bounds)*float64(scale) > 1 {
+				fits = false
+				break
+			}
+		}
+
+		if fits {
+			return scale
+		}
+	}
+
+	return 1
 }
 
-// createThumbnail 创建缩略图
-func (s Imaging) createThumbnail(ctx context.Context, bucket, key string, src image.Image, size image.Point, wg *sync.WaitGroup) {
-	defer wg.Done()
+// createThumbnail 从src创建缩略图, src为nil时使用原图, shared不为nil时与其他尺寸共用缩放后的图像, 返回该尺寸的处理结果
+func (s Imaging) createThumbnail(ctx context.Context, original *Original, src image.Image, shared *sharedRender, size Size) SizeResult {
 	start := time.Now()
-	fmt.Printf("Start create %dx%d thumbnail for %s\n", size.X, size.Y, key)
+	bucket, thumbnailKey := s.thumbnailLocation(original.Bucket, original.Key, original.Version, size)
+	result := SizeResult{Size: sizeName(size), Bucket: bucket, Key: thumbnailKey}
+
+	// 即将超时时不再开始新的尺寸, 以免上传到一半被终止
+	if remaining, near := s.deadlineNear(ctx); near {
+		logger.WarnContext(ctx, "Skip size near deadline", "size", result.Size, "thumbnail", thumbnailKey, "remainingMs", remaining.Milliseconds())
+		result.finish(start, errDeadline)
+		return result
+	}
+
+	// PDF渲染后没有可以交给vips的原图内容
+	if original.Source != nil && original.svgRenderer == "" && s.vipsSupported(size) {
+		return s.createThumbnailVips(ctx, original, size, result, start)
+	}
+
+	// SVG按尺寸需要的大小栅格化
+	if original.svgRenderer != "" {
+		var err error
+		if src, err = s.svgSource(original, size); err != nil {
+			logger.ErrorContext(ctx, "Rasterize svg failed", "size", result.Size, "error", err)
+			result.finish(start, err)
+			return result
+		}
+	}
+
+	// vips不支持的尺寸仍然需要解码原图
+	if err := original.decode(); err != nil {
+		logger.ErrorContext(ctx, "Decode image failed", "error", err)
+		result.finish(start, err)
+		return result
+	}
 
-	// 生成缩略图
-	thumbnail := resize.Thumbnail(uint(size.X), uint(size.Y), src, resize.Bilinear)
+	// 动图的webp尺寸生成动画
+	if len(original.frames) > 1 && size.Format == FormatWebP && !size.Placeholder {
+		return s.createAnimatedThumbnail(ctx, original, size, result, start)
+	}
+
+	_, segment := beginSegment(ctx, "resize")
+	segment.annotate("size", result.Size)
+	if src == nil {
+		src = original.Image
+	}
+	thumbnail, err := shared.render(func() (image.Image, error) {
+		var thumbnail image.Image
+		err := runStage(ctx, stageResize, s.config.ResizeTimeout, func() error {
+			thumbnail = s.renderThumbnail(original, src, size)
+			return nil
+		})
+		return thumbnail, err
+	})
+	segment.end(err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Resize image failed", "size", result.Size, "error", err)
+		result.finish(start, err)
+		return result
+	}
+	if thumbnail == nil {
+		result.finish(start, errSkipped)
+		return result
+	}
+	result.Width, result.Height = thumbnail.Bounds().Dx(), thumbnail.Bounds().Dy()
 	reiszed := time.Now()
-	fmt.Printf("Create %dx%d thumbnail for %s in %s\n", size.X, size.Y, key, reiszed.Sub(start).String())
+	result.ResizeMs = durationMs(start)
 
 	// 尝试保存到S3
-	thumbnailKey := s.thumbnailKey(key, size)
-	err := s.saveThumbnail(ctx, thumbnail, bucket, thumbnailKey)
+	uploadCtx, segment := beginSegment(ctx, "upload")
+	segment.annotate("size", result.Size)
+	err = s.saveThumbnail(uploadCtx, original, thumbnail, size, &result)
+	segment.end(err)
+	result.finish(start, err)
 	if err != nil {
-		fmt.Printf("Save thumbnail %s failed due to %v\n", thumbnailKey, err)
-		return
+		logger.ErrorContext(ctx, "Save thumbnail failed", "size", result.Size, "thumbnail", thumbnailKey, "error", err)
+		return result
+	}
+
+	logger.InfoContext(ctx, "Save thumbnail success", "size", result.Size, "thumbnail", thumbnailKey, "durationMs", durationMs(reiszed))
+	return result
+}
+
+// renderThumbnail 从src生成缩略图图像, 跳过该尺寸时返回nil
+func (s Imaging) renderThumbnail(original *Original, src image.Image, size Size) image.Image {
+	key := original.Key
+	start := time.Now()
+	logger.Debug("Start create thumbnail", "bucket", original.Bucket, "key", key, "size", sizeName(size))
+
+	// 避免放大原图, 按比例缩小解码时仍然与原图的尺寸比较
+	target := size
+	if bounds := original.Bounds; size.upscaleFactor(bounds) > 1 {
+		switch s.config.NoUpscale {
+		case "skip":
+			logger.Info("Skip thumbnail larger than original", "bucket", original.Bucket, "key", key, "size", sizeName(size), "width", bounds.X, "height", bounds.Y)
+			return nil
+		case "true":
+			target = size.limitTo(bounds)
+			logger.Info("Limit thumbnail to original", "bucket", original.Bucket, "key", key, "size", sizeName(size), "width", target.X, "height", target.Y)
+		}
+	}
+
+	// 按配置的步骤生成缩略图
+	thumbnail := s.runPipeline(&Render{Original: original, Size: target, Image: src})
+	logger.Debug("Create thumbnail", "bucket", original.Bucket, "key", key, "size", sizeName(size), "durationMs", durationMs(start))
+
+	return thumbnail
+}
+
+// saveThumbnail 保存缩略图到结果中的位置, 并记录写入的字节数和md5
+func (s Imaging) saveThumbnail(ctx context.Context, original *Original, thumbnail image.Image, size Size, result *SizeResult) error {
+	if s.streamable(original, size) {
+		return s.streamThumbnail(ctx, original, thumbnail, size, result)
 	}
 
-	// 发送完成通知
-	fmt.Printf("Save thumbnail %s success in %s\n", thumbnailKey, time.Now().Sub(reiszed).String())
+	return s.bufferThumbnail(ctx, original, thumbnail, size, result)
 }
 
-// saveThumbnail 保存缩略图
-func (s Imaging) saveThumbnail(ctx context.Context, thumbnail image.Image, bucket, key string) error {
+// bufferThumbnail 编码到缓冲区后上传, 上传失败时可以用同样的内容重试
+func (s Imaging) bufferThumbnail(ctx context.Context, original *Original, thumbnail image.Image, size Size, result *SizeResult) error {
+	// 编码到池中的缓冲区, 上传时可以直接按分段读取, 不需要再按分段大小分配缓冲区
+	buffer := getBuffer()
+	defer putBuffer(buffer)
 
-	// 按默认(75)的质量编码缩略图
-	buffer := new(bytes.Buffer)
-	err := jpeg.Encode(buffer, thumbnail, nil)
+	_, segment := beginSegment(ctx, "encode")
+	err := encodeImage(buffer, thumbnail, size)
+	segment.end(err)
 	if err != nil {
-		fmt.Printf("Encode jpeg failed due to %v", err)
+		logger.ErrorContext(ctx, "Encode thumbnail failed", "format", size.Format, "error", err)
 		return err
 	}
 
-	_, err = s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:       aws.String(bucket),
-		Key:          aws.String(key),
-		Body:         bytes.NewReader(buffer.Bytes()),
-		StorageClass: aws.String(s3.ObjectStorageClassStandard),
-		Metadata:     map[string]*string{"kind": aws.String("thumbnail")},
+	return s.putThumbnail(ctx, original, s.withEXIF(original, s.optimizeThumbnail(ctx, buffer.Bytes(), size), size), size, result)
+}
+
+// putThumbnail 写入编码后的缩略图, 并记录写入的字节数和md5
+func (s Imaging) putThumbnail(ctx context.Context, original *Original, content []byte, size Size, result *SizeResult) error {
+	options := s.thumbnailOptions(original, size)
+	uploadCtx, cancel := stageContext(ctx, s.config.UploadTimeout)
+	defer cancel()
+	err := s.retryStorage(uploadCtx, "put", false, func() error {
+		return s.destination.Put(uploadCtx, result.Bucket, result.Key, bytes.NewReader(content), options)
 	})
+	err = stageError(ctx, uploadCtx, stageUpload, s.config.UploadTimeout, err)
 	if err != nil {
-		fmt.Printf("Put bucket %s object %s failed due to %v\n", bucket, key, err)
+		logger.ErrorContext(ctx, "Put thumbnail failed", "thumbnailBucket", result.Bucket, "thumbnail", result.Key, "error", err)
 		return err
 	}
+	sum := md5.Sum(content)
+	result.Bytes, result.MD5 = int64(len(content)), hex.EncodeToString(sum[:])
 
-	return nil
+	err = s.putReplicas(uploadCtx, content, options, result)
+	return stageError(ctx, uploadCtx, stageUpload, s.config.UploadTimeout, err)
+}
+
+// thumbnailOptions 写入缩略图的选项
+func (s Imaging) thumbnailOptions(original *Original, size Size) PutOptions {
+	options := PutOptions{
+		ContentType:  formats[size.Format].ContentType,
+		CacheControl: s.config.CacheControl,
+		StorageClass: size.StorageClass,
+		Metadata:     original.ThumbnailMetadata,
+		Tags:         original.ThumbnailTags,
+	}
+	if s.config.Expires > 0 {
+		options.Expires = time.Now().Add(s.config.Expires)
+	}
+
+	return options
+}
+
+// thumbnailKey 缩略图的key, 模板中没有版本变量时不需要原图的版本
+// 缩略图与原图在同一个bucket且没有单独的前缀时, 依靠key中的WxH识别缩略图, 模板中需要包含尺寸
+func (s Imaging) thumbnailKey(key string, version naming.Version, size Size) string {
+	variant := variant(key, size)
+	variant.Version = version
+	return naming.Key(s.config.KeyTemplate, key, variant)
+}
+
+// thumbnailLocation 缩略图保存的bucket和key
+func (s Imaging) thumbnailLocation(bucket, key string, version naming.Version, size Size) (string, string) {
+	return s.destinationBucket(bucket), s.config.DestinationPrefix + s.thumbnailKey(key, version, size)
+}
+
+// missingSizes 返回尚未按当前原图生成缩略图的尺寸, 已存在的尺寸记录为跳过
+func (s Imaging) missingSizes(ctx context.Context, record events.S3EventRecord, configSizes []Size, result *RecordResult) []Size {
+	etag := strings.Trim(record.S3.Object.ETag, "\"")
+
+	var sizes []Size
+	for _, size := range configSizes {
+		start := time.Now()
+		bucket, key := s.thumbnailLocation(record.S3.Bucket.Name, record.S3.Object.Key, recordVersion(record), size)
+		output, err := s.destination.Head(ctx, bucket, key)
+		if err == nil && etag != "" && metadataValue(output.Metadata, "source-etag") == etag {
+			logger.InfoContext(ctx, "Skip existing thumbnail", "size", sizeName(size), "thumbnail", key)
+			sizeResult := SizeResult{Size: sizeName(size), Bucket: bucket, Key: key}
+			sizeResult.finish(start, errSkipped)
+			result.Sizes = append(result.Sizes, sizeResult)
+			continue
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	return sizes
+}
+
+// destinationBucket 缩略图保存的bucket, 默认保存到原图所在的bucket
+func (s Imaging) destinationBucket(bucket string) string {
+	if s.config.DestinationBucket != "" {
+		return s.config.DestinationBucket
+	}
+
+	return bucket
 }
 
-// thumbnailKey 缩略图的key
-func (s Imaging) thumbnailKey(key string, size image.Point) string {
-	ext := filepath.Ext(key)
-	return strings.Replace(key, ext, fmt.Sprintf("_%dx%d%s", size.X, size.Y, ext), -1)
+// isThumbnail 判断是否是resize生成的缩略图
+// 不能按保存位置判断时读取对象的元数据, 已删除的对象和不保存元数据的本地存储按配置的尺寸生成的key判断
+func (s Imaging) isThumbnail(ctx context.Context, record events.S3EventRecord) (bool, error) {
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	if thumbnail, known := s.thumbnailByLocation(bucket, key); known {
+		return thumbnail, nil
+	}
+	if strings.HasPrefix(record.EventName, "ObjectRemoved:") || s.config.Storage == StorageLocal {
+		return s.thumbnailByName(key), nil
+	}
+
+	var output *ObjectInfo
+	err := s.retryStorage(ctx, "head", true, func() error {
+		var err error
+		output, err = s.store.Head(ctx, bucket, key)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return metadataValue(output.Metadata, "kind") == "thumbnail", nil
+}
+
+// isSupportedKey 是否是支持生成缩略图的文件, 开启PDF, SVG, Video, RAW, GIF, PNG和TIFF时也支持PDF文档, SVG矢量图, 视频, 相机RAW文件, gif, png和tiff图片
+func (s Imaging) isSupportedKey(key string) bool {
+	switch {
+	case strings.HasSuffix(strings.ToLower(key), ".jpg"):
+		return true
+	case isPDF(key):
+		return s.config.PDF
+	case isSVG(key):
+		return s.config.SVG
+	case isVideo(key):
+		return s.config.Video
+	case isRAW(key):
+		return s.config.RAW
+	case isGIF(key):
+		return s.config.GIF
+	case isPNG(key):
+		return s.config.PNG
+	case isTIFF(key):
+		return s.config.TIFF
+	}
+
+	return false
+}
+
+// isThumbnailKey 不读取对象, 按保存位置和key判断是否是缩略图, 按DerivedSuffixes判断是否是其他程序写入的衍生文件
+func (s Imaging) isThumbnailKey(bucket, key string) bool {
+	if s.isDerivedKey(key) {
+		return true
+	}
+	if thumbnail, known := s.thumbnailByLocation(bucket, key); known {
+		return thumbnail
+	}
+
+	return s.thumbnailByName(key)
+}
+
+// thumbnailByLocation 按缩略图保存的位置判断是否是缩略图, 第二个返回值表示能否确定
+func (s Imaging) thumbnailByLocation(bucket, key string) (bool, bool) {
+	// 缩略图保存在其他bucket时不会触发当前bucket的事件
+	if s.destinationBucket(bucket) != bucket {
+		return false, true
+	}
+
+	// 缩略图保存在单独的前缀下
+	if s.config.DestinationPrefix != "" {
+		return strings.HasPrefix(key, s.config.DestinationPrefix), true
+	}
+
+	return false, false
+}
+
+// thumbnailByName 按配置的尺寸生成的key判断是否是缩略图, 只匹配配置的尺寸, 不会误判名称中带有宽高的原图
+func (s Imaging) thumbnailByName(key string) bool {
+	name := strings.TrimSuffix(key, filepath.Ext(key))
+	versioned := naming.Versioned(s.config.KeyTemplate)
+	for _, size := range append(s.config.allSizes(), s.config.OnDemandSizes...) {
+		if strings.HasSuffix(name, "_"+sizeName(size)) {
+			return true
+		}
+
+		// 带版本的key在尺寸后还有版本, 如photo_200x200.0f343b09.jpg
+		if versioned && strings.Contains(name, "_"+sizeName(size)+".") {
+			return true
+		}
+
+		// 命名尺寸可以按名称保存在单独的目录中
+		if size.Name != "" && (strings.HasPrefix(key, size.Name+"/") || strings.Contains(key, "/"+size.Name+"/")) {
+			return true
+		}
+	}
+
+	return false
 }
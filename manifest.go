@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// manifestSuffix 清单文件在原图key后追加的后缀, 如photo.jpg.manifest.json
+const manifestSuffix = ".manifest.json"
+
+// imageManifest 原图所有缩略图的清单, 前端读取一次即可生成<picture>和srcset
+type imageManifest struct {
+	Bucket   string            `json:"bucket"`
+	Key      string            `json:"key"`
+	Width    int               `json:"width"`
+	Height   int               `json:"height"`
+	Variants []manifestVariant `json:"variants"`
+	// URLExpires 缩略图预签名地址的过期时间, 过期后需要重新生成清单
+	URLExpires string `json:"urlExpires,omitempty"`
+}
+
+// manifestVariant 清单中的缩略图
+type manifestVariant struct {
+	Size        string `json:"size"`
+	Key         string `json:"key"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Format      string `json:"format"`
+	ContentType string `json:"contentType"`
+	Bytes       int64  `json:"bytes"`
+	PixelRatio  int    `json:"pixelRatio"`
+	URL         string `json:"url,omitempty"`
+}
+
+// manifestLocation 清单保存的bucket和key, 与缩略图保存在一起
+func (s Imaging) manifestLocation(bucket, key string) (string, string) {
+	return s.destinationBucket(bucket), s.config.DestinationPrefix + key + manifestSuffix
+}
+
+// writeManifest 所有尺寸处理完成后写入清单, 已存在而跳过的尺寸沿用之前清单中的记录
+func (s Imaging) writeManifest(ctx context.Context, original *Original, result *RecordResult) error {
+	bucket, key := s.manifestLocation(result.Bucket, result.Key)
+
+	results := make(map[string]SizeResult, len(result.Sizes))
+	for _, sizeResult := range result.Sizes {
+		results[sizeResult.Key] = sizeResult
+	}
+	previous := s.previousManifest(ctx, bucket, key, results)
+
+	manifest := imageManifest{Bucket: result.Bucket, Key: result.Key, Width: original.Bounds.X, Height: original.Bounds.Y, URLExpires: s.presignExpiresAt(time.Now())}
+	for _, size := range s.config.sizesFor(original.Key) {
+		thumbnailBucket, thumbnailKey := s.thumbnailLocation(result.Bucket, result.Key, original.Version, size)
+		sizeResult := results[thumbnailKey]
+
+		switch {
+		case sizeResult.Status == StatusSucceeded && sizeResult.Width > 0:
+			manifest.Variants = append(manifest.Variants, manifestVariant{
+				Size:        sizeResult.Size,
+				Key:         sizeResult.Key,
+				Width:       sizeResult.Width,
+				Height:      sizeResult.Height,
+				Format:      size.Format,
+				ContentType: formats[size.Format].ContentType,
+				Bytes:       sizeResult.Bytes,
+				PixelRatio:  pixelRatio(size),
+				URL:         s.presignThumbnail(ctx, thumbnailBucket, thumbnailKey),
+			})
+		case sizeResult.Status == StatusSkipped:
+			// 之前清单中的预签名地址可能已经过期, 重新签名
+			if variant, found := previous[thumbnailKey]; found {
+				variant.URL = s.presignThumbnail(ctx, thumbnailBucket, thumbnailKey)
+				manifest.Variants = append(manifest.Variants, variant)
+			}
+		}
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	options := PutOptions{
+		ContentType:  "application/json",
+		CacheControl: s.config.CacheControl,
+		Metadata:     original.ThumbnailMetadata,
+	}
+	err = s.retryStorage(ctx, "put", false, func() error {
+		return s.destination.Put(ctx, bucket, key, bytes.NewReader(content), options)
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Put manifest failed", "manifestBucket", bucket, "manifest", key, "error", err)
+		return err
+	}
+
+	logger.InfoContext(ctx, "Save manifest success", "manifest", key, "variants", len(manifest.Variants))
+	return nil
+}
+
+// previousManifest 有尺寸因为已存在而跳过时, 读取之前清单中的缩略图
+func (s Imaging) previousManifest(ctx context.Context, bucket, key string, results map[string]SizeResult) map[string]manifestVariant {
+	skipped := false
+	for _, result := range results {
+		if result.Status == StatusSkipped {
+			skipped = true
+			break
+		}
+	}
+	if !skipped {
+		return nil
+	}
+
+	manifest, err := s.readManifest(ctx, bucket, key)
+	if err != nil {
+		logger.WarnContext(ctx, "Read previous manifest failed", "manifest", key, "error", err)
+		return nil
+	}
+
+	variants := make(map[string]manifestVariant, len(manifest.Variants))
+	for _, variant := range manifest.Variants {
+		variants[variant.Key] = variant
+	}
+
+	return variants
+}
+
+// readManifest 读取已保存的清单
+func (s Imaging) readManifest(ctx context.Context, bucket, key string) (*imageManifest, error) {
+	object, err := s.destination.Get(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	manifest := new(imageManifest)
+	content, err := ioutil.ReadAll(object.Body)
+	if err == nil {
+		err = json.Unmarshal(content, manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// removeManifest 原图删除时删除清单
+func (s Imaging) removeManifest(ctx context.Context, result *RecordResult) error {
+	bucket, key := s.manifestLocation(result.Bucket, result.Key)
+	if err := s.destination.Delete(ctx, bucket, key); err != nil {
+		logger.ErrorContext(ctx, "Delete manifest failed", "manifestBucket", bucket, "manifest", key, "error", err)
+		return err
+	}
+
+	logger.InfoContext(ctx, "Delete manifest success", "manifest", key)
+	return nil
+}
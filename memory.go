@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+)
+
+const (
+	// memoryReserve 为运行时, 下载和上传缓冲区保留的内存
+	memoryReserve = 128 << 20
+	// memoryPerPixel 处理每个像素大约需要的内存, 解码后的RGBA图像和缩小时的中间图像各4字节
+	memoryPerPixel = 8
+	// typicalImagePixels 按2400万像素的照片估算同时处理的原图数量
+	typicalImagePixels = 24000000
+	// maxImagesPerCPU 每个CPU同时处理的原图数量上限, 下载和上传时不占用CPU
+	maxImagesPerCPU = 4
+)
+
+// memoryBudget 按内存大小得到的同时处理的原图数量和每张原图的最大像素数
+type memoryBudget struct {
+	MemoryMB            int64
+	MaxConcurrentImages int
+	MaxPixels           int64
+}
+
+// lambdaMemoryMB Lambda函数配置的内存, 单位MB, 不在Lambda中运行时为0
+func lambdaMemoryMB() int64 {
+	memory, err := strconv.ParseInt(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64)
+	if err != nil || memory <= 0 {
+		return 0
+	}
+
+	return memory
+}
+
+// newMemoryBudget 按内存大小计算并发和像素限制, 同时处理的原图都达到像素上限时也不超过可用内存
+// 256MB时一次处理一张不超过1600万像素的原图, 10GB时按CPU数量并行处理更多更大的原图
+func newMemoryBudget(memoryMB int64) *memoryBudget {
+	if memoryMB <= 0 {
+		return nil
+	}
+
+	available := memoryMB<<20 - memoryReserve
+	if available < memoryPerPixel*typicalImagePixels/4 {
+		available = memoryPerPixel * typicalImagePixels / 4
+	}
+
+	concurrency := int(available / (memoryPerPixel * typicalImagePixels))
+	if limit := runtime.NumCPU() * maxImagesPerCPU; concurrency > limit {
+		concurrency = limit
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &memoryBudget{
+		MemoryMB:            memoryMB,
+		MaxConcurrentImages: concurrency,
+		MaxPixels:           available / int64(concurrency) / memoryPerPixel,
+	}
+}
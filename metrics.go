@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// emfMetric 嵌入式指标中的指标定义
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// emfDirective 嵌入式指标的元数据
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+// sizeMetrics 单个尺寸的指标
+type sizeMetrics struct {
+	created  int
+	failures int
+	bytesOut int64
+	resizeMs []int64
+}
+
+// emitMetrics 按CloudWatch嵌入式指标格式输出处理结果, Lambda会自动将其转换为指标
+// 汇总指标不带维度, 缩略图指标按尺寸分维度
+func emitMetrics(namespace string, results []RecordResult) {
+	var processed, failed, corrupt int
+	var bytesIn, bytesOut, bytesSaved int64
+	decodeMs := []int64{}
+	sizes := make(map[string]*sizeMetrics)
+	var sizeNames []string
+
+	for _, result := range results {
+		switch result.Status {
+		case StatusSucceeded:
+			processed++
+		case StatusFailed:
+			failed++
+		}
+		if result.Code == errorCodeCorrupt {
+			corrupt++
+		}
+		if result.BytesIn > 0 {
+			bytesIn += result.BytesIn
+			decodeMs = append(decodeMs, result.DecodeMs)
+		}
+
+		for _, size := range result.Sizes {
+			metrics, found := sizes[size.Size]
+			if !found {
+				metrics = &sizeMetrics{resizeMs: []int64{}}
+				sizes[size.Size] = metrics
+				sizeNames = append(sizeNames, size.Size)
+			}
+
+			switch size.Status {
+			case StatusSucceeded:
+				metrics.created++
+			case StatusFailed:
+				metrics.failures++
+			}
+			metrics.bytesOut += size.Bytes
+			bytesOut += size.Bytes
+			if size.Status == StatusSucceeded && size.Bytes > 0 && result.BytesIn > 0 {
+				bytesSaved += result.BytesIn - size.Bytes
+			}
+			if size.ResizeMs > 0 {
+				metrics.resizeMs = append(metrics.resizeMs, size.ResizeMs)
+			}
+		}
+	}
+
+	writeMetrics(namespace, nil, map[string]interface{}{
+		"ImagesProcessed": processed,
+		"ImagesFailed":    failed,
+		"ImagesCorrupt":   corrupt,
+		"BytesIn":         bytesIn,
+		"BytesOut":        bytesOut,
+		"BytesSaved":      bytesSaved,
+		"DecodeDuration":  decodeMs,
+	})
+
+	for _, name := range sizeNames {
+		metrics := sizes[name]
+		writeMetrics(namespace, map[string]string{"Size": name}, map[string]interface{}{
+			"ThumbnailsCreated": metrics.created,
+			"ThumbnailFailures": metrics.failures,
+			"BytesOut":          metrics.bytesOut,
+			"ResizeDuration":    metrics.resizeMs,
+		})
+	}
+}
+
+// metricUnits 指标的单位
+var metricUnits = map[string]string{
+	"ImagesProcessed":   "Count",
+	"ImagesFailed":      "Count",
+	"ImagesCorrupt":     "Count",
+	"ThumbnailsCreated": "Count",
+	"ThumbnailFailures": "Count",
+	"BytesIn":           "Bytes",
+	"BytesOut":          "Bytes",
+	"BytesSaved":        "Bytes",
+	"SavedPercent":      "Percent",
+	"DecodeDuration":    "Milliseconds",
+	"ResizeDuration":    "Milliseconds",
+	"WarmupChecks":      "Count",
+	"WarmupFailures":    "Count",
+	"WarmupDuration":    "Milliseconds",
+}
+
+// writeMetrics 输出一条嵌入式指标日志
+func writeMetrics(namespace string, dimensions map[string]string, values map[string]interface{}) {
+	directive := emfDirective{Namespace: namespace, Dimensions: [][]string{{}}}
+	document := make(map[string]interface{})
+
+	for name, value := range dimensions {
+		directive.Dimensions[0] = append(directive.Dimensions[0], name)
+		document[name] = value
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := values[name]
+		// 没有样本的耗时不输出
+		if samples, ok := value.([]int64); ok && len(samples) == 0 {
+			continue
+		}
+
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: name, Unit: metricUnits[name]})
+		document[name] = value
+	}
+
+	document["_aws"] = map[string]interface{}{
+		"Timestamp":         time.Now().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []emfDirective{directive},
+	}
+
+	content, err := json.Marshal(document)
+	if err != nil {
+		logger.Error("Marshal metrics failed", "error", err)
+		return
+	}
+
+	// 嵌入式指标必须是单独的一行JSON
+	fmt.Fprintln(os.Stdout, string(content))
+}
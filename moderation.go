@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+const (
+	// defaultModerationConfidence 默认的审核标签置信度, 不低于该值时拒绝原图
+	defaultModerationConfidence = 80
+	// maxTagValueLength S3标签值的最大长度
+	maxTagValueLength = 256
+)
+
+// detectModeration 使用Rekognition检测不适宜的内容, 返回置信度不低于配置的标签名称
+// Rekognition直接读取S3中的原图, 不需要再下载一次
+func (s Imaging) detectModeration(ctx context.Context, bucket, key string) ([]string, error) {
+	start := time.Now()
+	output, err := s.rekognition.DetectModerationLabelsWithContext(ctx, &rekognition.DetectModerationLabelsInput{
+		Image: &rekognition.Image{
+			S3Object: &rekognition.S3Object{
+				Bucket: aws.String(bucket),
+				Name:   aws.String(key),
+			},
+		},
+		MinConfidence: aws.Float64(s.config.ModerationConfidence),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	for _, label := range output.ModerationLabels {
+		if aws.Float64Value(label.Confidence) >= s.config.ModerationConfidence {
+			labels = append(labels, aws.StringValue(label.Name))
+		}
+	}
+	logger.DebugContext(ctx, "Detect moderation labels", "labels", labels, "durationMs", durationMs(start))
+
+	return labels, nil
+}
+
+// rejectModerated 为未通过审核的原图添加标签, 设置了QuarantineBucket时移动到隔离bucket
+func (s Imaging) rejectModerated(ctx context.Context, record events.S3EventRecord, labels []string) error {
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+
+	// 试运行不修改原图
+	if s.config.DryRun {
+		logger.InfoContext(ctx, "Dry run reject moderated image", "labels", labels, "quarantineBucket", s.config.QuarantineBucket)
+		return nil
+	}
+
+	if writer, ok := s.store.(TagWriter); ok {
+		// 写入标签会替换所有标签, 需要保留原有的标签
+		tags := make(map[string]string)
+		if reader, ok := s.store.(TagReader); ok {
+			sourceTags, err := reader.Tags(ctx, bucket, key)
+			if err != nil {
+				logger.ErrorContext(ctx, "Read tags failed", "error", err)
+				return err
+			}
+			for name, value := range sourceTags {
+				tags[name] = value
+			}
+		}
+
+		tags["moderation"] = "rejected"
+		tags["moderation-labels"] = moderationTagValue(labels)
+		if err := writer.PutTags(ctx, bucket, key, tags); err != nil {
+			logger.ErrorContext(ctx, "Put moderation tags failed", "error", err)
+			return err
+		}
+	}
+
+	if s.config.QuarantineBucket == "" {
+		return nil
+	}
+
+	return s.quarantine(ctx, bucket, key, strings.Trim(record.S3.Object.ETag, "\""))
+}
+
+// quarantine 将etag对应的原图移动到隔离bucket, key保持不变, 原图已经被覆盖时不移动
+func (s Imaging) quarantine(ctx context.Context, bucket, key, etag string) error {
+	if err := s.copyObject(ctx, bucket, key, etag, s.config.QuarantineBucket, key, ""); err != nil {
+		logger.ErrorContext(ctx, "Copy image to quarantine failed", "quarantineBucket", s.config.QuarantineBucket, "error", err)
+		return err
+	}
+
+	if err := s.store.Delete(ctx, bucket, key); err != nil {
+		logger.ErrorContext(ctx, "Delete quarantined image failed", "error", err)
+		return err
+	}
+
+	logger.InfoContext(ctx, "Quarantine image success", "quarantineBucket", s.config.QuarantineBucket)
+	return nil
+}
+
+// moderationTagValue 审核标签名称组成的标签值, S3标签值不能包含逗号
+func moderationTagValue(labels []string) string {
+	value := strings.Join(labels, "/")
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+
+	return value
+}
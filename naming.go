@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/nzai/resize/pkg/naming"
+)
+
+// variant 命名缩略图使用的尺寸信息, 扩展名按原图和输出格式确定
+func variant(key string, size Size) naming.Variant {
+	return naming.Variant{
+		Name:        size.Name,
+		Width:       size.X,
+		Height:      size.Y,
+		Mode:        size.Mode,
+		PixelRatio:  size.PixelRatio,
+		Placeholder: size.Placeholder,
+		Extension:   formatExtension(key, size.Format),
+	}
+}
+
+// sizeName 尺寸的名称, 如thumb, 200x200, 200x200@2x或32x32_lqip
+func sizeName(size Size) string {
+	return variant("", size).SizeName()
+}
+
+// pixelRatio 尺寸的倍数, 原始尺寸为1
+func pixelRatio(size Size) int {
+	return variant("", size).Ratio()
+}
+
+// recordVersion 事件记录中原图的版本, 删除事件中没有ETag
+func recordVersion(record events.S3EventRecord) naming.Version {
+	return naming.Version{ETag: strings.Trim(record.S3.Object.ETag, "\""), ID: record.S3.Object.VersionID}
+}
+
+// sourceVersion 模板中有版本变量时读取原图最新版本的ETag和版本ID
+func (s Imaging) sourceVersion(ctx context.Context, bucket, key string) (naming.Version, error) {
+	if !naming.Versioned(s.config.KeyTemplate) {
+		return naming.Version{}, nil
+	}
+
+	info, err := s.store.Head(ctx, bucket, key)
+	if err != nil {
+		return naming.Version{}, err
+	}
+
+	return naming.Version{ETag: strings.Trim(info.ETag, "\""), ID: info.VersionID}, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// completionMessage 缩略图全部生成后发送的通知
+type completionMessage struct {
+	Bucket     string             `json:"bucket"`
+	Key        string             `json:"key"`
+	Thumbnails []thumbnailMessage `json:"thumbnails"`
+	// URLExpires 缩略图预签名地址的过期时间
+	URLExpires string `json:"urlExpires,omitempty"`
+}
+
+// thumbnailMessage 通知中的缩略图
+type thumbnailMessage struct {
+	Size   string `json:"size"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int64  `json:"bytes"`
+	MD5    string `json:"md5"`
+	URL    string `json:"url,omitempty"`
+}
+
+// completion 本次生成的缩略图, 配置了PresignExpires时附带预签名地址
+func (s Imaging) completion(ctx context.Context, result *RecordResult) completionMessage {
+	return completionMessage{
+		Bucket:     result.Bucket,
+		Key:        result.Key,
+		Thumbnails: s.readyThumbnails(ctx, result),
+		URLExpires: s.presignExpiresAt(time.Now()),
+	}
+}
+
+// readyThumbnails 本次生成的缩略图
+func (s Imaging) readyThumbnails(ctx context.Context, result *RecordResult) []thumbnailMessage {
+	var thumbnails []thumbnailMessage
+	for _, size := range result.Sizes {
+		if size.Status == StatusSucceeded && size.Width > 0 {
+			thumbnails = append(thumbnails, thumbnailMessage{
+				Size:   size.Size,
+				Bucket: size.Bucket,
+				Key:    size.Key,
+				Width:  size.Width,
+				Height: size.Height,
+				Bytes:  size.Bytes,
+				MD5:    size.MD5,
+				URL:    s.presignThumbnail(ctx, size.Bucket, size.Key),
+			})
+		}
+	}
+
+	return thumbnails
+}
+
+// notify 发送缩略图生成完成的通知, 没有配置主题或者没有新生成的缩略图时不发送
+// 缩略图已经保存, 发送失败只记录日志, 避免重试时重复生成
+func (s Imaging) notify(ctx context.Context, result *RecordResult) {
+	if s.sns == nil {
+		return
+	}
+
+	message := s.completion(ctx, result)
+	if len(message.Thumbnails) == 0 {
+		return
+	}
+
+	content, err := json.Marshal(message)
+	if err != nil {
+		logger.ErrorContext(ctx, "Marshal notification failed", "error", err)
+		return
+	}
+
+	output, err := s.sns.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.config.NotificationTopicArn),
+		Message:  aws.String(string(content)),
+		// 订阅可以按bucket过滤
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"bucket": {DataType: aws.String("String"), StringValue: aws.String(result.Bucket)},
+		},
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Publish notification failed", "error", err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Publish notification", "messageId", aws.StringValue(output.MessageId))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ObjectLambdaEvent S3 Object Lambda访问点的调用事件
+type ObjectLambdaEvent struct {
+	XAmzRequestID    string `json:"xAmzRequestId"`
+	GetObjectContext struct {
+		InputS3URL  string `json:"inputS3Url"`
+		OutputRoute string `json:"outputRoute"`
+		OutputToken string `json:"outputToken"`
+	} `json:"getObjectContext"`
+	Configuration struct {
+		AccessPointArn string `json:"accessPointArn"`
+		Payload        string `json:"payload"`
+	} `json:"configuration"`
+	UserRequest struct {
+		URL string `json:"url"`
+	} `json:"userRequest"`
+}
+
+// objectLambdaPayload 访问点配置中的默认参数, 如{"size": "300x300:fill"}
+type objectLambdaPayload struct {
+	Size string `json:"size"`
+}
+
+// ObjectLambdaEvent 处理经过Object Lambda访问点的GET请求, 返回转换后的图像, 不保存任何缩略图
+func (s Imaging) ObjectLambdaEvent(ctx context.Context, event ObjectLambdaEvent) (map[string]interface{}, error) {
+	writer, ok := s.store.(ObjectLambdaWriter)
+	if !ok {
+		return nil, fmt.Errorf("object lambda requires s3 storage")
+	}
+
+	output := objectLambdaOutput{
+		writer:       writer,
+		route:        event.GetObjectContext.OutputRoute,
+		token:        event.GetObjectContext.OutputToken,
+		cacheControl: s.config.CacheControl,
+	}
+
+	err := s.transformObject(ctx, event, &output)
+	if err != nil {
+		logger.ErrorContext(ctx, "Transform object failed", "url", event.UserRequest.URL, "error", err)
+		err = output.fail(ctx, http.StatusInternalServerError, "InternalError", "transform image failed")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"statusCode": http.StatusOK}, nil
+}
+
+// transformObject 读取原图并按请求参数转换
+func (s Imaging) transformObject(ctx context.Context, event ObjectLambdaEvent, output *objectLambdaOutput) error {
+	userURL, err := url.Parse(event.UserRequest.URL)
+	if err != nil {
+		return output.fail(ctx, http.StatusBadRequest, "InvalidRequest", "request url is invalid")
+	}
+	key := strings.TrimPrefix(userURL.Path, "/")
+
+	request, err := http.NewRequest(http.MethodGet, event.GetObjectContext.InputS3URL, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// 原图不存在或者没有权限时原样返回错误
+	if response.StatusCode != http.StatusOK {
+		return output.fail(ctx, response.StatusCode, http.StatusText(response.StatusCode), "get original object failed")
+	}
+
+	// 原样返回不支持的文件和没有指定尺寸的请求
+	query := map[string]string{"key": key}
+	for name := range userURL.Query() {
+		query[name] = userURL.Query().Get(name)
+	}
+	if query["w"] == "" && query["h"] == "" && event.Configuration.Payload != "" {
+		var payload objectLambdaPayload
+		if err = json.Unmarshal([]byte(event.Configuration.Payload), &payload); err != nil {
+			return fmt.Errorf("access point payload is invalid: %v", err)
+		}
+
+		if payload.Size != "" {
+			size, err := parseSize(payload.Size)
+			if err != nil {
+				return fmt.Errorf("access point payload size %s is invalid: %v", payload.Size, err)
+			}
+			query["w"], query["h"], query["mode"] = strconv.Itoa(size.X), strconv.Itoa(size.Y), size.Mode
+		}
+	}
+
+	if (query["w"] == "" && query["h"] == "") || !strings.HasSuffix(strings.ToLower(key), ".jpg") {
+		content, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+
+		return output.write(ctx, response.Header.Get("Content-Type"), content)
+	}
+
+	_, size, err := s.parseResizeQuery(query)
+	if err != nil {
+		return output.fail(ctx, http.StatusBadRequest, "InvalidArgument", err.Error())
+	}
+
+	object := &Object{
+		ObjectInfo: *s3ObjectInfo(aws.String(response.Header.Get("ETag")), aws.Int64(response.ContentLength), aws.String(response.Header.Get("Content-Type")),
+			aws.String(response.Header.Get("X-Amz-Server-Side-Encryption")), aws.String(response.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm")), nil),
+		Body: response.Body,
+	}
+	for name, values := range response.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") && len(values) > 0 {
+			object.Metadata[strings.ToLower(strings.TrimPrefix(name, "X-Amz-Meta-"))] = values[0]
+		}
+	}
+
+	original, err := s.decodeOriginal("", key, object, []Size{size})
+	if err != nil {
+		return err
+	}
+	if err = original.decode(); err != nil {
+		return err
+	}
+
+	size = s.prepareSizes(ctx, original, []Size{size})[0]
+	thumbnail := s.renderThumbnail(original, original.Image, size)
+	if thumbnail == nil {
+		// 不放大时直接返回原尺寸
+		size = size.limitTo(original.Bounds)
+		thumbnail = s.renderThumbnail(original, original.Image, size)
+	}
+
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	if err = encodeImage(buffer, thumbnail, size); err != nil {
+		return err
+	}
+
+	return output.write(ctx, formats[size.Format].ContentType, s.optimizeThumbnail(ctx, buffer.Bytes(), size))
+}
+
+// objectLambdaOutput 通过WriteGetObjectResponse返回给调用方的响应
+type objectLambdaOutput struct {
+	writer ObjectLambdaWriter
+	route  string
+	token  string
+	// cacheControl 转换后的图像返回的Cache-Control
+	cacheControl string
+}
+
+// write 返回图像
+func (o *objectLambdaOutput) write(ctx context.Context, contentType string, content []byte) error {
+	header := http.Header{}
+	header.Set("X-Amz-Fwd-Status", strconv.Itoa(http.StatusOK))
+	if contentType != "" {
+		header.Set("X-Amz-Fwd-Header-Content-Type", contentType)
+	}
+	if o.cacheControl != "" {
+		header.Set("X-Amz-Fwd-Header-Cache-Control", o.cacheControl)
+	}
+
+	return o.writer.WriteGetObjectResponse(ctx, o.route, o.token, header, content)
+}
+
+// fail 返回错误
+func (o *objectLambdaOutput) fail(ctx context.Context, statusCode int, code, message string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Fwd-Status", strconv.Itoa(statusCode))
+	header.Set("X-Amz-Fwd-Error-Code", code)
+	header.Set("X-Amz-Fwd-Error-Message", message)
+
+	return o.writer.WriteGetObjectResponse(ctx, o.route, o.token, header, nil)
+}
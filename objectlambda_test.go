@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// objectLambdaStore 记录WriteGetObjectResponse的本地存储
+type objectLambdaStore struct {
+	*LocalStore
+	route, token string
+	header       http.Header
+	content      []byte
+}
+
+// WriteGetObjectResponse 实现ObjectLambdaWriter
+func (s *objectLambdaStore) WriteGetObjectResponse(ctx context.Context, route, token string, header http.Header, content []byte) error {
+	s.route, s.token, s.header, s.content = route, token, header, content
+	return nil
+}
+
+// objectLambdaTestEvent 访问点的GET请求, 原图从source读取
+func objectLambdaTestEvent(source, path, payload string) ObjectLambdaEvent {
+	var event ObjectLambdaEvent
+	event.GetObjectContext.InputS3URL = source + path
+	event.GetObjectContext.OutputRoute = "io-route"
+	event.GetObjectContext.OutputToken = "io-token"
+	event.Configuration.Payload = payload
+	event.UserRequest.URL = "https://photos-ap-123456789012.s3-object-lambda.us-east-1.amazonaws.com" + path
+
+	return event
+}
+
+func TestObjectLambdaEvent(t *testing.T) {
+	original := testJPEG(t, 400, 300)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.jpg" {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(original)))
+		w.Write(original)
+	}))
+	defer source.Close()
+
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "CacheControl": "max-age=60"})
+	store := &objectLambdaStore{LocalStore: NewLocalStore()}
+	s.store = store
+
+	cases := []struct {
+		name, path, payload string
+		status              int
+		width, height       int
+	}{
+		{"query size", "/a.jpg?w=80&h=80&mode=fill", "", http.StatusOK, 80, 80},
+		{"payload size", "/a.jpg", `{"size": "100x100"}`, http.StatusOK, 100, 75},
+		{"original", "/a.jpg", "", http.StatusOK, 400, 300},
+		{"invalid size", "/a.jpg?w=0", "", http.StatusBadRequest, 0, 0},
+		{"missing", "/missing.jpg?w=80", "", http.StatusNotFound, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store.header, store.content = nil, nil
+			response, err := s.ObjectLambdaEvent(context.Background(), objectLambdaTestEvent(source.URL, c.path, c.payload))
+			if err != nil {
+				t.Fatalf("object lambda failed: %v", err)
+			}
+			if response["statusCode"] != http.StatusOK {
+				t.Errorf("invocation returned %v", response)
+			}
+			if store.route != "io-route" || store.token != "io-token" {
+				t.Errorf("response route is %s and token is %s", store.route, store.token)
+			}
+			if status := store.header.Get("X-Amz-Fwd-Status"); status != strconv.Itoa(c.status) {
+				t.Fatalf("forwarded status is %s, want %d: %s", status, c.status, store.header.Get("X-Amz-Fwd-Error-Message"))
+			}
+			if c.status != http.StatusOK {
+				if store.header.Get("X-Amz-Fwd-Error-Code") == "" || len(store.content) != 0 {
+					t.Errorf("failed response has headers %v and %d bytes", store.header, len(store.content))
+				}
+				return
+			}
+
+			if cacheControl := store.header.Get("X-Amz-Fwd-Header-Cache-Control"); cacheControl != "max-age=60" {
+				t.Errorf("forwarded cache control is %s", cacheControl)
+			}
+			config, _, err := image.DecodeConfig(bytes.NewReader(store.content))
+			if err != nil {
+				t.Fatalf("decode response failed: %v", err)
+			}
+			if config.Width != c.width || config.Height != c.height {
+				t.Errorf("response is %dx%d, want %dx%d", config.Width, config.Height, c.width, c.height)
+			}
+		})
+	}
+}
+
+func TestObjectLambdaRequiresWriter(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100"})
+	if _, err := s.ObjectLambdaEvent(context.Background(), objectLambdaTestEvent("http://127.0.0.1:1", "/a.jpg", "")); err == nil {
+		t.Errorf("object lambda with local storage returned no error")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// maxResponseSize Lambda同步调用的响应最大6MB, base64编码后会增大三分之一
+	maxResponseSize = 4 << 20
+)
+
+// httpRequest API Gateway REST API(1.0)和Function URL/HTTP API(2.0)的请求
+type httpRequest struct {
+	HTTPMethod            string            `json:"httpMethod"`
+	Path                  string            `json:"path"`
+	RawPath               string            `json:"rawPath"`
+	QueryStringParameters map[string]string `json:"queryStringParameters"`
+	RequestContext        struct {
+		HTTP struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// method 请求方法
+func (r httpRequest) method() string {
+	if r.HTTPMethod != "" {
+		return r.HTTPMethod
+	}
+
+	return r.RequestContext.HTTP.Method
+}
+
+// HTTPEvent 处理按需缩放的请求, 如GET /resize?key=photos/a.jpg&w=300&h=300&mode=fill&rotate=90
+func (s Imaging) HTTPEvent(ctx context.Context, request httpRequest) events.APIGatewayProxyResponse {
+	if request.method() != http.MethodGet {
+		return httpError(http.StatusMethodNotAllowed, "method %s is not allowed", request.method())
+	}
+
+	if s.config.SourceBucket == "" {
+		return httpError(http.StatusNotImplemented, "on-demand resize is not enabled")
+	}
+
+	key, size, err := s.parseResizeQuery(request.QueryStringParameters)
+	if err != nil {
+		return httpError(http.StatusBadRequest, "%v", err)
+	}
+
+	// 只允许访问会触发生成缩略图的原图
+	if s.isThumbnailKey(s.config.SourceBucket, key) || !s.config.KeyFilter.Match(key) || !s.isSupportedKey(key) {
+		return httpError(http.StatusForbidden, "key %s is not allowed", key)
+	}
+
+	// 请求中指定的旋转和翻转不体现在缩略图的key中, 不能使用缓存
+	query := request.QueryStringParameters
+	cache := s.config.CacheResized && query["rotate"] == "" && query["flip"] == ""
+	content, err := s.resizeOnDemand(ctx, s.config.SourceBucket, key, size, cache)
+	if err != nil {
+		if isNotFound(err) {
+			return httpError(http.StatusNotFound, "key %s is not found", key)
+		}
+		if isTooLarge(err) {
+			return httpError(http.StatusRequestEntityTooLarge, "%v", err)
+		}
+
+		logger.ErrorContext(ctx, "Resize on demand failed", "key", key, "size", sizeName(size), "error", err)
+		return httpError(http.StatusInternalServerError, "resize failed")
+	}
+
+	if len(content) > maxResponseSize {
+		return httpError(http.StatusBadGateway, "thumbnail is too large to return")
+	}
+
+	headers := map[string]string{"Content-Type": formats[size.Format].ContentType}
+	if s.config.CacheControl != "" {
+		headers["Cache-Control"] = s.config.CacheControl
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode:      http.StatusOK,
+		Headers:         headers,
+		Body:            base64.StdEncoding.EncodeToString(content),
+		IsBase64Encoded: true,
+	}
+}
+
+// parseResizeQuery 解析请求参数, 未指定的选项使用全局配置
+func (s Imaging) parseResizeQuery(query map[string]string) (string, Size, error) {
+	key := strings.TrimPrefix(query["key"], "/")
+	if key == "" {
+		return "", Size{}, fmt.Errorf("key is required")
+	}
+
+	width, err := strconv.Atoi(query["w"])
+	if err != nil || width <= 0 || width > s.config.MaxDimension {
+		return "", Size{}, fmt.Errorf("w %s is invalid", query["w"])
+	}
+
+	// 正方形头像只需要指定宽度
+	mode := query["mode"]
+	heightString := query["h"]
+	if mode == ModeSquare && heightString == "" {
+		heightString = query["w"]
+	}
+	height, err := strconv.Atoi(heightString)
+	if err != nil || height <= 0 || height > s.config.MaxDimension {
+		return "", Size{}, fmt.Errorf("h %s is invalid", query["h"])
+	}
+
+	token := fmt.Sprintf("%dx%d", width, height)
+	if mode != "" {
+		if mode != ModeFit && mode != ModeFill && mode != ModeStretch && mode != ModePad && mode != ModeSquare {
+			return "", Size{}, fmt.Errorf("mode %s is invalid", mode)
+		}
+		token += ":" + mode
+	}
+
+	// 每次请求可以单独指定旋转和翻转
+	for _, option := range []string{"rotate", "flip"} {
+		if value := query[option]; value != "" {
+			token += ":" + option + "=" + value
+		}
+	}
+
+	size, err := parseSize(token)
+	if err != nil {
+		return "", Size{}, err
+	}
+
+	size, err = s.onDemandSize(size)
+	if err != nil {
+		return "", Size{}, err
+	}
+
+	return key, size, nil
+}
+
+// onDemandSize 补充请求尺寸的默认选项, 配置了OnDemandSizes时只能请求其中的尺寸, 请求中的旋转和翻转覆盖配置
+func (s Imaging) onDemandSize(size Size) (Size, error) {
+	transform := size.Transform
+	size = s.config.sizeDefaults(size)
+
+	// 配置了允许的尺寸时只能请求这些尺寸, 避免被任意尺寸的请求刷爆存储和费用
+	if len(s.config.OnDemandSizes) == 0 {
+		return size, nil
+	}
+
+	for _, allowed := range s.config.OnDemandSizes {
+		if allowed.Point == size.Point && allowed.Mode == size.Mode {
+			allowed = s.config.sizeDefaults(allowed)
+			if !transform.IsZero() {
+				allowed.Transform = transform
+			}
+			return allowed, nil
+		}
+	}
+
+	return Size{}, fmt.Errorf("size %s is not allowed", size)
+}
+
+// resizeOnDemand 生成缩略图, 开启缓存时优先返回已保存的缩略图, 并保存新生成的缩略图
+func (s Imaging) resizeOnDemand(ctx context.Context, sourceBucket, key string, size Size, cache bool) ([]byte, error) {
+	version, err := s.sourceVersion(ctx, sourceBucket, key)
+	if err != nil {
+		return nil, err
+	}
+	bucket, thumbnailKey := s.thumbnailLocation(sourceBucket, key, version, size)
+	if cache {
+		if content, ok := s.cachedThumbnail(ctx, sourceBucket, key, bucket, thumbnailKey); ok {
+			logger.InfoContext(ctx, "Return cached thumbnail", "thumbnail", thumbnailKey)
+			return content, nil
+		}
+	}
+
+	record := events.S3EventRecord{EventSource: "http", EventName: "ObjectCreated:Get"}
+	record.S3.Bucket.Name = sourceBucket
+	record.S3.Object.Key = key
+
+	// 不放大时返回原尺寸, 仍然需要解码原图
+	original, err := s.readImage(ctx, record, []Size{size}, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = original.decode(); err != nil {
+		return nil, err
+	}
+
+	size = s.prepareSizes(ctx, original, []Size{size})[0]
+	thumbnail := s.renderThumbnail(original, original.Image, size)
+	if thumbnail == nil {
+		// 不放大时直接返回原尺寸
+		size = size.limitTo(original.Bounds)
+		thumbnail = s.renderThumbnail(original, original.Image, size)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err = encodeImage(buffer, thumbnail, size); err != nil {
+		return nil, err
+	}
+	content := s.optimizeThumbnail(ctx, buffer.Bytes(), size)
+
+	// 缓存失败不影响本次请求
+	if cache {
+		if err = s.destination.Put(ctx, bucket, thumbnailKey, bytes.NewReader(content), s.thumbnailOptions(original, size)); err != nil {
+			logger.WarnContext(ctx, "Cache thumbnail failed", "thumbnail", thumbnailKey, "error", err)
+		}
+	}
+
+	return content, nil
+}
+
+// cachedThumbnail 读取按当前原图生成的缩略图
+func (s Imaging) cachedThumbnail(ctx context.Context, sourceBucket, key, bucket, thumbnailKey string) ([]byte, bool) {
+	object, err := s.destination.Get(ctx, bucket, thumbnailKey)
+	if err != nil {
+		return nil, false
+	}
+	defer object.Body.Close()
+
+	// 原图更新后缓存失效
+	info, err := s.store.Head(ctx, sourceBucket, key)
+	if err != nil || strings.Trim(info.ETag, "\"") != metadataValue(object.Metadata, "source-etag") {
+		return nil, false
+	}
+
+	content, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return nil, false
+	}
+
+	return content, true
+}
+
+// httpError 错误响应
+func httpError(statusCode int, format string, args ...interface{}) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		Body:       fmt.Sprintf(format, args...),
+	}
+}
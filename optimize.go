@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultJPEGOptimizer 无损优化jpeg使用的jpegtran命令, 使用mozjpeg的jpegtran效果更好, Lambda中可以通过层安装到/opt/bin
+	defaultJPEGOptimizer = "jpegtran"
+	// jpegOptimizeTimeout 优化单个缩略图的超时时间
+	jpegOptimizeTimeout = 10 * time.Second
+)
+
+// optimizeThumbnail 无损优化编码后的jpeg缩略图, 失败或者没有变小时使用原来的内容
+func (s Imaging) optimizeThumbnail(ctx context.Context, content []byte, size Size) []byte {
+	if !s.config.OptimizeJPEG || size.Format != FormatJPEG {
+		return content
+	}
+
+	_, segment := beginSegment(ctx, "optimize")
+	start := time.Now()
+	optimized, err := optimizeJPEG(s.config.JPEGOptimizer, content)
+	segment.end(err)
+	if err != nil {
+		logger.WarnContext(ctx, "Optimize thumbnail failed", "size", sizeName(size), "error", err)
+		return content
+	}
+	if len(optimized) == 0 || len(optimized) >= len(content) {
+		return content
+	}
+	logger.DebugContext(ctx, "Optimize thumbnail", "size", sizeName(size), "bytes", len(content), "optimizedBytes", len(optimized), "durationMs", durationMs(start))
+
+	return optimized
+}
+
+// optimizeJPEG 用jpegtran重新计算霍夫曼表并去掉元数据, 图像内容不变
+func optimizeJPEG(optimizer string, content []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jpegOptimizeTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, optimizer, "-copy", "none", "-optimize")
+	command.Stdin, command.Stdout, command.Stderr = bytes.NewReader(content), &stdout, &stderr
+	if err := command.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed due to %v: %s", optimizer, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
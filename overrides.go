@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// overrideSizesMetadata 代替配置的尺寸, 格式与Sizes相同, 如100x100,300x300
+	overrideSizesMetadata = "resize-sizes"
+	// overrideModeMetadata 所有尺寸的缩放模式, fit, fill, stretch, pad或square
+	overrideModeMetadata = "resize-mode"
+	// overrideFormatMetadata 所有尺寸的输出格式
+	overrideFormatMetadata = "resize-format"
+	// overrideQualityMetadata 所有尺寸的jpeg编码质量
+	overrideQualityMetadata = "resize-quality"
+	// maxOverrideSizes 一个原图的元数据中最多可以指定的尺寸数量
+	maxOverrideSizes = 10
+)
+
+// objectSizes 原图使用的尺寸, 开启MetadataOverrides时读取原图的元数据覆盖配置的尺寸
+func (s Imaging) objectSizes(ctx context.Context, record events.S3EventRecord) ([]Size, error) {
+	sizes := s.config.sizesFor(record.S3.Object.Key)
+	if !s.config.MetadataOverrides {
+		return sizes, nil
+	}
+
+	var info *ObjectInfo
+	err := s.retryStorage(ctx, "head", true, func() error {
+		var err error
+		info, err = s.store.Head(ctx, record.S3.Bucket.Name, record.S3.Object.Key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.overrideSizes(ctx, info.Metadata, sizes), nil
+}
+
+// overrideSizes 按元数据覆盖尺寸, 无效的元数据忽略并使用配置的尺寸
+// 元数据中的尺寸不能超过MaxDimension, 避免上传者生成过大的缩略图
+func (s Imaging) overrideSizes(ctx context.Context, metadata map[string]string, sizes []Size) []Size {
+	sizesString := metadataValue(metadata, overrideSizesMetadata)
+	mode := strings.ToLower(metadataValue(metadata, overrideModeMetadata))
+	formatString := metadataValue(metadata, overrideFormatMetadata)
+	qualityString := metadataValue(metadata, overrideQualityMetadata)
+	if sizesString == "" && mode == "" && formatString == "" && qualityString == "" {
+		return sizes
+	}
+
+	overridden, err := s.parseOverrides(sizesString, mode, formatString, qualityString, sizes)
+	if err != nil {
+		logger.WarnContext(ctx, "Ignore invalid size overrides", "error", err)
+		return sizes
+	}
+	logger.InfoContext(ctx, "Override sizes", "sizes", fmt.Sprint(overridden))
+
+	return overridden
+}
+
+// parseOverrides 解析元数据中的尺寸和选项, 没有指定尺寸时修改配置的尺寸
+func (s Imaging) parseOverrides(sizesString, mode, formatString, qualityString string, sizes []Size) ([]Size, error) {
+	if sizesString != "" {
+		parsed, err := parseSizes(sizesString)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(parsed) > maxOverrideSizes {
+			return nil, fmt.Errorf("%d sizes are more than %d", len(parsed), maxOverrideSizes)
+		}
+
+		sizes = parsed
+		for index := range sizes {
+			if sizes[index].X > s.config.MaxDimension || sizes[index].Y > s.config.MaxDimension {
+				return nil, fmt.Errorf("size %s is larger than %d", sizes[index], s.config.MaxDimension)
+			}
+			sizes[index] = s.config.sizeDefaults(sizes[index])
+		}
+	}
+
+	switch mode {
+	case "", ModeFit, ModeFill, ModeStretch, ModePad, ModeSquare:
+	default:
+		return nil, fmt.Errorf("mode %s is invalid", mode)
+	}
+
+	var format string
+	if formatString != "" {
+		var err error
+		if format, err = parseFormat(formatString); err != nil {
+			return nil, err
+		}
+	}
+
+	var quality int
+	if qualityString != "" {
+		var err error
+		quality, err = strconv.Atoi(qualityString)
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("quality %s is invalid", qualityString)
+		}
+	}
+
+	// 配置的尺寸会被其他原图共用, 修改副本
+	overridden := make([]Size, len(sizes))
+	for index, size := range sizes {
+		switch mode {
+		case "":
+		case ModeSquare:
+			// 与按需缩放一样按宽度裁剪为正方形
+			size.Y, size.Mode = size.X, ModeFill
+		default:
+			size.Mode = mode
+		}
+		if format != "" {
+			size.Format = format
+		}
+		if quality != 0 && !size.Placeholder {
+			size.Quality = quality
+		}
+		overridden[index] = size
+	}
+
+	return overridden, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestOverrideSizes(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100,300x200", "MetadataOverrides": "true"})
+	ctx := context.Background()
+
+	sizes := s.overrideSizes(ctx, map[string]string{"Resize-Mode": "square"}, s.config.Sizes)
+	if len(sizes) != 2 || sizes[1].X != 300 || sizes[1].Y != 300 || sizes[1].Mode != ModeFill {
+		t.Errorf("square sizes are %v, want 100x100 and 300x300 filled", sizes)
+	}
+	if s.config.Sizes[1].Y != 200 {
+		t.Errorf("override changed the configured size %v", s.config.Sizes[1])
+	}
+
+	sizes = s.overrideSizes(ctx, map[string]string{"resize-sizes": "64x64,128x128", "resize-mode": "pad"}, s.config.Sizes)
+	if len(sizes) != 2 || sizes[0].X != 64 || sizes[1].Mode != ModePad {
+		t.Errorf("overridden sizes are %v", sizes)
+	}
+}
+
+func TestOverrideSizesInvalid(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "100x100", "MetadataOverrides": "true"})
+	tooMany := strings.TrimSuffix(strings.Repeat("10x10,", maxOverrideSizes+1), ",")
+
+	for name, metadata := range map[string]map[string]string{
+		"unknown mode": {"resize-mode": "zoom"},
+		"too large":    {"resize-sizes": "99999x10"},
+		"too many":     {"resize-sizes": tooMany},
+		"quality":      {"resize-quality": "101"},
+	} {
+		// 无效的元数据使用配置的尺寸
+		sizes := s.overrideSizes(context.Background(), metadata, s.config.Sizes)
+		if len(sizes) != 1 || sizes[0].Point != s.config.Sizes[0].Point || sizes[0].Mode != s.config.Sizes[0].Mode {
+			t.Errorf("%s overrides are %v, want the configured sizes", name, sizes)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"runtime/debug"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// recoverError 将panic转换为错误并记录堆栈, 必须直接在defer中调用
+func recoverError(ctx context.Context, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	logger.ErrorContext(ctx, "Recover panic", "panic", fmt.Sprint(value), "stack", string(debug.Stack()))
+	*err = fmt.Errorf("panic: %v", value)
+}
+
+// safeHandleRecord 处理单条事件记录, 损坏的图片导致panic时只有该记录失败
+func (s Imaging) safeHandleRecord(ctx context.Context, record events.S3EventRecord, result *RecordResult) (err error) {
+	defer recoverError(ctx, &err)
+
+	return s.handleRecord(ctx, record, result)
+}
+
+// safeCreateThumbnail 创建单个尺寸的缩略图, panic时只有该尺寸失败
+func (s Imaging) safeCreateThumbnail(ctx context.Context, original *Original, src image.Image, shared *sharedRender, size Size) (result SizeResult) {
+	start := time.Now()
+	var err error
+	defer func() {
+		if err != nil {
+			bucket, key := s.thumbnailLocation(original.Bucket, original.Key, original.Version, size)
+			result = SizeResult{Size: sizeName(size), Bucket: bucket, Key: key}
+			result.finish(start, err)
+		}
+	}()
+	defer recoverError(ctx, &err)
+
+	return s.createThumbnail(ctx, original, src, shared, size)
+}
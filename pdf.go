@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPDFRenderer 渲染PDF使用的poppler命令, Lambda中可以通过层安装到/opt/bin
+	defaultPDFRenderer = "pdftoppm"
+	// pdfRenderTimeout 渲染单个PDF的超时时间
+	pdfRenderTimeout = 30 * time.Second
+	// maxPDFRenderSize 渲染第一页时长边的最大像素数
+	maxPDFRenderSize = 4096
+)
+
+// isPDF 是否是PDF文档
+func isPDF(key string) bool {
+	return strings.HasSuffix(strings.ToLower(key), ".pdf")
+}
+
+// pdfRenderSize 第一页渲染后长边的像素数, 裁剪模式需要的短边可能大于尺寸的长边, 按最大尺寸的2倍渲染
+func pdfRenderSize(sizes []Size) int {
+	var longest int
+	for _, size := range sizes {
+		if size.X > longest {
+			longest = size.X
+		}
+		if size.Y > longest {
+			longest = size.Y
+		}
+	}
+
+	if longest <= 0 || longest*2 > maxPDFRenderSize {
+		return maxPDFRenderSize
+	}
+
+	return longest * 2
+}
+
+// decodePDF 保存PDF到临时目录, 用pdftoppm渲染第一页后按普通图片处理
+func (s Imaging) decodePDF(bucket, key string, object *Object, sizes []Size) (*Original, error) {
+	start := time.Now()
+
+	dir, err := ioutil.TempDir("", "resize-pdf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	body := newChecksumReader(object.Body)
+	input := filepath.Join(dir, "input.pdf")
+	if err = writeFile(input, body); err != nil {
+		logger.Error("Save pdf failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	img, err := renderPDF(s.config.PDFRenderer, input, filepath.Join(dir, "page"), pdfRenderSize(sizes))
+	if err != nil {
+		logger.Error("Render pdf failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	bounds := img.Bounds().Size()
+	if err = s.checkPixels(key, bounds.X, bounds.Y); err != nil {
+		logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+	logger.Debug("Render pdf", "bucket", bucket, "key", key, "width", bounds.X, "height", bounds.Y, "durationMs", durationMs(start))
+
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Image, original.Bounds, original.Scale = img, bounds, 1
+
+	return original, nil
+}
+
+// writeFile 将内容写入文件
+func writeFile(name string, reader io.Reader) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// renderPDF 将第一页渲染为长边为size像素的png并解码
+func renderPDF(renderer, input, root string, size int) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pdfRenderTimeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, renderer, "-f", "1", "-l", "1", "-singlefile", "-png", "-scale-to", strconv.Itoa(size), input, root)
+	if output, err := command.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s failed due to %v: %s", renderer, err, strings.TrimSpace(string(output)))
+	}
+
+	file, err := os.Open(root + ".png")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return png.Decode(file)
+}
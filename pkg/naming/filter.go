@@ -0,0 +1,53 @@
+package naming
+
+import (
+	"strings"
+)
+
+// KeyFilter 按前缀和后缀过滤需要处理的key
+type KeyFilter struct {
+	IncludePrefixes []string
+	ExcludePrefixes []string
+	IncludeSuffixes []string
+	ExcludeSuffixes []string
+}
+
+// Match 判断key是否需要处理, 排除规则优先于包含规则
+func (f KeyFilter) Match(key string) bool {
+	if hasAnyPrefix(key, f.ExcludePrefixes) || hasAnySuffix(key, f.ExcludeSuffixes) {
+		return false
+	}
+
+	if len(f.IncludePrefixes) > 0 && !hasAnyPrefix(key, f.IncludePrefixes) {
+		return false
+	}
+
+	if len(f.IncludeSuffixes) > 0 && !hasAnySuffix(key, f.IncludeSuffixes) {
+		return false
+	}
+
+	return true
+}
+
+// hasAnyPrefix key是否以任意一个前缀开头
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasAnySuffix key是否以任意一个后缀结尾, 忽略大小写
+func hasAnySuffix(key string, suffixes []string) bool {
+	lower := strings.ToLower(key)
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(lower, strings.ToLower(suffix)) {
+			return true
+		}
+	}
+
+	return false
+}
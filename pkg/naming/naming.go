@@ -0,0 +1,156 @@
+// Package naming 缩略图key的命名和原图key的过滤规则, 其它服务可以按相同的规则找到缩略图
+package naming
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// templatePattern 缩略图key模板中的变量
+	templatePattern = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+
+	// templateVariables 缩略图key模板支持的变量
+	templateVariables = map[string]bool{
+		"key":       true,
+		"dir":       true,
+		"name":      true,
+		"ext":       true,
+		"width":     true,
+		"height":    true,
+		"size_name": true,
+		"mode":      true,
+		"dpr":       true,
+		"etag":      true,
+		"etag8":     true,
+		"version":   true,
+	}
+
+	// versionVariables 随原图内容变化的变量
+	versionVariables = []string{"{etag}", "{etag8}", "{version}"}
+)
+
+// Version 原图的版本, 模板中使用{etag}, {etag8}或{version}时重新上传同名原图会生成新的key, CDN不会返回旧的缓存
+type Version struct {
+	// ETag 原图的ETag, 不含引号
+	ETag string
+	// ID 开启了版本控制的bucket中原图的版本ID
+	ID string
+}
+
+// Variant 命名缩略图需要的尺寸信息
+type Variant struct {
+	// Name 尺寸的名称, 设置后代替宽高用于缩略图的key
+	Name string
+	// Width 缩略图的宽度, 已经按倍数放大
+	Width int
+	// Height 缩略图的高度, 已经按倍数放大
+	Height int
+	Mode   string
+	// PixelRatio 高分辨率屏幕的倍数, 0表示原始尺寸
+	PixelRatio int
+	// Placeholder 是否是用于渐进加载的低质量占位图(LQIP)
+	Placeholder bool
+	// Extension 缩略图的扩展名, 如.jpg
+	Extension string
+	// Version 原图的版本, 只有模板中使用版本变量时需要
+	Version Version
+}
+
+// Ratio 尺寸的倍数, 原始尺寸为1
+func (v Variant) Ratio() int {
+	if v.PixelRatio > 1 {
+		return v.PixelRatio
+	}
+
+	return 1
+}
+
+// SizeName 尺寸的名称, 如thumb, 200x200, 200x200@2x或32x32_lqip
+// 高分辨率的版本使用原始尺寸的名称加上倍数
+func (v Variant) SizeName() string {
+	ratio := v.Ratio()
+
+	name := v.Name
+	if name == "" {
+		name = fmt.Sprintf("%dx%d", v.Width/ratio, v.Height/ratio)
+		if v.Placeholder {
+			name += "_lqip"
+		}
+	}
+	if ratio > 1 {
+		name += fmt.Sprintf("@%dx", ratio)
+	}
+
+	return name
+}
+
+// ValidateTemplate 检查缩略图key模板中的变量是否都支持
+func ValidateTemplate(template string) error {
+	for _, group := range templatePattern.FindAllStringSubmatch(template, -1) {
+		if !templateVariables[group[1]] {
+			return fmt.Errorf("key template variable %s is not supported", group[0])
+		}
+	}
+
+	return nil
+}
+
+// Versioned 模板中是否使用了随原图内容变化的变量, 此时只知道原图的key无法得到缩略图的key
+func Versioned(template string) bool {
+	for _, variable := range versionVariables {
+		if strings.Contains(template, variable) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Key 缩略图的key, 模板为空时在原图文件名后追加尺寸名称, 如photo.jpg生成photo_200x200.jpg
+func Key(template, key string, variant Variant) string {
+	if template != "" {
+		return RenderTemplate(template, key, variant)
+	}
+
+	ext := filepath.Ext(key)
+	return strings.Replace(key, ext, "_"+variant.SizeName()+variant.Extension, -1)
+}
+
+// RenderTemplate 按模板生成缩略图的key, 如{dir}/{name}/{width}x{height}.{ext}, thumbs/{size_name}/{key}或{dir}/{name}_{size_name}.{etag8}.{ext}
+func RenderTemplate(template, key string, variant Variant) string {
+	dir, file := path.Split(key)
+	ext := path.Ext(file)
+	values := map[string]string{
+		"key":       key,
+		"dir":       strings.TrimSuffix(dir, "/"),
+		"name":      strings.TrimSuffix(file, ext),
+		"ext":       strings.TrimPrefix(variant.Extension, "."),
+		"width":     strconv.Itoa(variant.Width),
+		"height":    strconv.Itoa(variant.Height),
+		"size_name": variant.SizeName(),
+		"mode":      variant.Mode,
+		"dpr":       strconv.Itoa(variant.Ratio()),
+		"etag":      variant.Version.ETag,
+		"etag8":     variant.Version.ETag,
+		"version":   variant.Version.ID,
+	}
+	if len(values["etag8"]) > 8 {
+		values["etag8"] = values["etag8"][:8]
+	}
+
+	rendered := templatePattern.ReplaceAllStringFunc(template, func(variable string) string {
+		return values[strings.Trim(variable, "{}")]
+	})
+
+	// 原图在根目录时{dir}为空, 去掉多余的分隔符
+	for strings.Contains(rendered, "//") {
+		rendered = strings.Replace(rendered, "//", "/", -1)
+	}
+
+	return strings.TrimPrefix(rendered, "/")
+}
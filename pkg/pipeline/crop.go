@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// smartAnalyseSize 分析图像内容时使用的最大边长
+	smartAnalyseSize = 256
+	// smartCenterBias 对靠近中心区域的偏好, 避免在内容均匀时裁到边角
+	smartCenterBias = 0.15
+)
+
+// subImager 支持裁剪的图像
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// Crop 按焦点裁剪到与目标尺寸相同的宽高比, smart焦点按图像内容选择裁剪区域
+func Crop(src image.Image, target image.Point, gravity Gravity) image.Image {
+	rect := FillRect(src.Bounds(), target, gravity)
+	if gravity.IsSmart() {
+		rect = SmartRect(src, rect)
+	}
+
+	return CropRect(src, rect)
+}
+
+// FillRect 计算与目标尺寸宽高比相同并且靠近焦点的裁剪区域
+func FillRect(bounds image.Rectangle, target image.Point, gravity Gravity) image.Rectangle {
+	width, height := bounds.Dx(), bounds.Dy()
+	if target.X <= 0 || target.Y <= 0 || width <= 0 || height <= 0 {
+		return bounds
+	}
+
+	cropWidth, cropHeight := width, height
+	if width*target.Y > height*target.X {
+		// 原图更宽, 裁掉左右
+		cropWidth = height * target.X / target.Y
+	} else {
+		// 原图更高, 裁掉上下
+		cropHeight = width * target.Y / target.X
+	}
+
+	if cropWidth < 1 {
+		cropWidth = 1
+	}
+	if cropHeight < 1 {
+		cropHeight = 1
+	}
+
+	min := bounds.Min.Add(image.Pt(gravity.offset(gravity.X, width, cropWidth), gravity.offset(gravity.Y, height, cropHeight)))
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(cropWidth, cropHeight))}
+}
+
+// CropRect 裁剪图像, 支持SubImage的图像不复制像素
+func CropRect(src image.Image, rect image.Rectangle) image.Image {
+	if rect == src.Bounds() {
+		return src
+	}
+
+	if sub, ok := src.(subImager); ok {
+		return sub.SubImage(rect)
+	}
+
+	var dst draw.Image = image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	if HighBitDepth(src) {
+		dst = image.NewRGBA64(dst.Bounds())
+	}
+	draw.Draw(dst, dst.Bounds(), src, rect.Min, draw.Src)
+
+	return dst
+}
+
+// SmartRect 根据边缘密度选择内容最丰富的裁剪区域, 裁剪区域的尺寸与rect一致
+func SmartRect(src image.Image, rect image.Rectangle) image.Rectangle {
+	bounds := src.Bounds()
+	if rect.Dx() >= bounds.Dx() && rect.Dy() >= bounds.Dy() {
+		return rect
+	}
+
+	// 缩小后再分析以降低计算量
+	sample := resize.Thumbnail(smartAnalyseSize, smartAnalyseSize, src, resize.NearestNeighbor)
+	scale := float64(sample.Bounds().Dx()) / float64(bounds.Dx())
+
+	width, height := sample.Bounds().Dx(), sample.Bounds().Dy()
+	cropWidth := clampInt(int(math.Round(float64(rect.Dx())*scale)), 1, width)
+	cropHeight := clampInt(int(math.Round(float64(rect.Dy())*scale)), 1, height)
+
+	integral := edgeIntegral(sample)
+	sum := func(x, y int) float64 {
+		return integral[(y+cropHeight)*(width+1)+x+cropWidth] - integral[y*(width+1)+x+cropWidth] -
+			integral[(y+cropHeight)*(width+1)+x] + integral[y*(width+1)+x]
+	}
+
+	bestX, bestY, bestScore := 0, 0, -1.0
+	for y := 0; y+cropHeight <= height; y++ {
+		for x := 0; x+cropWidth <= width; x++ {
+			// 距离中心越远得分越低
+			dx := (float64(x)+float64(cropWidth)/2)/float64(width) - 0.5
+			dy := (float64(y)+float64(cropHeight)/2)/float64(height) - 0.5
+			score := sum(x, y) * (1 - smartCenterBias*math.Sqrt(dx*dx+dy*dy)*2)
+			if score > bestScore {
+				bestX, bestY, bestScore = x, y, score
+			}
+		}
+	}
+
+	// 映射回原图坐标
+	min := bounds.Min.Add(image.Pt(
+		clampInt(int(float64(bestX)/scale), 0, bounds.Dx()-rect.Dx()),
+		clampInt(int(float64(bestY)/scale), 0, bounds.Dy()-rect.Dy()),
+	))
+
+	return image.Rectangle{Min: min, Max: min.Add(rect.Size())}
+}
+
+// edgeIntegral 计算亮度梯度的积分图
+func edgeIntegral(img image.Image) []float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	luma := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			luma[y*width+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+		}
+	}
+
+	integral := make([]float64, (width+1)*(height+1))
+	for y := 0; y < height; y++ {
+		var row float64
+		for x := 0; x < width; x++ {
+			var edge float64
+			if x > 0 && x < width-1 && y > 0 && y < height-1 {
+				gx := luma[y*width+x+1] - luma[y*width+x-1]
+				gy := luma[(y+1)*width+x] - luma[(y-1)*width+x]
+				edge = math.Sqrt(gx*gx + gy*gy)
+			}
+
+			row += edge
+			integral[(y+1)*(width+1)+x+1] = integral[y*(width+1)+x+1] + row
+		}
+	}
+
+	return integral
+}
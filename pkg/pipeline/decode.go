@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"io"
+
+	"github.com/nzai/resize/jpegscale"
+)
+
+const (
+	// gifMinDelay 浏览器把不超过10毫秒的帧间隔按100毫秒播放
+	gifMinDelay = 10
+	// gifDefaultDelay 帧间隔过短时使用的毫秒数
+	gifDefaultDelay = 100
+)
+
+// DecodeJPEG 解码jpeg图像, scale大于1时按1/scale解码, 印刷用的CMYK图像转换为RGB
+func DecodeJPEG(reader io.Reader, scale int) (image.Image, error) {
+	var img image.Image
+	var err error
+	if scale > 1 {
+		img, err = jpegscale.Decode(reader, scale)
+	} else {
+		img, err = jpeg.Decode(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cmyk, ok := img.(*image.CMYK); ok {
+		return cmykToRGBA(cmyk), nil
+	}
+
+	return img, nil
+}
+
+// cmykToRGBA 将CMYK图像转换为RGBA图像
+func cmykToRGBA(src *image.CMYK) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := src.CMYKAt(x, y)
+			r, g, b := color.CMYKToRGB(c.C, c.M, c.Y, c.K)
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset+0] = r
+			dst.Pix[offset+1] = g
+			dst.Pix[offset+2] = b
+			dst.Pix[offset+3] = 0xff
+		}
+	}
+
+	return dst
+}
+
+// ComposeGIF 按每一帧的处置方式合成完整的画面, all为false时只合成第一帧
+func ComposeGIF(animation *gif.GIF, all bool) []Frame {
+	canvas := image.NewRGBA(image.Rect(0, 0, animation.Config.Width, animation.Config.Height))
+
+	var frames []Frame
+	for index, frame := range animation.Image {
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if index < len(animation.Disposal) {
+			disposal = animation.Disposal[index]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		delay := gifDefaultDelay
+		if index < len(animation.Delay) && animation.Delay[index]*10 > gifMinDelay {
+			delay = animation.Delay[index] * 10
+		}
+		frames = append(frames, Frame{Image: cloneRGBA(canvas), Duration: delay})
+		if !all {
+			break
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+// cloneRGBA 复制图像
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Rect)
+	copy(dst.Pix, src.Pix)
+
+	return dst
+}
+
+// GIFLoopCount gif的循环次数转换为webp的播放次数
+// gif中0表示无限循环, -1表示只播放一次, n表示再重复n次, webp中0表示无限循环
+func GIFLoopCount(loopCount int) int {
+	switch {
+	case loopCount == 0:
+		return 0
+	case loopCount < 0:
+		return 1
+	default:
+		return loopCount + 1
+	}
+}
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+)
+
+func TestDecodeJPEGScale(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 160, 80)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for scale, expected := range map[int]image.Point{1: image.Pt(160, 80), 2: image.Pt(80, 40), 8: image.Pt(20, 10)} {
+		img, err := DecodeJPEG(bytes.NewReader(buffer.Bytes()), scale)
+		if err != nil {
+			t.Fatalf("decode with scale %d failed: %v", scale, err)
+		}
+		if size := img.Bounds().Size(); size != expected {
+			t.Errorf("scale %d size is %v, want %v", scale, size, expected)
+		}
+	}
+}
+
+// tiffEntry IFD中的一个SHORT标签
+type tiffEntry struct {
+	tag, value uint16
+}
+
+// littleTIFF 生成小端的未压缩RGB tiff, 只有一个条带
+func littleTIFF(width, height int, pix []byte) []byte {
+	entries := []tiffEntry{
+		{tiffTagImageWidth, uint16(width)},
+		{tiffTagImageLength, uint16(height)},
+		{tiffTagBitsPerSample, 8},
+		{tiffTagPhotometric, tiffPhotometricRGB},
+		{tiffTagStripOffsets, 0},
+		{tiffTagSamplesPerPixel, 3},
+		{tiffTagStripByteCounts, uint16(len(pix))},
+	}
+	offset := 8 + 2 + len(entries)*12 + 4
+
+	content := []byte("II*\x00")
+	content = binary.LittleEndian.AppendUint32(content, 8)
+	content = binary.LittleEndian.AppendUint16(content, uint16(len(entries)))
+	for _, entry := range entries {
+		if entry.tag == tiffTagStripOffsets {
+			entry.value = uint16(offset)
+		}
+		content = binary.LittleEndian.AppendUint16(content, entry.tag)
+		content = binary.LittleEndian.AppendUint16(content, tiffTypeShort)
+		content = binary.LittleEndian.AppendUint32(content, 1)
+		content = binary.LittleEndian.AppendUint32(content, uint32(entry.value))
+	}
+	content = binary.LittleEndian.AppendUint32(content, 0)
+
+	return append(content, pix...)
+}
+
+func TestDecodeTIFF(t *testing.T) {
+	content := littleTIFF(2, 1, []byte{0xff, 0, 0, 0, 0, 0xff})
+	img, err := DecodeTIFF(content)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("bounds are %v", img.Bounds())
+	}
+	for x, expected := range []color.NRGBA{{R: 0xff, A: 0xff}, {B: 0xff, A: 0xff}} {
+		if actual := color.NRGBAModel.Convert(img.At(x, 0)); actual != expected {
+			t.Errorf("pixel %d is %v, want %v", x, actual, expected)
+		}
+	}
+
+	// 条带超出文件范围
+	if _, err = DecodeTIFF(content[:len(content)-1]); err != ErrTIFFTruncated {
+		t.Errorf("truncated tiff error is %v, want %v", err, ErrTIFFTruncated)
+	}
+}
+
+func TestComposeGIF(t *testing.T) {
+	palette := color.Palette{color.Transparent, color.White}
+	first, second := image.NewPaletted(image.Rect(0, 0, 2, 2), palette), image.NewPaletted(image.Rect(1, 1, 2, 2), palette)
+	first.SetColorIndex(0, 0, 1)
+	second.SetColorIndex(1, 1, 1)
+	animation := &gif.GIF{
+		Image:  []*image.Paletted{first, second},
+		Delay:  []int{1, 20},
+		Config: image.Config{Width: 2, Height: 2},
+	}
+
+	if frames := ComposeGIF(animation, false); len(frames) != 1 {
+		t.Errorf("composed %d frames, want only the first", len(frames))
+	}
+
+	frames := ComposeGIF(animation, true)
+	if len(frames) != 2 {
+		t.Fatalf("composed %d frames, want 2", len(frames))
+	}
+	// 第二帧叠加在第一帧之上, 过短的间隔按默认间隔播放
+	if _, _, _, a := frames[1].Image.At(0, 0).RGBA(); a != 0xffff {
+		t.Errorf("second frame lost the first frame pixel")
+	}
+	if frames[0].Duration != gifDefaultDelay || frames[1].Duration != 200 {
+		t.Errorf("durations are %d and %d", frames[0].Duration, frames[1].Duration)
+	}
+}
+
+func TestGIFLoopCount(t *testing.T) {
+	for loopCount, expected := range map[int]int{0: 0, -1: 1, 2: 3} {
+		if actual := GIFLoopCount(loopCount); actual != expected {
+			t.Errorf("gif loop count %d is %d, want %d", loopCount, actual, expected)
+		}
+	}
+}
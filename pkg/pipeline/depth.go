@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"image"
+	"image/draw"
+)
+
+// bayerMatrix 8x8有序抖动的阈值, 0到63
+var bayerMatrix = [8][8]uint32{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// HighBitDepth 是否是每个通道16位的图像, 如16位的png和tiff
+func HighBitDepth(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+
+	return false
+}
+
+// ToRGBA64 转换为从(0,0)开始的RGBA64图像, 返回的图像可以直接修改
+func ToRGBA64(src image.Image) *image.RGBA64 {
+	bounds := src.Bounds()
+	dst := image.NewRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+
+	return dst
+}
+
+// Dither 将16位图像有序抖动为从(0,0)开始的8位图像, 直接截断为8位时平滑的渐变会出现色带
+// 灰度图像返回Gray, 其他返回RGBA, 8位的图像直接返回
+func Dither(src image.Image) image.Image {
+	if !HighBitDepth(src) {
+		return src
+	}
+
+	bounds := src.Bounds()
+	if gray, ok := src.(*image.Gray16); ok {
+		dst := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				dst.Pix[dst.PixOffset(x, y)] = dither8(uint32(gray.Gray16At(bounds.Min.X+x, bounds.Min.Y+y).Y), x, y)
+			}
+		}
+		return dst
+	}
+
+	return ditherRGBA(src)
+}
+
+// ditherRGBA 将16位图像有序抖动为RGBA图像, 预乘后的颜色不超过透明度
+func ditherRGBA(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, a := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			alpha := dither8(a, x, y)
+			pixel := dst.Pix[dst.PixOffset(x, y):]
+			for index, value := range [3]uint32{r, g, b} {
+				if pixel[index] = dither8(value, x, y); pixel[index] > alpha {
+					pixel[index] = alpha
+				}
+			}
+			pixel[3] = alpha
+		}
+	}
+
+	return dst
+}
+
+// dither8 按像素位置的阈值将16位的值转换为8位, 区域内的平均值与原来的值相同
+func dither8(value uint32, x, y int) uint8 {
+	scaled := value * 0xff
+	base, remainder := scaled/0xffff, scaled%0xffff
+	if remainder*128 > (bayerMatrix[y&7][x&7]*2+1)*0xffff {
+		base++
+	}
+
+	return uint8(base)
+}
@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	// EffectGrayscale 灰度
+	EffectGrayscale = "grayscale"
+	// EffectSepia 复古的棕褐色调
+	EffectSepia = "sepia"
+	// EffectTint 按亮度从黑色过渡到指定颜色的单色调
+	EffectTint = "tint"
+)
+
+// Effect 缩放后的颜色效果
+type Effect struct {
+	// Name grayscale, sepia或tint, 为空表示不处理
+	Name string
+	// Tint tint效果使用的颜色
+	Tint color.RGBA
+}
+
+// String 效果的描述, 与尺寸选项的格式相同
+func (e Effect) String() string {
+	if e.Name == EffectTint {
+		return fmt.Sprintf("tint=#%02x%02x%02x", e.Tint.R, e.Tint.G, e.Tint.B)
+	}
+
+	return e.Name
+}
+
+// Apply 按效果调整每个像素的颜色, 不处理透明通道
+func (e Effect) Apply(src image.Image) image.Image {
+	if e.Name == "" {
+		return src
+	}
+
+	dst := ToRGBA(src)
+	for index := 0; index < len(dst.Pix); index += 4 {
+		r, g, b := float64(dst.Pix[index]), float64(dst.Pix[index+1]), float64(dst.Pix[index+2])
+
+		switch e.Name {
+		case EffectGrayscale:
+			gray := clampUint8(0.299*r + 0.587*g + 0.114*b)
+			dst.Pix[index], dst.Pix[index+1], dst.Pix[index+2] = gray, gray, gray
+		case EffectSepia:
+			// RGBA是预乘透明度的, 颜色不能超过透明度
+			alpha := float64(dst.Pix[index+3])
+			dst.Pix[index] = clampUint8(math.Min(0.393*r+0.769*g+0.189*b, alpha))
+			dst.Pix[index+1] = clampUint8(math.Min(0.349*r+0.686*g+0.168*b, alpha))
+			dst.Pix[index+2] = clampUint8(math.Min(0.272*r+0.534*g+0.131*b, alpha))
+		case EffectTint:
+			// 亮度乘以颜色后仍然不超过透明度
+			luminance := (0.299*r + 0.587*g + 0.114*b) / 255
+			dst.Pix[index] = clampUint8(luminance * float64(e.Tint.R))
+			dst.Pix[index+1] = clampUint8(luminance * float64(e.Tint.G))
+			dst.Pix[index+2] = clampUint8(luminance * float64(e.Tint.B))
+		}
+	}
+
+	return dst
+}
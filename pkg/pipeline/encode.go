@@ -0,0 +1,100 @@
+// Package pipeline 缩略图处理中与配置和存储无关的图像操作, 包括解码, 裁剪, 缩放, 旋转翻转,
+// 自动色阶, 锐化, 颜色效果和编码, 其它服务可以直接使用, 得到与缩略图处理相同的结果
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/nzai/resize/jpegscale"
+)
+
+const (
+	// FormatJPEG jpeg格式
+	FormatJPEG = "jpeg"
+	// FormatPNG png格式
+	FormatPNG = "png"
+	// FormatWebP 无损的webp格式
+	FormatWebP = "webp"
+)
+
+// EncodeOptions 编码参数
+type EncodeOptions struct {
+	// Format 输出格式, 为空时使用jpeg
+	Format string
+	// Quality jpeg编码质量, 0表示默认质量
+	Quality int
+	// Subsampling jpeg的色度抽样, 默认4:2:0
+	Subsampling jpegscale.Subsampling
+	// Background jpeg中透明部分合成的背景色, 为空时使用白色
+	Background color.Color
+	// Colors png调色板的颜色数量, 0表示不减少颜色
+	Colors int
+	// Compression png的压缩级别
+	Compression png.CompressionLevel
+}
+
+// Encode 按参数的格式编码图像
+// 16位图像抖动为8位后编码
+func Encode(writer io.Writer, img image.Image, options EncodeOptions) error {
+	switch options.Format {
+	case FormatPNG:
+		img = Dither(img)
+		// 减少颜色后按调色板保存, 截图等图像的体积可以减小数倍
+		if options.Colors > 0 {
+			img = Quantize(img, options.Colors)
+		}
+		encoder := png.Encoder{CompressionLevel: options.Compression}
+		return encoder.Encode(writer, img)
+	case FormatWebP:
+		return EncodeWebP(writer, Dither(img))
+	default:
+		img = Dither(Flatten(img, options.Background))
+		// 标准库只支持4:2:0, 4:4:4使用jpegscale中修改后的编码器
+		if options.Subsampling == jpegscale.Subsampling444 {
+			return jpegscale.Encode(writer, img, &jpegscale.Options{Quality: jpegQuality(options.Quality), Subsampling: options.Subsampling})
+		}
+
+		// 未指定质量时按默认(75)的质量编码
+		var jpegOptions *jpeg.Options
+		if options.Quality > 0 {
+			jpegOptions = &jpeg.Options{Quality: options.Quality}
+		}
+
+		return jpeg.Encode(writer, img, jpegOptions)
+	}
+}
+
+// jpegQuality jpeg编码质量, 0表示默认质量
+func jpegQuality(quality int) int {
+	if quality > 0 {
+		return quality
+	}
+
+	return jpeg.DefaultQuality
+}
+
+// Flatten jpeg不支持透明, 有透明像素时合成到背景色上, 否则透明部分会变成黑色
+// 16位图像合成到RGBA64上, 保留精度
+func Flatten(img image.Image, background color.Color) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); !ok || opaque.Opaque() {
+		return img
+	}
+	if background == nil {
+		background = color.White
+	}
+
+	bounds := img.Bounds()
+	var dst draw.Image = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if HighBitDepth(img) {
+		dst = image.NewRGBA64(dst.Bounds())
+	}
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+
+	return dst
+}
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Gravity 裁剪时保留的焦点位置
+type Gravity struct {
+	Name string
+	// X, Y 焦点在原图中的相对位置, 取值0~1
+	X, Y float64
+}
+
+var (
+	// GravityCenter 居中裁剪
+	GravityCenter = Gravity{Name: "center", X: 0.5, Y: 0.5}
+
+	// gravities 预定义的焦点位置
+	gravities = map[string]Gravity{
+		"center": GravityCenter,
+		"top":    {Name: "top", X: 0.5, Y: 0},
+		"bottom": {Name: "bottom", X: 0.5, Y: 1},
+		"left":   {Name: "left", X: 0, Y: 0.5},
+		"right":  {Name: "right", X: 1, Y: 0.5},
+		// smart 根据图像内容选择裁剪区域
+		"smart": {Name: "smart", X: 0.5, Y: 0.5},
+		// face 根据人脸位置选择裁剪区域, 需要开启FaceDetection, 未检测到人脸时居中
+		"face": {Name: "face", X: 0.5, Y: 0.5},
+	}
+)
+
+// IsZero 是否未设置
+func (g Gravity) IsZero() bool {
+	return g.Name == ""
+}
+
+// IsSmart 是否根据图像内容选择裁剪区域
+func (g Gravity) IsSmart() bool {
+	return g.Name == "smart"
+}
+
+// IsFace 是否根据人脸位置选择裁剪区域
+func (g Gravity) IsFace() bool {
+	return g.Name == "face"
+}
+
+// String 焦点描述
+func (g Gravity) String() string {
+	return g.Name
+}
+
+// ParseGravity 解析焦点, 支持center, top, bottom, left, right, smart, face或者百分比焦点如30%/70%
+func ParseGravity(value string) (Gravity, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if gravity, found := gravities[value]; found {
+		return gravity, nil
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return Gravity{}, fmt.Errorf("gravity %s is invalid", value)
+	}
+
+	var point [2]float64
+	for index, part := range parts {
+		if !strings.HasSuffix(part, "%") {
+			return Gravity{}, fmt.Errorf("gravity %s is invalid", value)
+		}
+
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return Gravity{}, fmt.Errorf("gravity %s is invalid", value)
+		}
+
+		point[index] = percent / 100
+	}
+
+	return Gravity{Name: value, X: point[0], Y: point[1]}, nil
+}
+
+// offset 计算裁剪区域在一个方向上的起点, 尽量让焦点位于裁剪区域中心
+func (g Gravity) offset(focus float64, length, cropLength int) int {
+	if g.IsZero() {
+		focus = 0.5
+	}
+
+	offset := int(focus*float64(length) - float64(cropLength)/2)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > length-cropLength {
+		offset = length - cropLength
+	}
+
+	return offset
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"image"
+)
+
+const (
+	// normalizeClip 自动色阶时两端忽略的像素比例, 避免个别过亮或过暗的像素影响拉伸
+	normalizeClip = 0.005
+	// normalizeMinRange 亮度范围小于该值时不拉伸, 避免纯色图像的噪点被放大
+	normalizeMinRange = 32
+)
+
+// Normalize 自动色阶, 将亮度范围拉伸到0-255, 所有通道使用相同的映射以保持色相
+// 线性拉伸与缩放可以交换, 在缩放后的图像上计算和调整, 结果与缩放前处理相同而开销小得多
+func Normalize(src image.Image) image.Image {
+	dst := ToRGBA(src)
+
+	var histogram [256]int
+	pixels := 0
+	for index := 0; index < len(dst.Pix); index += 4 {
+		// 忽略完全透明的像素
+		if dst.Pix[index+3] == 0 {
+			continue
+		}
+		histogram[luminance(dst.Pix[index:index+3])]++
+		pixels++
+	}
+	if pixels == 0 {
+		return dst
+	}
+
+	clip := int(float64(pixels) * normalizeClip)
+	low, high := 0, 255
+	for count := 0; low < 255 && count+histogram[low] <= clip; low++ {
+		count += histogram[low]
+	}
+	for count := 0; high > 0 && count+histogram[high] <= clip; high-- {
+		count += histogram[high]
+	}
+	if high-low < normalizeMinRange {
+		return dst
+	}
+
+	scale := 255 / float64(high-low)
+	for index := 0; index < len(dst.Pix); index += 4 {
+		// RGBA是预乘透明度的, 按透明度缩放黑点并限制在透明度以内
+		alpha := float64(dst.Pix[index+3])
+		offset := float64(low) * alpha / 255
+		for channel := index; channel < index+3; channel++ {
+			value := (float64(dst.Pix[channel]) - offset) * scale
+			if value > alpha {
+				value = alpha
+			}
+			dst.Pix[channel] = clampUint8(value)
+		}
+	}
+
+	return dst
+}
+
+// luminance 预乘透明度的RGB的亮度
+func luminance(rgb []uint8) uint8 {
+	return clampUint8(0.299*float64(rgb[0]) + 0.587*float64(rgb[1]) + 0.114*float64(rgb[2]))
+}
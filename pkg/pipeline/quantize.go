@@ -0,0 +1,158 @@
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// colorBox 中位切分算法中的颜色区域
+type colorBox struct {
+	entries []colorEntry
+	count   int
+}
+
+// colorEntry 统计的颜色, 保存分量的总和用于计算平均色
+type colorEntry struct {
+	// channels 量化后的分量, 用于比较区域的范围
+	channels [4]uint8
+	sums     [4]int
+	count    int
+}
+
+// Quantize 将图像减少到最多colors种颜色, 颜色不超过colors种时保持不变
+// 否则按中位切分生成调色板, 并用Floyd-Steinberg抖动减少色带
+func Quantize(src image.Image, colors int) *image.Paletted {
+	rgba := ToRGBA(src)
+	dst := image.NewPaletted(rgba.Rect, nil)
+
+	// 截图等颜色较少的图像直接使用原有的颜色
+	exact := make(map[color.RGBA]bool)
+	for index := 0; index < len(rgba.Pix) && len(exact) <= colors; index += 4 {
+		exact[color.RGBA{R: rgba.Pix[index], G: rgba.Pix[index+1], B: rgba.Pix[index+2], A: rgba.Pix[index+3]}] = true
+	}
+	if len(exact) <= colors {
+		for c := range exact {
+			dst.Palette = append(dst.Palette, c)
+		}
+		sort.Slice(dst.Palette, func(i, j int) bool {
+			a, b := dst.Palette[i].(color.RGBA), dst.Palette[j].(color.RGBA)
+			return uint32(a.R)<<24|uint32(a.G)<<16|uint32(a.B)<<8|uint32(a.A) < uint32(b.R)<<24|uint32(b.G)<<16|uint32(b.B)<<8|uint32(b.A)
+		})
+		draw.Draw(dst, dst.Rect, rgba, rgba.Rect.Min, draw.Src)
+		return dst
+	}
+
+	dst.Palette = medianCut(rgba, colors)
+	draw.FloydSteinberg.Draw(dst, dst.Rect, rgba, rgba.Rect.Min)
+
+	return dst
+}
+
+// medianCut 统计每个分量高5位相同的颜色, 反复从范围最大的区域按中位数切分, 返回每个区域的平均色
+func medianCut(rgba *image.RGBA, colors int) color.Palette {
+	histogram := make(map[uint32]*colorEntry)
+	for index := 0; index < len(rgba.Pix); index += 4 {
+		pixel := rgba.Pix[index : index+4]
+		key := uint32(pixel[0]>>3)<<15 | uint32(pixel[1]>>3)<<10 | uint32(pixel[2]>>3)<<5 | uint32(pixel[3]>>3)
+		entry, found := histogram[key]
+		if !found {
+			entry = &colorEntry{channels: [4]uint8{pixel[0] >> 3, pixel[1] >> 3, pixel[2] >> 3, pixel[3] >> 3}}
+			histogram[key] = entry
+		}
+		for channel := range entry.sums {
+			entry.sums[channel] += int(pixel[channel])
+		}
+		entry.count++
+	}
+
+	box := colorBox{}
+	for _, entry := range histogram {
+		box.entries = append(box.entries, *entry)
+		box.count += entry.count
+	}
+	boxes := []colorBox{box}
+
+	for len(boxes) < colors {
+		// 选择范围最大的可切分区域
+		target, targetChannel, targetRange := -1, 0, 0
+		for index, box := range boxes {
+			if len(box.entries) < 2 {
+				continue
+			}
+			channel, width := box.widest()
+			if width > targetRange {
+				target, targetChannel, targetRange = index, channel, width
+			}
+		}
+		if target < 0 {
+			break
+		}
+
+		first, second := boxes[target].split(targetChannel)
+		boxes[target] = first
+		boxes = append(boxes, second)
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for index, box := range boxes {
+		palette[index] = box.average()
+	}
+
+	return palette
+}
+
+// widest 范围最大的分量及其范围
+func (b colorBox) widest() (int, int) {
+	channel, width := 0, 0
+	for c := 0; c < 4; c++ {
+		low, high := uint8(255), uint8(0)
+		for _, entry := range b.entries {
+			if entry.channels[c] < low {
+				low = entry.channels[c]
+			}
+			if entry.channels[c] > high {
+				high = entry.channels[c]
+			}
+		}
+		if int(high-low) > width {
+			channel, width = c, int(high-low)
+		}
+	}
+
+	return channel, width
+}
+
+// split 按分量排序后在像素数量的中位处切分
+func (b colorBox) split(channel int) (colorBox, colorBox) {
+	sort.Slice(b.entries, func(i, j int) bool { return b.entries[i].channels[channel] < b.entries[j].channels[channel] })
+
+	index, count := 0, 0
+	for index < len(b.entries)-1 && count+b.entries[index].count <= b.count/2 {
+		count += b.entries[index].count
+		index++
+	}
+	if index == 0 {
+		index, count = 1, b.entries[0].count
+	}
+
+	return colorBox{entries: b.entries[:index], count: count}, colorBox{entries: b.entries[index:], count: b.count - count}
+}
+
+// average 区域的平均色
+func (b colorBox) average() color.Color {
+	var sums [4]int
+	for _, entry := range b.entries {
+		for channel := range sums {
+			sums[channel] += entry.sums[channel]
+		}
+	}
+
+	return color.RGBA{
+		R: uint8(sums[0] / b.count),
+		G: uint8(sums[1] / b.count),
+		B: uint8(sums[2] / b.count),
+		A: uint8(sums[3] / b.count),
+	}
+}
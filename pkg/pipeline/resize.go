@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// ModeFit 等比缩放至尺寸范围内
+	ModeFit = "fit"
+	// ModeFill 等比缩放后按焦点裁剪为指定尺寸
+	ModeFill = "fill"
+	// ModeStretch 拉伸为指定尺寸
+	ModeStretch = "stretch"
+	// ModePad 等比缩放至尺寸范围内并用背景色填充为指定尺寸
+	ModePad = "pad"
+)
+
+// ResizeOptions 缩放参数
+type ResizeOptions struct {
+	// Mode 缩放模式, 为空时使用fit
+	Mode string
+	// Gravity fill模式裁剪的焦点, 为空时居中
+	Gravity Gravity
+	// Background pad模式的背景色, 为空时使用白色
+	Background color.Color
+	// Filter 插值算法
+	Filter resize.InterpolationFunction
+}
+
+// Thumbnail 按参数裁剪并缩放图像到目标尺寸, 相当于依次调用Crop和Resize
+func Thumbnail(src image.Image, target image.Point, options ResizeOptions) image.Image {
+	if options.Mode == ModeFill {
+		src = Crop(src, target, options.Gravity)
+	}
+
+	return Resize(src, target, options)
+}
+
+// Resize 按模式缩放图像, fill模式需要先经过Crop裁剪
+func Resize(src image.Image, target image.Point, options ResizeOptions) image.Image {
+	switch options.Mode {
+	case ModeFill, ModeStretch:
+		return resize.Resize(uint(target.X), uint(target.Y), src, options.Filter)
+	case ModePad:
+		return Pad(resize.Thumbnail(uint(target.X), uint(target.Y), src, options.Filter), target, options.Background)
+	default:
+		return resize.Thumbnail(uint(target.X), uint(target.Y), src, options.Filter)
+	}
+}
+
+// Pad 将图像居中绘制到指定尺寸的背景上, 透明区域会与背景色混合, 16位图像绘制到RGBA64上
+func Pad(src image.Image, target image.Point, background color.Color) image.Image {
+	if background == nil {
+		background = color.White
+	}
+
+	var dst draw.Image = image.NewRGBA(image.Rect(0, 0, target.X, target.Y))
+	if HighBitDepth(src) {
+		dst = image.NewRGBA64(dst.Bounds())
+	}
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.ZP, draw.Src)
+
+	bounds := src.Bounds()
+	offset := image.Pt((target.X-bounds.Dx())/2, (target.Y-bounds.Dy())/2)
+	draw.Draw(dst, image.Rectangle{Min: offset, Max: offset.Add(bounds.Size())}, src, bounds.Min, draw.Over)
+
+	return dst
+}
@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+func TestThumbnail(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	target := image.Pt(50, 50)
+
+	for mode, expected := range map[string]image.Point{
+		"":          image.Pt(50, 25),
+		ModeFit:     image.Pt(50, 25),
+		ModeFill:    image.Pt(50, 50),
+		ModeStretch: image.Pt(50, 50),
+		ModePad:     image.Pt(50, 50),
+	} {
+		thumbnail := Thumbnail(src, target, ResizeOptions{Mode: mode, Filter: resize.Bilinear})
+		if size := thumbnail.Bounds().Size(); size != expected {
+			t.Errorf("%q thumbnail is %v, want %v", mode, size, expected)
+		}
+	}
+}
+
+func TestCropGravity(t *testing.T) {
+	// 左半边黑色, 右半边白色
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 100; x < 200; x++ {
+			src.Set(x, y, color.White)
+		}
+	}
+
+	for name, expected := range map[string]image.Rectangle{
+		"left":   image.Rect(0, 0, 100, 100),
+		"center": image.Rect(50, 0, 150, 100),
+		"right":  image.Rect(100, 0, 200, 100),
+	} {
+		gravity, err := ParseGravity(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bounds := Crop(src, image.Pt(50, 50), gravity).Bounds(); bounds != expected {
+			t.Errorf("%s crop is %v, want %v", name, bounds, expected)
+		}
+	}
+
+	// 不设置焦点时居中
+	if bounds := Crop(src, image.Pt(50, 50), Gravity{}).Bounds(); bounds != image.Rect(50, 0, 150, 100) {
+		t.Errorf("crop without gravity is %v", bounds)
+	}
+}
+
+func TestPadBackground(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	padded := Pad(src, image.Pt(10, 20), nil)
+	if r, g, b, _ := padded.At(0, 0).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Errorf("default background is %v, want white", padded.At(0, 0))
+	}
+	if _, _, _, a := padded.At(5, 10).RGBA(); a != 0xffff {
+		t.Errorf("padded pixel is %v", padded.At(5, 10))
+	}
+}
@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Sharpen 锐化参数
+type Sharpen struct {
+	// Amount 锐化强度, 0表示不锐化
+	Amount float64
+	// Radius 高斯模糊半径(sigma), 单位为像素
+	Radius float64
+}
+
+// Apply 使用USM(Unsharp Mask)锐化图像
+func (s Sharpen) Apply(src image.Image) image.Image {
+	if s.Amount <= 0 || s.Radius <= 0 {
+		return src
+	}
+
+	dst := ToRGBA(src)
+	blurred := GaussianBlur(dst, s.Radius)
+	for index := range dst.Pix {
+		// 不处理透明通道
+		if index%4 == 3 {
+			continue
+		}
+
+		original := float64(dst.Pix[index])
+		value := original + s.Amount*(original-float64(blurred.Pix[index]))
+		dst.Pix[index] = clampUint8(value)
+	}
+
+	return dst
+}
+
+// ToRGBA 转换为从(0,0)开始的RGBA图像, 返回的图像可以直接修改, 16位图像抖动后转换
+func ToRGBA(src image.Image) *image.RGBA {
+	if HighBitDepth(src) {
+		return ditherRGBA(src)
+	}
+
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+
+	return dst
+}
+
+// GaussianBlur 高斯模糊, 先水平后垂直两次一维卷积
+func GaussianBlur(src *image.RGBA, sigma float64) *image.RGBA {
+	kernel := gaussianKernel(sigma)
+	radius := len(kernel) / 2
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	temp := image.NewRGBA(bounds)
+	dst := image.NewRGBA(bounds)
+
+	convolve := func(in, out *image.RGBA, horizontal bool) {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				var sum [4]float64
+				for k, weight := range kernel {
+					sx, sy := x, y
+					if horizontal {
+						sx = clampInt(x+k-radius, 0, width-1)
+					} else {
+						sy = clampInt(y+k-radius, 0, height-1)
+					}
+
+					offset := sy*in.Stride + sx*4
+					sum[0] += weight * float64(in.Pix[offset+0])
+					sum[1] += weight * float64(in.Pix[offset+1])
+					sum[2] += weight * float64(in.Pix[offset+2])
+					sum[3] += weight * float64(in.Pix[offset+3])
+				}
+
+				offset := y*out.Stride + x*4
+				out.Pix[offset+0] = clampUint8(sum[0])
+				out.Pix[offset+1] = clampUint8(sum[1])
+				out.Pix[offset+2] = clampUint8(sum[2])
+				out.Pix[offset+3] = clampUint8(sum[3])
+			}
+		}
+	}
+
+	convolve(src, temp, true)
+	convolve(temp, dst, false)
+
+	return dst
+}
+
+// gaussianKernel 生成归一化的一维高斯核
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+
+	var sum float64
+	for index := range kernel {
+		x := float64(index - radius)
+		kernel[index] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[index]
+	}
+
+	for index := range kernel {
+		kernel[index] /= sum
+	}
+
+	return kernel
+}
+
+// clampUint8 四舍五入并限制在0~255之间
+func clampUint8(value float64) uint8 {
+	if value <= 0 {
+		return 0
+	}
+	if value >= 255 {
+		return 255
+	}
+
+	return uint8(value + 0.5)
+}
+
+// clampInt 限制在min和max之间
+func clampInt(value, min, max int) int {
+	if value > max {
+		value = max
+	}
+	if value < min {
+		value = min
+	}
+
+	return value
+}
@@ -0,0 +1,293 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+const (
+	tiffTagImageWidth      = 0x0100
+	tiffTagImageLength     = 0x0101
+	tiffTagBitsPerSample   = 0x0102
+	tiffTagCompression     = 0x0103
+	tiffTagPhotometric     = 0x0106
+	tiffTagStripOffsets    = 0x0111
+	tiffTagSamplesPerPixel = 0x0115
+	tiffTagRowsPerStrip    = 0x0116
+	tiffTagStripByteCounts = 0x0117
+	tiffTagPlanarConfig    = 0x011c
+	tiffTagExtraSamples    = 0x0152
+
+	tiffTypeShort          = 3
+	tiffTypeLong           = 4
+	tiffTypeIFD            = 13
+	tiffCompressionNone    = 1
+	tiffPhotometricWhite   = 0
+	tiffPhotometricBlack   = 1
+	tiffPhotometricRGB     = 2
+	tiffExtraAssociated    = 1
+	tiffPlanarConfigChunky = 1
+	maxTIFFStrips          = 1 << 16
+)
+
+// ErrTIFFTruncated 条带超出了文件的范围
+var ErrTIFFTruncated = errors.New("tiff strip is truncated")
+
+// DecodeTIFF 解码未压缩的8位和16位tiff图片, 16位图像保留16位精度
+func DecodeTIFF(content []byte) (image.Image, error) {
+	layout, err := ReadTIFFLayout(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return layout.Decode(content)
+}
+
+// TIFFLayout 未压缩的tiff图像的第一个IFD中的像素布局
+type TIFFLayout struct {
+	// Width 宽度
+	Width int
+	// Height 高度
+	Height int
+	// Depth 每个通道的位数, 8或16
+	Depth int
+
+	order        binary.ByteOrder
+	samples      int
+	photometric  uint32
+	associated   bool
+	rowsPerStrip int
+	offsets      []uint32
+	lengths      []uint32
+}
+
+// ReadTIFFLayout 读取第一个IFD, 只支持未压缩, 按像素交错保存的灰度和RGB图像, 可以带透明通道
+func ReadTIFFLayout(content []byte) (*TIFFLayout, error) {
+	if len(content) < 8 {
+		return nil, errors.New("tiff header is truncated")
+	}
+
+	layout := new(TIFFLayout)
+	switch string(content[:4]) {
+	case "II*\x00":
+		layout.order = binary.LittleEndian
+	case "MM\x00*":
+		layout.order = binary.BigEndian
+	default:
+		return nil, errors.New("image is not tiff")
+	}
+
+	entries, _, ok := ReadIFDValues(content, layout.order, layout.order.Uint32(content[4:8]), maxTIFFStrips)
+	if !ok {
+		return nil, errors.New("tiff ifd is invalid")
+	}
+	value := func(tag uint16, defaultValue uint32) uint32 {
+		if values := entries[tag]; len(values) > 0 {
+			return values[0]
+		}
+		return defaultValue
+	}
+
+	if compression := value(tiffTagCompression, tiffCompressionNone); compression != tiffCompressionNone {
+		return nil, fmt.Errorf("tiff compression %d is not supported", compression)
+	}
+	if planar := value(tiffTagPlanarConfig, tiffPlanarConfigChunky); planar != tiffPlanarConfigChunky {
+		return nil, fmt.Errorf("tiff planar configuration %d is not supported", planar)
+	}
+
+	layout.Width, layout.Height = int(value(tiffTagImageWidth, 0)), int(value(tiffTagImageLength, 0))
+	layout.samples, layout.photometric = int(value(tiffTagSamplesPerPixel, 1)), value(tiffTagPhotometric, tiffPhotometricBlack)
+	layout.Depth = int(value(tiffTagBitsPerSample, 1))
+	for _, depth := range entries[tiffTagBitsPerSample] {
+		if int(depth) != layout.Depth {
+			return nil, errors.New("tiff samples with different bits are not supported")
+		}
+	}
+	if layout.Depth != 8 && layout.Depth != 16 {
+		return nil, fmt.Errorf("tiff %d bits per sample is not supported", layout.Depth)
+	}
+
+	// 灰度和RGB之后的额外通道是透明通道
+	colors := 1
+	switch layout.photometric {
+	case tiffPhotometricWhite, tiffPhotometricBlack:
+	case tiffPhotometricRGB:
+		colors = 3
+	default:
+		return nil, fmt.Errorf("tiff photometric %d is not supported", layout.photometric)
+	}
+	if layout.samples != colors && layout.samples != colors+1 {
+		return nil, fmt.Errorf("tiff %d samples per pixel is not supported", layout.samples)
+	}
+	layout.associated = layout.samples > colors && value(tiffTagExtraSamples, 0) == tiffExtraAssociated
+
+	if layout.Width <= 0 || layout.Height <= 0 {
+		return nil, errors.New("tiff size is invalid")
+	}
+	layout.rowsPerStrip = int(value(tiffTagRowsPerStrip, uint32(layout.Height)))
+	if layout.rowsPerStrip <= 0 || layout.rowsPerStrip > layout.Height {
+		layout.rowsPerStrip = layout.Height
+	}
+
+	layout.offsets, layout.lengths = entries[tiffTagStripOffsets], entries[tiffTagStripByteCounts]
+	if strips := (layout.Height + layout.rowsPerStrip - 1) / layout.rowsPerStrip; len(layout.offsets) != strips || len(layout.lengths) != strips {
+		return nil, errors.New("tiff strips are invalid")
+	}
+
+	return layout, nil
+}
+
+// Decode 按布局解码像素, 8位图像解码为Gray, RGBA或NRGBA, 16位图像解码为Gray16, RGBA64或NRGBA64
+func (l *TIFFLayout) Decode(content []byte) (image.Image, error) {
+	rect := image.Rect(0, 0, l.Width, l.Height)
+	bytesPerSample := l.Depth / 8
+	rowBytes := l.Width * l.samples * bytesPerSample
+
+	// 输出图像的每个像素按大端保存4个通道, 灰度图像只有1个通道
+	var img image.Image
+	var pix []uint8
+	var stride int
+	switch {
+	case l.samples == 1 && l.Depth == 8:
+		gray := image.NewGray(rect)
+		img, pix, stride = gray, gray.Pix, gray.Stride
+	case l.samples == 1:
+		gray := image.NewGray16(rect)
+		img, pix, stride = gray, gray.Pix, gray.Stride
+	case l.Depth == 8 && l.associated:
+		rgba := image.NewRGBA(rect)
+		img, pix, stride = rgba, rgba.Pix, rgba.Stride
+	case l.Depth == 8:
+		nrgba := image.NewNRGBA(rect)
+		img, pix, stride = nrgba, nrgba.Pix, nrgba.Stride
+	case l.associated:
+		rgba := image.NewRGBA64(rect)
+		img, pix, stride = rgba, rgba.Pix, rgba.Stride
+	default:
+		nrgba := image.NewNRGBA64(rect)
+		img, pix, stride = nrgba, nrgba.Pix, nrgba.Stride
+	}
+
+	colors := l.samples
+	if l.photometric == tiffPhotometricRGB {
+		colors = 3
+	} else if l.samples > 1 {
+		colors = 1
+	}
+
+	for strip, offset := range l.offsets {
+		rows := l.rowsPerStrip
+		if remaining := l.Height - strip*l.rowsPerStrip; remaining < rows {
+			rows = remaining
+		}
+		end := uint64(offset) + uint64(rows*rowBytes)
+		if uint64(l.lengths[strip]) < uint64(rows*rowBytes) || end > uint64(len(content)) {
+			return nil, ErrTIFFTruncated
+		}
+
+		for row := 0; row < rows; row++ {
+			y := strip*l.rowsPerStrip + row
+			src := content[uint64(offset)+uint64(row*rowBytes):]
+			dst := pix[y*stride:]
+			for x := 0; x < l.Width; x++ {
+				l.decodePixel(src[x*l.samples*bytesPerSample:], dst, x, colors)
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// decodePixel 解码一个像素的所有通道, 按大端写入输出图像, 没有透明通道时不透明
+func (l *TIFFLayout) decodePixel(src, dst []uint8, x, colors int) {
+	sample := func(index int) uint16 {
+		if l.Depth == 8 {
+			return uint16(src[index]) * 0x101
+		}
+		return l.order.Uint16(src[index*2:])
+	}
+	put := func(channel int, value uint16) {
+		if l.Depth == 8 {
+			dst[channel] = uint8(value >> 8)
+			return
+		}
+		binary.BigEndian.PutUint16(dst[channel*2:], value)
+	}
+
+	if l.samples == 1 {
+		value := sample(0)
+		if l.photometric == tiffPhotometricWhite {
+			value = 0xffff - value
+		}
+		put(x, value)
+		return
+	}
+
+	alpha := uint16(0xffff)
+	if l.samples > colors {
+		alpha = sample(colors)
+	}
+	for channel := 0; channel < 3; channel++ {
+		value := sample(channel % colors)
+		// 预乘的颜色不超过透明度, 反转时以透明度为最大值
+		if l.photometric == tiffPhotometricWhite && l.associated {
+			value = alpha - value
+		} else if l.photometric == tiffPhotometricWhite {
+			value = 0xffff - value
+		}
+		put(x*4+channel, value)
+	}
+	put(x*4+3, alpha)
+}
+
+// ReadIFDValues 读取IFD中整数类型的标签和下一个IFD的位置, 超过limit个值的标签忽略
+func ReadIFDValues(content []byte, order binary.ByteOrder, offset uint32, limit uint64) (map[uint16][]uint32, uint32, bool) {
+	if uint64(offset)+2 > uint64(len(content)) {
+		return nil, 0, false
+	}
+	count := uint64(order.Uint16(content[offset:]))
+	end := uint64(offset) + 2 + count*12
+	if end+4 > uint64(len(content)) {
+		return nil, 0, false
+	}
+
+	entries := make(map[uint16][]uint32, count)
+	for index := uint64(0); index < count; index++ {
+		entry := content[uint64(offset)+2+index*12:]
+		tag, kind, number := order.Uint16(entry), order.Uint16(entry[2:]), uint64(order.Uint32(entry[4:]))
+
+		var width uint64
+		switch kind {
+		case tiffTypeShort:
+			width = 2
+		case tiffTypeLong, tiffTypeIFD:
+			width = 4
+		default:
+			continue
+		}
+
+		// 不超过4字节的值直接保存在条目中, 否则条目中是值的位置
+		data := entry[8:12]
+		if number*width > 4 {
+			valueOffset := uint64(order.Uint32(entry[8:]))
+			if number > limit || valueOffset+number*width > uint64(len(content)) {
+				continue
+			}
+			data = content[valueOffset : valueOffset+number*width]
+		}
+
+		values := make([]uint32, number)
+		for i := range values {
+			if width == 2 {
+				values[i] = uint32(order.Uint16(data[uint64(i)*2:]))
+			} else {
+				values[i] = order.Uint32(data[uint64(i)*4:])
+			}
+		}
+		entries[tag] = values
+	}
+
+	return entries, order.Uint32(content[end:]), true
+}
@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Transform 缩放前对原图的旋转和翻转, 先顺时针旋转再翻转
+type Transform struct {
+	// Rotate 顺时针旋转的角度, 0, 90, 180或270
+	Rotate int
+	// FlipH 水平翻转
+	FlipH bool
+	// FlipV 垂直翻转
+	FlipV bool
+}
+
+// IsZero 是否不需要旋转和翻转
+func (t Transform) IsZero() bool {
+	return t == Transform{}
+}
+
+// String 变换的描述, 与尺寸选项的格式相同
+func (t Transform) String() string {
+	var options []string
+	if t.Rotate != 0 {
+		options = append(options, fmt.Sprintf("rotate=%d", t.Rotate))
+	}
+	switch {
+	case t.FlipH && t.FlipV:
+		options = append(options, "flip=hv")
+	case t.FlipH:
+		options = append(options, "flip=h")
+	case t.FlipV:
+		options = append(options, "flip=v")
+	}
+
+	return strings.Join(options, ":")
+}
+
+// Bounds 变换后的宽高
+func (t Transform) Bounds(size image.Point) image.Point {
+	if t.Rotate == 90 || t.Rotate == 270 {
+		return image.Pt(size.Y, size.X)
+	}
+
+	return size
+}
+
+// Focus 变换后焦点的位置, x和y是0到1之间的比例
+func (t Transform) Focus(x, y float64) (float64, float64) {
+	switch t.Rotate {
+	case 90:
+		x, y = 1-y, x
+	case 180:
+		x, y = 1-x, 1-y
+	case 270:
+		x, y = y, 1-x
+	}
+	if t.FlipH {
+		x = 1 - x
+	}
+	if t.FlipV {
+		y = 1 - y
+	}
+
+	return x, y
+}
+
+// Apply 旋转和翻转图像, 不需要变换时直接返回原图像, 16位图像变换后仍然是16位
+func (t Transform) Apply(src image.Image) image.Image {
+	if t.IsZero() {
+		return src
+	}
+
+	if HighBitDepth(src) {
+		in := ToRGBA64(src)
+		size := t.Bounds(in.Rect.Size())
+		dst := image.NewRGBA64(image.Rect(0, 0, size.X, size.Y))
+		t.remap(in.Rect.Size(), func(x, y, sx, sy int) {
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+8], in.Pix[in.PixOffset(sx, sy):in.PixOffset(sx, sy)+8])
+		})
+		return dst
+	}
+
+	in := ToRGBA(src)
+	size := t.Bounds(in.Rect.Size())
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	t.remap(in.Rect.Size(), func(x, y, sx, sy int) {
+		copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], in.Pix[in.PixOffset(sx, sy):in.PixOffset(sx, sy)+4])
+	})
+
+	return dst
+}
+
+// remap 遍历变换后图像的每个像素, 调用copyPixel复制变换前对应位置的像素
+func (t Transform) remap(source image.Point, copyPixel func(x, y, sx, sy int)) {
+	width, height := source.X, source.Y
+	size := t.Bounds(source)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			// 先撤销翻转, 再找到旋转前的位置
+			tx, ty := x, y
+			if t.FlipH {
+				tx = size.X - 1 - x
+			}
+			if t.FlipV {
+				ty = size.Y - 1 - y
+			}
+
+			sx, sy := tx, ty
+			switch t.Rotate {
+			case 90:
+				sx, sy = ty, height-1-tx
+			case 180:
+				sx, sy = width-1-tx, height-1-ty
+			case 270:
+				sx, sy = width-1-ty, tx
+			}
+
+			copyPixel(x, y, sx, sy)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+const (
+	// vp8lSignature VP8L无损位流的签名
+	vp8lSignature = 0x2f
+	// vp8lMaxSize VP8L支持的最大宽高
+	vp8lMaxSize = 1 << 14
+	// vp8lMaxCodeLength 前缀码的最大长度
+	vp8lMaxCodeLength = 15
+	// vp8lMaxCodeLengthCodeLength 编码前缀码长度使用的前缀码的最大长度
+	vp8lMaxCodeLengthCodeLength = 7
+
+	// webpFlagAlpha VP8X中表示有透明通道
+	webpFlagAlpha = 0x10
+	// webpFlagAnimation VP8X中表示有动画
+	webpFlagAnimation = 0x02
+	// webpFrameNoBlend ANMF中表示不与上一帧混合
+	webpFrameNoBlend = 0x02
+)
+
+// vp8lCodeLengthOrder 前缀码长度的前缀码按此顺序保存
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lAlphabetSizes 绿(含长度前缀), 红, 蓝, 透明和距离前缀码的符号数量, 不使用颜色缓存
+var vp8lAlphabetSizes = [5]int{256 + 24, 256, 256, 256, 40}
+
+// Frame 动画的一帧
+type Frame struct {
+	Image image.Image
+	// Duration 显示的毫秒数
+	Duration int
+}
+
+// EncodeWebP 编码为无损的WebP
+func EncodeWebP(writer io.Writer, img image.Image) error {
+	if err := checkWebPSize(img.Bounds().Size()); err != nil {
+		return err
+	}
+	bitstream, _ := encodeVP8L(img)
+
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = appendChunk(body, "VP8L", bitstream)
+
+	return writeRIFF(writer, body)
+}
+
+// EncodeAnimatedWebP 编码为无损的动画WebP, 每一帧覆盖整个画布
+// loopCount为0时无限循环
+func EncodeAnimatedWebP(writer io.Writer, frames []Frame, loopCount int) error {
+	if len(frames) == 1 {
+		return EncodeWebP(writer, frames[0].Image)
+	}
+
+	size := frames[0].Image.Bounds().Size()
+	if err := checkWebPSize(size); err != nil {
+		return err
+	}
+	var flags byte = webpFlagAnimation
+	var chunks []byte
+	for _, frame := range frames {
+		bitstream, alpha := encodeVP8L(frame.Image)
+		if alpha {
+			flags |= webpFlagAlpha
+		}
+
+		header := make([]byte, 16)
+		putUint24(header[6:], uint32(size.X-1))
+		putUint24(header[9:], uint32(size.Y-1))
+		putUint24(header[12:], uint32(frame.Duration))
+		header[15] = webpFrameNoBlend
+		chunks = appendChunk(chunks, "ANMF", appendChunk(header, "VP8L", bitstream))
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = flags
+	putUint24(vp8x[4:], uint32(size.X-1))
+	putUint24(vp8x[7:], uint32(size.Y-1))
+
+	// 背景色为透明, 之后是循环次数
+	anim := make([]byte, 6)
+	binary.LittleEndian.PutUint16(anim[4:], uint16(loopCount))
+
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = appendChunk(body, "VP8X", vp8x)
+	body = appendChunk(body, "ANIM", anim)
+	body = append(body, chunks...)
+
+	return writeRIFF(writer, body)
+}
+
+// checkWebPSize 检查宽高是否超过VP8L的限制
+func checkWebPSize(size image.Point) error {
+	if size.X <= 0 || size.Y <= 0 || size.X > vp8lMaxSize || size.Y > vp8lMaxSize {
+		return fmt.Errorf("webp size %dx%d is invalid", size.X, size.Y)
+	}
+
+	return nil
+}
+
+// writeRIFF 写入RIFF文件头和内容
+func writeRIFF(writer io.Writer, body []byte) error {
+	header := make([]byte, 8)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(body)))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	_, err := writer.Write(body)
+	return err
+}
+
+// appendChunk 追加RIFF块, 奇数长度的块需要补齐
+func appendChunk(buffer []byte, fourCC string, payload []byte) []byte {
+	header := make([]byte, 8)
+	copy(header, fourCC)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+	buffer = append(append(buffer, header...), payload...)
+	if len(payload)%2 == 1 {
+		buffer = append(buffer, 0)
+	}
+
+	return buffer
+}
+
+// putUint24 写入小端的24位整数
+func putUint24(buffer []byte, value uint32) {
+	buffer[0], buffer[1], buffer[2] = byte(value), byte(value>>8), byte(value>>16)
+}
+
+// encodeVP8L 编码VP8L位流, 不使用变换, 颜色缓存和反向引用, 每个通道一个前缀码
+// 返回是否使用了透明通道
+func encodeVP8L(img image.Image) ([]byte, bool) {
+	bounds := img.Bounds()
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Rect.Min != (image.Point{}) {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	}
+	width, height := nrgba.Rect.Dx(), nrgba.Rect.Dy()
+
+	// 按绿, 红, 蓝, 透明的顺序统计
+	var histograms [4][]int
+	for index := range histograms {
+		histograms[index] = make([]int, vp8lAlphabetSizes[index])
+	}
+	alpha := false
+	for y := 0; y < height; y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+width*4]
+		for x := 0; x < len(row); x += 4 {
+			histograms[0][row[x+1]]++
+			histograms[1][row[x]]++
+			histograms[2][row[x+2]]++
+			histograms[3][row[x+3]]++
+			alpha = alpha || row[x+3] != 0xff
+		}
+	}
+
+	w := &bitWriter{}
+	w.buffer = append(w.buffer, vp8lSignature)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if alpha {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+	// 版本, 变换, 颜色缓存和元前缀码
+	w.write(0, 3)
+	w.write(0, 1)
+	w.write(0, 1)
+	w.write(0, 1)
+
+	var codes [4]prefixCode
+	for index := range histograms {
+		codes[index] = w.writePrefixCode(histograms[index])
+	}
+	// 不使用反向引用, 距离前缀码只有一个符号
+	w.writePrefixCode(make([]int, vp8lAlphabetSizes[4]))
+
+	for y := 0; y < height; y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+width*4]
+		for x := 0; x < len(row); x += 4 {
+			codes[0].write(w, int(row[x+1]))
+			codes[1].write(w, int(row[x]))
+			codes[2].write(w, int(row[x+2]))
+			codes[3].write(w, int(row[x+3]))
+		}
+	}
+
+	return w.bytes(), alpha
+}
+
+// bitWriter 从低位开始写入位流
+type bitWriter struct {
+	buffer []byte
+	bits   uint64
+	count  uint
+}
+
+// write 写入value的低n位
+func (w *bitWriter) write(value uint32, n uint) {
+	w.bits |= uint64(value) << w.count
+	w.count += n
+	for w.count >= 8 {
+		w.buffer = append(w.buffer, byte(w.bits))
+		w.bits >>= 8
+		w.count -= 8
+	}
+}
+
+// bytes 补齐最后一个字节并返回位流
+func (w *bitWriter) bytes() []byte {
+	if w.count > 0 {
+		w.buffer = append(w.buffer, byte(w.bits))
+		w.bits, w.count = 0, 0
+	}
+
+	return w.buffer
+}
+
+// prefixCode 范式前缀码, codes已经按位倒序, 可以直接从低位写入
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+// write 写入符号的前缀码, 只有一个符号时长度为0
+func (c prefixCode) write(w *bitWriter, symbol int) {
+	if length := c.lengths[symbol]; length > 0 {
+		w.write(c.codes[symbol], uint(length))
+	}
+}
+
+// writePrefixCode 按直方图生成并写入前缀码
+// 不超过两个符号且都小于256时使用简单编码, 否则写入每个符号的码长
+func (w *bitWriter) writePrefixCode(histogram []int) prefixCode {
+	var symbols []int
+	for symbol, count := range histogram {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		lengths := make([]uint8, len(histogram))
+		if len(symbols) == 0 {
+			symbols = []int{0}
+		}
+
+		w.write(1, 1)
+		w.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(symbols[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			w.write(uint32(symbols[1]), 8)
+			lengths[symbols[0]], lengths[symbols[1]] = 1, 1
+		}
+
+		return prefixCode{lengths: lengths, codes: canonicalCodes(lengths)}
+	}
+
+	lengths := huffmanLengths(histogram, vp8lMaxCodeLength)
+	w.write(0, 1)
+	w.writeCodeLengths(lengths)
+
+	return prefixCode{lengths: lengths, codes: canonicalCodes(lengths)}
+}
+
+// writeCodeLengths 写入码长, 连续的0用17和18编码
+func (w *bitWriter) writeCodeLengths(lengths []uint8) {
+	type token struct {
+		symbol int
+		extra  uint32
+		bits   uint
+	}
+
+	var tokens []token
+	for index := 0; index < len(lengths); {
+		if lengths[index] != 0 {
+			tokens = append(tokens, token{symbol: int(lengths[index])})
+			index++
+			continue
+		}
+
+		run := 1
+		for index+run < len(lengths) && lengths[index+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run < 3:
+			for i := 0; i < run; i++ {
+				tokens = append(tokens, token{symbol: 0})
+			}
+		case run <= 10:
+			tokens = append(tokens, token{symbol: 17, extra: uint32(run - 3), bits: 3})
+		default:
+			tokens = append(tokens, token{symbol: 18, extra: uint32(run - 11), bits: 7})
+		}
+		index += run
+	}
+
+	histogram := make([]int, len(vp8lCodeLengthOrder))
+	for _, t := range tokens {
+		histogram[t.symbol]++
+	}
+	// 只有一个符号时解码器按0位读取, 补充一个符号保证每个符号都写入1位
+	used := 0
+	for _, count := range histogram {
+		if count > 0 {
+			used++
+		}
+	}
+	if used == 1 {
+		if histogram[0] == 0 {
+			histogram[0] = 1
+		} else {
+			histogram[1] = 1
+		}
+	}
+
+	codeLengths := huffmanLengths(histogram, vp8lMaxCodeLengthCodeLength)
+	count := len(vp8lCodeLengthOrder)
+	for count > 4 && codeLengths[vp8lCodeLengthOrder[count-1]] == 0 {
+		count--
+	}
+	w.write(uint32(count-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:count] {
+		w.write(uint32(codeLengths[symbol]), 3)
+	}
+
+	// 码长覆盖全部符号, 不使用max_symbol
+	w.write(0, 1)
+
+	code := prefixCode{lengths: codeLengths, codes: canonicalCodes(codeLengths)}
+	for _, t := range tokens {
+		code.write(w, t.symbol)
+		if t.bits > 0 {
+			w.write(t.extra, t.bits)
+		}
+	}
+}
+
+// huffmanLengths 按直方图计算不超过limit的哈夫曼码长, 超过时减小差距后重新计算
+func huffmanLengths(histogram []int, limit int) []uint8 {
+	counts := append([]int{}, histogram...)
+	for {
+		lengths, depth := buildHuffman(counts)
+		if depth <= limit {
+			return lengths
+		}
+
+		for index, count := range counts {
+			if count > 0 {
+				counts[index] = (count + 1) / 2
+			}
+		}
+	}
+}
+
+// buildHuffman 计算哈夫曼码长, 返回最大码长, 至少需要两个符号
+func buildHuffman(counts []int) ([]uint8, int) {
+	type node struct {
+		weight      int
+		symbol      int
+		left, right int
+	}
+
+	var nodes []node
+	for symbol, count := range counts {
+		if count > 0 {
+			nodes = append(nodes, node{weight: count, symbol: symbol, left: -1, right: -1})
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	// 两个队列合并: 叶子按权重排序, 合并出的节点权重单调不减
+	leaves := len(nodes)
+	leaf, merged := 0, leaves
+	pick := func() int {
+		if leaf < leaves && (merged >= len(nodes) || nodes[leaf].weight <= nodes[merged].weight) {
+			leaf++
+			return leaf - 1
+		}
+		merged++
+		return merged - 1
+	}
+	for index := 1; index < leaves; index++ {
+		left := pick()
+		right := pick()
+		nodes = append(nodes, node{weight: nodes[left].weight + nodes[right].weight, symbol: -1, left: left, right: right})
+	}
+
+	lengths := make([]uint8, len(counts))
+	depth := 0
+	var walk func(index, level int)
+	walk = func(index, level int) {
+		if nodes[index].left < 0 {
+			lengths[nodes[index].symbol] = uint8(level)
+			if level > depth {
+				depth = level
+			}
+			return
+		}
+		walk(nodes[index].left, level+1)
+		walk(nodes[index].right, level+1)
+	}
+	walk(len(nodes)-1, 0)
+
+	return lengths, depth
+}
+
+// canonicalCodes 按码长生成范式前缀码, 结果按位倒序
+func canonicalCodes(lengths []uint8) []uint32 {
+	var counts [vp8lMaxCodeLength + 1]uint32
+	for _, length := range lengths {
+		counts[length]++
+	}
+	counts[0] = 0
+
+	var next [vp8lMaxCodeLength + 2]uint32
+	code := uint32(0)
+	for length := 1; length <= vp8lMaxCodeLength; length++ {
+		code = (code + counts[length-1]) << 1
+		next[length] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		value := next[length]
+		next[length]++
+
+		var reversed uint32
+		for bit := uint8(0); bit < length; bit++ {
+			reversed = reversed<<1 | (value>>bit)&1
+		}
+		codes[symbol] = reversed
+	}
+
+	return codes
+}
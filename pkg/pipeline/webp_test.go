@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// riffChunk RIFF中的块
+type riffChunk struct {
+	fourCC  string
+	payload []byte
+}
+
+// readChunks 按块长度和补齐拆分块, 长度与内容不符时测试失败
+func readChunks(t *testing.T, data []byte) []riffChunk {
+	t.Helper()
+	var chunks []riffChunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("chunk header is truncated: % x", data)
+		}
+		length := int(binary.LittleEndian.Uint32(data[4:8]))
+		padded := length + length%2
+		if 8+padded > len(data) {
+			t.Fatalf("chunk %s is %d bytes, only %d bytes left", data[:4], length, len(data)-8)
+		}
+		if length%2 == 1 && data[8+length] != 0 {
+			t.Errorf("chunk %s padding is %d", data[:4], data[8+length])
+		}
+		chunks = append(chunks, riffChunk{fourCC: string(data[:4]), payload: data[8 : 8+length]})
+		data = data[8+padded:]
+	}
+
+	return chunks
+}
+
+// readRIFF 检查RIFF文件头, 返回WEBP之后的块
+func readRIFF(t *testing.T, data []byte) []riffChunk {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Fatalf("riff header is invalid: % x", data[:12])
+	}
+	if size := binary.LittleEndian.Uint32(data[4:8]); int(size) != len(data)-8 {
+		t.Errorf("riff size is %d, file has %d bytes after the header", size, len(data)-8)
+	}
+
+	return readChunks(t, data[12:])
+}
+
+// uint24 读取小端的24位整数
+func uint24(data []byte) int {
+	return int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+}
+
+// checkVP8L 检查VP8L位流头中的签名, 宽高, 透明提示和版本
+func checkVP8L(t *testing.T, bitstream []byte, width, height int, alpha bool) {
+	t.Helper()
+	if len(bitstream) < 5 || bitstream[0] != vp8lSignature {
+		t.Fatalf("vp8l signature is invalid: % x", bitstream)
+	}
+	header := binary.LittleEndian.Uint32(bitstream[1:5])
+	if w := int(header&0x3fff) + 1; w != width {
+		t.Errorf("vp8l width is %d, want %d", w, width)
+	}
+	if h := int(header>>14&0x3fff) + 1; h != height {
+		t.Errorf("vp8l height is %d, want %d", h, height)
+	}
+	if hint := header>>28&1 == 1; hint != alpha {
+		t.Errorf("vp8l alpha hint is %v, want %v", hint, alpha)
+	}
+	if version := header >> 29; version != 0 {
+		t.Errorf("vp8l version is %d", version)
+	}
+}
+
+// frameImage 按基础颜色生成的渐变图像
+func frameImage(width, height int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: c.R + uint8(x*7), G: c.G + uint8(y*11), B: c.B, A: c.A})
+		}
+	}
+
+	return img
+}
+
+func TestEncodeWebP(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	if err := EncodeWebP(buffer, frameImage(7, 5, color.NRGBA{R: 10, G: 20, B: 30, A: 255})); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	chunks := readRIFF(t, buffer.Bytes())
+	if len(chunks) != 1 || chunks[0].fourCC != "VP8L" {
+		t.Fatalf("still image has chunks %v", chunks)
+	}
+	checkVP8L(t, chunks[0].payload, 7, 5, false)
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	frames := []Frame{
+		{Image: frameImage(9, 6, color.NRGBA{R: 200, A: 255}), Duration: 100},
+		{Image: frameImage(9, 6, color.NRGBA{G: 200, A: 128}), Duration: 250},
+		{Image: frameImage(9, 6, color.NRGBA{B: 200, A: 255}), Duration: 70000},
+	}
+	buffer := new(bytes.Buffer)
+	if err := EncodeAnimatedWebP(buffer, frames, 3); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	chunks := readRIFF(t, buffer.Bytes())
+	if len(chunks) != 2+len(frames) || chunks[0].fourCC != "VP8X" || chunks[1].fourCC != "ANIM" {
+		t.Fatalf("animation starts with %v", chunks)
+	}
+
+	// VP8X: 标志, 3字节保留, 画布宽高减一
+	vp8x := chunks[0].payload
+	if len(vp8x) != 10 {
+		t.Fatalf("vp8x is %d bytes", len(vp8x))
+	}
+	if vp8x[0] != webpFlagAnimation|webpFlagAlpha {
+		t.Errorf("vp8x flags are %08b, want animation and alpha", vp8x[0])
+	}
+	if vp8x[1] != 0 || vp8x[2] != 0 || vp8x[3] != 0 {
+		t.Errorf("vp8x reserved bytes are % x", vp8x[1:4])
+	}
+	if width, height := uint24(vp8x[4:])+1, uint24(vp8x[7:])+1; width != 9 || height != 6 {
+		t.Errorf("canvas is %dx%d, want 9x6", width, height)
+	}
+
+	// ANIM: 背景色和循环次数
+	anim := chunks[1].payload
+	if len(anim) != 6 || binary.LittleEndian.Uint32(anim) != 0 || binary.LittleEndian.Uint16(anim[4:]) != 3 {
+		t.Errorf("anim is % x, want transparent background and 3 loops", anim)
+	}
+
+	for index, chunk := range chunks[2:] {
+		if chunk.fourCC != "ANMF" {
+			t.Fatalf("chunk %d is %s, want ANMF", index+2, chunk.fourCC)
+		}
+
+		// ANMF: 偏移, 帧宽高减一, 时长, 混合和处置标志, 之后是帧的位流块
+		frame := chunk.payload
+		if len(frame) < 16 {
+			t.Fatalf("frame %d is %d bytes", index, len(frame))
+		}
+		if x, y := uint24(frame[0:]), uint24(frame[3:]); x != 0 || y != 0 {
+			t.Errorf("frame %d offset is %d,%d", index, x*2, y*2)
+		}
+		if width, height := uint24(frame[6:])+1, uint24(frame[9:])+1; width != 9 || height != 6 {
+			t.Errorf("frame %d is %dx%d, want 9x6", index, width, height)
+		}
+		if duration := uint24(frame[12:]); duration != frames[index].Duration {
+			t.Errorf("frame %d duration is %d, want %d", index, duration, frames[index].Duration)
+		}
+		if frame[15] != webpFrameNoBlend {
+			t.Errorf("frame %d flags are %08b, want no blend and no dispose", index, frame[15])
+		}
+
+		bitstreams := readChunks(t, frame[16:])
+		if len(bitstreams) != 1 || bitstreams[0].fourCC != "VP8L" {
+			t.Fatalf("frame %d has chunks %v", index, bitstreams)
+		}
+		checkVP8L(t, bitstreams[0].payload, 9, 6, !frames[index].Image.(*image.NRGBA).Opaque())
+	}
+}
+
+func TestEncodeAnimatedWebPOpaque(t *testing.T) {
+	frames := []Frame{
+		{Image: frameImage(4, 4, color.NRGBA{R: 200, A: 255}), Duration: 40},
+		{Image: frameImage(4, 4, color.NRGBA{B: 200, A: 255}), Duration: 40},
+	}
+	buffer := new(bytes.Buffer)
+	if err := EncodeAnimatedWebP(buffer, frames, 0); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	chunks := readRIFF(t, buffer.Bytes())
+	if flags := chunks[0].payload[0]; flags != webpFlagAnimation {
+		t.Errorf("vp8x flags are %08b, want only animation", flags)
+	}
+	if loops := binary.LittleEndian.Uint16(chunks[1].payload[4:]); loops != 0 {
+		t.Errorf("loop count is %d, want 0 for infinite", loops)
+	}
+}
+
+func TestEncodeAnimatedWebPSingleFrame(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	frames := []Frame{{Image: frameImage(3, 2, color.NRGBA{R: 1, A: 255}), Duration: 100}}
+	if err := EncodeAnimatedWebP(buffer, frames, 0); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	// 只有一帧时编码为静态图像
+	chunks := readRIFF(t, buffer.Bytes())
+	if len(chunks) != 1 || chunks[0].fourCC != "VP8L" {
+		t.Fatalf("single frame has chunks %v", chunks)
+	}
+}
+
+func TestEncodeWebPInvalidSize(t *testing.T) {
+	for _, size := range []image.Point{{0, 10}, {vp8lMaxSize + 1, 1}} {
+		img := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		if err := EncodeWebP(new(bytes.Buffer), img); err == nil {
+			t.Errorf("encode %v returned no error", size)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isPNG 是否是png图片
+func isPNG(key string) bool {
+	return strings.ToLower(filepath.Ext(key)) == ".png"
+}
+
+// decodePNG 解码png图片, 先读取图像头检查尺寸
+func (s Imaging) decodePNG(bucket, key string, object *Object) (*Original, error) {
+	start := time.Now()
+
+	// 读取图像头, 已读取的内容在解码时重新使用
+	body := newChecksumReader(object.Body)
+	header := getBuffer()
+	defer putBuffer(header)
+	imageConfig, err := png.DecodeConfig(io.TeeReader(body, header))
+	if err != nil {
+		logger.Error("Decode image config failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	if err = s.checkPixels(key, imageConfig.Width, imageConfig.Height); err != nil {
+		logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 隔行扫描的png按7遍扫描解码, 像素数已经按完整尺寸检查
+	interlaced := pngInterlaced(header.Bytes())
+	img, err := png.Decode(io.MultiReader(header, body))
+	if err != nil {
+		logger.Error("Decode image failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+	logger.Debug("Decode image", "bucket", bucket, "key", key, "interlaced", interlaced, "durationMs", durationMs(start))
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Image, original.Bounds, original.Scale = img, image.Pt(imageConfig.Width, imageConfig.Height), 1
+
+	return original, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// maxPresignExpires SigV4预签名URL的最长有效期
+	maxPresignExpires = 7 * 24 * time.Hour
+)
+
+// presignThumbnail 生成缩略图的预签名GET地址, 其他账号不需要修改bucket策略即可读取
+// 未配置PresignExpires, 存储不支持或者签名失败时返回空, 不影响缩略图的生成
+func (s Imaging) presignThumbnail(ctx context.Context, bucket, key string) string {
+	signer, ok := s.destination.(URLSigner)
+	if !ok || s.config.PresignExpires <= 0 {
+		return ""
+	}
+
+	// 使用写入缩略图的凭证签名, 临时凭证过期后签名的地址也会失效
+	url, err := signer.PresignGet(bucket, key, s.config.PresignExpires)
+	if err != nil {
+		logger.WarnContext(ctx, "Presign thumbnail failed", "thumbnail", key, "error", err)
+		return ""
+	}
+
+	return url
+}
+
+// presignExpiresAt 预签名地址的过期时间, 不生成预签名地址时为空
+func (s Imaging) presignExpiresAt(now time.Time) string {
+	if _, ok := s.destination.(URLSigner); !ok || s.config.PresignExpires <= 0 {
+		return ""
+	}
+
+	return now.Add(s.config.PresignExpires).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// jpegProgressiveMarker 渐进式jpeg的帧开始标记
+	jpegProgressiveMarker = 0xc2
+	// pngInterlaceOffset png的IHDR中隔行扫描标志的位置, 在签名, 块长度, 块类型和前12字节数据之后
+	pngInterlaceOffset = 8 + 8 + 12
+	// progressiveBytesPerPixel 渐进式jpeg解码时保存所有扫描的DCT系数, 4:2:0时每像素约6字节
+	progressiveBytesPerPixel = 6
+)
+
+// SmallImageError 不放大原图时原图小于所有尺寸, 只读取了图像头
+type SmallImageError struct {
+	Key    string
+	Bounds image.Point
+}
+
+// Error 实现error
+func (e *SmallImageError) Error() string {
+	return fmt.Sprintf("image %s is %dx%d pixels, smaller than all sizes", e.Key, e.Bounds.X, e.Bounds.Y)
+}
+
+// replayBody 已读取的图像头在解码时重新读取的对象内容
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// probeDecoder 只读取图像头的尺寸解码器, 与decodeOriginal的格式判断一致
+// PDF, SVG, 视频, RAW和tiff需要读取完整内容才能得到尺寸, 返回nil
+func (s Imaging) probeDecoder(key string) func(io.Reader) (image.Config, error) {
+	switch {
+	case s.config.PDF && isPDF(key), s.config.SVG && isSVG(key), s.config.Video && isVideo(key), s.config.RAW && isRAW(key):
+		return nil
+	case s.config.GIF && isGIF(key):
+		return gif.DecodeConfig
+	case s.config.PNG && isPNG(key):
+		return png.DecodeConfig
+	case s.config.TIFF && isTIFF(key):
+		return nil
+	}
+
+	return jpeg.DecodeConfig
+}
+
+// probeImage 不放大原图时先读取图像头, 所有尺寸都会跳过时返回SmallImageError, 不再下载和解码剩余的内容
+// 已读取的图像头在解码时重新读取, 渐进式jpeg和隔行扫描png的尺寸同样在图像头中
+func (s Imaging) probeImage(ctx context.Context, key string, object *Object, sizes []Size) error {
+	decodeConfig := s.probeDecoder(key)
+	if decodeConfig == nil || len(sizes) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	header := new(bytes.Buffer)
+	imageConfig, err := decodeConfig(io.TeeReader(object.Body, header))
+	object.Body = replayBody{Reader: io.MultiReader(header, object.Body), Closer: object.Body}
+	if err != nil {
+		// 由解码报告错误
+		return nil
+	}
+
+	bounds := image.Pt(imageConfig.Width, imageConfig.Height)
+	logger.DebugContext(ctx, "Probe image", "width", bounds.X, "height", bounds.Y, "progressive", jpegProgressive(header.Bytes()), "interlaced", pngInterlaced(header.Bytes()), "headerBytes", header.Len(), "durationMs", durationMs(start))
+
+	// 对象元数据中的旋转和翻转会覆盖配置的变换, 与prepareSizes一致
+	transform, hasTransform := metadataTransform(ctx, object.Metadata)
+	for _, size := range sizes {
+		if hasTransform {
+			size.Transform = transform
+		}
+		if size.upscaleFactor(bounds) <= 1 {
+			return nil
+		}
+	}
+
+	return &SmallImageError{Key: key, Bounds: bounds}
+}
+
+// skipSmallImage 原图小于所有尺寸时将所有尺寸记录为跳过
+func (s Imaging) skipSmallImage(ctx context.Context, record events.S3EventRecord, sizes []Size, err *SmallImageError, result *RecordResult) {
+	logger.InfoContext(ctx, "Skip image smaller than all sizes", "width", err.Bounds.X, "height", err.Bounds.Y)
+	for _, size := range sizes {
+		start := time.Now()
+		bucket, key := s.thumbnailLocation(record.S3.Bucket.Name, record.S3.Object.Key, recordVersion(record), size)
+		sizeResult := SizeResult{Size: sizeName(size), Bucket: bucket, Key: key}
+		sizeResult.finish(start, errSkipped)
+		result.Sizes = append(result.Sizes, sizeResult)
+	}
+	result.Status = StatusSkipped
+}
+
+// jpegProgressive jpeg图像头中的帧是否是渐进式的
+func jpegProgressive(header []byte) bool {
+	progressive := false
+	jpegSegments(header, func(marker byte, segment []byte) bool {
+		if jpegFrameMarker(marker) {
+			progressive = marker == jpegProgressiveMarker
+			return false
+		}
+		return true
+	})
+
+	return progressive
+}
+
+// pngInterlaced png图像头中是否标记了Adam7隔行扫描
+func pngInterlaced(header []byte) bool {
+	if len(header) <= pngInterlaceOffset || !bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")) || string(header[12:16]) != "IHDR" {
+		return false
+	}
+
+	return header[pngInterlaceOffset] == 1
+}
+
+// checkProgressive 渐进式jpeg需要额外保存DCT系数, 按折算后的像素数检查原图
+func (s Imaging) checkProgressive(key string, width, height int) error {
+	if s.config.MaxPixels <= 0 {
+		return nil
+	}
+
+	limit := s.config.MaxPixels * memoryPerPixel / (memoryPerPixel + progressiveBytesPerPixel)
+	if int64(width)*int64(height) > limit {
+		return &ImageTooLargeError{Key: key, Reason: fmt.Sprintf("is progressive %dx%d pixels, limit for progressive is %d pixels", width, height, limit)}
+	}
+
+	return nil
+}
+
+// jpegFrameMarker 是否是帧开始标记, 0xc4, 0xc8和0xcc是其他段
+func jpegFrameMarker(marker byte) bool {
+	return marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc
+}
+
+// jpegSegments 依次访问jpeg图像头中扫描开始之前的段, visit返回false时停止
+func jpegSegments(header []byte, visit func(marker byte, segment []byte) bool) {
+	if len(header) < 4 || header[0] != 0xff || header[1] != 0xd8 {
+		return
+	}
+
+	for offset := 2; offset+4 <= len(header); {
+		if header[offset] != 0xff {
+			return
+		}
+		marker := header[offset+1]
+		length := int(binary.BigEndian.Uint16(header[offset+2:]))
+		end := offset + 2 + length
+		if marker == 0xda || length < 2 || end > len(header) {
+			return
+		}
+
+		if !visit(marker, header[offset+4:end]) {
+			return
+		}
+		offset = end
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// interlacedPNG 按Adam7隔行扫描编码测试图像, 标准库只能编码非隔行扫描的png
+func interlacedPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := testImage(width, height)
+	passes := []struct{ x, y, dx, dy int }{
+		{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2},
+	}
+
+	data := new(bytes.Buffer)
+	writer := zlib.NewWriter(data)
+	for _, pass := range passes {
+		if pass.x >= width || pass.y >= height {
+			continue
+		}
+		for y := pass.y; y < height; y += pass.dy {
+			row := []byte{0}
+			for x := pass.x; x < width; x += pass.dx {
+				pixel := img.RGBAAt(x, y)
+				row = append(row, pixel.R, pixel.G, pixel.B)
+			}
+			writer.Write(row)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(width))
+	binary.BigEndian.PutUint32(header[4:], uint32(height))
+	header[8], header[9], header[12] = 8, 2, 1
+
+	buffer := bytes.NewBufferString("\x89PNG\r\n\x1a\n")
+	for _, chunk := range []struct {
+		name string
+		data []byte
+	}{{"IHDR", header}, {"IDAT", data.Bytes()}, {"IEND", nil}} {
+		binary.Write(buffer, binary.BigEndian, uint32(len(chunk.data)))
+		content := append([]byte(chunk.name), chunk.data...)
+		buffer.Write(content)
+		binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(content))
+	}
+
+	return buffer.Bytes()
+}
+
+// progressiveJPEG 150x103的渐进式jpeg, 来自go标准库的测试图像
+func progressiveJPEG(t *testing.T) []byte {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "progressive.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+// countingReader 记录已经读取的字节数
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+// Read 实现io.Reader
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+// Close 实现io.Closer
+func (r *countingReader) Close() error {
+	return nil
+}
+
+func TestInterlacedPNGFixture(t *testing.T) {
+	img, err := png.Decode(bytes.NewReader(interlacedPNG(t, 19, 13)))
+	if err != nil {
+		t.Fatalf("decode interlaced png failed: %v", err)
+	}
+
+	expected := testImage(19, 13)
+	for y := 0; y < 13; y++ {
+		for x := 0; x < 19; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			pixel := expected.RGBAAt(x, y)
+			if uint8(r>>8) != pixel.R || uint8(g>>8) != pixel.G || uint8(b>>8) != pixel.B {
+				t.Fatalf("pixel %d,%d is %d,%d,%d, want %v", x, y, r>>8, g>>8, b>>8, pixel)
+			}
+		}
+	}
+}
+
+func TestHeaderScanFlags(t *testing.T) {
+	baselinePNG := new(bytes.Buffer)
+	if err := png.Encode(baselinePNG, testImage(20, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name                    string
+		content                 []byte
+		progressive, interlaced bool
+	}{
+		{"baseline jpeg", testJPEG(t, 20, 10), false, false},
+		{"progressive jpeg", progressiveJPEG(t), true, false},
+		{"png", baselinePNG.Bytes(), false, false},
+		{"interlaced png", interlacedPNG(t, 20, 10), false, true},
+		{"truncated png", interlacedPNG(t, 20, 10)[:pngInterlaceOffset], false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if progressive := jpegProgressive(c.content); progressive != c.progressive {
+				t.Errorf("progressive is %v, want %v", progressive, c.progressive)
+			}
+			if interlaced := pngInterlaced(c.content); interlaced != c.interlaced {
+				t.Errorf("interlaced is %v, want %v", interlaced, c.interlaced)
+			}
+		})
+	}
+}
+
+func TestDecodeProgressiveAndInterlaced(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{
+		"Sizes": "50x50",
+		"PNG":   "true",
+	})
+
+	cases := []struct {
+		key           string
+		content       []byte
+		width, height int
+	}{
+		{"progressive.jpg", progressiveJPEG(t), 50, 34},
+		{"interlaced.png", interlacedPNG(t, 120, 90), 50, 37},
+	}
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			writeTestFile(t, bucket, c.key, c.content)
+			result := s.processRecord(context.Background(), createdRecord(t, s, bucket, c.key))
+			if err := result.Err(); err != nil {
+				t.Fatalf("process failed: %v", err)
+			}
+			if len(result.Sizes) != 1 {
+				t.Fatalf("created %d sizes, want 1", len(result.Sizes))
+			}
+
+			thumbnail, _, err := image.DecodeConfig(bytes.NewReader(readTestFile(t, bucket, result.Sizes[0].Key)))
+			if err != nil {
+				t.Fatalf("decode thumbnail failed: %v", err)
+			}
+			if thumbnail.Width != c.width || thumbnail.Height != c.height {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", thumbnail.Width, thumbnail.Height, c.width, c.height)
+			}
+		})
+	}
+}
+
+func TestProgressivePixelLimit(t *testing.T) {
+	bucket := t.TempDir()
+	// 150x103的原图在普通限制之内, 按DCT系数折算后超过限制
+	s := newTestImaging(t, map[string]string{
+		"Sizes":     "50x50",
+		"MaxPixels": "20000",
+	})
+
+	cases := []struct {
+		key      string
+		content  []byte
+		tooLarge bool
+	}{
+		{"baseline.jpg", testJPEG(t, 150, 103), false},
+		{"progressive.jpg", progressiveJPEG(t), true},
+	}
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			writeTestFile(t, bucket, c.key, c.content)
+			record := createdRecord(t, s, bucket, c.key)
+			_, err := s.readImage(context.Background(), record, s.config.Sizes, false)
+			if isTooLarge(err) != c.tooLarge {
+				t.Errorf("read image returned %v, too large should be %v", err, c.tooLarge)
+			}
+		})
+	}
+}
+
+func TestProbeImage(t *testing.T) {
+	s := newTestImaging(t, map[string]string{
+		"Sizes":     "50x50",
+		"PNG":       "true",
+		"NoUpscale": "skip",
+	})
+
+	content := interlacedPNG(t, 120, 90)
+	cases := []struct {
+		name  string
+		sizes string
+		small bool
+	}{
+		{"fits", "100x80:fill", false},
+		{"fit mode never upscales", "200x200,300x300", false},
+		{"smaller than all sizes", "200x200:fill,300x300:fill", true},
+		{"smaller than some sizes", "100x80:fill,300x300:fill", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sizes, err := parseSizes(c.sizes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := &countingReader{Reader: bytes.NewReader(content)}
+			object := &Object{Body: body}
+			err = s.probeImage(context.Background(), "interlaced.png", object, sizes)
+
+			// 只读取了图像头
+			if body.read >= len(content) {
+				t.Errorf("probe read %d of %d bytes", body.read, len(content))
+			}
+
+			small, ok := err.(*SmallImageError)
+			if ok != c.small {
+				t.Fatalf("probe returned %v, small should be %v", err, c.small)
+			}
+			if ok && small.Bounds != image.Pt(120, 90) {
+				t.Errorf("probe bounds is %v, want 120x90", small.Bounds)
+			}
+
+			// 解码时重新读取已读取的图像头
+			replayed, err := ioutil.ReadAll(object.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(replayed, content) {
+				t.Errorf("replayed %d bytes, want %d", len(replayed), len(content))
+			}
+		})
+	}
+}
+
+func TestSkipSmallOriginal(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{
+		"Sizes":     "200x200:fill,300x300:fill",
+		"NoUpscale": "skip",
+	})
+
+	writeTestFile(t, bucket, "small.jpg", progressiveJPEG(t))
+	result := s.processRecord(context.Background(), createdRecord(t, s, bucket, "small.jpg"))
+	if err := result.Err(); err != nil {
+		t.Fatalf("process failed: %v", err)
+	}
+	if result.Status != StatusSkipped {
+		t.Errorf("status is %s, want %s", result.Status, StatusSkipped)
+	}
+	if len(result.Sizes) != 2 {
+		t.Fatalf("recorded %d sizes, want 2", len(result.Sizes))
+	}
+	for _, size := range result.Sizes {
+		if size.Status != StatusSkipped {
+			t.Errorf("size %s status is %s, want %s", size.Size, size.Status, StatusSkipped)
+		}
+		if _, err := os.Stat(filepath.Join(bucket, filepath.FromSlash(size.Key))); !os.IsNotExist(err) {
+			t.Errorf("thumbnail %s was written", size.Key)
+		}
+	}
+}
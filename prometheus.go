@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// promBuckets 耗时直方图的区间, 单位秒, 与Prometheus客户端的默认值一致
+var promBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// promHistogram 直方图
+type promHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe 记录一个样本
+func (h *promHistogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(promBuckets))
+	}
+	for index, bound := range promBuckets {
+		if value <= bound {
+			h.counts[index]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// promMetrics 服务模式下通过/metrics暴露的Prometheus指标
+type promMetrics struct {
+	mutex sync.Mutex
+
+	records    map[string]float64
+	thumbnails map[string]map[string]float64
+	bytesIn    float64
+	bytesOut   float64
+	duration   promHistogram
+	decode     promHistogram
+	resize     map[string]*promHistogram
+}
+
+// newPromMetrics 新建Prometheus指标
+func newPromMetrics() *promMetrics {
+	return &promMetrics{
+		records:    make(map[string]float64),
+		thumbnails: make(map[string]map[string]float64),
+		resize:     make(map[string]*promHistogram),
+	}
+}
+
+// observe 按处理结果更新指标
+func (m *promMetrics) observe(results []RecordResult) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, result := range results {
+		m.records[result.Status]++
+		if result.Status == StatusIgnored {
+			continue
+		}
+
+		m.duration.observe(float64(result.DurationMs) / 1000)
+		if result.BytesIn > 0 {
+			m.bytesIn += float64(result.BytesIn)
+			m.decode.observe(float64(result.DecodeMs) / 1000)
+		}
+
+		for _, size := range result.Sizes {
+			if m.thumbnails[size.Size] == nil {
+				m.thumbnails[size.Size] = make(map[string]float64)
+				m.resize[size.Size] = new(promHistogram)
+			}
+			m.thumbnails[size.Size][size.Status]++
+			m.bytesOut += float64(size.Bytes)
+			if size.ResizeMs > 0 {
+				m.resize[size.Size].observe(float64(size.ResizeMs) / 1000)
+			}
+		}
+	}
+}
+
+// ServeHTTP 以文本格式输出指标
+func (m *promMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writePromHeader(w, "resize_records_total", "counter", "Event records processed by status.")
+	for _, status := range sortedKeys(m.records) {
+		fmt.Fprintf(w, "resize_records_total{status=%q} %g\n", status, m.records[status])
+	}
+
+	writePromHeader(w, "resize_thumbnails_total", "counter", "Thumbnails processed by size and status.")
+	for _, size := range sortedKeys(m.thumbnails) {
+		for _, status := range sortedKeys(m.thumbnails[size]) {
+			fmt.Fprintf(w, "resize_thumbnails_total{size=%q,status=%q} %g\n", size, status, m.thumbnails[size][status])
+		}
+	}
+
+	writePromHeader(w, "resize_bytes_in_total", "counter", "Bytes of originals read.")
+	fmt.Fprintf(w, "resize_bytes_in_total %g\n", m.bytesIn)
+	writePromHeader(w, "resize_bytes_out_total", "counter", "Bytes of thumbnails written.")
+	fmt.Fprintf(w, "resize_bytes_out_total %g\n", m.bytesOut)
+
+	writePromHeader(w, "resize_record_duration_seconds", "histogram", "Time to process an event record.")
+	writePromHistogram(w, "resize_record_duration_seconds", "", &m.duration)
+	writePromHeader(w, "resize_decode_duration_seconds", "histogram", "Time to read and decode an original.")
+	writePromHistogram(w, "resize_decode_duration_seconds", "", &m.decode)
+	writePromHeader(w, "resize_resize_duration_seconds", "histogram", "Time to render a thumbnail by size.")
+	for _, size := range sortedKeys(m.resize) {
+		writePromHistogram(w, "resize_resize_duration_seconds", fmt.Sprintf("size=%q", size), m.resize[size])
+	}
+}
+
+// writePromHeader 输出指标的说明和类型
+func writePromHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writePromHistogram 输出直方图的区间, 总和与数量
+func writePromHistogram(w io.Writer, name, labels string, h *promHistogram) {
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+
+	for index, bound := range promBuckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[index]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, bound, count)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, suffix, h.sum, name, suffix, h.count)
+}
+
+// sortedKeys 排序后的map key, 保证输出顺序稳定
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch values := m.(type) {
+	case map[string]float64:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]map[string]float64:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*promHistogram:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// serveMux 服务模式的路由, /metrics输出指标, 其他路径交给事件处理
+func serveMux(metrics *promMetrics, handler http.HandlerFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/", handler)
+
+	return mux
+}
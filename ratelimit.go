@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// tokenBucket 令牌桶限速, 每秒补充rate个令牌, 最多积累一秒的令牌以允许短暂的突发
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket 新建令牌桶, rate为0时不限速, 返回nil
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := math.Max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait 取得一个令牌, 令牌不足时等待, ctx结束时返回错误
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	// 先预留令牌再等待, 等待中的请求按到达的顺序依次发出
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		// 没有发出请求, 归还令牌
+		b.mutex.Lock()
+		b.tokens++
+		b.mutex.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// s3ReadOperations 按S3GetRate限速的S3操作
+var s3ReadOperations = map[string]bool{
+	"GetObject":  true,
+	"HeadObject": true,
+}
+
+// s3WriteOperations 按S3PutRate限速的S3操作, 分段上传的每个请求都计入
+var s3WriteOperations = map[string]bool{
+	"PutObject":               true,
+	"CreateMultipartUpload":   true,
+	"UploadPart":              true,
+	"CompleteMultipartUpload": true,
+	"AbortMultipartUpload":    true,
+	"DeleteObject":            true,
+	"CopyObject":              true,
+}
+
+// limitS3Requests 在签名S3请求前按S3GetRate和S3PutRate限速, 每次发送前都会重新签名, SDK的重试和分段下载上传的每个请求都计入
+func limitS3Requests(handlers *request.Handlers, config *Config) {
+	get, put := newTokenBucket(config.S3GetRate), newTokenBucket(config.S3PutRate)
+	if get == nil && put == nil {
+		return
+	}
+
+	handlers.Sign.PushFront(func(r *request.Request) {
+		// 预签名只在本地签名, 不发送请求
+		if r.ClientInfo.ServiceName != "s3" || r.ExpireTime > 0 {
+			return
+		}
+
+		var bucket *tokenBucket
+		switch {
+		case s3ReadOperations[r.Operation.Name]:
+			bucket = get
+		case s3WriteOperations[r.Operation.Name]:
+			bucket = put
+		default:
+			return
+		}
+
+		start := time.Now()
+		if err := bucket.wait(r.Context()); err != nil {
+			r.Error = err
+			return
+		}
+		if waited := time.Since(start); waited >= time.Second {
+			logger.DebugContext(r.Context(), "Wait for S3 rate limit", "operation", r.Operation.Name, "waitMs", int64(waited/time.Millisecond))
+		}
+	})
+}
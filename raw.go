@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+const (
+	tiffTagCompression     = 0x0103
+	tiffTagStripOffsets    = 0x0111
+	tiffTagStripByteCounts = 0x0117
+	tiffTagSubIFDs         = 0x014a
+	tiffTagJPEGOffset      = 0x0201
+	tiffTagJPEGLength      = 0x0202
+	tiffCompressionOldJPEG = 6
+	tiffCompressionJPEG    = 7
+	maxRAWIFDs             = 32
+)
+
+// errNoRAWPreview RAW文件中没有可以解码的jpeg预览
+var errNoRAWPreview = errors.New("raw file has no jpeg preview")
+
+// isRAW 是否是相机RAW文件, 都是基于TIFF的格式
+func isRAW(key string) bool {
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".cr2", ".nef", ".arw", ".dng":
+		return true
+	}
+
+	return false
+}
+
+// decodeRAW 读取RAW文件中最大的jpeg预览, 之后与jpeg原图一样处理
+func (s Imaging) decodeRAW(bucket, key string, object *Object, sizes []Size) (*Original, error) {
+	start := time.Now()
+
+	body := newChecksumReader(object.Body)
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		logger.Error("Read raw failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	preview, imageConfig, err := rawPreview(content)
+	if err != nil {
+		logger.Error("Extract raw preview failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	if err = s.checkPixels(key, imageConfig.Width, imageConfig.Height); err != nil {
+		logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// vips后端直接处理预览的内容
+	bounds := image.Pt(imageConfig.Width, imageConfig.Height)
+	scale := s.decodeScale(bounds, sizes)
+	var img image.Image
+	var source []byte
+	if s.config.Backend == BackendVips {
+		source = preview
+	} else if img, err = pipeline.DecodeJPEG(bytes.NewReader(preview), scale); err != nil {
+		logger.Error("Decode raw preview failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+	logger.Debug("Decode raw preview", "bucket", bucket, "key", key, "width", bounds.X, "height", bounds.Y, "scale", scale, "durationMs", durationMs(start))
+
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Image, original.Bounds, original.Scale, original.Source = img, bounds, scale, source
+	original.exif = readEXIF(content, exifInfo{ColorSpace: colorSpace(imageConfig.ColorModel)})
+
+	return original, nil
+}
+
+// rawPreview 遍历TIFF的IFD和SubIFD, 返回可以解码的最大的jpeg预览
+// DNG中无损jpeg压缩的原始数据无法用标准库解码, 会被跳过
+func rawPreview(content []byte) ([]byte, image.Config, error) {
+	if len(content) < 8 {
+		return nil, image.Config{}, errNoRAWPreview
+	}
+
+	var order binary.ByteOrder
+	switch string(content[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, image.Config{}, errors.New("raw file is not tiff based")
+	}
+
+	var candidates [][]byte
+	visited := make(map[uint32]bool)
+	pending := []uint32{order.Uint32(content[4:8])}
+	for len(pending) > 0 && len(visited) < maxRAWIFDs {
+		offset := pending[0]
+		pending = pending[1:]
+		if offset == 0 || visited[offset] {
+			continue
+		}
+		visited[offset] = true
+
+		entries, next, ok := readIFD(content, order, offset)
+		if !ok {
+			continue
+		}
+		pending = append(pending, next)
+		pending = append(pending, entries[tiffTagSubIFDs]...)
+
+		// 缩略图和预览的jpeg位置
+		if offsets, lengths := entries[tiffTagJPEGOffset], entries[tiffTagJPEGLength]; len(offsets) == 1 && len(lengths) == 1 {
+			candidates = appendSegment(candidates, content, offsets[0], lengths[0])
+		}
+
+		// CR2的IFD0和部分DNG的预览以单个jpeg压缩的条带保存
+		if compression := entries[tiffTagCompression]; len(compression) == 1 && (compression[0] == tiffCompressionOldJPEG || compression[0] == tiffCompressionJPEG) {
+			if offsets, lengths := entries[tiffTagStripOffsets], entries[tiffTagStripByteCounts]; len(offsets) == 1 && len(lengths) == 1 {
+				candidates = appendSegment(candidates, content, offsets[0], lengths[0])
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return len(candidates[i]) > len(candidates[j]) })
+	for _, candidate := range candidates {
+		if config, err := jpeg.DecodeConfig(bytes.NewReader(candidate)); err == nil {
+			return candidate, config, nil
+		}
+	}
+
+	return nil, image.Config{}, errNoRAWPreview
+}
+
+// appendSegment 添加以jpeg开始标记开头的区段
+func appendSegment(candidates [][]byte, content []byte, offset, length uint32) [][]byte {
+	end := uint64(offset) + uint64(length)
+	if length < 2 || end > uint64(len(content)) || content[offset] != 0xff || content[offset+1] != 0xd8 {
+		return candidates
+	}
+
+	return append(candidates, content[offset:end])
+}
+
+// readIFD 读取IFD中整数类型的标签和下一个IFD的位置
+func readIFD(content []byte, order binary.ByteOrder, offset uint32) (map[uint16][]uint32, uint32, bool) {
+	return pipeline.ReadIFDValues(content, order, offset, maxRAWIFDs)
+}
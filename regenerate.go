@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// eventSourceRegenerate 控制对象触发重新生成时构造的事件来源
+	eventSourceRegenerate = "aws:s3:regenerate"
+	// regenerateAfterMetadata 控制对象中记录的进度, 重新写入控制对象后从该key之后继续
+	regenerateAfterMetadata = "regenerate-after"
+	// regeneratePageSize 每次列出的对象数量
+	regeneratePageSize = 1000
+	// regenerateBatchSize 每批并行处理的原图数量, 每批之前检查剩余时间
+	regenerateBatchSize = 32
+)
+
+// isRegenerateMarker 是否是配置的重新生成控制对象, 如photos/album1/.regenerate
+func (s Imaging) isRegenerateMarker(key string) bool {
+	return s.config.RegenerateMarker != "" && path.Base(key) == s.config.RegenerateMarker
+}
+
+// onRegenerate 上传控制对象时按当前配置重新处理同一前缀下的所有原图, 覆盖已有的缩略图
+// 剩余时间不足时在控制对象中记录进度并重新写入, 由新的事件继续处理, 全部完成后删除控制对象
+func (s Imaging) onRegenerate(ctx context.Context, record events.S3EventRecord, result *RecordResult) error {
+	if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+		logger.InfoContext(ctx, "Ignore regenerate marker event", "event", record.EventName)
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	lister, ok := s.store.(ObjectLister)
+	if !ok {
+		logger.WarnContext(ctx, "Ignore regenerate marker, storage can not list objects", "storage", s.config.Storage)
+		result.Status = StatusIgnored
+		return nil
+	}
+
+	// 重新写入的控制对象中记录了URL编码后的上次处理到的位置, 控制对象已被删除时表示已经完成或者取消
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	var info *ObjectInfo
+	err := s.retryStorage(ctx, "head", true, func() error {
+		var err error
+		info, err = s.store.Head(ctx, bucket, key)
+		return err
+	})
+	if isNotFound(err) {
+		logger.InfoContext(ctx, "Ignore removed regenerate marker")
+		result.Status = StatusIgnored
+		return nil
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Head object failed", "error", err)
+		return err
+	}
+
+	prefix := strings.TrimSuffix(key, s.config.RegenerateMarker)
+	after, err := url.QueryUnescape(metadataValue(info.Metadata, regenerateAfterMetadata))
+	if err != nil {
+		logger.WarnContext(ctx, "Ignore invalid regenerate progress", "error", err)
+		after = ""
+	}
+	logger.InfoContext(ctx, "Regenerate thumbnails", "prefix", prefix, "after", after)
+
+	start := time.Now()
+	stats := new(backfillStats)
+	var batchDuration time.Duration
+	for more := true; more; {
+		var keys []string
+		err = s.retryStorage(ctx, "list", false, func() error {
+			var err error
+			keys, more, err = lister.List(ctx, bucket, prefix, after, regeneratePageSize)
+			return err
+		})
+		if err != nil {
+			logger.ErrorContext(ctx, "List objects failed", "prefix", prefix, "error", err)
+			return err
+		}
+
+		for len(keys) > 0 {
+			// 按上一批的耗时估计下一批, 剩余时间不足时交给下一次调用
+			if s.batchTimeShort(ctx, batchDuration) {
+				logger.InfoContext(ctx, "Continue regenerate later", "prefix", prefix, "after", after, "rows", stats.Rows, "processed", stats.Processed, "failed", stats.Failed)
+				return s.continueRegenerate(ctx, bucket, key, after)
+			}
+
+			batch := keys
+			if len(batch) > regenerateBatchSize {
+				batch = batch[:regenerateBatchSize]
+			}
+			keys = keys[len(batch):]
+
+			batchStart := time.Now()
+			s.regenerateBatch(ctx, bucket, key, batch, stats)
+			batchDuration = time.Since(batchStart)
+			after = batch[len(batch)-1]
+		}
+	}
+
+	// 处理失败的原图已经记录在报告中, 返回错误会让整个前缀重新处理
+	logger.InfoContext(ctx, "Regenerate complete", "prefix", prefix, "rows", stats.Rows, "skipped", stats.Skipped, "processed", stats.Processed, "failed", stats.Failed, "durationMs", durationMs(start))
+	if s.config.DryRun {
+		logger.InfoContext(ctx, "Dry run remove regenerate marker")
+		return nil
+	}
+	if err = s.store.Delete(ctx, bucket, key); err != nil {
+		logger.WarnContext(ctx, "Remove regenerate marker failed", "error", err)
+	}
+
+	return nil
+}
+
+// regenerateBatch 并行处理一批原图, 控制对象已经占用了一个处理槽, 不再经过imageSlots, 并发数与MaxConcurrentImages相同
+// 构造的事件没有ETag, 不会因为台账或者SkipExisting跳过
+func (s Imaging) regenerateBatch(ctx context.Context, bucket, marker string, keys []string, stats *backfillStats) {
+	var records []events.S3EventRecord
+	for _, key := range keys {
+		stats.Rows++
+		if s.isRegenerateMarker(key) || strings.HasSuffix(key, "/") || s.isThumbnailKey(bucket, key) || !s.config.KeyFilter.Match(key) || !s.isSupportedKey(key) {
+			stats.Skipped++
+			continue
+		}
+
+		// 与S3事件一样, 事件中的key经过URL编码
+		record := events.S3EventRecord{EventSource: eventSourceRegenerate, EventName: "ObjectCreated:Put"}
+		record.S3.Bucket.Name = bucket
+		record.S3.Object.Key = url.QueryEscape(key)
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	concurrency := s.config.MaxConcurrentImages
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	slots := make(chan struct{}, concurrency)
+
+	recordCtx := resetLogAttrs(ctx, "regenerateMarker", marker)
+	results := make([]RecordResult, len(records))
+	wg := new(sync.WaitGroup)
+	wg.Add(len(records))
+	for index, record := range records {
+		go func(index int, record events.S3EventRecord) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[index] = s.processRecord(recordCtx, record)
+		}(index, record)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		stats.Processed++
+		if result.Err() != nil {
+			stats.Failed++
+		}
+	}
+	s.logReport(recordCtx, results)
+}
+
+// batchTimeShort 剩余时间是否不够再处理一批, 没有截止时间时总是足够
+func (s Imaging) batchTimeShort(ctx context.Context, batchDuration time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false
+	}
+
+	return time.Until(deadline) < s.config.DeadlineMargin+2*batchDuration
+}
+
+// continueRegenerate 在控制对象的元数据中记录处理到的位置并重新写入, 新的事件从该位置继续
+func (s Imaging) continueRegenerate(ctx context.Context, bucket, key, after string) error {
+	if s.config.DryRun {
+		logger.InfoContext(ctx, "Dry run continue regenerate", "after", after)
+		return nil
+	}
+
+	// 元数据只能包含ASCII字符
+	options := PutOptions{Metadata: map[string]string{regenerateAfterMetadata: url.QueryEscape(after)}}
+	err := s.retryStorage(ctx, "put", false, func() error {
+		return s.store.Put(ctx, bucket, key, bytes.NewReader(nil), options)
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Put regenerate marker failed", "after", after, "error", err)
+		return err
+	}
+
+	return nil
+}
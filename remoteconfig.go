@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// loadRemoteConfig 读取Parameter Store和Secrets Manager中的配置, 覆盖配置文件中的值
+func loadRemoteConfig(values map[string]string) (map[string]string, error) {
+	parameter, secret := os.Getenv("ConfigParameter"), os.Getenv("ConfigSecret")
+	if parameter == "" && secret == "" {
+		return values, nil
+	}
+
+	sess, err := configSession()
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string]string)
+	}
+
+	if parameter != "" {
+		parameters, err := readParameters(ssm.New(sess), parameter)
+		if err != nil {
+			return nil, fmt.Errorf("read parameter %s failed due to %v", parameter, err)
+		}
+		for name, value := range parameters {
+			values[name] = value
+		}
+	}
+
+	// 访问密钥等凭证保存在Secrets Manager中
+	if secret != "" {
+		output, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(secret)})
+		if err != nil {
+			return nil, fmt.Errorf("read secret %s failed due to %v", secret, err)
+		}
+
+		secrets, err := parseJSONConfig([]byte(aws.StringValue(output.SecretString)))
+		if err != nil {
+			return nil, fmt.Errorf("secret %s must be a json object: %v", secret, err)
+		}
+		for name, value := range secrets {
+			values[name] = value
+		}
+	}
+
+	return values, nil
+}
+
+// readParameters 读取Parameter Store中的配置
+// 以/结尾时读取路径下的所有参数, 参数名最后一段为配置名, 否则参数的值为JSON对象
+func readParameters(client *ssm.SSM, name string) (map[string]string, error) {
+	if !strings.HasSuffix(name, "/") {
+		output, err := client.GetParameter(&ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+		if err != nil {
+			return nil, err
+		}
+
+		return parseJSONConfig([]byte(aws.StringValue(output.Parameter.Value)))
+	}
+
+	values := make(map[string]string)
+	input := &ssm.GetParametersByPathInput{Path: aws.String(name), WithDecryption: aws.Bool(true)}
+	err := client.GetParametersByPathPages(input, func(output *ssm.GetParametersByPathOutput, lastPage bool) bool {
+		for _, parameter := range output.Parameters {
+			values[path.Base(aws.StringValue(parameter.Name))] = aws.StringValue(parameter.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// refreshingHandler 按ConfigRefreshInterval重新读取配置, 热启动的函数不需要重新部署即可使用新的配置
+type refreshingHandler struct {
+	mutex   sync.Mutex
+	imaging *Imaging
+	expires time.Time
+}
+
+// Handle 配置过期后重新读取配置并创建图片处理, 失败时继续使用原来的配置
+func (h *refreshingHandler) Handle(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	return h.current(ctx).Handle(ctx, payload)
+}
+
+// current 返回当前配置的图片处理
+func (h *refreshingHandler) current(ctx context.Context) *Imaging {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	interval := h.imaging.config.ConfigRefreshInterval
+	if interval <= 0 || time.Now().Before(h.expires) {
+		return h.imaging
+	}
+	h.expires = time.Now().Add(interval)
+
+	config, err := readConfig()
+	if err != nil {
+		logger.Warn("Refresh config failed", "error", err)
+		return h.imaging
+	}
+
+	imaging, err := newImaging(ctx, config)
+	if err != nil {
+		logger.Warn("Refresh config failed", "error", err)
+		return h.imaging
+	}
+
+	// 缓存大小不变时保留已经缓存的原图
+	if h.imaging.sourceCache != nil && config.SourceCacheSize == h.imaging.config.SourceCacheSize {
+		imaging.sourceCache = h.imaging.sourceCache
+	}
+	// 继续累计上次汇总之后的字节数
+	if h.imaging.savings != nil && imaging.savings != nil {
+		imaging.savings = h.imaging.savings
+	}
+
+	logger.Info("Refresh config", "sizes", len(config.Sizes))
+	h.imaging = imaging
+
+	return imaging
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// replicaBucket 缩略图的副本所在的区域和bucket
+type replicaBucket struct {
+	Region string
+	Bucket string
+}
+
+// parseReplicas 解析缩略图副本, 如eu-west-1:photos-eu,us-east-1:photos-us
+func parseReplicas(value string) ([]replicaBucket, error) {
+	var replicas []replicaBucket
+	for _, item := range parseList(value) {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("replica %s is invalid, use region:bucket", item)
+		}
+		replicas = append(replicas, replicaBucket{Region: parts[0], Bucket: parts[1]})
+	}
+
+	return replicas, nil
+}
+
+// replicaRegions 当前配置和所有bucket的配置中使用的副本区域
+func replicaRegions(config *Config) []string {
+	var regions []string
+	found := make(map[string]bool)
+	config.anyBucket(func(c *Config) bool {
+		for _, replica := range c.Replicas {
+			if !found[replica.Region] {
+				found[replica.Region] = true
+				regions = append(regions, replica.Region)
+			}
+		}
+		return false
+	})
+
+	return regions
+}
+
+// putReplicas 并行写入缩略图的所有副本, 每个副本单独重试, 一个副本失败不影响其他副本
+// 任意副本失败时返回错误, 重试时重新写入所有副本
+func (s Imaging) putReplicas(ctx context.Context, content []byte, options PutOptions, result *SizeResult) error {
+	if len(s.config.Replicas) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(s.config.Replicas))
+	wg := new(sync.WaitGroup)
+	wg.Add(len(s.config.Replicas))
+	for index, replica := range s.config.Replicas {
+		go func(index int, replica replicaBucket) {
+			defer wg.Done()
+			store, found := s.replicas[replica.Region]
+			if !found {
+				errs[index] = fmt.Errorf("replica region %s has no client", replica.Region)
+				return
+			}
+
+			errs[index] = s.retryStorage(ctx, "put", false, func() error {
+				return store.Put(ctx, replica.Bucket, result.Key, bytes.NewReader(content), options)
+			})
+		}(index, replica)
+	}
+	wg.Wait()
+
+	var lastErr error
+	for index, replica := range s.config.Replicas {
+		if errs[index] != nil {
+			logger.ErrorContext(ctx, "Put replica thumbnail failed", "region", replica.Region, "replicaBucket", replica.Bucket, "thumbnail", result.Key, "error", errs[index])
+			lastErr = errs[index]
+			continue
+		}
+		logger.DebugContext(ctx, "Put replica thumbnail success", "region", replica.Region, "replicaBucket", replica.Bucket, "thumbnail", result.Key)
+	}
+
+	return lastErr
+}
+
+// removeReplicas 删除缩略图的所有副本, 返回最后一个错误
+func (s Imaging) removeReplicas(ctx context.Context, key string) error {
+	var lastErr error
+	for _, replica := range s.config.Replicas {
+		store, found := s.replicas[replica.Region]
+		if !found {
+			continue
+		}
+
+		if err := store.Delete(ctx, replica.Bucket, key); err != nil {
+			logger.ErrorContext(ctx, "Delete replica thumbnail failed", "region", replica.Region, "replicaBucket", replica.Bucket, "thumbnail", key, "error", err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// StatusSucceeded 处理成功
+	StatusSucceeded = "succeeded"
+	// StatusFailed 处理失败
+	StatusFailed = "failed"
+	// StatusSkipped 已存在, 不放大原图或者未通过审核而跳过
+	StatusSkipped = "skipped"
+	// StatusIgnored 目录, 缩略图或者不支持的文件
+	StatusIgnored = "ignored"
+)
+
+var (
+	// errSkipped 跳过了该尺寸
+	errSkipped = errors.New("skipped")
+	// errDeadline 调用即将超时, 没有开始处理
+	errDeadline = errors.New("not enough time left before the deadline")
+)
+
+// Report 一次调用的处理结果
+type Report struct {
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Skipped   int            `json:"skipped"`
+	Ignored   int            `json:"ignored"`
+	Records   []RecordResult `json:"records"`
+}
+
+// RecordResult 单条记录的处理结果
+type RecordResult struct {
+	Bucket     string       `json:"bucket"`
+	Key        string       `json:"key"`
+	Event      string       `json:"event"`
+	Status     string       `json:"status"`
+	DurationMs int64        `json:"durationMs"`
+	Error      string       `json:"error,omitempty"`
+	Code       string       `json:"code,omitempty"`
+	BytesIn    int64        `json:"bytesIn,omitempty"`
+	DecodeMs   int64        `json:"decodeMs,omitempty"`
+	Sizes      []SizeResult `json:"sizes,omitempty"`
+
+	err error
+	// etag 触发事件的原图ETag
+	etag string
+	// claimed 已在处理台账中登记, 处理完成后需要更新
+	claimed bool
+}
+
+// SizeResult 单个尺寸的处理结果
+type SizeResult struct {
+	Size       string `json:"size"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	MD5        string `json:"md5,omitempty"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"durationMs"`
+	ResizeMs   int64  `json:"resizeMs,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	err error
+}
+
+// Err 处理失败的错误
+func (r RecordResult) Err() error {
+	return r.err
+}
+
+// finish 记录处理结果和耗时
+func (r *RecordResult) finish(start time.Time, err error) {
+	r.DurationMs = durationMs(start)
+	r.err = err
+	switch {
+	case err != nil:
+		r.Status, r.Error, r.Code = StatusFailed, err.Error(), errorCode(err)
+	case r.Status == "":
+		r.Status = StatusSucceeded
+	}
+}
+
+// finish 记录处理结果和耗时
+func (r *SizeResult) finish(start time.Time, err error) {
+	r.DurationMs = durationMs(start)
+	switch {
+	case err == errSkipped:
+		r.Status = StatusSkipped
+	case err != nil:
+		r.Status, r.Error, r.err = StatusFailed, err.Error(), err
+	default:
+		r.Status = StatusSucceeded
+	}
+}
+
+// newReport 汇总记录的处理结果
+func newReport(results []RecordResult) Report {
+	report := Report{Records: results}
+	for _, result := range results {
+		switch result.Status {
+		case StatusFailed:
+			report.Failed++
+		case StatusSkipped:
+			report.Skipped++
+		case StatusIgnored:
+			report.Ignored++
+		default:
+			report.Succeeded++
+		}
+	}
+
+	return report
+}
+
+// log 输出处理结果, 便于按失败数量配置告警
+func (r Report) log(ctx context.Context) {
+	logger.InfoContext(ctx, "Report", "report", r)
+}
+
+// durationMs 从start开始经过的毫秒数
+func durationMs(start time.Time) int64 {
+	return int64(time.Now().Sub(start) / time.Millisecond)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	// storageBackoff 读写对象首次重试的等待时间, 之后每次翻倍
+	storageBackoff = 200 * time.Millisecond
+	// storageMaxBackoff 读写对象重试的最长等待时间
+	storageMaxBackoff = 5 * time.Second
+)
+
+// retryStorage 读写对象失败时按StorageRetry重试, 等待时间随机抖动以免同时重试
+// notFound为true时对象不存在也重试, 事件刚发出时对象可能还读不到
+func (s Imaging) retryStorage(ctx context.Context, operation string, notFound bool, do func() error) error {
+	backoff := storageBackoff
+	for attempt := 0; ; attempt++ {
+		err := do()
+		if err == nil || attempt >= s.config.StorageRetry || !retryableStorageError(err, notFound) {
+			return err
+		}
+
+		// 等待后可能来不及完成, 直接返回错误
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if remaining, near := s.deadlineNear(ctx); near || (remaining > 0 && remaining-wait < s.config.DeadlineMargin) {
+			return err
+		}
+
+		logger.WarnContext(ctx, "Retry storage", "operation", operation, "attempt", attempt+1, "backoffMs", int64(wait/time.Millisecond), "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > storageMaxBackoff {
+			backoff = storageMaxBackoff
+		}
+	}
+}
+
+// retryableStorageError 是否是限流, 服务端错误或者可以重试的对象不存在
+func retryableStorageError(err error, notFound bool) bool {
+	if isNotFound(err) {
+		return notFound
+	}
+
+	switch e := err.(type) {
+	case *StatusError:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	case awserr.RequestFailure:
+		return e.StatusCode() == http.StatusTooManyRequests || e.StatusCode() >= 500 || e.Code() == "SlowDown"
+	case awserr.Error:
+		return e.Code() == "SlowDown" || e.Code() == "RequestTimeout" || (e.Code() == "NoSuchKey" && notFound)
+	}
+
+	return false
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Store 基于S3的对象存储
+type S3Store struct {
+	config   *Config
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// NewS3Store 新建S3存储
+func NewS3Store(config *Config, client *s3.S3) *S3Store {
+	return &S3Store{
+		config: config,
+		client: client,
+		uploader: s3manager.NewUploaderWithClient(client, func(uploader *s3manager.Uploader) {
+			uploader.PartSize = config.PartSize
+		}, s3manager.WithUploaderRequestOptions(withChecksumSHA256)),
+	}
+}
+
+// Get 读取对象的最新版本, 超过阈值的大文件使用分段并行下载
+func (s *S3Store) Get(ctx context.Context, bucket, key string) (*Object, error) {
+	return s.GetVersion(ctx, bucket, key, "")
+}
+
+// GetVersion 读取对象的指定版本, versionID为空时读取最新版本
+func (s *S3Store) GetVersion(ctx context.Context, bucket, key, versionID string) (*Object, error) {
+	var version *string
+	if versionID != "" {
+		version = aws.String(versionID)
+	}
+	sseAlgorithm, sseKey := s.sseCustomer()
+
+	if s.config.DownloadThreshold <= 0 {
+		output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: version,
+
+			SSECustomerAlgorithm: sseAlgorithm,
+			SSECustomerKey:       sseKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		info := s3ObjectInfo(output.ETag, output.ContentLength, output.ContentType, output.ServerSideEncryption, output.SSECustomerAlgorithm, output.Metadata)
+		info.VersionID = aws.StringValue(output.VersionId)
+		return &Object{ObjectInfo: *info, Body: output.Body}, nil
+	}
+
+	// 先读取元数据, 分段下载时用ETag保证每个分段来自同一个对象
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(key),
+		VersionId: version,
+
+		SSECustomerAlgorithm: sseAlgorithm,
+		SSECustomerKey:       sseKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := s3ObjectInfo(head.ETag, head.ContentLength, head.ContentType, head.ServerSideEncryption, head.SSECustomerAlgorithm, head.Metadata)
+	info.VersionID = aws.StringValue(head.VersionId)
+
+	if info.Size < s.config.DownloadThreshold {
+		output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: version,
+			IfMatch:   head.ETag,
+
+			SSECustomerAlgorithm: sseAlgorithm,
+			SSECustomerKey:       sseKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &Object{ObjectInfo: *info, Body: output.Body}, nil
+	}
+
+	// 下载到池中的缓冲区, 关闭Body时归还
+	start := time.Now()
+	pooled := getBuffer()
+	pooled.Grow(int(info.Size))
+	buffer := aws.NewWriteAtBuffer(pooled.Bytes()[:0])
+	downloader := s3manager.NewDownloaderWithClient(s.client, func(downloader *s3manager.Downloader) {
+		downloader.PartSize = s.config.DownloadPartSize
+		downloader.Concurrency = s.config.DownloadConcurrency
+	})
+
+	n, err := downloader.DownloadWithContext(ctx, buffer, &s3.GetObjectInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(key),
+		VersionId: version,
+		IfMatch:   head.ETag,
+
+		SSECustomerAlgorithm: sseAlgorithm,
+		SSECustomerKey:       sseKey,
+	})
+	if err != nil {
+		putBuffer(pooled)
+		return nil, err
+	}
+	logger.DebugContext(ctx, "Download in parallel", "bytes", n, "durationMs", durationMs(start))
+
+	return &Object{ObjectInfo: *info, Body: newPooledReader(pooled, buffer.Bytes())}, nil
+}
+
+// Head 读取对象的元数据
+func (s *S3Store) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	sseAlgorithm, sseKey := s.sseCustomer()
+	output, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+
+		SSECustomerAlgorithm: sseAlgorithm,
+		SSECustomerKey:       sseKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := s3ObjectInfo(output.ETag, output.ContentLength, output.ContentType, output.ServerSideEncryption, output.SSECustomerAlgorithm, output.Metadata)
+	info.VersionID = aws.StringValue(output.VersionId)
+
+	return info, nil
+}
+
+// Put 边读边上传, 超过分段大小时自动使用分段上传
+func (s *S3Store) Put(ctx context.Context, bucket, key string, body io.Reader, options PutOptions) error {
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: aws.StringMap(options.Metadata),
+	}
+
+	if options.ContentType != "" {
+		input.ContentType = aws.String(options.ContentType)
+	}
+	if options.StorageClass != "" {
+		input.StorageClass = aws.String(options.StorageClass)
+	}
+
+	if len(options.Tags) > 0 {
+		tags := url.Values{}
+		for key, value := range options.Tags {
+			tags.Set(key, value)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	if s.config.ObjectACL != "" {
+		input.ACL = aws.String(s.config.ObjectACL)
+	}
+
+	// 供CDN缓存使用
+	if options.CacheControl != "" {
+		input.CacheControl = aws.String(options.CacheControl)
+	}
+	if !options.Expires.IsZero() {
+		input.Expires = aws.Time(options.Expires)
+	}
+
+	// 服务端加密
+	if s.config.SSEAlgorithm != "" {
+		input.ServerSideEncryption = aws.String(s.config.SSEAlgorithm)
+		if s.config.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.config.KMSKeyID)
+		}
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomer()
+
+	// S3会校验内容的校验和, 上传内容损坏时直接失败
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+// Delete 删除对象
+func (s *S3Store) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
+
+// Tags 读取对象的标签
+func (s *S3Store) Tags(ctx context.Context, bucket, key string) (map[string]string, error) {
+	output, err := s.client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return tags, nil
+}
+
+// PutTags 替换对象的所有标签
+func (s *S3Store) PutTags(ctx context.Context, bucket, key string, tags map[string]string) error {
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for name, value := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(name), Value: aws.String(value)})
+	}
+
+	_, err := s.client.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+
+	return err
+}
+
+// ReplaceMetadata 原地复制对象以替换用户元数据, 内容类型, 缓存, 存储类别和加密方式保持不变
+// 只复制etag对应的对象, 复制前对象已经被覆盖时返回412, 复制不保留ACL, 超过5GB的对象无法复制
+func (s *S3Store) ReplaceMetadata(ctx context.Context, bucket, key, etag string, metadata map[string]string) error {
+	sseAlgorithm, sseKey := s.sseCustomer()
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		IfMatch: aws.String(etag),
+
+		SSECustomerAlgorithm: sseAlgorithm,
+		SSECustomerKey:       sseKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(s3CopySource(bucket, key)),
+		CopySourceIfMatch: aws.String(etag),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata:          aws.StringMap(metadata),
+
+		CacheControl:            head.CacheControl,
+		ContentDisposition:      head.ContentDisposition,
+		ContentEncoding:         head.ContentEncoding,
+		ContentLanguage:         head.ContentLanguage,
+		ContentType:             head.ContentType,
+		StorageClass:            head.StorageClass,
+		WebsiteRedirectLocation: head.WebsiteRedirectLocation,
+
+		CopySourceSSECustomerAlgorithm: sseAlgorithm,
+		CopySourceSSECustomerKey:       sseKey,
+		SSECustomerAlgorithm:           sseAlgorithm,
+		SSECustomerKey:                 sseKey,
+	}
+	if expires, err := http.ParseTime(aws.StringValue(head.Expires)); err == nil {
+		input.Expires = aws.Time(expires)
+	}
+
+	// 不指定加密方式时使用bucket的默认加密, 原来使用KMS加密的对象需要再次指定
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		input.ServerSideEncryption, input.SSEKMSKeyId = head.ServerSideEncryption, head.SSEKMSKeyId
+	}
+
+	_, err = s.client.CopyObjectWithContext(ctx, input)
+	return err
+}
+
+// Copy 用CopyObject复制对象, 元数据, 内容类型, 缓存和标签随对象复制, ACL和加密方式与Put一致
+// etag不为空时只复制etag对应的对象, 复制前对象已经被覆盖时返回412, 超过5GB的对象无法复制
+func (s *S3Store) Copy(ctx context.Context, bucket, key, etag, destinationBucket, destinationKey, storageClass string) error {
+	sseAlgorithm, sseKey := s.sseCustomer()
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(destinationBucket),
+		Key:               aws.String(destinationKey),
+		CopySource:        aws.String(s3CopySource(bucket, key)),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		TaggingDirective:  aws.String(s3.TaggingDirectiveCopy),
+
+		CopySourceSSECustomerAlgorithm: sseAlgorithm,
+		CopySourceSSECustomerKey:       sseKey,
+		SSECustomerAlgorithm:           sseAlgorithm,
+		SSECustomerKey:                 sseKey,
+	}
+	if etag != "" {
+		input.CopySourceIfMatch = aws.String(etag)
+	}
+	if storageClass != "" {
+		input.StorageClass = aws.String(storageClass)
+	}
+	if s.config.ObjectACL != "" {
+		input.ACL = aws.String(s.config.ObjectACL)
+	}
+	if s.config.SSEAlgorithm != "" {
+		input.ServerSideEncryption = aws.String(s.config.SSEAlgorithm)
+		if s.config.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.config.KMSKeyID)
+		}
+	}
+
+	_, err := s.client.CopyObjectWithContext(ctx, input)
+	return err
+}
+
+// PresignGet 生成GetObject的预签名地址, 有效期不能超过7天
+func (s *S3Store) PresignGet(bucket, key string, expires time.Duration) (string, error) {
+	request, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	return request.Presign(expires)
+}
+
+// List 用ListObjectsV2按key的顺序列出前缀下的对象
+func (s *S3Store) List(ctx context.Context, bucket, prefix, startAfter string, limit int) ([]string, bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+
+	output, err := s.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys := make([]string, 0, len(output.Contents))
+	for _, object := range output.Contents {
+		keys = append(keys, aws.StringValue(object.Key))
+	}
+
+	return keys, aws.BoolValue(output.IsTruncated), nil
+}
+
+// BucketTags 读取bucket的标签, 没有标签时S3返回NoSuchTagSet
+func (s *S3Store) BucketTags(ctx context.Context, bucket string) (map[string]string, error) {
+	output, err := s.client.GetBucketTaggingWithContext(ctx, &s3.GetBucketTaggingInput{Bucket: aws.String(bucket)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchTagSet" {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return tags, nil
+}
+
+// s3CopySource CopyObject的复制源, key中的每一段都需要URL编码, S3会把未编码的+当作空格
+func s3CopySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for index, segment := range segments {
+		segments[index] = strings.Replace(url.PathEscape(segment), "+", "%2B", -1)
+	}
+
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// sseCustomer SSE-C的算法和密钥, 读写对象时都需要提供, 未配置SSECustomerKey时都为nil
+func (s *S3Store) sseCustomer() (*string, *string) {
+	if s.config.SSECustomerKey == "" {
+		return nil, nil
+	}
+
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(s.config.SSECustomerKey)
+}
+
+// s3ObjectInfo 转换S3返回的元数据, KMS和SSE-C加密对象的ETag不是md5
+func s3ObjectInfo(etag *string, contentLength *int64, contentType, sse, sseCustomerAlgorithm *string, metadata map[string]*string) *ObjectInfo {
+	info := &ObjectInfo{
+		ETag:        aws.StringValue(etag),
+		Size:        aws.Int64Value(contentLength),
+		ContentType: aws.StringValue(contentType),
+		Metadata:    aws.StringValueMap(metadata),
+	}
+
+	if aws.StringValue(sse) != s3.ServerSideEncryptionAwsKms && aws.StringValue(sseCustomerAlgorithm) == "" {
+		if md5 := strings.Trim(info.ETag, "\""); isMD5ETag(md5) {
+			info.MD5 = md5
+		}
+	}
+
+	return info
+}
+
+// WriteGetObjectResponse 调用WriteGetObjectResponse, 使用S3客户端的区域和凭证签名
+func (s *S3Store) WriteGetObjectResponse(ctx context.Context, route, token string, header http.Header, content []byte) error {
+	region := aws.StringValue(s.client.Config.Region)
+	location := fmt.Sprintf("https://%s.s3-object-lambda.%s.amazonaws.com/WriteGetObjectResponse", route, region)
+
+	request, err := http.NewRequest(http.MethodPost, location, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("X-Amz-Request-Route", route)
+	request.Header.Set("X-Amz-Request-Token", token)
+
+	signer := v4.NewSigner(s.client.Config.Credentials)
+	if _, err = signer.Sign(request, bytes.NewReader(content), "s3-object-lambda", region, time.Now()); err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return &StatusError{Service: "s3-object-lambda", StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// defaultSavingsInterval 配置了SavingsTable但没有配置SavingsInterval时汇总的间隔
+	defaultSavingsInterval = 5 * time.Minute
+)
+
+// savingsTotals 原图和缩略图的字节数
+// BytesSaved 是每个缩略图相对原图减少的字节数之和, 即每个缩略图代替原图传输一次节省的流量
+type savingsTotals struct {
+	Images     int64
+	Thumbnails int64
+	BytesIn    int64
+	BytesOut   int64
+	BytesSaved int64
+}
+
+// add 累加另一组字节数
+func (t *savingsTotals) add(other savingsTotals) {
+	t.Images += other.Images
+	t.Thumbnails += other.Thumbnails
+	t.BytesIn += other.BytesIn
+	t.BytesOut += other.BytesOut
+	t.BytesSaved += other.BytesSaved
+}
+
+// savedPercent 缩略图的字节数相对原图减少的百分比
+func (t savingsTotals) savedPercent() float64 {
+	if t.BytesIn <= 0 || t.Thumbnails <= 0 {
+		return 0
+	}
+
+	return float64(t.BytesSaved) * 100 / float64(t.BytesIn*t.Thumbnails)
+}
+
+// recordSavings 按bucket统计成功处理的原图和生成的缩略图, 跳过和失败的尺寸不计入
+func recordSavings(results []RecordResult) map[string]*savingsTotals {
+	buckets := make(map[string]*savingsTotals)
+	for _, result := range results {
+		if result.Status != StatusSucceeded || result.BytesIn <= 0 {
+			continue
+		}
+
+		var record savingsTotals
+		for _, size := range result.Sizes {
+			if size.Status != StatusSucceeded || size.Bytes <= 0 {
+				continue
+			}
+			record.Thumbnails++
+			record.BytesOut += size.Bytes
+			record.BytesSaved += result.BytesIn - size.Bytes
+		}
+		if record.Thumbnails == 0 {
+			continue
+		}
+		record.Images, record.BytesIn = 1, result.BytesIn
+
+		totals, found := buckets[result.Bucket]
+		if !found {
+			totals = new(savingsTotals)
+			buckets[result.Bucket] = totals
+		}
+		totals.add(record)
+	}
+
+	return buckets
+}
+
+// savingsReporter 热启动的调用之间按bucket累计字节数, 每隔SavingsInterval输出一次汇总并写入SavingsTable
+// 容器回收时尚未汇总的字节数会丢失
+type savingsReporter struct {
+	mutex   sync.Mutex
+	buckets map[string]*savingsTotals
+	since   time.Time
+}
+
+// newSavingsReporter 新建字节数汇总
+func newSavingsReporter() *savingsReporter {
+	return &savingsReporter{buckets: make(map[string]*savingsTotals), since: time.Now()}
+}
+
+// add 按bucket累计字节数
+func (r *savingsReporter) add(buckets map[string]*savingsTotals) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for bucket, totals := range buckets {
+		pending, found := r.buckets[bucket]
+		if !found {
+			pending = new(savingsTotals)
+			r.buckets[bucket] = pending
+		}
+		pending.add(*totals)
+	}
+}
+
+// take 距离上次汇总超过interval时取出累计的字节数并重新计数, 未到间隔时返回nil
+func (r *savingsReporter) take(interval time.Duration) (map[string]*savingsTotals, time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.since) < interval {
+		return nil, time.Time{}
+	}
+	buckets, since := r.buckets, r.since
+	r.buckets, r.since = make(map[string]*savingsTotals), time.Now()
+
+	return buckets, since
+}
+
+// recordSavings 累计本次调用节省的字节数, 距离上次汇总超过SavingsInterval时输出汇总并写入按月汇总的表
+// 汇总在间隔之后的下一次调用中进行, 每个bucket只写入一次
+func (s Imaging) recordSavings(ctx context.Context, results []RecordResult) {
+	if s.savings == nil {
+		return
+	}
+
+	s.savings.add(recordSavings(results))
+	buckets, since := s.savings.take(s.config.SavingsInterval)
+	if len(buckets) == 0 {
+		return
+	}
+
+	s.reportSavings(ctx, buckets, since)
+	if s.dynamodb != nil && s.config.SavingsTable != "" {
+		// 写入失败的bucket累计到下一次汇总
+		s.savings.add(s.rollupSavings(ctx, buckets))
+	}
+}
+
+// reportSavings 输出上次汇总之后所有bucket的字节数的日志和指标
+func (s Imaging) reportSavings(ctx context.Context, buckets map[string]*savingsTotals, since time.Time) {
+	var totals savingsTotals
+	for _, bucket := range buckets {
+		totals.add(*bucket)
+	}
+
+	logger.InfoContext(ctx, "Savings summary",
+		"buckets", len(buckets),
+		"images", totals.Images,
+		"thumbnails", totals.Thumbnails,
+		"bytesIn", totals.BytesIn,
+		"bytesOut", totals.BytesOut,
+		"bytesSaved", totals.BytesSaved,
+		"savedPercent", strconv.FormatFloat(totals.savedPercent(), 'f', 1, 64),
+		"sinceMs", durationMs(since),
+	)
+	if s.config.Metrics {
+		writeMetrics(s.config.MetricsNamespace, map[string]string{"Summary": "Savings"}, map[string]interface{}{
+			"BytesIn":      totals.BytesIn,
+			"BytesOut":     totals.BytesOut,
+			"BytesSaved":   totals.BytesSaved,
+			"SavedPercent": totals.savedPercent(),
+		})
+	}
+}
+
+// rollupSavings 按月和bucket累加到SavingsTable, id形如2024-01/photos, 返回写入失败的bucket
+func (s Imaging) rollupSavings(ctx context.Context, buckets map[string]*savingsTotals) map[string]*savingsTotals {
+	month := time.Now().UTC().Format("2006-01")
+	names := make([]string, 0, len(buckets))
+	for bucket := range buckets {
+		names = append(names, bucket)
+	}
+	sort.Strings(names)
+
+	failed := make(map[string]*savingsTotals)
+	for _, bucket := range names {
+		totals := buckets[bucket]
+		_, err := s.dynamodb.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(s.config.SavingsTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": {S: aws.String(month + "/" + bucket)},
+			},
+			UpdateExpression: aws.String("SET #month = :month, #bucket = :bucket, updatedAt = :now " +
+				"ADD images :images, thumbnails :thumbnails, bytesIn :bytesIn, bytesOut :bytesOut, bytesSaved :bytesSaved"),
+			ExpressionAttributeNames: map[string]*string{
+				"#month":  aws.String("month"),
+				"#bucket": aws.String("bucket"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":month":      {S: aws.String(month)},
+				":bucket":     {S: aws.String(bucket)},
+				":now":        {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+				":images":     {N: aws.String(strconv.FormatInt(totals.Images, 10))},
+				":thumbnails": {N: aws.String(strconv.FormatInt(totals.Thumbnails, 10))},
+				":bytesIn":    {N: aws.String(strconv.FormatInt(totals.BytesIn, 10))},
+				":bytesOut":   {N: aws.String(strconv.FormatInt(totals.BytesOut, 10))},
+				":bytesSaved": {N: aws.String(strconv.FormatInt(totals.BytesSaved, 10))},
+			},
+		})
+		if err != nil {
+			logger.WarnContext(ctx, "Rollup savings failed", "table", s.config.SavingsTable, "month", month, "bucket", bucket, "error", err)
+			failed[bucket] = totals
+		}
+	}
+
+	return failed
+}
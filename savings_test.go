@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// savingsTable 记录UpdateItem请求的DynamoDB, failing为true时返回500
+type savingsTable struct {
+	mutex   sync.Mutex
+	failing bool
+	updates map[string]map[string]string
+}
+
+// ServeHTTP 实现http.Handler
+func (t *savingsTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Key                       map[string]map[string]string
+		ExpressionAttributeValues map[string]map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.failing {
+		http.Error(w, `{"__type":"InternalServerError"}`, http.StatusInternalServerError)
+		return
+	}
+
+	values := make(map[string]string)
+	for name, value := range input.ExpressionAttributeValues {
+		values[name] = value["N"]
+	}
+	t.updates[input.Key["id"]["S"]] = values
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Write([]byte("{}"))
+}
+
+// take 取出记录的请求
+func (t *savingsTable) take() map[string]map[string]string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	updates := t.updates
+	t.updates = make(map[string]map[string]string)
+
+	return updates
+}
+
+// fail 设置是否返回500
+func (t *savingsTable) fail(failing bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.failing = failing
+}
+
+// savingsResult 一张原图生成了多个尺寸的结果
+func savingsResult(bucket string, bytesIn int64, sizes ...int64) RecordResult {
+	result := RecordResult{Bucket: bucket, Status: StatusSucceeded, BytesIn: bytesIn}
+	for _, size := range sizes {
+		result.Sizes = append(result.Sizes, SizeResult{Status: StatusSucceeded, Bytes: size})
+	}
+
+	return result
+}
+
+func TestRecordSavingsTotals(t *testing.T) {
+	failed := savingsResult("photos", 1000, 100)
+	failed.Status = StatusFailed
+	partial := savingsResult("photos", 2000, 300)
+	partial.Sizes = append(partial.Sizes, SizeResult{Status: StatusSkipped, Bytes: 900}, SizeResult{Status: StatusFailed})
+
+	buckets := recordSavings([]RecordResult{
+		savingsResult("photos", 1000, 100, 200),
+		partial,
+		failed,
+		savingsResult("avatars", 500, 50),
+		// 没有生成缩略图的原图不计入
+		savingsResult("avatars", 800),
+	})
+
+	expected := map[string]savingsTotals{
+		"photos":  {Images: 2, Thumbnails: 3, BytesIn: 3000, BytesOut: 600, BytesSaved: 900 + 800 + 1700},
+		"avatars": {Images: 1, Thumbnails: 1, BytesIn: 500, BytesOut: 50, BytesSaved: 450},
+	}
+	if len(buckets) != len(expected) {
+		t.Fatalf("recorded %d buckets, want %d", len(buckets), len(expected))
+	}
+	for bucket, totals := range expected {
+		if *buckets[bucket] != totals {
+			t.Errorf("bucket %s totals are %+v, want %+v", bucket, *buckets[bucket], totals)
+		}
+	}
+}
+
+func TestSavingsRollupOnInterval(t *testing.T) {
+	table := &savingsTable{updates: make(map[string]map[string]string)}
+	server := httptest.NewServer(table)
+	defer server.Close()
+
+	s := newTestImaging(t, map[string]string{
+		"Sizes":           "100x100",
+		"SavingsTable":    "savings",
+		"SavingsInterval": "1h",
+	})
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(server.URL).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dynamodb = dynamodb.New(sess)
+	ctx := context.Background()
+	month := time.Now().UTC().Format("2006-01")
+
+	// 间隔之内只累计, 不写入
+	s.recordSavings(ctx, []RecordResult{savingsResult("photos", 1000, 100)})
+	s.recordSavings(ctx, []RecordResult{savingsResult("photos", 1000, 200), savingsResult("avatars", 500, 50)})
+	if updates := table.take(); len(updates) != 0 {
+		t.Fatalf("rolled up %v before the interval", updates)
+	}
+
+	// 间隔之后的下一次调用按bucket各写入一次
+	s.savings.since = time.Now().Add(-2 * time.Hour)
+	s.recordSavings(ctx, []RecordResult{savingsResult("photos", 1000, 300)})
+	updates := table.take()
+	if len(updates) != 2 {
+		t.Fatalf("rolled up %v, want photos and avatars", updates)
+	}
+	photos := updates[month+"/photos"]
+	if photos[":images"] != "3" || photos[":thumbnails"] != "3" || photos[":bytesIn"] != "3000" || photos[":bytesOut"] != "600" || photos[":bytesSaved"] != "2400" {
+		t.Errorf("photos rolled up %v", photos)
+	}
+	if avatars := updates[month+"/avatars"]; avatars[":images"] != "1" || avatars[":bytesSaved"] != "450" {
+		t.Errorf("avatars rolled up %v", avatars)
+	}
+
+	// 写入失败的字节数累计到下一次汇总
+	table.fail(true)
+	s.savings.since = time.Now().Add(-2 * time.Hour)
+	s.recordSavings(ctx, []RecordResult{savingsResult("photos", 1000, 100)})
+	table.fail(false)
+	s.recordSavings(ctx, []RecordResult{savingsResult("photos", 1000, 100)})
+	if updates := table.take(); len(updates) != 0 {
+		t.Fatalf("rolled up %v before the interval", updates)
+	}
+
+	s.savings.since = time.Now().Add(-2 * time.Hour)
+	s.recordSavings(ctx, nil)
+	updates = table.take()
+	if photos := updates[month+"/photos"]; len(updates) != 1 || photos[":images"] != "2" || photos[":bytesSaved"] != "1800" {
+		t.Errorf("retry rolled up %v, want 2 photos images", updates)
+	}
+}
+
+func TestSavingsIntervalDefault(t *testing.T) {
+	t.Run("with table", func(t *testing.T) {
+		s := newTestImaging(t, map[string]string{"Sizes": "100x100", "SavingsTable": "savings"})
+		if s.config.SavingsInterval != defaultSavingsInterval || s.savings == nil {
+			t.Errorf("savings interval is %v, want %v", s.config.SavingsInterval, defaultSavingsInterval)
+		}
+	})
+
+	t.Run("without table", func(t *testing.T) {
+		s := newTestImaging(t, map[string]string{"Sizes": "100x100"})
+		if s.config.SavingsInterval != 0 || s.savings != nil {
+			t.Errorf("savings interval is %v without SavingsTable", s.config.SavingsInterval)
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// serveShutdownTimeout 收到停止信号后等待处理中的请求完成的时间
+	serveShutdownTimeout = 30 * time.Second
+)
+
+// serveRequest 按key处理已上传原图的请求
+type serveRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// runServe 服务模式, 在ECS或Kubernetes中通过HTTP或gRPC调用与Lambda相同的处理流程
+// 配置与Lambda相同, 从环境变量和配置文件中读取
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("resize serve", flag.ContinueOnError)
+	port := flags.String("port", "", "port to listen on, defaults to the PORT environment variable or 8080")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if *port != "" {
+		config.Port = *port
+	}
+
+	imaging, err := newImaging(context.Background(), config)
+	if err != nil {
+		return err
+	}
+	imaging.prometheus = newPromMetrics()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resize", imaging.ServeResize)
+	mux.HandleFunc("/upload", imaging.ServeUpload)
+	mux.HandleFunc(grpcServicePath, imaging.GRPC)
+	mux.HandleFunc("/version", imaging.ServeVersion)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	server := &http.Server{Addr: ":" + config.Port, Handler: serveMux(imaging.prometheus, mux.ServeHTTP)}
+	// gRPC客户端使用明文HTTP/2(h2c)连接, 同一端口仍然支持HTTP/1.1
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	// ECS和Kubernetes停止任务时发送SIGTERM, 处理完进行中的请求再退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Shutdown failed", "error", err)
+		}
+	}()
+
+	logger.Info("Listen", "port", config.Port)
+	if err = server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// ServeResize 为已上传的原图生成缩略图, 请求体为{"bucket": "photos", "key": "a/b.jpg"}
+// 未指定bucket时使用SourceBucket, 只能读写SourceBucket或者有单独配置的bucket
+func (s Imaging) ServeResize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request serveRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Bucket == "" {
+		request.Bucket = s.config.SourceBucket
+	}
+	if request.Bucket == "" || request.Key == "" {
+		http.Error(w, "bucket and key are required", http.StatusBadRequest)
+		return
+	}
+	if !validObjectKey(request.Key) {
+		http.Error(w, "key is invalid", http.StatusBadRequest)
+		return
+	}
+	if !s.bucketAllowed(request.Bucket) {
+		http.Error(w, "bucket is not allowed", http.StatusForbidden)
+		return
+	}
+
+	s.serveRecord(w, r, serveEventRecord(request.Bucket, request.Key, 0))
+}
+
+// ServeUpload 保存请求体中的原图并生成缩略图, bucket和key在查询参数中, 未指定bucket时使用SourceBucket
+// 只能写入SourceBucket或者有单独配置的bucket
+func (s Imaging) ServeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bucket, key := r.URL.Query().Get("bucket"), r.URL.Query().Get("key")
+	if bucket == "" {
+		bucket = s.config.SourceBucket
+	}
+	if bucket == "" || key == "" {
+		http.Error(w, "bucket and key are required", http.StatusBadRequest)
+		return
+	}
+	if !validObjectKey(key) {
+		http.Error(w, "key is invalid", http.StatusBadRequest)
+		return
+	}
+	if !s.bucketAllowed(bucket) {
+		http.Error(w, "bucket is not allowed", http.StatusForbidden)
+		return
+	}
+
+	// 超过大小限制的原图不需要读完
+	body := r.Body
+	if s.config.MaxObjectSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.config.MaxObjectSize)
+	}
+	content, err := ioutil.ReadAll(body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		// 连接中断或者请求体不完整
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := withLogAttrs(r.Context(), "bucket", bucket, "key", key)
+	options := PutOptions{ContentType: r.Header.Get("Content-Type")}
+	err = s.retryStorage(ctx, "put", false, func() error {
+		return s.store.Put(ctx, bucket, key, bytes.NewReader(content), options)
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Put upload failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	logger.InfoContext(ctx, "Save upload success", "bytes", len(content))
+
+	s.serveRecord(w, r, serveEventRecord(bucket, key, int64(len(content))))
+}
+
+// bucketAllowed 服务模式是否可以读写bucket, 只允许SourceBucket和Buckets中有单独配置的bucket
+func (s Imaging) bucketAllowed(bucket string) bool {
+	if bucket == s.config.SourceBucket {
+		return true
+	}
+	_, found := s.config.Buckets[bucket]
+
+	return found
+}
+
+// validObjectKey 请求中的key是否有效, 绝对路径和包含..的key在本地存储中会写到bucket目录之外
+func validObjectKey(key string) bool {
+	if path.IsAbs(key) {
+		return false
+	}
+	for _, segment := range strings.Split(path.Clean(key), "/") {
+		if segment == ".." || segment == "." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serveRecord 处理一条记录并返回处理结果, 处理失败时返回500
+func (s Imaging) serveRecord(w http.ResponseWriter, r *http.Request, record events.S3EventRecord) {
+	report, _ := s.S3Event(r.Context(), events.S3Event{Records: []events.S3EventRecord{record}})
+
+	statusCode := http.StatusOK
+	if report.Failed > 0 {
+		statusCode = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(report)
+}
+
+// serveEventRecord 服务模式请求对应的事件记录, 与S3事件一致, key经过URL编码
+func serveEventRecord(bucket, key string, size int64) events.S3EventRecord {
+	record := events.S3EventRecord{EventSource: "serve", EventName: "ObjectCreated:Put", EventTime: time.Now()}
+	record.S3.Bucket.Name = bucket
+	record.S3.Object.Key = url.QueryEscape(key)
+	record.S3.Object.Size = size
+
+	return record
+}
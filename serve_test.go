@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// uploadRequest 上传原图的请求, bucket为空时不指定
+func uploadRequest(bucket, key string, body io.Reader) *http.Request {
+	query := url.Values{"key": {key}}
+	if bucket != "" {
+		query.Set("bucket", bucket)
+	}
+
+	return httptest.NewRequest(http.MethodPut, "/upload?"+query.Encode(), body)
+}
+
+func TestServeUpload(t *testing.T) {
+	source, configured := t.TempDir(), t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "50x50", "MaxObjectSize": "100000"})
+	s.config.SourceBucket = source
+	s.config.Buckets = map[string]*Config{configured: s.config}
+	original := testJPEG(t, 120, 90)
+
+	cases := []struct {
+		name, bucket, key string
+		body              io.Reader
+		status            int
+	}{
+		{"source bucket", "", "up/a.jpg", bytes.NewReader(original), http.StatusOK},
+		{"configured bucket", configured, "up/a.jpg", bytes.NewReader(original), http.StatusOK},
+		{"other bucket", t.TempDir(), "up/a.jpg", bytes.NewReader(original), http.StatusForbidden},
+		{"parent key", "", "../up/a.jpg", bytes.NewReader(original), http.StatusBadRequest},
+		{"absolute key", "", "/up/a.jpg", bytes.NewReader(original), http.StatusBadRequest},
+		{"too large", "", "up/a.jpg", bytes.NewReader(make([]byte, 100001)), http.StatusRequestEntityTooLarge},
+		{"truncated body", "", "up/a.jpg", iotest.TimeoutReader(bytes.NewReader(original[:10])), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeUpload(w, uploadRequest(c.bucket, c.key, c.body))
+			if w.Code != c.status {
+				t.Fatalf("status is %d, want %d: %s", w.Code, c.status, w.Body.String())
+			}
+			if c.status != http.StatusOK {
+				return
+			}
+
+			bucket := c.bucket
+			if bucket == "" {
+				bucket = source
+			}
+			if content := readTestFile(t, bucket, "up/a.jpg"); !bytes.Equal(content, original) {
+				t.Errorf("saved %d bytes, want %d", len(content), len(original))
+			}
+			readTestFile(t, bucket, "up/a_50x50.jpg")
+		})
+	}
+}
+
+func TestServeResize(t *testing.T) {
+	source, configured, other := t.TempDir(), t.TempDir(), t.TempDir()
+	s := newTestImaging(t, map[string]string{"Sizes": "50x50"})
+	s.config.SourceBucket = source
+	s.config.Buckets = map[string]*Config{configured: s.config}
+	for _, bucket := range []string{source, configured, other} {
+		writeTestFile(t, bucket, "a.jpg", testJPEG(t, 120, 90))
+	}
+
+	cases := []struct {
+		name, body string
+		bucket     string
+		status     int
+	}{
+		{"source bucket", `{"key": "a.jpg"}`, source, http.StatusOK},
+		{"configured bucket", `{"bucket": "` + configured + `", "key": "a.jpg"}`, configured, http.StatusOK},
+		{"other bucket", `{"bucket": "` + other + `", "key": "a.jpg"}`, other, http.StatusForbidden},
+		// 缩略图会写到bucket目录之外
+		{"parent key", `{"key": "x/../../a.jpg"}`, filepath.Dir(source), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeResize(w, httptest.NewRequest(http.MethodPost, "/resize", strings.NewReader(c.body)))
+			if w.Code != c.status {
+				t.Fatalf("status is %d, want %d: %s", w.Code, c.status, w.Body.String())
+			}
+
+			_, err := os.Stat(filepath.Join(c.bucket, "a_50x50.jpg"))
+			if created := err == nil; created != (c.status == http.StatusOK) {
+				t.Errorf("thumbnail created is %v with status %d", created, w.Code)
+			}
+		})
+	}
+}
+
+func TestValidObjectKey(t *testing.T) {
+	for key, valid := range map[string]bool{
+		"a.jpg":         true,
+		"photos/a.jpg":  true,
+		"a/../b.jpg":    true,
+		"..a.jpg":       true,
+		"../a.jpg":      false,
+		"a/../../b.jpg": false,
+		"/etc/a.jpg":    false,
+		".":             false,
+		"photos/..":     false,
+	} {
+		if validObjectKey(key) != valid {
+			t.Errorf("key %s valid is %v, want %v", key, !valid, valid)
+		}
+	}
+}
+
+func TestServeUploadRequiresBucket(t *testing.T) {
+	s := newTestImaging(t, map[string]string{"Sizes": "50x50"})
+	w := httptest.NewRecorder()
+	s.ServeUpload(w, uploadRequest("", "a.jpg", bytes.NewReader(testJPEG(t, 60, 40))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status is %d without SourceBucket, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image/color"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// sidecarSuffix 原图信息文件在原图key后追加的后缀, 如photo.jpg.metadata.json
+	sidecarSuffix = ".metadata.json"
+
+	exifTagExifIFD             = 0x8769
+	exifTagGPSIFD              = 0x8825
+	exifTagDateTimeOriginal    = 0x9003
+	exifTagOffsetTimeOriginal  = 0x9011
+	exifTagColorSpace          = 0xa001
+	exifTypeASCII              = 2
+	exifColorSpaceSRGB         = 1
+	exifColorSpaceUncalibrated = 0xffff
+	// exifDateLayout EXIF中日期时间的格式, 不含时区
+	exifDateLayout = "2006:01:02 15:04:05"
+)
+
+// imageSidecar 原图的信息, 下游建立索引时不需要重新下载和解析原图
+type imageSidecar struct {
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Format     string `json:"format"`
+	Bytes      int64  `json:"bytes"`
+	CapturedAt string `json:"capturedAt,omitempty"`
+	GPS        bool   `json:"gps"`
+	ColorSpace string `json:"colorSpace,omitempty"`
+}
+
+// exifInfo 从EXIF中读取的拍摄信息
+type exifInfo struct {
+	// CapturedAt 拍摄时间, 有时区时带时区, 如2006-01-02T15:04:05+08:00
+	CapturedAt string
+	// GPS 是否包含GPS位置
+	GPS bool
+	// ColorSpace 色彩空间, EXIF中没有时按解码的颜色模型判断
+	ColorSpace string
+}
+
+// sidecarLocation 原图信息保存的bucket和key, 与缩略图保存在一起
+func (s Imaging) sidecarLocation(bucket, key string) (string, string) {
+	return s.destinationBucket(bucket), s.config.DestinationPrefix + key + sidecarSuffix
+}
+
+// writeSidecar 写入原图的信息
+func (s Imaging) writeSidecar(ctx context.Context, original *Original, result *RecordResult) error {
+	bucket, key := s.sidecarLocation(result.Bucket, result.Key)
+
+	sidecar := imageSidecar{
+		Bucket:     result.Bucket,
+		Key:        result.Key,
+		Width:      original.Bounds.X,
+		Height:     original.Bounds.Y,
+		Format:     sourceFormat(original.Key),
+		Bytes:      original.Bytes,
+		CapturedAt: original.exif.CapturedAt,
+		GPS:        original.exif.GPS,
+		ColorSpace: original.exif.ColorSpace,
+	}
+	if sidecar.ColorSpace == "" && original.Image != nil {
+		sidecar.ColorSpace = colorSpace(original.Image.ColorModel())
+	}
+
+	content, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+
+	options := PutOptions{
+		ContentType:  "application/json",
+		CacheControl: s.config.CacheControl,
+		Metadata:     original.ThumbnailMetadata,
+	}
+	err = s.retryStorage(ctx, "put", false, func() error {
+		return s.destination.Put(ctx, bucket, key, bytes.NewReader(content), options)
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Put sidecar failed", "sidecarBucket", bucket, "sidecar", key, "error", err)
+		return err
+	}
+
+	logger.InfoContext(ctx, "Save sidecar success", "sidecar", key)
+	return nil
+}
+
+// removeSidecar 原图删除时删除原图信息
+func (s Imaging) removeSidecar(ctx context.Context, result *RecordResult) error {
+	bucket, key := s.sidecarLocation(result.Bucket, result.Key)
+	if err := s.destination.Delete(ctx, bucket, key); err != nil {
+		logger.ErrorContext(ctx, "Delete sidecar failed", "sidecarBucket", bucket, "sidecar", key, "error", err)
+		return err
+	}
+
+	logger.InfoContext(ctx, "Delete sidecar success", "sidecar", key)
+	return nil
+}
+
+// sourceFormat 原图的格式, 按扩展名判断
+func sourceFormat(key string) string {
+	switch format := strings.TrimPrefix(strings.ToLower(filepath.Ext(key)), "."); format {
+	case "jpg":
+		return FormatJPEG
+	default:
+		return format
+	}
+}
+
+// colorSpace 按颜色模型判断色彩空间
+func colorSpace(model color.Model) string {
+	switch model {
+	case color.GrayModel, color.Gray16Model:
+		return "gray"
+	case color.CMYKModel:
+		return "cmyk"
+	default:
+		return "rgb"
+	}
+}
+
+// jpegEXIF 从jpeg的图像头中读取EXIF, header至少包含到帧开始标记为止的内容
+func jpegEXIF(header []byte, model color.Model) exifInfo {
+	info := exifInfo{ColorSpace: colorSpace(model)}
+	if content := exifSegment(header); content != nil {
+		return readEXIF(content, info)
+	}
+
+	return info
+}
+
+// readEXIF 读取TIFF格式的EXIF中的拍摄时间, GPS和色彩空间, 未读取到的信息保留info中的值
+func readEXIF(content []byte, info exifInfo) exifInfo {
+	if len(content) < 8 {
+		return info
+	}
+
+	var order binary.ByteOrder
+	switch string(content[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return info
+	}
+
+	entries, _, ok := readIFD(content, order, order.Uint32(content[4:8]))
+	if !ok {
+		return info
+	}
+	if gps := entries[exifTagGPSIFD]; len(gps) == 1 && gps[0] != 0 {
+		info.GPS = true
+	}
+
+	pointer := entries[exifTagExifIFD]
+	if len(pointer) != 1 {
+		return info
+	}
+	exif, _, ok := readIFD(content, order, pointer[0])
+	if !ok {
+		return info
+	}
+
+	switch value := exif[exifTagColorSpace]; {
+	case len(value) != 1:
+	case value[0] == exifColorSpaceSRGB:
+		info.ColorSpace = "srgb"
+	case value[0] == exifColorSpaceUncalibrated:
+		info.ColorSpace = "uncalibrated"
+	}
+
+	original := readASCII(content, order, pointer[0], exifTagDateTimeOriginal)
+	if capturedAt, err := time.Parse(exifDateLayout, original); err == nil {
+		info.CapturedAt = capturedAt.Format("2006-01-02T15:04:05")
+		if offset := readASCII(content, order, pointer[0], exifTagOffsetTimeOriginal); len(offset) == 6 && (offset[0] == '+' || offset[0] == '-') {
+			info.CapturedAt += offset
+		}
+	}
+
+	return info
+}
+
+// readASCII 读取IFD中字符串类型的标签, 没有该标签时返回空字符串
+func readASCII(content []byte, order binary.ByteOrder, offset uint32, tag uint16) string {
+	if uint64(offset)+2 > uint64(len(content)) {
+		return ""
+	}
+
+	count := uint64(order.Uint16(content[offset:]))
+	if uint64(offset)+2+count*12 > uint64(len(content)) {
+		return ""
+	}
+	for index := uint64(0); index < count; index++ {
+		entry := content[uint64(offset)+2+index*12:]
+		if order.Uint16(entry) != tag || order.Uint16(entry[2:]) != exifTypeASCII {
+			continue
+		}
+
+		// 不超过4字节的值直接保存在条目中, 否则条目中是值的位置
+		number := uint64(order.Uint32(entry[4:]))
+		data := entry[8:12]
+		if number > 4 {
+			valueOffset := uint64(order.Uint32(entry[8:]))
+			if valueOffset+number > uint64(len(content)) {
+				return ""
+			}
+			data = content[valueOffset : valueOffset+number]
+		} else {
+			data = data[:number]
+		}
+
+		return strings.TrimRight(string(data), "\x00 ")
+	}
+
+	return ""
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nzai/resize/jpegscale"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+var (
+	// storageClassPattern S3存储类型的格式, 具体取值由S3校验
+	storageClassPattern = regexp.MustCompile("^[A-Z_]+$")
+	// sizeNamePattern 尺寸名称的格式, 会用在缩略图的key中
+	sizeNamePattern = regexp.MustCompile("^[A-Za-z][A-Za-z0-9_-]*$")
+	// squareSizePattern 正方形尺寸只需要指定边长
+	squareSizePattern = regexp.MustCompile("^\\d+$")
+)
+
+const (
+	// ModeFit 等比缩放至尺寸范围内
+	ModeFit = pipeline.ModeFit
+	// ModeFill 等比缩放后按焦点裁剪为指定尺寸
+	ModeFill = pipeline.ModeFill
+	// ModeStretch 拉伸为指定尺寸
+	ModeStretch = pipeline.ModeStretch
+	// ModePad 等比缩放至尺寸范围内并用背景色填充为指定尺寸
+	ModePad = pipeline.ModePad
+	// ModeSquare 按焦点裁剪为正方形后缩放, 用于头像, 解析后等同于宽高相同的fill
+	ModeSquare = "square"
+
+	// placeholderSize 低质量占位图的默认尺寸
+	placeholderSize = 32
+	// placeholderQuality 低质量占位图的编码质量
+	placeholderQuality = 30
+	// placeholderBlur 低质量占位图的模糊半径
+	placeholderBlur = 1.5
+)
+
+// Size 缩略图尺寸
+type Size struct {
+	image.Point
+	// Name 尺寸的名称, 设置后代替宽高用于缩略图的key, 修改宽高时key不变
+	Name string
+	// PixelRatio 高分辨率屏幕的倍数, 宽高已经按倍数放大, 0表示原始尺寸
+	PixelRatio int
+	Mode       string
+	Gravity    pipeline.Gravity
+	Background color.Color
+	// Quality jpeg编码质量, 0表示默认质量
+	Quality int
+	// Placeholder 是否是用于渐进加载的低质量占位图(LQIP)
+	Placeholder bool
+	// StorageClass 缩略图的存储类型
+	StorageClass string
+	// Format 缩略图的输出格式
+	Format string
+	// Transform 缩放前对原图的旋转和翻转
+	Transform pipeline.Transform
+	// Effect 缩放后的灰度, 复古或单色调效果
+	Effect pipeline.Effect
+	// Normalize 自动色阶, 用于曝光不足的照片和扫描件
+	Normalize bool
+	// Colors png调色板的颜色数量, 0表示不减少颜色
+	Colors int
+	// Compression png的压缩级别
+	Compression png.CompressionLevel
+	// Subsampling jpeg的色度抽样, 默认4:2:0, 小图上的红色文字等需要4:4:4才不会模糊
+	Subsampling jpegscale.Subsampling
+}
+
+// String 尺寸描述
+func (s Size) String() string {
+	return fmt.Sprintf("%dx%d:%s", s.X, s.Y, s.Mode)
+}
+
+// upscaleFactor 生成缩略图时相对原图的放大倍数, 不大于1表示不需要放大
+// 旋转90或270度时按旋转后的宽高计算
+func (s Size) upscaleFactor(original image.Point) float64 {
+	original = s.Transform.Bounds(original)
+	if original.X <= 0 || original.Y <= 0 {
+		return 1
+	}
+
+	scaleX := float64(s.X) / float64(original.X)
+	scaleY := float64(s.Y) / float64(original.Y)
+
+	switch s.Mode {
+	case ModeFill, ModeStretch:
+		return math.Max(scaleX, scaleY)
+	case ModePad:
+		// 只有画布在两个方向上都大于原图时才算放大
+		return math.Min(scaleX, scaleY)
+	default:
+		// fit模式本身不会放大
+		return 1
+	}
+}
+
+// coverScale 生成缩略图需要的原图最小缩放比例, 原图缩小到该比例时仍然不需要放大
+func (s Size) coverScale(original image.Point) float64 {
+	original = s.Transform.Bounds(original)
+	if original.X <= 0 || original.Y <= 0 {
+		return 1
+	}
+
+	scaleX := float64(s.X) / float64(original.X)
+	scaleY := float64(s.Y) / float64(original.Y)
+
+	switch s.Mode {
+	case ModeFill, ModeStretch:
+		return math.Max(scaleX, scaleY)
+	default:
+		// fit和pad模式按较小的比例缩放, 宽或高为0时不限制该方向
+		if s.X <= 0 {
+			return scaleY
+		}
+		if s.Y <= 0 {
+			return scaleX
+		}
+		return math.Min(scaleX, scaleY)
+	}
+}
+
+// limitTo 将尺寸限制在原图尺寸范围内
+func (s Size) limitTo(original image.Point) Size {
+	factor := s.upscaleFactor(original)
+	if factor <= 1 {
+		return s
+	}
+	original = s.Transform.Bounds(original)
+
+	switch s.Mode {
+	case ModeStretch:
+		if s.X > original.X {
+			s.X = original.X
+		}
+		if s.Y > original.Y {
+			s.Y = original.Y
+		}
+	default:
+		s.X = int(math.Max(1, math.Round(float64(s.X)/factor)))
+		s.Y = int(math.Max(1, math.Round(float64(s.Y)/factor)))
+	}
+
+	return s
+}
+
+// parseSizes 解析尺寸配置, 如200x200,800x600:fill:gravity=top,300x300:pad:background=#000000:quality=90:class=STANDARD_IA:format=png,lqip
+// 尺寸前可以加上名称, 如thumb=150x150,card=400x300:fill,hero=1600x900
+func parseSizes(value string) ([]Size, error) {
+	var sizes []Size
+	names := make(map[string]bool)
+	for _, token := range strings.FieldsFunc(value, isSizeSeparator) {
+		size, err := parseSize(token)
+		if err != nil {
+			return nil, err
+		}
+
+		if size.Name != "" {
+			if names[size.Name] {
+				return nil, fmt.Errorf("size name %s is duplicated", size.Name)
+			}
+			names[size.Name] = true
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+// PrefixSizes 指定前缀下的原图使用的尺寸
+type PrefixSizes struct {
+	Prefix string
+	Sizes  []Size
+}
+
+// parsePrefixSizes 解析按前缀配置的尺寸, 前缀之间用|分隔, 如avatars/=64x64,128x128|products/=400x400,1200x1200
+// 按前缀从长到短排序, 以便优先匹配最长的前缀
+func parsePrefixSizes(value string) ([]PrefixSizes, error) {
+	var prefixSizes []PrefixSizes
+	prefixes := make(map[string]bool)
+	for _, rule := range strings.Split(value, "|") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("prefix sizes %s must be prefix=sizes", rule)
+		}
+		if prefixes[parts[0]] {
+			return nil, fmt.Errorf("prefix %s is duplicated", parts[0])
+		}
+		prefixes[parts[0]] = true
+
+		sizes, err := parseSizes(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("prefix %s: %v", parts[0], err)
+		}
+		if len(sizes) == 0 {
+			return nil, fmt.Errorf("prefix %s has no sizes", parts[0])
+		}
+
+		prefixSizes = append(prefixSizes, PrefixSizes{Prefix: parts[0], Sizes: sizes})
+	}
+
+	sort.SliceStable(prefixSizes, func(i, j int) bool {
+		return len(prefixSizes[i].Prefix) > len(prefixSizes[j].Prefix)
+	})
+
+	return prefixSizes, nil
+}
+
+// isSizeSeparator 尺寸之间的分隔符
+func isSizeSeparator(r rune) bool {
+	return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n'
+}
+
+// parseSize 解析单个尺寸
+func parseSize(token string) (Size, error) {
+	parts := strings.Split(token, ":")
+
+	// name=宽x高形式的命名尺寸
+	var name string
+	if index := strings.Index(parts[0], "="); index >= 0 {
+		name, parts[0] = parts[0][:index], parts[0][index+1:]
+		if !sizeNamePattern.MatchString(name) {
+			return Size{}, fmt.Errorf("size %s name %s is invalid", token, name)
+		}
+	}
+
+	// lqip是32x32:lqip的简写
+	if strings.EqualFold(parts[0], "lqip") {
+		parts[0] = fmt.Sprintf("%dx%d", placeholderSize, placeholderSize)
+		parts = append(parts, "lqip")
+	}
+
+	// 128:square是128x128:square的简写
+	if squareSizePattern.MatchString(parts[0]) && hasOption(parts[1:], ModeSquare) {
+		parts[0] = parts[0] + "x" + parts[0]
+	}
+
+	group := sizePattern.FindStringSubmatch(parts[0])
+	if len(group) != 3 || group[0] != parts[0] {
+		return Size{}, fmt.Errorf("size %s is invalid", token)
+	}
+
+	width, err := strconv.Atoi(group[1])
+	if err != nil {
+		return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+	}
+
+	height, err := strconv.Atoi(group[2])
+	if err != nil {
+		return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+	}
+
+	size := Size{Point: image.Pt(width, height), Name: name, Mode: ModeFit}
+	for _, option := range parts[1:] {
+		name, value := option, ""
+		if index := strings.Index(option, "="); index >= 0 {
+			name, value = option[:index], option[index+1:]
+		}
+
+		switch strings.ToLower(name) {
+		case ModeFit, ModeFill, ModeStretch, ModePad:
+			size.Mode = strings.ToLower(name)
+		case ModeSquare:
+			if width != height {
+				return Size{}, fmt.Errorf("size %s is not square", token)
+			}
+			size.Mode = ModeFill
+		case "gravity":
+			size.Gravity, err = pipeline.ParseGravity(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "lqip":
+			size.Placeholder = true
+			if size.Quality == 0 {
+				size.Quality = placeholderQuality
+			}
+		case "quality":
+			size.Quality, err = strconv.Atoi(value)
+			if err != nil || size.Quality < 1 || size.Quality > 100 {
+				return Size{}, fmt.Errorf("size %s quality %s is invalid", token, value)
+			}
+		case "subsampling":
+			size.Subsampling, err = parseSubsampling(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "class":
+			size.StorageClass, err = parseStorageClass(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "format":
+			size.Format, err = parseFormat(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "background":
+			size.Background, err = parseColor(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "colors":
+			size.Colors, err = parseColors(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "compression":
+			size.Compression, err = parseCompression(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "normalize":
+			size.Normalize = true
+		case pipeline.EffectGrayscale, pipeline.EffectSepia:
+			size.Effect = pipeline.Effect{Name: strings.ToLower(name)}
+		case pipeline.EffectTint:
+			size.Effect, err = parseTint(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "rotate":
+			size.Transform.Rotate, err = parseRotate(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		case "flip":
+			size.Transform.FlipH, size.Transform.FlipV, err = parseFlip(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("size %s is invalid: %v", token, err)
+			}
+		default:
+			return Size{}, fmt.Errorf("size %s option %s is invalid", token, option)
+		}
+	}
+
+	return size, nil
+}
+
+// hasOption 尺寸选项中是否有该选项, 忽略大小写
+func hasOption(options []string, name string) bool {
+	for _, option := range options {
+		if strings.EqualFold(option, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parsePixelRatios 解析高分辨率屏幕的倍数, 如2,3
+func parsePixelRatios(value string) ([]int, error) {
+	var ratios []int
+	for _, token := range strings.FieldsFunc(value, isSizeSeparator) {
+		ratio, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(token), "x"))
+		if err != nil || ratio < 2 || ratio > 4 {
+			return nil, fmt.Errorf("pixel ratio %s is invalid", token)
+		}
+
+		ratios = append(ratios, ratio)
+	}
+
+	return ratios, nil
+}
+
+// withPixelRatios 在每个尺寸后追加按倍数放大的版本, 用于srcset, 占位图不需要
+func withPixelRatios(sizes []Size, ratios []int) []Size {
+	var expanded []Size
+	for _, size := range sizes {
+		expanded = append(expanded, size)
+		if size.Placeholder {
+			continue
+		}
+
+		for _, ratio := range ratios {
+			variant := size
+			variant.X, variant.Y = size.X*ratio, size.Y*ratio
+			variant.PixelRatio = ratio
+			expanded = append(expanded, variant)
+		}
+	}
+
+	return expanded
+}
+
+// parseStorageClass 解析S3存储类型, 如STANDARD, STANDARD_IA
+func parseStorageClass(value string) (string, error) {
+	class := strings.ToUpper(strings.TrimSpace(value))
+	if !storageClassPattern.MatchString(class) {
+		return "", fmt.Errorf("storage class %s is invalid", value)
+	}
+
+	return class, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"strings"
+	"sync"
+)
+
+// sourceCache 热启动时缓存最近解码的原图, 重复或重试的事件不需要再次下载和解码
+// 按bucket, key和ETag缓存, 超过容量时淘汰最久未使用的原图
+type sourceCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+// sourceCacheEntry 缓存的原图及其占用的字节数
+type sourceCacheEntry struct {
+	key      string
+	original *Original
+	cost     int64
+}
+
+// newSourceCache 新建容量为capacity字节的原图缓存
+func newSourceCache(capacity int64) *sourceCache {
+	return &sourceCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// sourceCacheKey 缓存的key, 原图更新后ETag变化, 不会读到旧的原图
+func sourceCacheKey(bucket, key, etag string) string {
+	return bucket + "/" + key + "@" + strings.Trim(etag, "\"")
+}
+
+// get 读取缓存的原图, 返回可以单独修改的副本
+func (c *sourceCache) get(bucket, key, etag string) (*Original, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.entries[sourceCacheKey(bucket, key, etag)]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	return element.Value.(*sourceCacheEntry).original.clone(), true
+}
+
+// add 缓存解码后的原图, 超过容量的原图不缓存
+func (c *sourceCache) add(etag string, original *Original) {
+	cost := original.cost()
+	if cost > c.capacity {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cacheKey := sourceCacheKey(original.Bucket, original.Key, etag)
+	if element, found := c.entries[cacheKey]; found {
+		c.remove(element)
+	}
+
+	c.entries[cacheKey] = c.order.PushFront(&sourceCacheEntry{key: cacheKey, original: original.clone(), cost: cost})
+	c.size += cost
+
+	for c.size > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove 删除缓存的原图, 调用方需要持有锁
+func (c *sourceCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*sourceCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.cost
+}
+
+// clone 复制原图, 图像和内容共享, 元数据可以单独修改
+func (o *Original) clone() *Original {
+	clone := &Original{
+		Bucket:            o.Bucket,
+		Key:               o.Key,
+		Image:             o.Image,
+		Bounds:            o.Bounds,
+		Scale:             o.Scale,
+		Source:            o.Source,
+		Metadata:          o.Metadata,
+		ThumbnailMetadata: make(map[string]string, len(o.ThumbnailMetadata)),
+		Bytes:             o.Bytes,
+		DecodeMs:          o.DecodeMs,
+		ContentHash:       o.ContentHash,
+		Version:           o.Version,
+		svgRenderer:       o.svgRenderer,
+		frames:            o.frames,
+		loopCount:         o.loopCount,
+		exif:              o.exif,
+		exifData:          o.exifData,
+	}
+	for name, value := range o.ThumbnailMetadata {
+		clone.ThumbnailMetadata[name] = value
+	}
+
+	return clone
+}
+
+// cost 原图在内存中占用的字节数
+func (o *Original) cost() int64 {
+	cost := int64(len(o.Source))
+	switch img := o.Image.(type) {
+	case nil:
+	case *image.YCbCr:
+		cost += int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	case *image.Gray:
+		cost += int64(len(img.Pix))
+	case *image.RGBA:
+		cost += int64(len(img.Pix))
+	default:
+		size := img.Bounds().Size()
+		cost += int64(size.X) * int64(size.Y) * 4
+	}
+	for _, frame := range o.frames {
+		size := frame.Image.Bounds().Size()
+		cost += int64(size.X) * int64(size.Y) * 4
+	}
+
+	return cost
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceCacheHitMatchesColdRead(t *testing.T) {
+	bucket := t.TempDir()
+	s := newTestImaging(t, map[string]string{
+		"Sizes":           "100x100,80x60:fill",
+		"SourceCacheSize": "16MB",
+		"PreserveExif":    "true",
+	})
+
+	// 只有Make标签的EXIF
+	exif := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x0f\x01\x02\x00\x04\x00\x00\x00Test\x00\x00\x00\x00")
+	writeTestFile(t, bucket, "photos/a.jpg", insertEXIF(testJPEG(t, 400, 300), exif))
+	record := createdRecord(t, s, bucket, "photos/a.jpg")
+
+	ctx := context.Background()
+	cold := s.processRecord(ctx, record)
+	if err := cold.Err(); err != nil {
+		t.Fatalf("cold read failed: %v", err)
+	}
+
+	thumbnails := make(map[string][]byte)
+	for _, size := range cold.Sizes {
+		content := readTestFile(t, bucket, size.Key)
+		if !bytes.Contains(content, []byte("Exif\x00\x00")) {
+			t.Errorf("thumbnail %s from cold read has no exif", size.Key)
+		}
+		thumbnails[size.Key] = content
+	}
+
+	// 删除原图, 重复的事件只能从缓存读取
+	if err := os.Remove(filepath.Join(bucket, "photos", "a.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	for key := range thumbnails {
+		if err := os.Remove(filepath.Join(bucket, filepath.FromSlash(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hit := s.processRecord(ctx, record)
+	if err := hit.Err(); err != nil {
+		t.Fatalf("cache hit failed: %v", err)
+	}
+	if len(hit.Sizes) != len(cold.Sizes) {
+		t.Fatalf("cache hit created %d sizes, cold read created %d", len(hit.Sizes), len(cold.Sizes))
+	}
+	for index, size := range hit.Sizes {
+		if size.Key != cold.Sizes[index].Key {
+			t.Errorf("cache hit wrote %s, cold read wrote %s", size.Key, cold.Sizes[index].Key)
+			continue
+		}
+		if !bytes.Equal(readTestFile(t, bucket, size.Key), thumbnails[size.Key]) {
+			t.Errorf("thumbnail %s from cache hit differs from cold read", size.Key)
+		}
+	}
+}
+
+func TestOriginalCloneKeepsReadState(t *testing.T) {
+	original := &Original{
+		Bucket:            "photos",
+		Key:               "a.jpg",
+		ThumbnailMetadata: map[string]string{"kind": "thumbnail"},
+		ContentHash:       "abc",
+		exifData:          []byte("exif"),
+	}
+	original.Version.ETag, original.Version.ID = "etag", "v1"
+
+	clone := original.clone()
+	if clone.Version != original.Version {
+		t.Errorf("clone version is %+v, want %+v", clone.Version, original.Version)
+	}
+	if clone.ContentHash != original.ContentHash {
+		t.Errorf("clone content hash is %q, want %q", clone.ContentHash, original.ContentHash)
+	}
+	if !bytes.Equal(clone.exifData, original.exifData) {
+		t.Errorf("clone exif is %q, want %q", clone.exifData, original.exifData)
+	}
+
+	clone.ThumbnailMetadata["kind"] = "changed"
+	if original.ThumbnailMetadata["kind"] != "thumbnail" {
+		t.Error("clone shares thumbnail metadata with original")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SQSEvent SQS触发Lambda的事件
+type SQSEvent struct {
+	Records []SQSMessage `json:"Records"`
+}
+
+// SQSMessage SQS消息
+type SQSMessage struct {
+	MessageID     string `json:"messageId"`
+	ReceiptHandle string `json:"receiptHandle"`
+	Body          string `json:"body"`
+	EventSource   string `json:"eventSource"`
+}
+
+// SQSBatchResponse 批量处理结果, 事件源映射需要开启ReportBatchItemFailures
+type SQSBatchResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+// SQSBatchItemFailure 处理失败的消息, 只有这些消息会重新投递
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// SQSEvent 处理S3通知到SQS的消息, 返回处理失败的消息
+func (s Imaging) SQSEvent(ctx context.Context, sqsEvent SQSEvent) SQSBatchResponse {
+	var records []events.S3EventRecord
+	var messageIDs []string
+	response := SQSBatchResponse{BatchItemFailures: []SQSBatchItemFailure{}}
+
+	for _, message := range sqsEvent.Records {
+		// S3->SNS->SQS未开启原始消息投递时, 消息体是SNS的信封
+		s3Event, err := parseS3Notification(message.Body)
+		if err != nil {
+			// 无法解析的消息重试也不会成功, 交给死信队列处理
+			logger.ErrorContext(ctx, "Parse message failed", "messageId", message.MessageID, "error", err)
+			response.BatchItemFailures = append(response.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: message.MessageID})
+			continue
+		}
+
+		// 配置通知时S3会发送不包含记录的s3:TestEvent
+		if len(s3Event.Records) == 0 {
+			logger.InfoContext(ctx, "Ignore message without records", "messageId", message.MessageID)
+			continue
+		}
+
+		for _, record := range s3Event.Records {
+			records = append(records, record)
+			messageIDs = append(messageIDs, message.MessageID)
+		}
+	}
+
+	// 一条消息可能包含多条记录, 任意一条失败都需要重试整条消息
+	failed := make(map[string]bool)
+	results := s.processRecords(ctx, records)
+	for index, result := range results {
+		if result.Err() != nil && !failed[messageIDs[index]] {
+			failed[messageIDs[index]] = true
+			response.BatchItemFailures = append(response.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: messageIDs[index]})
+		}
+	}
+
+	s.logReport(ctx, results)
+	logger.InfoContext(ctx, "Process messages", "messages", len(sqsEvent.Records), "failures", len(response.BatchItemFailures))
+	return response
+}
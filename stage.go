@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// stageDownload 下载原图, 边下载边解码时包含读取剩余内容
+	stageDownload = "download"
+	// stageDecode 解码原图
+	stageDecode = "decode"
+	// stageResize 生成一个尺寸的缩略图
+	stageResize = "resize"
+	// stageUpload 写入一个尺寸的缩略图, 包括重试和副本
+	stageUpload = "upload"
+)
+
+// StageTimeoutError 处理阶段超过了配置的超时时间
+type StageTimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+}
+
+// Error 实现error
+func (e *StageTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Stage, e.Timeout)
+}
+
+// isPermanentTimeout 是否是解码或者缩小超时, 与网络无关, 同一张原图重试也会超时
+func isPermanentTimeout(err error) bool {
+	e, ok := err.(*StageTimeoutError)
+	return ok && (e.Stage == stageDecode || e.Stage == stageResize)
+}
+
+// stageContext 为可以取消的下载和上传阶段设置超时, timeout为0时不设置
+func stageContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// stageError 阶段的ctx超时而调用的ctx没有结束时返回StageTimeoutError, 其他情况返回原来的错误
+func stageError(ctx, stageCtx context.Context, stage string, timeout time.Duration, err error) error {
+	if err != nil && timeout > 0 && ctx.Err() == nil && stageCtx.Err() == context.DeadlineExceeded {
+		return &StageTimeoutError{Stage: stage, Timeout: timeout}
+	}
+
+	return err
+}
+
+// runStage 运行不能取消的解码和缩小阶段, 超时后不再等待, 返回StageTimeoutError
+// do在后台继续运行直到完成, 超时后调用方不能再读取do写入的结果
+// 后台运行的do中的panic不能由调用方恢复, 转换为错误返回
+func runStage(ctx context.Context, stage string, timeout time.Duration, do func() error) error {
+	if timeout <= 0 {
+		return do()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer recoverError(ctx, &err)
+		err = do()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return &StageTimeoutError{Stage: stage, Timeout: timeout}
+	}
+}
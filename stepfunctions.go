@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// StepFunctionsInput Step Functions任务的输入, 如{"sourceBucket": "photos", "sourceKey": "a/b.jpg", "sizes": ["200x200", "800x800:fill"]}
+// sourceKey不需要URL编码, sizes为空时使用配置的尺寸, sourceBucket为空时使用SourceBucket
+type StepFunctionsInput struct {
+	SourceBucket string   `json:"sourceBucket"`
+	SourceKey    string   `json:"sourceKey"`
+	Sizes        []string `json:"sizes,omitempty"`
+}
+
+// StepFunctionsOutput Step Functions任务的输出, 作为下一个状态的输入
+type StepFunctionsOutput struct {
+	SourceBucket string       `json:"sourceBucket"`
+	SourceKey    string       `json:"sourceKey"`
+	Status       string       `json:"status"`
+	DurationMs   int64        `json:"durationMs"`
+	Sizes        []SizeResult `json:"sizes"`
+}
+
+// TemporaryFailure 可以重试的失败, Lambda把错误的类型名作为Step Functions中的错误名称
+type TemporaryFailure struct {
+	Message string
+}
+
+// Error 实现error
+func (e *TemporaryFailure) Error() string {
+	return e.Message
+}
+
+// PermanentFailure 原图不存在, 过大, 无法解码或者输入无效, 重试也不会成功, 状态机中应该Catch
+type PermanentFailure struct {
+	Message string
+}
+
+// Error 实现error
+func (e *PermanentFailure) Error() string {
+	return e.Message
+}
+
+// StepFunctionsEvent 处理Step Functions任务, 失败时按能否重试返回TemporaryFailure或PermanentFailure
+// 状态机可以按错误名称配置Retry和Catch, 如"ErrorEquals": ["TemporaryFailure"]
+func (s Imaging) StepFunctionsEvent(ctx context.Context, input StepFunctionsInput) (*StepFunctionsOutput, error) {
+	bucket := input.SourceBucket
+	if bucket == "" {
+		bucket = s.config.SourceBucket
+	}
+	if bucket == "" || input.SourceKey == "" {
+		return nil, &PermanentFailure{Message: "sourceBucket and sourceKey are required"}
+	}
+
+	// 指定了尺寸时只生成这些尺寸, 其余配置仍然按租户或者bucket读取
+	s, _ = s.forObject(ctx, bucket, input.SourceKey)
+	config := *s.config
+	if len(input.Sizes) > 0 {
+		sizes, err := parseSizes(strings.Join(input.Sizes, ","))
+		if err != nil {
+			return nil, &PermanentFailure{Message: fmt.Sprintf("sizes %v is invalid: %v", input.Sizes, err)}
+		}
+		for index := range sizes {
+			sizes[index] = config.sizeDefaults(sizes[index])
+		}
+		config.Sizes, config.PrefixSizes, config.Buckets, config.Tenants = sizes, nil, nil, nil
+	}
+	s.config = &config
+
+	// 与S3通知一致, 事件中的key经过URL编码
+	record := events.S3EventRecord{EventSource: "aws:states", EventName: "ObjectCreated:Put"}
+	record.S3.Bucket.Name = bucket
+	record.S3.Object.Key = url.QueryEscape(input.SourceKey)
+
+	results := s.processRecords(ctx, []events.S3EventRecord{record})
+	s.logReport(ctx, results)
+
+	result := results[0]
+	if err := result.Err(); err != nil {
+		if batchResultCode(err) == batchPermanentFailure {
+			return nil, &PermanentFailure{Message: err.Error()}
+		}
+		return nil, &TemporaryFailure{Message: err.Error()}
+	}
+
+	return &StepFunctionsOutput{
+		SourceBucket: bucket,
+		SourceKey:    input.SourceKey,
+		Status:       result.Status,
+		DurationMs:   result.DurationMs,
+		Sizes:        result.Sizes,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+const (
+	// StepOrient 按尺寸和对象元数据旋转翻转
+	StepOrient = "orient"
+	// StepCrop fill模式按焦点裁剪到目标宽高比, 其他模式不裁剪
+	StepCrop = "crop"
+	// StepResize 按尺寸的模式缩放, pad模式同时补边
+	StepResize = "resize"
+	// StepNormalize 尺寸开启normalize时自动色阶
+	StepNormalize = "normalize"
+	// StepSharpen 按配置锐化, 占位图改为模糊
+	StepSharpen = "sharpen"
+	// StepEffect 尺寸的颜色效果
+	StepEffect = "effect"
+	// StepWatermark 配置了水印时添加水印, 占位图不添加
+	StepWatermark = "watermark"
+)
+
+// defaultPipeline 默认的处理步骤, 与没有Pipeline配置之前的处理顺序相同
+var defaultPipeline = []string{StepOrient, StepCrop, StepResize, StepNormalize, StepSharpen, StepEffect, StepWatermark}
+
+// Render 生成一个尺寸的缩略图时在步骤之间传递的状态
+type Render struct {
+	// Original 原图, 步骤中不应该修改
+	Original *Original
+	// Size 目标尺寸, 不放大原图时已经限制到原图大小
+	Size Size
+	// Image 当前的图像, 第一个步骤的输入是解码后的原图或者链式缩放的中间图像
+	Image image.Image
+}
+
+// Step 解码之后和编码之前的一个处理步骤, 修改render中的图像
+// 新的操作实现Step并注册后可以在Pipeline中按名称配置, 不需要修改事件和存储的处理
+type Step interface {
+	Apply(s Imaging, render *Render)
+}
+
+// StepFunc 函数形式的步骤
+type StepFunc func(s Imaging, render *Render)
+
+// Apply 实现Step
+func (f StepFunc) Apply(s Imaging, render *Render) {
+	f(s, render)
+}
+
+// steps 可以在Pipeline中使用的步骤
+var steps = map[string]Step{
+	StepOrient: StepFunc(func(s Imaging, render *Render) {
+		// 人脸位置是在原图中检测的, 需要跟随旋转和翻转
+		if render.Size.Gravity.IsFace() {
+			render.Size.Gravity.X, render.Size.Gravity.Y = render.Size.Transform.Focus(render.Size.Gravity.X, render.Size.Gravity.Y)
+		}
+		render.Image = render.Size.Transform.Apply(render.Image)
+	}),
+	StepCrop: StepFunc(func(s Imaging, render *Render) {
+		render.Image = cropImage(render.Image, render.Size)
+	}),
+	StepResize: StepFunc(func(s Imaging, render *Render) {
+		render.Image = resizeImage(render.Image, render.Size, s.config.Filter)
+	}),
+	StepNormalize: StepFunc(func(s Imaging, render *Render) {
+		if render.Size.Normalize {
+			render.Image = pipeline.Normalize(render.Image)
+		}
+	}),
+	StepSharpen: StepFunc(func(s Imaging, render *Render) {
+		if render.Size.Placeholder {
+			// 占位图只需要轮廓和颜色, 模糊后可以大幅减小体积
+			render.Image = pipeline.GaussianBlur(pipeline.ToRGBA(render.Image), placeholderBlur)
+			return
+		}
+		render.Image = s.config.Sharpen.Apply(render.Image)
+	}),
+	StepEffect: StepFunc(func(s Imaging, render *Render) {
+		render.Image = render.Size.Effect.Apply(render.Image)
+	}),
+	StepWatermark: StepFunc(func(s Imaging, render *Render) {
+		if s.watermark != nil && !render.Size.Placeholder {
+			render.Image = s.watermark.apply(render.Image, s.config.Filter)
+		}
+	}),
+}
+
+// registerStep 注册新的步骤, 名称重复时panic
+func registerStep(name string, step Step) {
+	if _, found := steps[name]; found {
+		panic("step " + name + " is already registered")
+	}
+	steps[name] = step
+}
+
+// parsePipeline 解析逗号分隔的步骤名称, 步骤不能重复, 必须包含resize
+func parsePipeline(value string) ([]string, error) {
+	names := parseList(strings.ToLower(value))
+	if len(names) == 0 {
+		return defaultPipeline, nil
+	}
+
+	found := make(map[string]bool)
+	for _, name := range names {
+		if _, ok := steps[name]; !ok {
+			return nil, fmt.Errorf("step %s is not supported", name)
+		}
+		if found[name] {
+			return nil, fmt.Errorf("step %s is duplicated", name)
+		}
+		found[name] = true
+	}
+	if !found[StepResize] {
+		return nil, fmt.Errorf("pipeline %s has no %s step", value, StepResize)
+	}
+
+	return names, nil
+}
+
+// pipelineSteps 配置的步骤名称, 没有配置时使用默认的步骤
+func (c *Config) pipelineSteps() []string {
+	if len(c.Pipeline) == 0 {
+		return defaultPipeline
+	}
+
+	return c.Pipeline
+}
+
+// isDefaultPipeline 是否使用默认的处理步骤, 其他步骤只能由Go实现
+func (c *Config) isDefaultPipeline() bool {
+	return strings.Join(c.pipelineSteps(), ",") == strings.Join(defaultPipeline, ",")
+}
+
+// runPipeline 依次执行配置的步骤
+func (s Imaging) runPipeline(render *Render) image.Image {
+	for _, name := range s.config.pipelineSteps() {
+		steps[name].Apply(s, render)
+	}
+
+	return render.Image
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	// StorageS3 AWS S3及S3兼容存储
+	StorageS3 = "s3"
+	// StorageGCS Google Cloud Storage
+	StorageGCS = "gcs"
+	// StorageAzure Azure Blob Storage
+	StorageAzure = "azure"
+	// StorageLocal 本地文件系统, bucket对应目录
+	StorageLocal = "local"
+)
+
+// ObjectStore 对象存储, 屏蔽S3和GCS等存储服务的差异
+type ObjectStore interface {
+	// Get 读取对象内容和元数据
+	Get(ctx context.Context, bucket, key string) (*Object, error)
+	// Head 只读取对象的元数据
+	Head(ctx context.Context, bucket, key string) (*ObjectInfo, error)
+	// Put 写入对象
+	Put(ctx context.Context, bucket, key string, body io.Reader, options PutOptions) error
+	// Delete 删除对象, 对象不存在时不返回错误
+	Delete(ctx context.Context, bucket, key string) error
+}
+
+// TagReader 支持对象标签的存储
+type TagReader interface {
+	// Tags 读取对象的标签
+	Tags(ctx context.Context, bucket, key string) (map[string]string, error)
+}
+
+// VersionReader 支持读取对象指定版本的存储, 开启了版本控制的bucket中事件对应的版本可能已经不是最新版本
+type VersionReader interface {
+	// GetVersion 读取对象的指定版本, versionID为空时读取最新版本
+	GetVersion(ctx context.Context, bucket, key, versionID string) (*Object, error)
+}
+
+// TagWriter 支持写入对象标签的存储
+type TagWriter interface {
+	// PutTags 替换对象的所有标签
+	PutTags(ctx context.Context, bucket, key string, tags map[string]string) error
+}
+
+// MetadataWriter 支持原地替换对象用户元数据的存储
+type MetadataWriter interface {
+	// ReplaceMetadata 替换etag对应的对象的用户元数据, 对象内容和标签不变, 对象已经被覆盖时返回错误
+	ReplaceMetadata(ctx context.Context, bucket, key, etag string, metadata map[string]string) error
+}
+
+// ObjectCopier 支持在服务端复制对象的存储, 对象内容不经过函数
+type ObjectCopier interface {
+	// Copy 复制etag对应的对象, 保留内容类型, 缓存, 元数据和标签, storageClass为空时使用默认存储类别, 复制前对象已经被覆盖时返回错误
+	Copy(ctx context.Context, bucket, key, etag, destinationBucket, destinationKey, storageClass string) error
+}
+
+// URLSigner 支持生成预签名地址的存储
+type URLSigner interface {
+	// PresignGet 生成读取对象的预签名地址, expires后过期
+	PresignGet(bucket, key string, expires time.Duration) (string, error)
+}
+
+// ObjectLister 支持按前缀列出对象的存储
+type ObjectLister interface {
+	// List 按顺序列出prefix下startAfter之后最多limit个对象的key, 第二个返回值表示是否还有更多对象
+	List(ctx context.Context, bucket, prefix, startAfter string, limit int) ([]string, bool, error)
+}
+
+// BucketTagging 支持读取bucket标签的存储
+type BucketTagging interface {
+	// BucketTags 读取bucket的所有标签, 没有标签时返回空的map
+	BucketTags(ctx context.Context, bucket string) (map[string]string, error)
+}
+
+// ObjectLambdaWriter 支持返回S3 Object Lambda响应的存储
+type ObjectLambdaWriter interface {
+	// WriteGetObjectResponse 将转换后的对象返回给访问点的调用方, header中是X-Amz-Fwd-*形式的状态和响应头, 失败时content为空
+	WriteGetObjectResponse(ctx context.Context, route, token string, header http.Header, content []byte) error
+}
+
+// 编译时检查各存储的实现, Imaging只依赖ObjectStore, 测试时可以替换为LocalStore或其它实现
+var (
+	_ ObjectStore    = (*S3Store)(nil)
+	_ ObjectStore    = (*GCSStore)(nil)
+	_ ObjectStore    = (*AzureStore)(nil)
+	_ ObjectStore    = (*LocalStore)(nil)
+	_ TagReader      = (*S3Store)(nil)
+	_ TagReader      = (*AzureStore)(nil)
+	_ TagWriter      = (*S3Store)(nil)
+	_ VersionReader  = (*S3Store)(nil)
+	_ MetadataWriter = (*S3Store)(nil)
+	_ ObjectCopier   = (*S3Store)(nil)
+	_ URLSigner      = (*S3Store)(nil)
+	_ ObjectLister   = (*S3Store)(nil)
+	_ ObjectLister   = (*LocalStore)(nil)
+	_ BucketTagging  = (*S3Store)(nil)
+
+	_ ObjectLambdaWriter = (*S3Store)(nil)
+)
+
+// ObjectInfo 对象的元数据
+type ObjectInfo struct {
+	ETag        string
+	Size        int64
+	ContentType string
+	// MD5 对象内容的md5, 十六进制编码, 无法得知时为空
+	MD5 string
+	// Metadata 用户自定义元数据
+	Metadata map[string]string
+	// VersionID 开启了版本控制的bucket中对象的版本ID
+	VersionID string
+}
+
+// Object 对象
+type Object struct {
+	ObjectInfo
+	Body io.ReadCloser
+}
+
+// PutOptions 写入对象的选项
+type PutOptions struct {
+	ContentType  string
+	CacheControl string
+	Expires      time.Time
+	StorageClass string
+	Metadata     map[string]string
+	Tags         map[string]string
+}
+
+// StatusError 基于HTTP的存储服务返回的错误
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Message    string
+}
+
+// Error 实现error
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s status %d: %s", e.Service, e.StatusCode, e.Message)
+}
+
+// isNotFound 是否是对象不存在的错误
+func isNotFound(err error) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return e.StatusCode == http.StatusNotFound
+	case awserr.RequestFailure:
+		return e.StatusCode() == http.StatusNotFound
+	}
+
+	return os.IsNotExist(err)
+}
+
+// parseObjectLocation 解析scheme://bucket/key形式的对象地址
+func parseObjectLocation(location, scheme string) (string, string, bool) {
+	if !strings.HasPrefix(location, scheme) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(location, scheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// loadImage 从对象存储(s3://bucket/key, gs://bucket/key, az://container/blob)或者本地文件读取图像
+func loadImage(ctx context.Context, store ObjectStore, location string) (image.Image, error) {
+	for _, scheme := range []string{"s3://", "gs://", "az://"} {
+		if !strings.HasPrefix(location, scheme) {
+			continue
+		}
+
+		bucket, key, ok := parseObjectLocation(location, scheme)
+		if !ok {
+			return nil, fmt.Errorf("location %s is invalid", location)
+		}
+
+		object, err := store.Get(ctx, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		defer object.Body.Close()
+
+		img, _, err := image.Decode(object.Body)
+		return img, err
+	}
+
+	// 随部署包一起发布的文件
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	return img, err
+}
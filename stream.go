@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"image"
+	"io"
+)
+
+// streamable 是否可以边编码边上传, 需要优化或写入EXIF的尺寸需要完整的编码结果, 副本需要重复上传同样的内容
+func (s Imaging) streamable(original *Original, size Size) bool {
+	if !s.config.StreamUpload || len(s.config.Replicas) > 0 {
+		return false
+	}
+	if size.Format == FormatJPEG && (s.config.OptimizeJPEG || s.config.PreserveExif && original.exifData != nil) {
+		return false
+	}
+
+	return true
+}
+
+// streamThumbnail 编码的同时通过io.Pipe上传, 上传读取的同时计算md5和字节数
+// 读取过的内容不能重试, 编码成功但上传失败时改为编码到缓冲区后按配置重试
+func (s Imaging) streamThumbnail(ctx context.Context, original *Original, thumbnail image.Image, size Size, result *SizeResult) error {
+	reader, writer := io.Pipe()
+	encoded := make(chan error, 1)
+	go func() {
+		_, segment := beginSegment(ctx, "encode")
+		err := encodeImage(writer, thumbnail, size)
+		segment.end(err)
+		writer.CloseWithError(err)
+		encoded <- err
+	}()
+
+	body := newChecksumReader(reader)
+	options := s.thumbnailOptions(original, size)
+	uploadCtx, cancel := stageContext(ctx, s.config.UploadTimeout)
+	defer cancel()
+	err := s.destination.Put(uploadCtx, result.Bucket, result.Key, body, options)
+	err = stageError(ctx, uploadCtx, stageUpload, s.config.UploadTimeout, err)
+
+	// 上传失败时编码可能阻塞在写入, 关闭读取端后等待编码退出, 此时编码返回io.ErrClosedPipe
+	reader.Close()
+	if encodeErr := <-encoded; encodeErr != nil && !(err != nil && encodeErr == io.ErrClosedPipe) {
+		logger.ErrorContext(ctx, "Encode thumbnail failed", "format", size.Format, "error", encodeErr)
+		return encodeErr
+	}
+	if err != nil {
+		if ctx.Err() != nil || uploadCtx.Err() != nil {
+			logger.ErrorContext(ctx, "Put thumbnail failed", "thumbnailBucket", result.Bucket, "thumbnail", result.Key, "error", err)
+			return err
+		}
+
+		logger.WarnContext(ctx, "Stream thumbnail failed, retry with buffer", "thumbnailBucket", result.Bucket, "thumbnail", result.Key, "error", err)
+		return s.bufferThumbnail(ctx, original, thumbnail, size, result)
+	}
+	result.Bytes, result.MD5 = body.length, hex.EncodeToString(body.md5.Sum(nil))
+
+	return nil
+}
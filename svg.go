@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSVGRenderer 栅格化SVG使用的librsvg命令, Lambda中可以通过层安装到/opt/bin
+	defaultSVGRenderer = "rsvg-convert"
+	// svgRenderTimeout 栅格化单个尺寸的超时时间
+	svgRenderTimeout = 10 * time.Second
+)
+
+// isSVG 是否是SVG矢量图
+func isSVG(key string) bool {
+	return strings.HasSuffix(strings.ToLower(key), ".svg")
+}
+
+// decodeSVG 读取SVG并解析固有尺寸, 每个尺寸按输出的大小单独栅格化
+func (s Imaging) decodeSVG(bucket, key string, object *Object) (*Original, error) {
+	start := time.Now()
+
+	body := newChecksumReader(object.Body)
+	source, err := ioutil.ReadAll(body)
+	if err != nil {
+		logger.Error("Read svg failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	bounds, err := svgBounds(bytes.NewReader(source))
+	if err != nil {
+		logger.Error("Decode svg failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Bounds, original.Scale, original.Source = bounds, 1, source
+	original.svgRenderer = s.config.SVGRenderer
+
+	return original, nil
+}
+
+// svgSource 按尺寸需要的大小栅格化SVG, 缩放时不会损失清晰度
+// 输出jpeg等不支持透明的格式时使用白色背景
+func (s Imaging) svgSource(original *Original, size Size) (image.Image, error) {
+	scale := size.coverScale(original.Bounds)
+	width := int(math.Max(1, math.Round(float64(original.Bounds.X)*scale)))
+	height := int(math.Max(1, math.Round(float64(original.Bounds.Y)*scale)))
+
+	background := ""
+	if size.Format != FormatPNG {
+		background = "white"
+	}
+
+	return rasterizeSVG(original.svgRenderer, original.Source, width, height, background)
+}
+
+// rasterizeSVG 将SVG栅格化为指定大小的图像
+func rasterizeSVG(renderer string, source []byte, width, height int, background string) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), svgRenderTimeout)
+	defer cancel()
+
+	args := []string{"-w", strconv.Itoa(width), "-h", strconv.Itoa(height), "-f", "png"}
+	if background != "" {
+		args = append(args, "-b", background)
+	}
+
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, renderer, args...)
+	command.Stdin, command.Stdout, command.Stderr = bytes.NewReader(source), &stdout, &stderr
+	if err := command.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed due to %v: %s", renderer, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return png.Decode(&stdout)
+}
+
+// svgBounds 按根元素的width, height或者viewBox计算固有尺寸, 都没有时与浏览器一样使用300x150
+func svgBounds(reader io.Reader) (image.Point, error) {
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return image.Point{}, fmt.Errorf("svg root element is not found: %v", err)
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if element.Name.Local != "svg" {
+			return image.Point{}, fmt.Errorf("root element %s is not svg", element.Name.Local)
+		}
+
+		var width, height float64
+		var viewBox []float64
+		for _, attr := range element.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width = svgLength(attr.Value)
+			case "height":
+				height = svgLength(attr.Value)
+			case "viewBox":
+				for _, field := range strings.FieldsFunc(attr.Value, func(r rune) bool { return r == ',' || r == ' ' }) {
+					value, err := strconv.ParseFloat(field, 64)
+					if err != nil {
+						return image.Point{}, fmt.Errorf("viewBox %s is invalid", attr.Value)
+					}
+					viewBox = append(viewBox, value)
+				}
+			}
+		}
+
+		// 只有宽或高时按viewBox的比例计算另一边
+		if len(viewBox) == 4 && viewBox[2] > 0 && viewBox[3] > 0 {
+			switch {
+			case width == 0 && height == 0:
+				width, height = viewBox[2], viewBox[3]
+			case width == 0:
+				width = height * viewBox[2] / viewBox[3]
+			case height == 0:
+				height = width * viewBox[3] / viewBox[2]
+			}
+		}
+		if width == 0 {
+			width = 300
+		}
+		if height == 0 {
+			height = 150
+		}
+
+		return image.Pt(int(math.Ceil(width)), int(math.Ceil(height))), nil
+	}
+}
+
+// svgLength 解析以像素为单位的长度, 百分比等相对单位返回0
+func svgLength(value string) float64 {
+	value = strings.TrimSuffix(strings.TrimSpace(value), "px")
+	length, err := strconv.ParseFloat(value, 64)
+	if err != nil || length < 0 {
+		return 0
+	}
+
+	return length
+}
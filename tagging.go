@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// parseTags 解析逗号分隔的标签, 如kind=thumbnail,source-key={key}
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, item := range parseList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("tag %s is invalid", item)
+		}
+
+		tags[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return tags, nil
+}
+
+// thumbnailTags 生成缩略图的标签, 包括原图的标签和配置的附加标签
+func (s Imaging) thumbnailTags(ctx context.Context, original *Original) (map[string]string, error) {
+	tags := make(map[string]string)
+	if reader, ok := s.store.(TagReader); ok && s.config.CopyTags {
+		sourceTags, err := reader.Tags(ctx, original.Bucket, original.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range sourceTags {
+			tags[key] = value
+		}
+	}
+
+	// 附加标签中可以引用原图的bucket和key
+	replacer := strings.NewReplacer("{bucket}", original.Bucket, "{key}", original.Key)
+	for key, value := range s.config.ThumbnailTags {
+		tags[key] = replacer.Replace(value)
+	}
+
+	return tags, nil
+}
+
+// optedOut 原图的元数据或者标签是否包含OptOut中的标记, 名称和值都忽略大小写
+// 先读取元数据, 不匹配时再读取标签, 未配置OptOut时不读取
+func (s Imaging) optedOut(ctx context.Context, bucket, key string) (bool, error) {
+	if len(s.config.OptOut) == 0 {
+		return false, nil
+	}
+
+	var info *ObjectInfo
+	err := s.retryStorage(ctx, "head", true, func() error {
+		var err error
+		info, err = s.store.Head(ctx, bucket, key)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if matchOptOut(s.config.OptOut, info.Metadata) {
+		return true, nil
+	}
+
+	reader, ok := s.store.(TagReader)
+	if !ok {
+		return false, nil
+	}
+
+	tags, err := reader.Tags(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+
+	return matchOptOut(s.config.OptOut, tags), nil
+}
+
+// matchOptOut 元数据或者标签中是否有与标记相同的项
+func matchOptOut(markers, values map[string]string) bool {
+	for name, value := range markers {
+		if actual := metadataValue(values, name); actual != "" && strings.EqualFold(actual, value) {
+			return true
+		}
+	}
+
+	return false
+}
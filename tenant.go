@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tenantScopePrefix 租户配置的前缀, 形如Tenant.acme.Sizes, bucket名称不能包含大写字母, 不会与bucket的配置混淆
+const tenantScopePrefix = "Tenant."
+
+// configTenants 配置中有单独配置的租户, 租户名称不能包含点
+func configTenants() []string {
+	var tenants []string
+	found := make(map[string]bool)
+	for name := range fileConfig {
+		if !strings.HasPrefix(name, tenantScopePrefix) {
+			continue
+		}
+
+		scoped := strings.TrimPrefix(name, tenantScopePrefix)
+		index := strings.Index(scoped, ".")
+		if index <= 0 || found[scoped[:index]] {
+			continue
+		}
+		found[scoped[:index]] = true
+		tenants = append(tenants, scoped[:index])
+	}
+	sort.Strings(tenants)
+
+	return tenants
+}
+
+// readTenantConfigs 读取所有租户的配置, 租户的配置覆盖全局配置, 不继承bucket的配置
+// TenantPrefixes只从租户自己的配置中读取, 避免所有租户继承同一个前缀
+func readTenantConfigs(config *Config) error {
+	for _, tenant := range configTenants() {
+		configScope = tenantScopePrefix + tenant
+		tenantConfig, err := parseConfig()
+		configScope = ""
+		if err != nil {
+			return fmt.Errorf("tenant %s: %v", tenant, err)
+		}
+
+		tenantConfig.TenantPrefixes = parseList(fileConfig[tenantScopePrefix+tenant+".TenantPrefixes"])
+		if len(tenantConfig.TenantPrefixes) == 0 && config.TenantTag == "" {
+			logger.Warn("Tenant has no prefixes and TenantTag is not configured", "tenant", tenant)
+		}
+
+		if config.Tenants == nil {
+			config.Tenants = make(map[string]*Config)
+		}
+		config.Tenants[tenant] = tenantConfig
+	}
+
+	return nil
+}
+
+// tenantByPrefix 按最长的前缀匹配租户
+func (c *Config) tenantByPrefix(key string) string {
+	var tenant string
+	var longest int
+	for name, config := range c.Tenants {
+		for _, prefix := range config.TenantPrefixes {
+			if strings.HasPrefix(key, prefix) && (len(prefix) > longest || len(prefix) == longest && name < tenant) {
+				tenant, longest = name, len(prefix)
+			}
+		}
+	}
+
+	return tenant
+}
+
+// bucketTenants 缓存按标签读取的bucket所属的租户, 配置刷新时重新读取
+type bucketTenants struct {
+	mutex   sync.Mutex
+	tenants map[string]string
+}
+
+// newBucketTenants 新建bucket租户的缓存
+func newBucketTenants() *bucketTenants {
+	return &bucketTenants{tenants: make(map[string]string)}
+}
+
+// tenantByTag 按bucket的TenantTag标签选择租户, 标签的值必须是配置的租户
+// 读取标签失败时不缓存, 下一条记录重新读取
+func (s Imaging) tenantByTag(ctx context.Context, bucket string) string {
+	if s.config.TenantTag == "" || s.bucketTenants == nil {
+		return ""
+	}
+	reader, ok := s.store.(BucketTagging)
+	if !ok {
+		return ""
+	}
+
+	s.bucketTenants.mutex.Lock()
+	tenant, found := s.bucketTenants.tenants[bucket]
+	s.bucketTenants.mutex.Unlock()
+	if found {
+		return tenant
+	}
+
+	var tags map[string]string
+	err := s.retryStorage(ctx, "tags", false, func() error {
+		var err error
+		tags, err = reader.BucketTags(ctx, bucket)
+		return err
+	})
+	if err != nil {
+		logger.WarnContext(ctx, "Read bucket tags failed", "bucket", bucket, "error", err)
+		return ""
+	}
+
+	tenant = tags[s.config.TenantTag]
+	if _, configured := s.config.Tenants[tenant]; tenant != "" && !configured {
+		logger.WarnContext(ctx, "Ignore unknown tenant", "bucket", bucket, "tenant", tenant)
+		tenant = ""
+	}
+
+	s.bucketTenants.mutex.Lock()
+	s.bucketTenants.tenants[bucket] = tenant
+	s.bucketTenants.mutex.Unlock()
+
+	return tenant
+}
+
+// forObject 原图使用的配置和水印, 按key的前缀或者bucket的标签匹配租户, 前缀优先
+// 没有匹配的租户时使用bucket的配置, 存储和凭证在所有租户之间共享
+func (s Imaging) forObject(ctx context.Context, bucket, key string) (Imaging, string) {
+	tenant := s.config.tenantByPrefix(key)
+	if tenant == "" && len(s.config.Tenants) > 0 {
+		tenant = s.tenantByTag(ctx, bucket)
+	}
+	if tenant == "" {
+		s.config = s.config.forBucket(bucket)
+		return s, ""
+	}
+
+	s.config, s.watermark = s.config.Tenants[tenant], s.tenantWatermarks[tenant]
+	return s, tenant
+}
+
+// loadTenantWatermarks 加载各租户配置的水印, 租户可以使用不同的位置和透明度, 每个租户单独加载
+func (s *Imaging) loadTenantWatermarks(ctx context.Context) error {
+	for tenant, config := range s.config.Tenants {
+		if config.Watermark == "" {
+			continue
+		}
+
+		imaging := Imaging{config: config, store: s.store}
+		if err := imaging.loadWatermark(ctx); err != nil {
+			return err
+		}
+		if s.tenantWatermarks == nil {
+			s.tenantWatermarks = make(map[string]*Watermark)
+		}
+		s.tenantWatermarks[tenant] = imaging.watermark
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+// isTIFF 是否是tiff图片
+func isTIFF(key string) bool {
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".tif", ".tiff":
+		return true
+	}
+
+	return false
+}
+
+// decodeTIFF 解码未压缩的8位和16位tiff图片, 16位图像保留16位精度, 缩放后编码时再抖动为8位
+func (s Imaging) decodeTIFF(bucket, key string, object *Object) (*Original, error) {
+	start := time.Now()
+
+	body := newChecksumReader(object.Body)
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		logger.Error("Read tiff failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	layout, err := pipeline.ReadTIFFLayout(content)
+	if err != nil {
+		logger.Error("Decode image config failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	if err = s.checkPixels(key, layout.Width, layout.Height); err != nil {
+		logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// vips后端直接处理原图内容
+	var img image.Image
+	var source []byte
+	if s.config.Backend == BackendVips {
+		source = content
+	} else if img, err = layout.Decode(content); err != nil {
+		if err == pipeline.ErrTIFFTruncated {
+			err = &CorruptImageError{Key: key, Reason: err.Error()}
+		}
+		logger.Error("Decode image failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+	logger.Debug("Decode image", "bucket", bucket, "key", key, "depth", layout.Depth, "durationMs", durationMs(start))
+
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Image, original.Bounds, original.Scale, original.Source = img, image.Pt(layout.Width, layout.Height), 1, source
+	original.exif = readEXIF(content, exifInfo{})
+
+	return original, nil
+}
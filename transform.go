@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+// cropImage fill模式按焦点裁剪到与目标尺寸相同的宽高比, 其他模式不裁剪
+func cropImage(src image.Image, size Size) image.Image {
+	if size.Mode != ModeFill {
+		return src
+	}
+
+	return pipeline.Crop(src, size.Point, size.Gravity)
+}
+
+// resizeImage 按尺寸的模式缩放图像, fill模式需要先经过cropImage裁剪
+func resizeImage(src image.Image, size Size, filter resize.InterpolationFunction) image.Image {
+	return pipeline.Resize(src, size.Point, pipeline.ResizeOptions{Mode: size.Mode, Background: size.Background, Filter: filter})
+}
+
+// parseColor 解析#rrggbb格式的颜色
+func parseColor(value string) (color.Color, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("color %s is invalid", value)
+	}
+
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("color %s is invalid: %v", value, err)
+	}
+
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}, nil
+}
+
+// parseTint 解析tint效果的颜色
+func parseTint(value string) (pipeline.Effect, error) {
+	tint, err := parseColor(value)
+	if err != nil {
+		return pipeline.Effect{}, err
+	}
+
+	return pipeline.Effect{Name: pipeline.EffectTint, Tint: color.RGBAModel.Convert(tint).(color.RGBA)}, nil
+}
+
+// parseRotate 解析顺时针旋转的角度, 必须是90的倍数, 如90, 180, -90
+func parseRotate(value string) (int, error) {
+	degrees, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || degrees%90 != 0 {
+		return 0, fmt.Errorf("rotate %s is invalid", value)
+	}
+
+	return (degrees%360 + 360) % 360, nil
+}
+
+// parseFlip 解析翻转方向, h表示水平翻转, v表示垂直翻转, hv表示同时翻转
+func parseFlip(value string) (bool, bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "h":
+		return true, false, nil
+	case "v":
+		return false, true, nil
+	case "hv", "vh":
+		return true, true, nil
+	}
+
+	return false, false, fmt.Errorf("flip %s is invalid", value)
+}
+
+// metadataTransform 读取对象元数据中的rotate和flip, 无效的值忽略
+func metadataTransform(ctx context.Context, metadata map[string]string) (pipeline.Transform, bool) {
+	var transform pipeline.Transform
+	rotateString, flipString := metadataValue(metadata, "rotate"), metadataValue(metadata, "flip")
+	if rotateString == "" && flipString == "" {
+		return transform, false
+	}
+
+	var err error
+	if rotateString != "" {
+		if transform.Rotate, err = parseRotate(rotateString); err != nil {
+			logger.WarnContext(ctx, "Ignore invalid rotate metadata", "error", err)
+			return transform, false
+		}
+	}
+	if flipString != "" {
+		if transform.FlipH, transform.FlipV, err = parseFlip(flipString); err != nil {
+			logger.WarnContext(ctx, "Ignore invalid flip metadata", "error", err)
+			return transform, false
+		}
+	}
+
+	return transform, true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+)
+
+// 编译时通过-ldflags "-X main.version=v1.2.0 -X main.commit=abc1234 -X main.buildTime=2024-01-01T00:00:00Z"写入
+var (
+	// version 发布的版本号, 本地编译时为dev
+	version = "dev"
+	// commit 编译时的git提交
+	commit = ""
+	// buildTime 编译时间
+	buildTime = ""
+)
+
+// BuildInfo 版本和编译时启用的功能
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	GoVersion string `json:"goVersion"`
+	// Backends 可用的缩放实现, go总是可用, vips需要使用-tags vips编译
+	Backends []string `json:"backends"`
+	// Decoders 可以处理的原图格式, pdf, svg和video需要运行环境中有对应的命令
+	Decoders []string `json:"decoders"`
+	// Encoders 支持的输出格式
+	Encoders []string `json:"encoders"`
+	// Optimizers 运行环境中可用的无损优化命令
+	Optimizers []string `json:"optimizers,omitempty"`
+}
+
+// buildInfo 当前程序的版本和功能, 外部命令按默认名称在PATH中查找
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+		Backends:  []string{BackendGo},
+		Decoders:  []string{"jpeg", "png", "gif", "tiff", "raw"},
+	}
+	if vipsAvailable {
+		info.Backends = append(info.Backends, BackendVips)
+	}
+
+	for _, renderer := range []struct{ name, command string }{
+		{"pdf", defaultPDFRenderer},
+		{"svg", defaultSVGRenderer},
+		{"video", defaultVideoRenderer},
+	} {
+		if _, err := exec.LookPath(renderer.command); err == nil {
+			info.Decoders = append(info.Decoders, renderer.name)
+		}
+	}
+
+	for name := range formats {
+		info.Encoders = append(info.Encoders, name)
+	}
+	sort.Strings(info.Encoders)
+
+	if _, err := exec.LookPath(defaultJPEGOptimizer); err == nil {
+		info.Optimizers = append(info.Optimizers, defaultJPEGOptimizer)
+	}
+
+	return info
+}
+
+// runVersion version参数输出版本和功能
+func runVersion(args []string) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(buildInfo())
+}
+
+// ServeVersion 服务模式的/version, 返回版本和功能
+func (s Imaging) ServeVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo())
+}
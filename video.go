@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultVideoRenderer 截取视频帧使用的ffmpeg命令, Lambda中可以通过层安装到/opt/bin
+	defaultVideoRenderer = "ffmpeg"
+	// defaultPosterTime 默认截取的视频帧的时间点, 第一帧经常是黑屏
+	defaultPosterTime = time.Second
+	// videoRenderTimeout 截取视频帧的超时时间
+	videoRenderTimeout = 60 * time.Second
+)
+
+// isVideo 是否是mp4或mov视频
+func isVideo(key string) bool {
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".mp4", ".mov":
+		return true
+	}
+
+	return false
+}
+
+// decodeVideo 保存视频到临时目录, 用ffmpeg截取PosterTime处的一帧后按普通图片处理
+func (s Imaging) decodeVideo(bucket, key string, object *Object) (*Original, error) {
+	start := time.Now()
+
+	dir, err := ioutil.TempDir("", "resize-video")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	body := newChecksumReader(object.Body)
+	input := filepath.Join(dir, "input"+strings.ToLower(filepath.Ext(key)))
+	if err = writeFile(input, body); err != nil {
+		logger.Error("Save video failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	// 校验下载内容是否完整
+	if err = body.verify(object.MD5, object.Size); err != nil {
+		logger.Error("Verify object failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	img, err := extractFrame(s.config.VideoRenderer, input, s.config.PosterTime)
+	if err != nil {
+		logger.Error("Extract frame failed", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+
+	bounds := img.Bounds().Size()
+	if err = s.checkPixels(key, bounds.X, bounds.Y); err != nil {
+		logger.Error("Reject image", "bucket", bucket, "key", key, "error", err)
+		return nil, err
+	}
+	logger.Debug("Extract frame", "bucket", bucket, "key", key, "width", bounds.X, "height", bounds.Y, "durationMs", durationMs(start))
+
+	original := newOriginal(bucket, key, object, body.length, start)
+	original.Image, original.Bounds, original.Scale = img, bounds, 1
+
+	return original, nil
+}
+
+// extractFrame 截取指定时间点的一帧, 视频比该时间点短时截取第一帧
+func extractFrame(renderer, input string, at time.Duration) (image.Image, error) {
+	content, err := runFFmpeg(renderer, input, at)
+	if err == nil && len(content) == 0 && at > 0 {
+		content, err = runFFmpeg(renderer, input, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return nil, fmt.Errorf("video %s has no frame", filepath.Base(input))
+	}
+
+	return png.Decode(bytes.NewReader(content))
+}
+
+// runFFmpeg 将指定时间点的一帧编码为png输出到标准输出
+func runFFmpeg(renderer, input string, at time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), videoRenderTimeout)
+	defer cancel()
+
+	seconds := strconv.FormatFloat(at.Seconds(), 'f', 3, 64)
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, renderer, "-nostdin", "-loglevel", "error", "-ss", seconds, "-i", input,
+		"-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "pipe:1")
+	command.Stdout, command.Stderr = &stdout, &stderr
+	if err := command.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed due to %v: %s", renderer, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,105 @@
+//go:build vips
+// +build vips
+
+package main
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// resize_thumbnail 缩放并编码为jpeg, crop为VIPS_INTERESTING, force表示拉伸
+static int resize_thumbnail(void *buf, size_t len, int width, int height, int crop, int force, int quality,
+	void **out, size_t *out_len, int *out_width, int *out_height) {
+	VipsImage *image = NULL;
+	int result;
+
+	if (force) {
+		result = vips_thumbnail_buffer(buf, len, &image, width, "height", height, "size", VIPS_SIZE_FORCE, NULL);
+	} else if (crop >= 0) {
+		result = vips_thumbnail_buffer(buf, len, &image, width, "height", height, "crop", crop, NULL);
+	} else {
+		result = vips_thumbnail_buffer(buf, len, &image, width, "height", height, NULL);
+	}
+	if (result != 0) {
+		return result;
+	}
+
+	*out_width = vips_image_get_width(image);
+	*out_height = vips_image_get_height(image);
+	if (quality > 0) {
+		result = vips_jpegsave_buffer(image, out, out_len, "Q", quality, "strip", TRUE, NULL);
+	} else {
+		result = vips_jpegsave_buffer(image, out, out_len, "strip", TRUE, NULL);
+	}
+	g_object_unref(image);
+
+	return result;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"strings"
+	"unsafe"
+)
+
+// vipsAvailable 是否使用-tags vips编译
+const vipsAvailable = true
+
+func init() {
+	name := C.CString("resize")
+	defer C.free(unsafe.Pointer(name))
+
+	if C.vips_init(name) != 0 {
+		panic("init vips failed: " + vipsError().Error())
+	}
+}
+
+// vipsThumbnail 用vips生成jpeg缩略图, 返回编码后的内容和实际尺寸
+func vipsThumbnail(source []byte, size Size) ([]byte, int, int, error) {
+	if len(source) == 0 {
+		return nil, 0, 0, errors.New("vips requires the original content")
+	}
+
+	// 宽或高为0时不限制该方向
+	width, height := size.X, size.Y
+	if width <= 0 {
+		width = C.VIPS_MAX_COORD
+	}
+	if height <= 0 {
+		height = C.VIPS_MAX_COORD
+	}
+
+	crop, force := C.int(-1), C.int(0)
+	switch size.Mode {
+	case ModeFill:
+		crop = C.VIPS_INTERESTING_CENTRE
+		if size.Gravity.IsSmart() {
+			crop = C.VIPS_INTERESTING_ATTENTION
+		}
+	case ModeStretch:
+		force = 1
+	}
+
+	var out unsafe.Pointer
+	var outLength C.size_t
+	var outWidth, outHeight C.int
+	result := C.resize_thumbnail(unsafe.Pointer(&source[0]), C.size_t(len(source)), C.int(width), C.int(height), crop, force,
+		C.int(size.Quality), &out, &outLength, &outWidth, &outHeight)
+	if result != 0 {
+		return nil, 0, 0, vipsError()
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLength)), int(outWidth), int(outHeight), nil
+}
+
+// vipsError 读取并清空vips的错误信息
+func vipsError() error {
+	message := strings.TrimSpace(C.GoString(C.vips_error_buffer()))
+	C.vips_error_clear()
+
+	return errors.New(message)
+}
@@ -0,0 +1,16 @@
+//go:build !vips
+// +build !vips
+
+package main
+
+import (
+	"errors"
+)
+
+// vipsAvailable 是否使用-tags vips编译
+const vipsAvailable = false
+
+// vipsThumbnail 未使用-tags vips编译时不可用
+func vipsThumbnail(source []byte, size Size) ([]byte, int, int, error) {
+	return nil, 0, 0, errors.New("vips backend requires building with -tags vips")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// eventSourceScheduled EventBridge定时规则的事件来源
+	eventSourceScheduled = "aws.events"
+	// eventDetailScheduled EventBridge定时规则的事件类型
+	eventDetailScheduled = "Scheduled Event"
+	// warmupCanaryKey 检查写入和删除权限时写入的对象, 位于DestinationPrefix下
+	warmupCanaryKey = ".resize-warmup"
+	// maxWarmupDimension 测试图像的最大边长, 更大的尺寸放大生成, 避免自检占用过多内存
+	maxWarmupDimension = 1024
+)
+
+// WarmupCheck 一项自检的结果
+type WarmupCheck struct {
+	// Name decode:jpeg, size:200x200或canary
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// WarmupResult 自检的结果
+type WarmupResult struct {
+	Status     string        `json:"status"`
+	Checks     []WarmupCheck `json:"checks"`
+	DurationMs int64         `json:"durationMs"`
+}
+
+// WarmupEvent 处理定时的预热事件, 解码生成的测试图像, 生成所有配置的尺寸, 并在缩略图位置写入和删除一个对象
+// 检查配置, 权限和编解码是否正常, 不写入缩略图, 任意一项失败时返回错误以便按Lambda的错误数告警
+func (s Imaging) WarmupEvent(ctx context.Context) (*WarmupResult, error) {
+	start := time.Now()
+	result := &WarmupResult{Status: StatusSucceeded}
+	check := func(name string, do func() error) {
+		checkStart := time.Now()
+		err := do()
+		warmupCheck := WarmupCheck{Name: name, Status: StatusSucceeded, DurationMs: durationMs(checkStart)}
+		switch {
+		case err == errSkipped:
+			warmupCheck.Status = StatusSkipped
+		case err != nil:
+			warmupCheck.Status, warmupCheck.Error = StatusFailed, err.Error()
+			result.Status = StatusFailed
+			logger.ErrorContext(ctx, "Warmup check failed", "check", name, "error", err)
+		}
+		result.Checks = append(result.Checks, warmupCheck)
+	}
+
+	sizes := s.config.allSizes()
+	src := warmupImage(sizes)
+
+	// 按原图的格式编码后再解码, 尺寸检查使用解码后的jpeg
+	var original *Original
+	for _, codec := range s.warmupCodecs() {
+		codec := codec
+		check("decode:"+codec.name, func() error {
+			// gif编码时逐像素抖动到调色板, 只编码一小块
+			img := image.Image(src)
+			if codec.name == "gif" {
+				img = src.SubImage(image.Rect(0, 0, 64, 64))
+			}
+			decoded, err := s.warmupDecode(codec.key, codec.encode, img, sizes)
+			if err == nil && codec.name == "jpeg" {
+				original = decoded
+			}
+			return err
+		})
+	}
+
+	for _, size := range sizes {
+		size := size
+		check("size:"+sizeName(size), func() error {
+			if original == nil {
+				return errors.New("test image is not decoded")
+			}
+			return s.warmupSize(original, size)
+		})
+	}
+
+	check("canary", func() error {
+		return s.warmupCanary(ctx)
+	})
+
+	result.DurationMs = durationMs(start)
+	s.warmupMetrics(result)
+	logger.InfoContext(ctx, "Warmup", "status", result.Status, "checks", len(result.Checks), "durationMs", result.DurationMs)
+	if result.Status == StatusFailed {
+		return result, errors.New("warmup failed")
+	}
+
+	return result, nil
+}
+
+// warmupCodec 自检的原图格式
+type warmupCodec struct {
+	name   string
+	key    string
+	encode func(io.Writer, image.Image) error
+}
+
+// warmupCodecs 需要检查的原图格式, jpeg总是检查, gif和png按配置检查
+func (s Imaging) warmupCodecs() []warmupCodec {
+	codecs := []warmupCodec{{name: "jpeg", key: "warmup.jpg", encode: func(writer io.Writer, img image.Image) error {
+		return jpeg.Encode(writer, img, nil)
+	}}}
+	if s.config.PNG {
+		codecs = append(codecs, warmupCodec{name: "png", key: "warmup.png", encode: png.Encode})
+	}
+	if s.config.GIF {
+		codecs = append(codecs, warmupCodec{name: "gif", key: "warmup.gif", encode: func(writer io.Writer, img image.Image) error {
+			return gif.Encode(writer, img, nil)
+		}})
+	}
+
+	return codecs
+}
+
+// warmupImage 生成测试图像, 边长与最大的尺寸相同, 不超过maxWarmupDimension
+func warmupImage(sizes []Size) *image.RGBA {
+	bounds := image.Pt(64, 64)
+	for _, size := range sizes {
+		if size.X > bounds.X {
+			bounds.X = size.X
+		}
+		if size.Y > bounds.Y {
+			bounds.Y = size.Y
+		}
+	}
+	if bounds.X > maxWarmupDimension {
+		bounds.X = maxWarmupDimension
+	}
+	if bounds.Y > maxWarmupDimension {
+		bounds.Y = maxWarmupDimension
+	}
+
+	// 渐变可以覆盖色度抽样和调色板
+	img := image.NewRGBA(image.Rectangle{Max: bounds})
+	for y := 0; y < bounds.Y; y++ {
+		for x := 0; x < bounds.X; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / bounds.X), G: uint8(y * 255 / bounds.Y), B: 128, A: 255})
+		}
+	}
+
+	return img
+}
+
+// warmupDecode 编码测试图像后按原图的处理方式解码
+func (s Imaging) warmupDecode(key string, encode func(io.Writer, image.Image) error, src image.Image, sizes []Size) (*Original, error) {
+	buffer := new(bytes.Buffer)
+	if err := encode(buffer, src); err != nil {
+		return nil, err
+	}
+
+	object := &Object{ObjectInfo: ObjectInfo{Size: int64(buffer.Len())}, Body: ioutil.NopCloser(buffer)}
+	original, err := s.decodeOriginal("", key, object, sizes)
+	if err != nil {
+		return nil, err
+	}
+	if err = original.decode(); err != nil {
+		return nil, err
+	}
+	if original.Bounds != src.Bounds().Size() {
+		return nil, fmt.Errorf("decoded %dx%d pixels, expected %dx%d", original.Bounds.X, original.Bounds.Y, src.Bounds().Dx(), src.Bounds().Dy())
+	}
+
+	return original, nil
+}
+
+// warmupSize 按配置的步骤生成并编码一个尺寸, 不放大原图时跳过
+func (s Imaging) warmupSize(original *Original, size Size) error {
+	thumbnail := s.renderThumbnail(original, original.Image, size)
+	if thumbnail == nil {
+		return errSkipped
+	}
+
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+
+	return encodeImage(buffer, thumbnail, size)
+}
+
+// warmupCanary 在缩略图的位置写入并删除一个对象, 没有配置SourceBucket和DestinationBucket时跳过
+func (s Imaging) warmupCanary(ctx context.Context) error {
+	bucket := s.destinationBucket(s.config.SourceBucket)
+	if bucket == "" {
+		return errSkipped
+	}
+
+	key := s.config.DestinationPrefix + warmupCanaryKey
+	options := PutOptions{ContentType: "text/plain", Metadata: map[string]string{"kind": "warmup"}}
+	if err := s.destination.Put(ctx, bucket, key, bytes.NewReader([]byte("warmup")), options); err != nil {
+		return fmt.Errorf("put %s failed: %v", key, err)
+	}
+	if err := s.destination.Delete(ctx, bucket, key); err != nil {
+		return fmt.Errorf("delete %s failed: %v", key, err)
+	}
+
+	return nil
+}
+
+// warmupMetrics 按嵌入式指标格式输出自检结果, 每项检查按名称分维度
+func (s Imaging) warmupMetrics(result *WarmupResult) {
+	if !s.config.Metrics {
+		return
+	}
+
+	var failures int
+	for _, check := range result.Checks {
+		failed := 0
+		if check.Status == StatusFailed {
+			failed = 1
+			failures++
+		}
+		writeMetrics(s.config.MetricsNamespace, map[string]string{"Check": check.Name}, map[string]interface{}{
+			"WarmupFailures": failed,
+			"WarmupDuration": []int64{check.DurationMs},
+		})
+	}
+
+	writeMetrics(s.config.MetricsNamespace, nil, map[string]interface{}{
+		"WarmupChecks":   len(result.Checks),
+		"WarmupFailures": failures,
+		"WarmupDuration": []int64{result.DurationMs},
+	})
+}
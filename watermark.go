@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	// 水印一般使用带透明通道的png
+	_ "image/png"
+
+	"github.com/nfnt/resize"
+	"github.com/nzai/resize/pkg/pipeline"
+)
+
+var (
+	// watermarkPositions 支持的水印位置
+	watermarkPositions = map[string]bool{
+		"top-left":     true,
+		"top-right":    true,
+		"bottom-left":  true,
+		"bottom-right": true,
+		"center":       true,
+	}
+)
+
+// Watermark 水印
+type Watermark struct {
+	Image    image.Image
+	Position string
+	Opacity  float64
+	Margin   int
+}
+
+// apply 将水印叠加到图像上
+func (w Watermark) apply(src image.Image, filter resize.InterpolationFunction) image.Image {
+	bounds := src.Bounds()
+	dst := pipeline.ToRGBA(src)
+
+	// 水印超过可用区域时等比缩小
+	mark := w.Image
+	available := image.Pt(bounds.Dx()-2*w.Margin, bounds.Dy()-2*w.Margin)
+	if available.X <= 0 || available.Y <= 0 {
+		return dst
+	}
+	if mark.Bounds().Dx() > available.X || mark.Bounds().Dy() > available.Y {
+		mark = resize.Thumbnail(uint(available.X), uint(available.Y), mark, filter)
+	}
+
+	size := mark.Bounds().Size()
+	var offset image.Point
+	switch w.Position {
+	case "top-left":
+		offset = image.Pt(w.Margin, w.Margin)
+	case "top-right":
+		offset = image.Pt(bounds.Dx()-w.Margin-size.X, w.Margin)
+	case "bottom-left":
+		offset = image.Pt(w.Margin, bounds.Dy()-w.Margin-size.Y)
+	case "center":
+		offset = image.Pt((bounds.Dx()-size.X)/2, (bounds.Dy()-size.Y)/2)
+	default:
+		offset = image.Pt(bounds.Dx()-w.Margin-size.X, bounds.Dy()-w.Margin-size.Y)
+	}
+
+	mask := image.NewUniform(color.Alpha{A: uint8(w.Opacity * 0xff)})
+	draw.DrawMask(dst, image.Rectangle{Min: offset, Max: offset.Add(size)}, mark, mark.Bounds().Min, mask, image.ZP, draw.Over)
+
+	return dst
+}
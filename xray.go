@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	// xrayHeader 发送给X-Ray守护进程的文档头
+	xrayHeader = "{\"format\": \"json\", \"version\": 1}\n"
+	// xrayDaemonAddress 默认的守护进程地址, Lambda中由AWS_XRAY_DAEMON_ADDRESS指定
+	xrayDaemonAddress = "127.0.0.1:2000"
+	// lambdaTraceKey aws-lambda-go保存跟踪头的context key
+	lambdaTraceKey = "x-amzn-trace-id"
+)
+
+var (
+	// tracingEnabled 读取配置后设置
+	tracingEnabled bool
+
+	xrayOnce sync.Once
+	xrayConn net.Conn
+)
+
+// traceSegmentKey context中当前子分段的key
+type traceSegmentKey struct{}
+
+// traceSegment X-Ray子分段, 为nil时所有方法都不做任何事
+type traceSegment struct {
+	ID          string                 `json:"id"`
+	TraceID     string                 `json:"trace_id"`
+	ParentID    string                 `json:"parent_id"`
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name"`
+	Namespace   string                 `json:"namespace,omitempty"`
+	StartTime   float64                `json:"start_time"`
+	EndTime     float64                `json:"end_time"`
+	Error       bool                   `json:"error,omitempty"`
+	Fault       bool                   `json:"fault,omitempty"`
+	Cause       map[string]interface{} `json:"cause,omitempty"`
+	HTTP        map[string]interface{} `json:"http,omitempty"`
+	AWS         map[string]interface{} `json:"aws,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+// beginSegment 开始一个子分段, 作为context中当前分段或者Lambda调用分段的子分段
+// 没有开启跟踪或者调用未被采样时返回nil
+func beginSegment(ctx context.Context, name string) (context.Context, *traceSegment) {
+	if !tracingEnabled {
+		return ctx, nil
+	}
+
+	segment := &traceSegment{ID: newSegmentID(), Type: "subsegment", Name: name, StartTime: epochSeconds(time.Now())}
+	if parent, ok := ctx.Value(traceSegmentKey{}).(*traceSegment); ok && parent != nil {
+		segment.TraceID, segment.ParentID = parent.TraceID, parent.ID
+	} else {
+		header, _ := ctx.Value(lambdaTraceKey).(string)
+		if header == "" {
+			header = os.Getenv("_X_AMZN_TRACE_ID")
+		}
+
+		fields := parseTraceHeader(header)
+		if fields["Root"] == "" || fields["Parent"] == "" || fields["Sampled"] != "1" {
+			return ctx, nil
+		}
+		segment.TraceID, segment.ParentID = fields["Root"], fields["Parent"]
+	}
+
+	return context.WithValue(ctx, traceSegmentKey{}, segment), segment
+}
+
+// annotate 添加可以用于筛选跟踪的注释
+func (s *traceSegment) annotate(name string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Annotations == nil {
+		s.Annotations = make(map[string]interface{})
+	}
+	s.Annotations[name] = value
+}
+
+// end 结束子分段并发送到X-Ray守护进程
+func (s *traceSegment) end(err error) {
+	if s == nil {
+		return
+	}
+
+	s.EndTime = epochSeconds(time.Now())
+	if err != nil {
+		s.Fault = true
+		s.Cause = map[string]interface{}{
+			"exceptions": []map[string]string{{"id": newSegmentID(), "message": err.Error()}},
+		}
+	}
+
+	content, err := json.Marshal(s)
+	if err != nil {
+		logger.Error("Marshal trace segment failed", "error", err)
+		return
+	}
+
+	xrayOnce.Do(func() {
+		address := xrayDaemonAddress
+		// 可能是host:port或者"tcp:host:port udp:host:port"的形式
+		for _, part := range strings.Fields(os.Getenv("AWS_XRAY_DAEMON_ADDRESS")) {
+			if !strings.HasPrefix(part, "tcp:") {
+				address = strings.TrimPrefix(part, "udp:")
+			}
+		}
+
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			logger.Error("Connect xray daemon failed", "address", address, "error", err)
+			return
+		}
+		xrayConn = conn
+	})
+	if xrayConn == nil {
+		return
+	}
+
+	if _, err = xrayConn.Write(append([]byte(xrayHeader), content...)); err != nil {
+		logger.Warn("Send trace segment failed", "error", err)
+	}
+}
+
+// traceHeader 传递给下游服务的跟踪头
+func (s *traceSegment) traceHeader() string {
+	return "Root=" + s.TraceID + ";Parent=" + s.ID + ";Sampled=1"
+}
+
+// instrumentHandlers 为AWS客户端的每次请求创建子分段
+func instrumentHandlers(handlers *request.Handlers) {
+	handlers.Validate.PushFront(func(r *request.Request) {
+		ctx, segment := beginSegment(r.Context(), r.ClientInfo.ServiceName)
+		if segment == nil {
+			return
+		}
+
+		segment.Namespace = "aws"
+		segment.AWS = map[string]interface{}{"operation": r.Operation.Name, "region": aws.StringValue(r.Config.Region)}
+		r.SetContext(ctx)
+		r.HTTPRequest.Header.Set("X-Amzn-Trace-Id", segment.traceHeader())
+	})
+
+	handlers.Complete.PushBack(func(r *request.Request) {
+		segment, ok := r.Context().Value(traceSegmentKey{}).(*traceSegment)
+		if !ok || segment == nil || segment.Namespace != "aws" {
+			return
+		}
+
+		segment.AWS["request_id"] = r.RequestID
+		if r.HTTPResponse != nil {
+			segment.HTTP = map[string]interface{}{"response": map[string]interface{}{"status": r.HTTPResponse.StatusCode}}
+		}
+		segment.end(r.Error)
+	})
+}
+
+// parseTraceHeader 解析Root=...;Parent=...;Sampled=1形式的跟踪头
+func parseTraceHeader(header string) map[string]string {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(header, ";") {
+		if pair := strings.SplitN(strings.TrimSpace(part), "=", 2); len(pair) == 2 {
+			fields[pair[0]] = pair[1]
+		}
+	}
+
+	return fields
+}
+
+// newSegmentID 新建16位十六进制的分段id
+func newSegmentID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// epochSeconds X-Ray使用的带小数的秒级时间戳
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}